@@ -1,4 +1,5 @@
 import * as cheerio from 'cheerio';
+import { createHmac } from 'crypto';
 import { URL } from 'url';
 import dotenv from 'dotenv';
 
@@ -14,6 +15,7 @@ const TIMEOUT_MS = 10000;  // 10 second timeout for all fetch requests
 // Update these for your setup
 const OGGOLE_API_URL = process.env.OGGOLE_API_URL || 'http://localhost:8080/api/batch-pages';
 const API_KEY = process.env.CRAWLER_API_KEY;
+const SIGNING_SECRET = process.env.CRAWLER_SIGNING_SECRET;  // Optional, must match server
 
 // Validate API key is set
 if (!API_KEY) {
@@ -108,13 +110,25 @@ async function sendToOggole(pages) {
     try {
         console.log(`\nSending ${pages.length} pages to Oggole...`);
 
+        const body = JSON.stringify({ pages });
+        const headers = {
+            'Content-Type': 'application/json',
+            'X-API-Key': API_KEY
+        };
+
+        // Sign "<timestamp>.<body>" with HMAC-SHA256 (same scheme as utils.SignRequest)
+        if (SIGNING_SECRET) {
+            const timestamp = Math.floor(Date.now() / 1000).toString();
+            headers['X-Timestamp'] = timestamp;
+            headers['X-Signature'] = createHmac('sha256', SIGNING_SECRET)
+                .update(`${timestamp}.${body}`)
+                .digest('hex');
+        }
+
         const response = await fetch(OGGOLE_API_URL, {
             method: 'POST',
-            headers: {
-                'Content-Type': 'application/json',
-                'X-API-Key': API_KEY
-            },
-            body: JSON.stringify({ pages }),
+            headers,
+            body,
             signal: controller.signal
         });
 
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// accountPage renders the account settings (GET /account, behind requireLogin)
+func accountPage(w http.ResponseWriter, r *http.Request) {
+	renderTemplate(w, "account.html", buildViewData(w, r))
+}
+
+// checkCurrentPassword compares a password against the user's stored hash
+func checkCurrentPassword(userID int, password string) (bool, error) {
+	var storedPassword string
+	err := db.QueryRow("SELECT password FROM users WHERE id = $1", userID).Scan(&storedPassword)
+	if err != nil {
+		return false, err
+	}
+	return bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(password)) == nil, nil
+}
+
+// currentSessionToken returns the token from the session cookie, or "" when there is none
+func currentSessionToken(r *http.Request) string {
+	cookie, err := r.Cookie("session_token")
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// changePassword sets a new password after checking the current one (POST /api/account/password)
+// Every other session of the user is ended, this browser stays logged in
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	clientIP := getClientIP(r)
+	currentPassword := r.FormValue("current_password")
+	password := r.FormValue("password")
+	password2 := r.FormValue("password2")
+
+	if currentPassword == "" || password == "" || password2 == "" {
+		renderFormError(w, r, "account.html", nil, http.StatusBadRequest, "All password fields are required", nil)
+		return
+	}
+	if password != password2 {
+		renderFormError(w, r, "account.html", nil, http.StatusBadRequest, "Passwords do not match",
+			map[string]string{"password2": "Passwords do not match"})
+		return
+	}
+
+	ok, err := checkCurrentPassword(user.ID, currentPassword)
+	if err != nil {
+		log.Printf("Password change failed: username=%s ip=%s reason=database_error error=%v", user.Username, clientIP, err)
+		renderFormError(w, r, "account.html", nil, http.StatusInternalServerError, "Internal server error", nil)
+		return
+	}
+	if !ok {
+		log.Printf("Password change failed: username=%s ip=%s reason=wrong_password", user.Username, clientIP)
+		renderFormError(w, r, "account.html", nil, http.StatusUnauthorized, "Current password is incorrect",
+			map[string]string{"current_password": "Current password is incorrect"})
+		return
+	}
+
+	if reasons := checkPasswordPolicy(password, user.Username, user.Email); len(reasons) > 0 {
+		renderFormError(w, r, "account.html", nil, http.StatusBadRequest, "Password does not meet the requirements",
+			map[string]string{"password": strings.Join(reasons, " ")})
+		return
+	}
+
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		log.Printf("Password change failed: username=%s ip=%s reason=hash_generation_error", user.Username, clientIP)
+		renderFormError(w, r, "account.html", nil, http.StatusInternalServerError, "Failed to change password", nil)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err == nil {
+		defer tx.Rollback()
+		_, err = tx.Exec("UPDATE users SET password = $1 WHERE id = $2", hashedPassword, user.ID)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM sessions WHERE username = $1 AND token_hash <> $2", user.Username, hashToken(currentSessionToken(r)))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Password change failed: username=%s ip=%s reason=database_error error=%v", user.Username, clientIP, err)
+		renderFormError(w, r, "account.html", nil, http.StatusInternalServerError, "Failed to change password", nil)
+		return
+	}
+
+	log.Printf("Password change success: username=%s ip=%s", user.Username, clientIP)
+	setFlash(w, "Your password has been changed and your other sessions were logged out")
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// changeEmail updates the e-mail address and sends a new verification link (POST /api/account/email)
+// The account is unverified until the new address is confirmed
+func changeEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	clientIP := getClientIP(r)
+	email := strings.TrimSpace(r.FormValue("email"))
+	password := r.FormValue("email_password")
+	values := map[string]string{"Email": email}
+
+	if !isValidEmail(email) {
+		renderFormError(w, r, "account.html", values, http.StatusBadRequest, "Invalid e-mail address",
+			map[string]string{"email": "Please enter a valid e-mail address"})
+		return
+	}
+	if strings.EqualFold(email, user.Email) {
+		renderFormError(w, r, "account.html", values, http.StatusBadRequest, "E-mail address unchanged",
+			map[string]string{"email": "This is already your e-mail address"})
+		return
+	}
+
+	ok, err := checkCurrentPassword(user.ID, password)
+	if err != nil {
+		log.Printf("Email change failed: username=%s ip=%s reason=database_error error=%v", user.Username, clientIP, err)
+		renderFormError(w, r, "account.html", values, http.StatusInternalServerError, "Internal server error", nil)
+		return
+	}
+	if !ok {
+		log.Printf("Email change failed: username=%s ip=%s reason=wrong_password", user.Username, clientIP)
+		renderFormError(w, r, "account.html", values, http.StatusUnauthorized, "Current password is incorrect",
+			map[string]string{"email_password": "Current password is incorrect"})
+		return
+	}
+
+	var existingID int
+	err = db.QueryRow("SELECT id FROM users WHERE LOWER(email) = LOWER($1) AND id <> $2", email, user.ID).Scan(&existingID)
+	if err == nil {
+		log.Printf("Email change failed: username=%s ip=%s reason=email_taken", user.Username, clientIP)
+		renderFormError(w, r, "account.html", values, http.StatusConflict, "Email already registered",
+			map[string]string{"email": "Email already registered"})
+		return
+	} else if err != sql.ErrNoRows {
+		log.Printf("Email change failed: username=%s ip=%s reason=database_error error=%v", user.Username, clientIP, err)
+		renderFormError(w, r, "account.html", values, http.StatusInternalServerError, "Internal server error", nil)
+		return
+	}
+
+	// Clearing verified_at also voids verification and reset links sent to the old address
+	_, err = db.Exec("UPDATE users SET email = $1, verified_at = NULL WHERE id = $2", email, user.ID)
+	if err != nil {
+		log.Printf("Email change failed: username=%s ip=%s reason=update_error error=%v", user.Username, clientIP, err)
+		renderFormError(w, r, "account.html", values, http.StatusInternalServerError, "Failed to change e-mail address", nil)
+		return
+	}
+
+	log.Printf("Email change success: username=%s ip=%s", user.Username, clientIP)
+
+	if err := sendVerificationEmail(user.ID, user.Username, email); err != nil {
+		log.Printf("Verification e-mail failed: username=%s email=%s error=%v", user.Username, email, err)
+		setFlash(w, "Your e-mail address has been changed, but we couldn't send the verification e-mail")
+	} else {
+		setFlash(w, "Your e-mail address has been changed, check your inbox to verify it")
+	}
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// deleteAccount removes the user, their sessions and personal data (POST /api/account/delete)
+// Tables holding per-user data reference users(id) ON DELETE CASCADE, sessions are keyed by username
+func deleteAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	clientIP := getClientIP(r)
+	password := r.FormValue("delete_password")
+
+	if r.FormValue("confirm") != user.Username {
+		renderFormError(w, r, "account.html", nil, http.StatusBadRequest, "Account not deleted",
+			map[string]string{"confirm": "Type your username exactly to confirm"})
+		return
+	}
+
+	ok, err := checkCurrentPassword(user.ID, password)
+	if err != nil {
+		log.Printf("Account deletion failed: username=%s ip=%s reason=database_error error=%v", user.Username, clientIP, err)
+		renderFormError(w, r, "account.html", nil, http.StatusInternalServerError, "Internal server error", nil)
+		return
+	}
+	if !ok {
+		log.Printf("Account deletion failed: username=%s ip=%s reason=wrong_password", user.Username, clientIP)
+		renderFormError(w, r, "account.html", nil, http.StatusUnauthorized, "Current password is incorrect",
+			map[string]string{"delete_password": "Current password is incorrect"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err == nil {
+		defer tx.Rollback()
+		_, err = tx.Exec("DELETE FROM sessions WHERE username = $1", user.Username)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM users WHERE id = $1", user.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Account deletion failed: username=%s ip=%s reason=database_error error=%v", user.Username, clientIP, err)
+		renderFormError(w, r, "account.html", nil, http.StatusInternalServerError, "Failed to delete account", nil)
+		return
+	}
+
+	// Drop in-memory state tied to the account
+	sessionSearches.mu.Lock()
+	delete(sessionSearches.searches, currentSessionToken(r))
+	sessionSearches.mu.Unlock()
+	verificationResends.mu.Lock()
+	delete(verificationResends.lastSent, user.ID)
+	verificationResends.mu.Unlock()
+
+	log.Printf("Account deletion success: username=%s ip=%s", user.Username, clientIP)
+
+	clearSessionCookie(w)
+	setFlash(w, "Your account has been deleted")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// accountRequest builds a form POST from a logged-in user, as requireLogin would pass it on
+func accountRequest(path string, form url.Values, user *User, token string) *http.Request {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "session_token", Value: token})
+	return withUser(req, user)
+}
+
+// TestAccountPage_Renders verifies the settings page shows the user's details
+func TestAccountPage_Renders(t *testing.T) {
+	templates = template.Must(template.ParseGlob("../templates/*.html"))
+
+	req := withUser(httptest.NewRequest("GET", "/account", nil), &User{ID: 1, Username: "testuser_page", Email: "page@example.com"})
+	w := httptest.NewRecorder()
+	accountPage(w, req)
+
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "page@example.com") || !strings.Contains(body, "not verified") {
+		t.Errorf("account page = %d:\n%s", w.Code, body)
+	}
+}
+
+// TestDeleteAccount_RequiresConfirmation verifies the username must be typed before anything is deleted
+func TestDeleteAccount_RequiresConfirmation(t *testing.T) {
+	templates = template.Must(template.ParseGlob("../templates/*.html"))
+
+	user := &User{ID: 1, Username: "testuser_confirm", Email: "confirm@example.com"}
+	w := httptest.NewRecorder()
+	deleteAccount(w, accountRequest("/api/account/delete", url.Values{"confirm": {"someone-else"}}, user, "token"))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status code = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if !strings.Contains(w.Body.String(), "Type your username exactly to confirm") {
+		t.Errorf("response does not explain the missing confirmation")
+	}
+}
+
+// TestAccountSettings_Integration verifies password change, e-mail change and deletion
+func TestAccountSettings_Integration(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	capture := useCaptureMailer(t)
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("old-password"), bcrypt.MinCost)
+	var userID int
+	err := testDB.QueryRow(`INSERT INTO users (username, email, password, registration_ip, verified_at)
+		VALUES ($1, $2, $3, $4, NOW()) RETURNING id`,
+		"testuser_account", "testuser_account@example.com", string(hashedPassword), "127.0.0.1").Scan(&userID)
+	if err != nil {
+		t.Fatalf("failed to create test user: %v", err)
+	}
+	for _, token := range []string{"test-account-current", "test-account-other"} {
+		createSession("testuser_account", token, "Go-http-client/1.1", "127.0.0.1")
+	}
+	user := &User{ID: userID, Username: "testuser_account", Email: "testuser_account@example.com", Verified: true}
+
+	t.Run("change password", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		changePassword(w, accountRequest("/api/account/password", url.Values{
+			"current_password": {"wrong-password"},
+			"password":         {"violet-canoe-42-ladder"},
+			"password2":        {"violet-canoe-42-ladder"},
+		}, user, "test-account-current"))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("wrong current password: status code = %d, want %d", w.Code, http.StatusUnauthorized)
+		}
+
+		w = httptest.NewRecorder()
+		changePassword(w, accountRequest("/api/account/password", url.Values{
+			"current_password": {"old-password"},
+			"password":         {"violet-canoe-42-ladder"},
+			"password2":        {"violet-canoe-42-ladder"},
+		}, user, "test-account-current"))
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("status code = %d, body=%s", w.Code, w.Body.String())
+		}
+
+		var tokens []string
+		rows, _ := testDB.Query("SELECT token_hash FROM sessions WHERE username = $1", "testuser_account")
+		for rows.Next() {
+			var token string
+			rows.Scan(&token)
+			tokens = append(tokens, token)
+		}
+		rows.Close()
+		if len(tokens) != 1 || tokens[0] != hashToken("test-account-current") {
+			t.Errorf("sessions after password change = %v, want only the current one", tokens)
+		}
+	})
+
+	t.Run("change email", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		changeEmail(w, accountRequest("/api/account/email", url.Values{
+			"email":          {"testuser_account_new@example.com"},
+			"email_password": {"violet-canoe-42-ladder"},
+		}, user, "test-account-current"))
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("status code = %d, body=%s", w.Code, w.Body.String())
+		}
+
+		var email string
+		var verified bool
+		testDB.QueryRow("SELECT email, verified_at IS NOT NULL FROM users WHERE id = $1", userID).Scan(&email, &verified)
+		if email != "testuser_account_new@example.com" || verified {
+			t.Errorf("after e-mail change: email=%s verified=%v", email, verified)
+		}
+		if len(capture.sent) != 1 || capture.sent[0].To != "testuser_account_new@example.com" {
+			t.Errorf("expected a verification e-mail to the new address, got %+v", capture.sent)
+		}
+	})
+
+	t.Run("delete account", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		deleteAccount(w, accountRequest("/api/account/delete", url.Values{
+			"delete_password": {"violet-canoe-42-ladder"},
+			"confirm":         {"testuser_account"},
+		}, user, "test-account-current"))
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("status code = %d, body=%s", w.Code, w.Body.String())
+		}
+
+		var users, sessions int
+		testDB.QueryRow("SELECT COUNT(*) FROM users WHERE id = $1", userID).Scan(&users)
+		testDB.QueryRow("SELECT COUNT(*) FROM sessions WHERE username = $1", "testuser_account").Scan(&sessions)
+		if users != 0 || sessions != 0 {
+			t.Errorf("after deletion: users=%d sessions=%d, want 0", users, sessions)
+		}
+	})
+}
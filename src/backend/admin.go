@@ -0,0 +1,521 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rows per page in the admin user and page lists
+const adminPageSize = 50
+
+// Role is a named set of permissions that can be granted to users
+type Role struct {
+	ID          int
+	Name        string
+	Description string
+	Permissions []string
+}
+
+// AdminUser is one row of the admin user list
+type AdminUser struct {
+	ID           int
+	Username     string
+	Email        string
+	Verified     bool
+	TwoFactor    bool
+	RegisteredAt *time.Time
+	LastLoginAt  *time.Time
+	LoginCount   int
+	Roles        []string
+}
+
+// HasRole reports whether the user holds the named role
+func (u AdminUser) HasRole(name string) bool {
+	for _, role := range u.Roles {
+		if role == name {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminPage is one row of the admin page list, without the content itself
+type AdminPage struct {
+	Title       string
+	URL         string
+	Language    string
+	ContentType string
+	LastUpdated time.Time
+	Size        int
+}
+
+// CountRow is a labelled count for the stats tables
+type CountRow struct {
+	Label string
+	Count int
+}
+
+// CrawlFailure is a queued URL whose last fetch failed
+type CrawlFailure struct {
+	URL          string
+	Status       string
+	FailureCount int
+	LastError    string
+	NextFetchAt  time.Time
+}
+
+// SearchStat is an aggregated query from search_stats
+type SearchStat struct {
+	Query          string
+	Language       string
+	Searches       int
+	ZeroResults    int
+	LastSearchedAt time.Time
+}
+
+// adminViewData is buildViewData plus the permissions requirePermission loaded, for the admin navigation
+func adminViewData(w http.ResponseWriter, r *http.Request) map[string]interface{} {
+	data := buildViewData(w, r)
+	data["Permissions"] = currentPermissions(r)
+	return data
+}
+
+// adminPageNumber returns the 1-based ?page= of a paginated admin list
+func adminPageNumber(r *http.Request) int {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		return 1
+	}
+	return page
+}
+
+// setPagination adds previous and next links that keep the list's other query parameters
+func setPagination(data map[string]interface{}, r *http.Request, page int, hasNext bool) {
+	link := func(n int) string {
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(n))
+		return (&url.URL{Path: r.URL.Path, RawQuery: query.Encode()}).String()
+	}
+
+	data["PageNumber"] = page
+	if page > 1 {
+		data["PrevURL"] = link(page - 1)
+	}
+	if hasNext {
+		data["NextURL"] = link(page + 1)
+	}
+}
+
+// countQuery runs a query returning a single count
+func countQuery(query string, args ...interface{}) (int, error) {
+	var n int
+	err := db.QueryRow(query, args...).Scan(&n)
+	return n, err
+}
+
+// countRows reads (label, count) rows
+func countRows(query string, args ...interface{}) ([]CountRow, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []CountRow
+	for rows.Next() {
+		var row CountRow
+		if err := rows.Scan(&row.Label, &row.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, row)
+	}
+	return counts, rows.Err()
+}
+
+// adminError logs a failed admin query and answers with a 500
+func adminError(w http.ResponseWriter, r *http.Request, what string, err error) {
+	log.Printf("Admin %s failed: username=%s error=%v", what, currentUser(r).Username, err)
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
+
+// adminDashboard shows headline numbers and links to the sections the user may see (GET /admin)
+func adminDashboard(w http.ResponseWriter, r *http.Request) {
+	counts := map[string]int{}
+	for key, query := range map[string]string{
+		"Users":          "SELECT COUNT(*) FROM users",
+		"VerifiedUsers":  "SELECT COUNT(*) FROM users WHERE verified_at IS NOT NULL",
+		"Pages":          "SELECT COUNT(*) FROM pages",
+		"QueuedURLs":     "SELECT COUNT(*) FROM crawl_queue",
+		"Searches":       "SELECT COALESCE(SUM(search_count), 0) FROM search_stats",
+		"ActiveSessions": "SELECT COUNT(*) FROM sessions WHERE expires_at > NOW() AND absolute_expires_at > NOW()",
+	} {
+		n, err := countQuery(query)
+		if err != nil {
+			adminError(w, r, "dashboard", err)
+			return
+		}
+		counts[key] = n
+	}
+
+	data := adminViewData(w, r)
+	data["Counts"] = counts
+	renderTemplate(w, "admin.html", data)
+}
+
+// listRoles returns every role with its permissions
+func listRoles() ([]Role, error) {
+	rows, err := db.Query(`SELECT roles.id, roles.name, roles.description,
+			COALESCE(string_agg(role_permissions.permission, ',' ORDER BY role_permissions.permission), '')
+		FROM roles
+		LEFT JOIN role_permissions ON role_permissions.role_id = roles.id
+		GROUP BY roles.id
+		ORDER BY roles.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []Role
+	for rows.Next() {
+		var role Role
+		var permissions string
+		if err := rows.Scan(&role.ID, &role.Name, &role.Description, &permissions); err != nil {
+			return nil, err
+		}
+		if permissions != "" {
+			role.Permissions = strings.Split(permissions, ",")
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// listAdminUsers returns one page of users matching search on username or e-mail, and whether more follow
+func listAdminUsers(search string, page int) ([]AdminUser, bool, error) {
+	rows, err := db.Query(`SELECT users.id, users.username, users.email, users.verified_at IS NOT NULL,
+			users.totp_enabled_at IS NOT NULL, users.registration_date, users.last_login_date, COALESCE(users.login_count, 0),
+			COALESCE((SELECT string_agg(roles.name, ',' ORDER BY roles.name)
+				FROM user_roles JOIN roles ON roles.id = user_roles.role_id
+				WHERE user_roles.user_id = users.id), '')
+		FROM users
+		WHERE $1 = '' OR users.username ILIKE '%' || $1 || '%' OR users.email ILIKE '%' || $1 || '%'
+		ORDER BY users.id
+		LIMIT $2 OFFSET $3`, search, adminPageSize+1, (page-1)*adminPageSize)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var users []AdminUser
+	for rows.Next() {
+		var user AdminUser
+		var roles string
+		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Verified, &user.TwoFactor,
+			&user.RegisteredAt, &user.LastLoginAt, &user.LoginCount, &roles)
+		if err != nil {
+			return nil, false, err
+		}
+		if roles != "" {
+			user.Roles = strings.Split(roles, ",")
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasNext := len(users) > adminPageSize
+	if hasNext {
+		users = users[:adminPageSize]
+	}
+	return users, hasNext, nil
+}
+
+// adminUsers lists users with their roles (GET /admin/users, needs users.view)
+func adminUsers(w http.ResponseWriter, r *http.Request) {
+	search := strings.TrimSpace(r.URL.Query().Get("q"))
+	page := adminPageNumber(r)
+
+	users, hasNext, err := listAdminUsers(search, page)
+	if err != nil {
+		adminError(w, r, "user list", err)
+		return
+	}
+	roles, err := listRoles()
+	if err != nil {
+		adminError(w, r, "role list", err)
+		return
+	}
+
+	data := adminViewData(w, r)
+	data["Search"] = search
+	data["Users"] = users
+	data["Roles"] = roles
+	setPagination(data, r, page, hasNext)
+	renderTemplate(w, "admin_users.html", data)
+}
+
+// adminUserRoles grants or revokes one role (POST /api/admin/users/roles, needs users.manage)
+// Admins can't change their own roles, so nobody locks themselves out of the console
+func adminUserRoles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	clientIP := getClientIP(r)
+	role := r.FormValue("role")
+	action := r.FormValue("action")
+
+	userID, err := strconv.Atoi(r.FormValue("user_id"))
+	if err != nil || role == "" || (action != "grant" && action != "revoke") {
+		http.Error(w, "Invalid role change", http.StatusBadRequest)
+		return
+	}
+	if userID == user.ID {
+		setFlash(w, "You can't change your own roles, ask another admin")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	var target string
+	if err := db.QueryRow("SELECT username FROM users WHERE id = $1", userID).Scan(&target); err != nil {
+		log.Printf("Role change failed: username=%s ip=%s user_id=%d reason=unknown_user error=%v", user.Username, clientIP, userID, err)
+		setFlash(w, "That user was not found")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	var result sql.Result
+	if action == "grant" {
+		result, err = db.Exec(`INSERT INTO user_roles (user_id, role_id, granted_by)
+			SELECT $1, id, $3 FROM roles WHERE name = $2
+			ON CONFLICT DO NOTHING`, userID, role, user.Username)
+	} else {
+		result, err = db.Exec(`DELETE FROM user_roles
+			WHERE user_id = $1 AND role_id = (SELECT id FROM roles WHERE name = $2)`, userID, role)
+	}
+	if err != nil {
+		log.Printf("Role change failed: username=%s ip=%s target=%s role=%s action=%s error=%v", user.Username, clientIP, target, role, action, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if changed, _ := result.RowsAffected(); changed == 0 {
+		setFlash(w, "Nothing changed, "+target+" already had that role or the role doesn't exist")
+	} else {
+		log.Printf("Role changed: username=%s ip=%s target=%s role=%s action=%s", user.Username, clientIP, target, role, action)
+		if action == "grant" {
+			setFlash(w, "Granted "+role+" to "+target)
+		} else {
+			setFlash(w, "Revoked "+role+" from "+target)
+		}
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// listAdminPages returns one page of indexed pages matching search on title or URL, and whether more follow
+func listAdminPages(search, language string, page int) ([]AdminPage, bool, error) {
+	rows, err := db.Query(`SELECT title, url, language, content_type, last_updated, length(content)
+		FROM pages
+		WHERE ($1 = '' OR title ILIKE '%' || $1 || '%' OR url ILIKE '%' || $1 || '%')
+		  AND ($2 = '' OR language = $2)
+		ORDER BY last_updated DESC, title
+		LIMIT $3 OFFSET $4`, search, language, adminPageSize+1, (page-1)*adminPageSize)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var pages []AdminPage
+	for rows.Next() {
+		var p AdminPage
+		if err := rows.Scan(&p.Title, &p.URL, &p.Language, &p.ContentType, &p.LastUpdated, &p.Size); err != nil {
+			return nil, false, err
+		}
+		pages = append(pages, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasNext := len(pages) > adminPageSize
+	if hasNext {
+		pages = pages[:adminPageSize]
+	}
+	return pages, hasNext, nil
+}
+
+// adminPages lists indexed pages, newest first (GET /admin/pages, needs pages.view)
+func adminPages(w http.ResponseWriter, r *http.Request) {
+	search := strings.TrimSpace(r.URL.Query().Get("q"))
+	language := r.URL.Query().Get("language")
+	page := adminPageNumber(r)
+
+	pages, hasNext, err := listAdminPages(search, language, page)
+	if err != nil {
+		adminError(w, r, "page list", err)
+		return
+	}
+
+	data := adminViewData(w, r)
+	data["Search"] = search
+	data["Language"] = language
+	data["Pages"] = pages
+	setPagination(data, r, page, hasNext)
+	renderTemplate(w, "admin_pages.html", data)
+}
+
+// adminIngest shows the crawl queue, recrawl totals and what's in the index (GET /admin/ingest, needs stats.view)
+func adminIngest(w http.ResponseWriter, r *http.Request) {
+	data := adminViewData(w, r)
+
+	queue, err := countRows("SELECT status, COUNT(*) FROM crawl_queue GROUP BY status ORDER BY status")
+	if err != nil {
+		adminError(w, r, "ingest stats", err)
+		return
+	}
+	data["Queue"] = queue
+
+	due, err := countQuery(`SELECT COUNT(*) FROM crawl_queue
+		WHERE status IN ('pending', 'done', 'blocked') AND next_fetch_at <= NOW()`)
+	if err != nil {
+		adminError(w, r, "ingest stats", err)
+		return
+	}
+	data["Due"] = due
+
+	var fetches, changes int
+	var lastFetched *time.Time
+	err = db.QueryRow(`SELECT COALESCE(SUM(fetch_count), 0), COALESCE(SUM(change_count), 0), MAX(last_fetched_at)
+		FROM crawl_state`).Scan(&fetches, &changes, &lastFetched)
+	if err != nil {
+		adminError(w, r, "ingest stats", err)
+		return
+	}
+	data["Fetches"] = fetches
+	data["Changes"] = changes
+	data["LastFetched"] = lastFetched
+
+	byLanguage, err := countRows("SELECT language, COUNT(*) FROM pages GROUP BY language ORDER BY COUNT(*) DESC")
+	if err != nil {
+		adminError(w, r, "ingest stats", err)
+		return
+	}
+	data["PagesByLanguage"] = byLanguage
+
+	byType, err := countRows("SELECT content_type, COUNT(*) FROM pages GROUP BY content_type ORDER BY COUNT(*) DESC")
+	if err != nil {
+		adminError(w, r, "ingest stats", err)
+		return
+	}
+	data["PagesByType"] = byType
+
+	updated, err := countRows(`SELECT to_char(date_trunc('day', last_updated), 'YYYY-MM-DD'), COUNT(*)
+		FROM pages WHERE last_updated > NOW() - INTERVAL '14 days'
+		GROUP BY 1 ORDER BY 1 DESC`)
+	if err != nil {
+		adminError(w, r, "ingest stats", err)
+		return
+	}
+	data["UpdatedPerDay"] = updated
+
+	rows, err := db.Query(`SELECT url, status, failure_count, last_error, next_fetch_at
+		FROM crawl_queue WHERE last_error IS NOT NULL
+		ORDER BY next_fetch_at DESC LIMIT 20`)
+	if err != nil {
+		adminError(w, r, "ingest stats", err)
+		return
+	}
+	defer rows.Close()
+
+	var failures []CrawlFailure
+	for rows.Next() {
+		var failure CrawlFailure
+		if err := rows.Scan(&failure.URL, &failure.Status, &failure.FailureCount, &failure.LastError, &failure.NextFetchAt); err != nil {
+			adminError(w, r, "ingest stats", err)
+			return
+		}
+		failures = append(failures, failure)
+	}
+	if err := rows.Err(); err != nil {
+		adminError(w, r, "ingest stats", err)
+		return
+	}
+	data["Failures"] = failures
+
+	renderTemplate(w, "admin_ingest.html", data)
+}
+
+// listSearchStats reads aggregated queries in the given order
+func listSearchStats(where, orderBy string, limit int) ([]SearchStat, error) {
+	rows, err := db.Query(`SELECT query, language, search_count, zero_result_count, last_searched_at
+		FROM search_stats WHERE `+where+` ORDER BY `+orderBy+` LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []SearchStat
+	for rows.Next() {
+		var stat SearchStat
+		if err := rows.Scan(&stat.Query, &stat.Language, &stat.Searches, &stat.ZeroResults, &stat.LastSearchedAt); err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, rows.Err()
+}
+
+// adminSearch shows what visitors search for and which searches find nothing (GET /admin/search, needs stats.view)
+func adminSearch(w http.ResponseWriter, r *http.Request) {
+	data := adminViewData(w, r)
+
+	var searches, zeroResults, distinct int
+	err := db.QueryRow(`SELECT COALESCE(SUM(search_count), 0), COALESCE(SUM(zero_result_count), 0), COUNT(*)
+		FROM search_stats`).Scan(&searches, &zeroResults, &distinct)
+	if err != nil {
+		adminError(w, r, "search analytics", err)
+		return
+	}
+	data["Searches"] = searches
+	data["ZeroResults"] = zeroResults
+	data["DistinctQueries"] = distinct
+
+	byLanguage, err := countRows("SELECT language, SUM(search_count)::int FROM search_stats GROUP BY language ORDER BY 2 DESC")
+	if err != nil {
+		adminError(w, r, "search analytics", err)
+		return
+	}
+	data["ByLanguage"] = byLanguage
+
+	top, err := listSearchStats("TRUE", "search_count DESC, query", 50)
+	if err != nil {
+		adminError(w, r, "search analytics", err)
+		return
+	}
+	data["TopQueries"] = top
+
+	zero, err := listSearchStats("zero_result_count > 0", "zero_result_count DESC, query", 50)
+	if err != nil {
+		adminError(w, r, "search analytics", err)
+		return
+	}
+	data["ZeroResultQueries"] = zero
+
+	recent, err := listSearchStats("TRUE", "last_searched_at DESC", 20)
+	if err != nil {
+		adminError(w, r, "search analytics", err)
+		return
+	}
+	data["RecentQueries"] = recent
+
+	renderTemplate(w, "admin_search.html", data)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// grantTestRole assigns one of the built-in roles to a test user
+func grantTestRole(t *testing.T, testDB *sql.DB, userID int, role string) {
+	t.Helper()
+	_, err := testDB.Exec(`INSERT INTO user_roles (user_id, role_id, granted_by)
+		SELECT $1, id, 'test' FROM roles WHERE name = $2`, userID, role)
+	if err != nil {
+		t.Fatalf("failed to grant role %s: %v", role, err)
+	}
+}
+
+// TestRequirePermission_NotLoggedIn verifies anonymous requests never reach an admin handler
+func TestRequirePermission_NotLoggedIn(t *testing.T) {
+	reached := false
+	handler := requirePermission(permAdminAccess, func(w http.ResponseWriter, r *http.Request) { reached = true })
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/admin", nil))
+	if reached || w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+		t.Errorf("browser request = %d to %q, reached=%v, want a redirect to /login", w.Code, w.Header().Get("Location"), reached)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/api/admin/users/roles", nil))
+	if reached || w.Code != http.StatusUnauthorized {
+		t.Errorf("API request = %d, reached=%v, want %d", w.Code, reached, http.StatusUnauthorized)
+	}
+}
+
+// TestPermissions_Has verifies lookups in a permission set, including the empty default
+func TestPermissions_Has(t *testing.T) {
+	permissions := Permissions{permPagesView: true}
+	if !permissions.Has(permPagesView) || permissions.Has(permUsersManage) {
+		t.Errorf("Has() = %v/%v, want true/false", permissions.Has(permPagesView), permissions.Has(permUsersManage))
+	}
+
+	if currentPermissions(httptest.NewRequest("GET", "/", nil)).Has(permAdminAccess) {
+		t.Errorf("a request without loaded permissions has admin.access")
+	}
+}
+
+// TestNormalizeSearchQuery verifies queries are aggregated regardless of case and spacing
+func TestNormalizeSearchQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"Go Lang", "go lang"},
+		{"  go \t  lang ", "go lang"},
+		{"", ""},
+		{"   ", ""},
+		{strings.Repeat("a", 300), strings.Repeat("a", maxStatsQueryLength)},
+		// A two-byte rune straddling the limit is dropped rather than cut in half
+		{strings.Repeat("a", maxStatsQueryLength-1) + "æ", strings.Repeat("a", maxStatsQueryLength-1)},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeSearchQuery(tt.query); got != tt.want {
+			t.Errorf("normalizeSearchQuery(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+// TestSetPagination verifies page links keep the filters and only appear when there is a page to go to
+func TestSetPagination(t *testing.T) {
+	r := httptest.NewRequest("GET", "/admin/pages?q=go&language=da&page=2", nil)
+
+	data := map[string]interface{}{}
+	setPagination(data, r, 2, true)
+	if data["PrevURL"] != "/admin/pages?language=da&page=1&q=go" || data["NextURL"] != "/admin/pages?language=da&page=3&q=go" {
+		t.Errorf("links = %v / %v", data["PrevURL"], data["NextURL"])
+	}
+
+	data = map[string]interface{}{}
+	setPagination(data, r, 1, false)
+	if _, ok := data["PrevURL"]; ok {
+		t.Errorf("first page has a previous link")
+	}
+	if _, ok := data["NextURL"]; ok {
+		t.Errorf("last page has a next link")
+	}
+}
+
+// TestAdminUsersTemplate verifies role forms are shown to managers, carry the CSRF token and skip the admin's own row
+func TestAdminUsersTemplate(t *testing.T) {
+	templates = template.Must(template.ParseGlob("../templates/*.html"))
+
+	render := func(permissions Permissions) string {
+		w := httptest.NewRecorder()
+		renderTemplate(w, "admin_users.html", map[string]interface{}{
+			"User":        &User{ID: 1, Username: "testuser_admin"},
+			"CSRFToken":   "test-csrf-token",
+			"Permissions": permissions,
+			"Users": []AdminUser{
+				{ID: 1, Username: "testuser_admin", Roles: []string{"admin"}},
+				{ID: 2, Username: "testuser_member"},
+			},
+			"Roles":      []Role{{ID: 1, Name: "admin"}, {ID: 2, Name: "analyst"}},
+			"PageNumber": 1,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("render = %d:\n%s", w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	body := render(Permissions{permUsersView: true, permUsersManage: true})
+	if !strings.Contains(body, `name="user_id" value="2"`) || !strings.Contains(body, `value="Grant analyst"`) {
+		t.Errorf("manager does not see role forms for other users")
+	}
+	if strings.Contains(body, `name="user_id" value="1"`) {
+		t.Errorf("manager sees role forms for their own account")
+	}
+	if !strings.Contains(body, `name="csrf_token" value="test-csrf-token"`) {
+		t.Errorf("role forms carry no CSRF token")
+	}
+
+	body = render(Permissions{permUsersView: true})
+	if strings.Contains(body, "/api/admin/users/roles") {
+		t.Errorf("viewer without users.manage sees role forms")
+	}
+}
+
+// TestAdminConsole_Integration verifies roles decide which admin pages and actions are allowed
+func TestAdminConsole_Integration(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	ids := map[string]int{}
+	for _, username := range []string{"testuser_rbac_admin", "testuser_rbac_analyst", "testuser_rbac_member"} {
+		var id int
+		err := testDB.QueryRow(`INSERT INTO users (username, email, password, registration_ip, verified_at)
+			VALUES ($1, $2, $3, $4, NOW()) RETURNING id`,
+			username, username+"@example.com", string(hashedPassword), "127.0.0.1").Scan(&id)
+		if err != nil {
+			t.Fatalf("failed to create test user: %v", err)
+		}
+		ids[username] = id
+		if err := createSession(username, "test-"+username, "Go-http-client/1.1", "127.0.0.1"); err != nil {
+			t.Fatalf("failed to create test session: %v", err)
+		}
+	}
+	grantTestRole(t, testDB, ids["testuser_rbac_admin"], "admin")
+	grantTestRole(t, testDB, ids["testuser_rbac_analyst"], "analyst")
+
+	t.Run("page access by role", func(t *testing.T) {
+		routes := []struct {
+			path       string
+			permission string
+			handler    http.HandlerFunc
+		}{
+			{"/admin", permAdminAccess, adminDashboard},
+			{"/admin/users", permUsersView, adminUsers},
+			{"/admin/pages", permPagesView, adminPages},
+			{"/admin/ingest", permStatsView, adminIngest},
+			{"/admin/search", permStatsView, adminSearch},
+		}
+		want := map[string]map[string]int{
+			"testuser_rbac_admin":   {"/admin": 200, "/admin/users": 200, "/admin/pages": 200, "/admin/ingest": 200, "/admin/search": 200},
+			"testuser_rbac_analyst": {"/admin": 200, "/admin/users": 303, "/admin/pages": 200, "/admin/ingest": 200, "/admin/search": 200},
+			"testuser_rbac_member":  {"/admin": 303, "/admin/users": 303, "/admin/pages": 303, "/admin/ingest": 303, "/admin/search": 303},
+		}
+
+		for username, codes := range want {
+			for _, route := range routes {
+				req := httptest.NewRequest("GET", route.path, nil)
+				req.AddCookie(&http.Cookie{Name: "session_token", Value: "test-" + username})
+				w := httptest.NewRecorder()
+				requirePermission(route.permission, route.handler)(w, req)
+				if w.Code != codes[route.path] {
+					t.Errorf("%s GET %s = %d, want %d", username, route.path, w.Code, codes[route.path])
+				}
+			}
+		}
+	})
+
+	roleChange := func(username string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/admin/users/roles", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: "test-" + username})
+		w := httptest.NewRecorder()
+		requirePermission(permUsersManage, adminUserRoles)(w, req)
+		return w
+	}
+	hasRole := func(username, role string) bool {
+		var exists bool
+		testDB.QueryRow(`SELECT EXISTS (SELECT 1 FROM user_roles
+			JOIN users ON users.id = user_roles.user_id JOIN roles ON roles.id = user_roles.role_id
+			WHERE users.username = $1 AND roles.name = $2)`, username, role).Scan(&exists)
+		return exists
+	}
+
+	t.Run("analyst can't change roles", func(t *testing.T) {
+		w := roleChange("testuser_rbac_analyst", url.Values{
+			"user_id": {strconv.Itoa(ids["testuser_rbac_member"])}, "role": {"admin"}, "action": {"grant"},
+		})
+		if w.Code != http.StatusForbidden || hasRole("testuser_rbac_member", "admin") {
+			t.Errorf("analyst role change = %d, member is admin: %v", w.Code, hasRole("testuser_rbac_member", "admin"))
+		}
+	})
+
+	t.Run("admin grants and revokes", func(t *testing.T) {
+		member := strconv.Itoa(ids["testuser_rbac_member"])
+
+		w := roleChange("testuser_rbac_admin", url.Values{"user_id": {member}, "role": {"analyst"}, "action": {"grant"}})
+		if w.Code != http.StatusSeeOther || !hasRole("testuser_rbac_member", "analyst") {
+			t.Fatalf("grant = %d, flash %q", w.Code, flashFrom(w))
+		}
+
+		// The new role applies on the member's next request, no new login needed
+		req := httptest.NewRequest("GET", "/admin/search", nil)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: "test-testuser_rbac_member"})
+		page := httptest.NewRecorder()
+		requirePermission(permStatsView, adminSearch)(page, req)
+		if page.Code != http.StatusOK {
+			t.Errorf("member with analyst role GET /admin/search = %d", page.Code)
+		}
+
+		w = roleChange("testuser_rbac_admin", url.Values{"user_id": {member}, "role": {"analyst"}, "action": {"revoke"}})
+		if w.Code != http.StatusSeeOther || hasRole("testuser_rbac_member", "analyst") {
+			t.Errorf("revoke = %d, flash %q", w.Code, flashFrom(w))
+		}
+	})
+
+	t.Run("admin can't revoke their own role", func(t *testing.T) {
+		w := roleChange("testuser_rbac_admin", url.Values{
+			"user_id": {strconv.Itoa(ids["testuser_rbac_admin"])}, "role": {"admin"}, "action": {"revoke"},
+		})
+		if !hasRole("testuser_rbac_admin", "admin") || !strings.Contains(flashFrom(w), "can't change your own roles") {
+			t.Errorf("self revoke = %d, flash %q", w.Code, flashFrom(w))
+		}
+	})
+
+	t.Run("invalid role change", func(t *testing.T) {
+		w := roleChange("testuser_rbac_admin", url.Values{
+			"user_id": {strconv.Itoa(ids["testuser_rbac_member"])}, "role": {"admin"}, "action": {"promote"},
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("unknown action = %d, want %d", w.Code, http.StatusBadRequest)
+		}
+	})
+}
+
+// TestRecordSearchStats_Integration verifies searches are aggregated per normalized query and language
+func TestRecordSearchStats_Integration(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	defer testDB.Exec("DELETE FROM search_stats WHERE query LIKE 'testquery%'")
+
+	recordSearchStats("TestQuery  Stats", "en", 3)
+	recordSearchStats("testquery stats", "en", 0)
+	recordSearchStats("testquery stats", "da", 0)
+
+	var searches, zero int
+	err := testDB.QueryRow(`SELECT search_count, zero_result_count FROM search_stats
+		WHERE query = 'testquery stats' AND language = 'en'`).Scan(&searches, &zero)
+	if err != nil {
+		t.Fatalf("failed to read search stats: %v", err)
+	}
+	if searches != 2 || zero != 1 {
+		t.Errorf("en stats = %d searches, %d without results", searches, zero)
+	}
+
+	err = testDB.QueryRow(`SELECT search_count FROM search_stats
+		WHERE query = 'testquery stats' AND language = 'da'`).Scan(&searches)
+	if err != nil || searches != 1 {
+		t.Errorf("da stats = %d, error=%v", searches, err)
+	}
+}
@@ -0,0 +1,701 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Alert channels a saved search can be subscribed to, each delivered by the Notifier registered in notifiers
+const (
+	alertChannelEmail   = "email"
+	alertChannelWebhook = "webhook"
+	alertChannelInbox   = "inbox"
+)
+
+// Time allowed for an alert webhook to answer
+const alertWebhookTimeout = 10 * time.Second
+
+// Indexed batches wait in alert_evaluations and the notifications they cause in alert_notifications,
+// the alert worker works through both
+const (
+	maxAlertAttempts           = 5
+	alertClaimLease            = time.Minute // claimed notifications become due again if the worker dies mid-send
+	alertBatchSize             = 20
+	alertNotificationRetention = 30 * 24 * time.Hour
+)
+
+// errAlertUndeliverable marks notifications that retrying can't fix, like e-mail to an address that is no longer verified
+var errAlertUndeliverable = errors.New("alert can no longer be delivered")
+
+// Pages listed in one alert, the rest are summarised as a count
+const maxAlertPagesListed = 20
+
+// Alert reports pages that newly match one of a user's saved searches
+type Alert struct {
+	SubscriptionID int
+	UserID         int
+	Username       string
+	Email          string
+	SearchName     string
+	Query          string
+	Language       string
+	WebhookURL     string
+	Pages          []Page
+}
+
+// SearchURL links to the search page for the alert's query
+func (a Alert) SearchURL() string {
+	return getBaseURL() + SavedSearch{Query: a.Query, Language: a.Language}.SearchURL()
+}
+
+// Summary is the one-line description used as e-mail subject and inbox title
+func (a Alert) Summary() string {
+	if len(a.Pages) == 1 {
+		return fmt.Sprintf("1 new result for %q", a.SearchName)
+	}
+	return fmt.Sprintf("%d new results for %q", len(a.Pages), a.SearchName)
+}
+
+// pageList lists the alert's pages as "title\nurl" lines, capped at maxAlertPagesListed
+func (a Alert) pageList() string {
+	var b strings.Builder
+	for i, page := range a.Pages {
+		if i == maxAlertPagesListed {
+			fmt.Fprintf(&b, "...and %d more\n", len(a.Pages)-maxAlertPagesListed)
+			break
+		}
+		fmt.Fprintf(&b, "%s\n%s\n\n", page.Title, page.URL)
+	}
+	return b.String()
+}
+
+// Notifier delivers alerts over one channel
+type Notifier interface {
+	Notify(alert Alert) error
+}
+
+// notifiers maps each alert channel to its Notifier, tests swap entries to capture alerts
+var notifiers = map[string]Notifier{
+	alertChannelEmail:   EmailNotifier{},
+	alertChannelWebhook: WebhookNotifier{Client: newPublicHTTPClient(alertWebhookTimeout)},
+	alertChannelInbox:   InboxNotifier{},
+}
+
+// EmailNotifier mails alerts to the user's verified address through the configured mailer
+type EmailNotifier struct{}
+
+// Notify sends the alert e-mail
+func (EmailNotifier) Notify(alert Alert) error {
+	return mailer.Send(Mail{
+		To:      alert.Email,
+		Subject: alert.Summary(),
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"New pages match your saved search %q:\n\n%s"+
+			"See all results: %s\n"+
+			"Manage your alerts: %s/searches\n",
+			alert.Username, alert.SearchName, alert.pageList(), alert.SearchURL(), getBaseURL()),
+	})
+}
+
+// alertWebhookPayload is the JSON body posted to alert webhooks
+type alertWebhookPayload struct {
+	Event  string             `json:"event"`
+	Search alertWebhookSearch `json:"search"`
+	Pages  []alertWebhookPage `json:"pages"`
+	SentAt time.Time          `json:"sent_at"`
+}
+
+type alertWebhookSearch struct {
+	Name     string `json:"name"`
+	Query    string `json:"query"`
+	Language string `json:"language"`
+	URL      string `json:"url"`
+}
+
+type alertWebhookPage struct {
+	Title    string `json:"title"`
+	URL      string `json:"url"`
+	Language string `json:"language"`
+}
+
+// WebhookNotifier posts alerts as JSON to the URL the user subscribed with
+type WebhookNotifier struct {
+	Client *http.Client
+}
+
+// Notify posts the alert, treating any non-2xx answer as a failure
+func (n WebhookNotifier) Notify(alert Alert) error {
+	payload := alertWebhookPayload{
+		Event: "saved_search.alert",
+		Search: alertWebhookSearch{
+			Name:     alert.SearchName,
+			Query:    alert.Query,
+			Language: alert.Language,
+			URL:      alert.SearchURL(),
+		},
+		SentAt: time.Now().UTC(),
+	}
+	for _, page := range alert.Pages {
+		payload.Pages = append(payload.Pages, alertWebhookPage{Title: page.Title, URL: page.URL, Language: page.Language})
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", alert.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Oggole-Alerts/1.0")
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// InboxNotifier stores alerts in the user's in-app inbox
+type InboxNotifier struct{}
+
+// Notify adds the alert to inbox_notifications
+func (InboxNotifier) Notify(alert Alert) error {
+	_, err := db.Exec("INSERT INTO inbox_notifications (user_id, title, body, link) VALUES ($1, $2, $3, $4)",
+		alert.UserID, alert.Summary(), alert.pageList(),
+		SavedSearch{Query: alert.Query, Language: alert.Language}.SearchURL())
+	return err
+}
+
+var errNonPublicAddress = errors.New("refusing to connect to a non-public address")
+
+// newPublicHTTPClient returns a client that only connects to public IP addresses
+// Webhook URLs come from users, so they must not reach the database, metadata endpoints or the local network
+func newPublicHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return errNonPublicAddress
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: timeout,
+		// No proxy, the address check has to see the real destination
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: timeout},
+	}
+}
+
+// isPublicIP reports whether ip is a globally routable unicast address
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast()
+}
+
+// alertSubscription is a subscription loaded for evaluation, with its saved search and owner
+type alertSubscription struct {
+	Alert
+	Channel string
+}
+
+// loadAlertSubscriptions returns every subscription that can currently be delivered
+// E-mail alerts are only sent to verified addresses
+func loadAlertSubscriptions(tx *sql.Tx) ([]alertSubscription, error) {
+	rows, err := tx.Query(`SELECT a.id, a.channel, COALESCE(a.webhook_url, ''), s.name, s.query, s.language, u.id, u.username, u.email
+		FROM alert_subscriptions a
+		JOIN saved_searches s ON s.id = a.saved_search_id
+		JOIN users u ON u.id = s.user_id
+		WHERE a.channel <> $1 OR u.verified_at IS NOT NULL
+		ORDER BY a.id`, alertChannelEmail)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []alertSubscription
+	for rows.Next() {
+		var s alertSubscription
+		err := rows.Scan(&s.SubscriptionID, &s.Channel, &s.WebhookURL, &s.SearchName, &s.Query, &s.Language,
+			&s.UserID, &s.Username, &s.Email)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	return subscriptions, rows.Err()
+}
+
+// matchingPages returns which of the pages at urls match a search, using the same condition as performSearch
+func matchingPages(tx *sql.Tx, query, language string, urls []string) ([]Page, error) {
+	sqlQuery := fmt.Sprintf(`SELECT title, url, language FROM pages
+		WHERE language = $1 AND url = ANY($4) AND %s
+		ORDER BY title`, searchMatchCondition(getTextSearchConfig(language)))
+	rows, err := tx.Query(sqlQuery, language, query, "%"+query+"%", pq.Array(urls))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pages []Page
+	for rows.Next() {
+		var page Page
+		if err := rows.Scan(&page.Title, &page.URL, &page.Language); err != nil {
+			return nil, err
+		}
+		pages = append(pages, page)
+	}
+	return pages, rows.Err()
+}
+
+// enqueueAlertEvaluation stores the URLs of an indexed batch for the alert worker to match against saved searches
+func enqueueAlertEvaluation(urls []string) error {
+	if len(urls) == 0 {
+		return nil
+	}
+	_, err := db.Exec("INSERT INTO alert_evaluations (urls) VALUES ($1)", pq.Array(urls))
+	return err
+}
+
+// evaluateNextAlertBatch matches the oldest stored batch against the alert subscriptions and queues the
+// notifications it causes. The batch is removed in the same transaction, so a failure or crash leaves it
+// for the next run, and SKIP LOCKED lets several app instances take different batches
+// Returns false when no batch was waiting
+func evaluateNextAlertBatch() (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var urls []string
+	err = tx.QueryRow(`DELETE FROM alert_evaluations WHERE id = (
+			SELECT id FROM alert_evaluations ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED
+		) RETURNING urls`).Scan(pq.Array(&urls))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := evaluateAlerts(tx, urls); err != nil {
+		return true, err
+	}
+	return true, tx.Commit()
+}
+
+// evaluateAlerts checks the alert subscriptions against pages just indexed by batchPages and queues
+// notifications of matches subscribers haven't been told about
+func evaluateAlerts(tx *sql.Tx, urls []string) error {
+	subscriptions, err := loadAlertSubscriptions(tx)
+	if err != nil {
+		return fmt.Errorf("load subscriptions: %w", err)
+	}
+
+	// Subscriptions on the same query share one lookup
+	type searchKey struct{ query, language string }
+	matches := map[searchKey][]Page{}
+	for _, subscription := range subscriptions {
+		key := searchKey{subscription.Query, subscription.Language}
+		pages, done := matches[key]
+		if !done {
+			pages, err = matchingPages(tx, subscription.Query, subscription.Language, urls)
+			if err != nil {
+				return fmt.Errorf("match query %q: %w", subscription.Query, err)
+			}
+			matches[key] = pages
+		}
+		if len(pages) > 0 {
+			if err := queueAlert(tx, subscription, pages); err != nil {
+				return fmt.Errorf("queue alert for subscription %d: %w", subscription.SubscriptionID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// queueAlert queues a notification of the pages a subscriber hasn't been told about yet
+// The pages are recorded in alert_deliveries along with it, so each page is queued once
+// and the alert worker retries the notification until it is sent
+func queueAlert(tx *sql.Tx, subscription alertSubscription, pages []Page) error {
+	rows, err := tx.Query(`INSERT INTO alert_deliveries (subscription_id, page_url)
+		SELECT $1, unnest($2::text[])
+		ON CONFLICT DO NOTHING
+		RETURNING page_url`, subscription.SubscriptionID, pq.Array(resultURLs(pages)))
+	if err != nil {
+		return err
+	}
+	isFresh := map[string]bool{}
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			rows.Close()
+			return err
+		}
+		isFresh[url] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(isFresh) == 0 {
+		return nil
+	}
+
+	var fresh []alertWebhookPage
+	for _, page := range pages {
+		if isFresh[page.URL] {
+			fresh = append(fresh, alertWebhookPage{Title: page.Title, URL: page.URL, Language: page.Language})
+		}
+	}
+	payload, err := json.Marshal(fresh)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO alert_notifications (subscription_id, pages) VALUES ($1, $2)",
+		subscription.SubscriptionID, string(payload))
+	return err
+}
+
+// claimedAlert is a due notification with everything needed to send it
+type claimedAlert struct {
+	Alert
+	ID       int64
+	Channel  string
+	Verified bool
+	Attempts int
+}
+
+// claimAlertNotifications pushes up to limit due notifications back by alertClaimLease and returns them,
+// SKIP LOCKED lets several app instances share the work without double sending
+func claimAlertNotifications(now time.Time, limit int) ([]claimedAlert, error) {
+	rows, err := db.Query(`
+		UPDATE alert_notifications n SET next_attempt_at = $2
+		FROM alert_subscriptions a
+		JOIN saved_searches s ON s.id = a.saved_search_id
+		JOIN users u ON u.id = s.user_id
+		WHERE a.id = n.subscription_id AND n.id IN (
+			SELECT id FROM alert_notifications
+			WHERE status = 'pending' AND next_attempt_at <= $1
+			ORDER BY next_attempt_at
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING n.id, n.pages, n.attempts, a.id, a.channel, COALESCE(a.webhook_url, ''),
+			s.name, s.query, s.language, u.id, u.username, u.email, u.verified_at IS NOT NULL
+	`, now, now.Add(alertClaimLease), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var claimed []claimedAlert
+	for rows.Next() {
+		var c claimedAlert
+		var payload string
+		err := rows.Scan(&c.ID, &payload, &c.Attempts, &c.SubscriptionID, &c.Channel, &c.WebhookURL,
+			&c.SearchName, &c.Query, &c.Language, &c.UserID, &c.Username, &c.Email, &c.Verified)
+		if err != nil {
+			return nil, err
+		}
+		var pages []alertWebhookPage
+		if err := json.Unmarshal([]byte(payload), &pages); err != nil {
+			return nil, err
+		}
+		for _, page := range pages {
+			c.Pages = append(c.Pages, Page{Title: page.Title, URL: page.URL, Language: page.Language})
+		}
+		claimed = append(claimed, c)
+	}
+	return claimed, rows.Err()
+}
+
+// sendAlert delivers a claimed notification through its channel's Notifier
+func sendAlert(c claimedAlert) error {
+	notifier, ok := notifiers[c.Channel]
+	switch {
+	case !ok:
+		return fmt.Errorf("%w: unknown channel %s", errAlertUndeliverable, c.Channel)
+	case c.Channel == alertChannelEmail && !c.Verified:
+		return fmt.Errorf("%w: e-mail address is not verified", errAlertUndeliverable)
+	}
+	return notifier.Notify(c.Alert)
+}
+
+// recordAlertAttempt stores the outcome of a send, scheduling a retry or giving up after maxAlertAttempts
+func recordAlertAttempt(c claimedAlert, sendErr error, now time.Time) error {
+	attempts := c.Attempts + 1
+
+	if sendErr == nil {
+		alertNotifications.WithLabelValues(c.Channel, "sent").Inc()
+		log.Printf("Alert sent: subscription=%d channel=%s username=%s pages=%d",
+			c.SubscriptionID, c.Channel, c.Username, len(c.Pages))
+		_, err := db.Exec(`UPDATE alert_notifications
+			SET status = 'sent', attempts = $2, last_error = NULL, sent_at = $3
+			WHERE id = $1`, c.ID, attempts, now)
+		return err
+	}
+
+	// Retried on the crawl frontier's failure schedule
+	status, outcome, next := "pending", "retry", now.Add(failureBackoff(attempts))
+	if attempts >= maxAlertAttempts || errors.Is(sendErr, errAlertUndeliverable) {
+		status, outcome, next = "failed", "failed", now
+	}
+	alertNotifications.WithLabelValues(c.Channel, outcome).Inc()
+	log.Printf("Alert delivery failed: notification=%d subscription=%d channel=%s username=%s attempt=%d status=%s error=%v",
+		c.ID, c.SubscriptionID, c.Channel, c.Username, attempts, status, sendErr)
+
+	_, err := db.Exec(`UPDATE alert_notifications
+		SET status = $2, attempts = $3, last_error = $4, next_attempt_at = $5
+		WHERE id = $1`, c.ID, status, attempts, sendErr.Error(), next)
+	return err
+}
+
+// deliverDueAlerts sends one batch of due notifications and returns how many were attempted
+func deliverDueAlerts(ctx context.Context, now time.Time) (int, error) {
+	claimed, err := claimAlertNotifications(now, alertBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, c := range claimed {
+		if ctx.Err() != nil {
+			// The rest become due again when their lease runs out
+			return i, ctx.Err()
+		}
+		if err := recordAlertAttempt(c, sendAlert(c), time.Now()); err != nil {
+			log.Printf("Failed to record alert notification: notification=%d error=%v", c.ID, err)
+		}
+	}
+	return len(claimed), nil
+}
+
+// pruneAlertNotifications drops sent and failed notifications older than alertNotificationRetention
+func pruneAlertNotifications(now time.Time) (int64, error) {
+	result, err := db.Exec("DELETE FROM alert_notifications WHERE status <> 'pending' AND created_at < $1",
+		now.Add(-alertNotificationRetention))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// startAlertWorker evaluates stored batches and sends the queued notifications until ctx is cancelled
+func startAlertWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for ctx.Err() == nil {
+				found, err := evaluateNextAlertBatch()
+				if err != nil {
+					log.Printf("Alert evaluation failed: error=%v", err)
+					break
+				}
+				if !found {
+					break
+				}
+			}
+
+			// Keep going while full batches come back so a backlog drains without waiting a tick each
+			for {
+				n, err := deliverDueAlerts(ctx, time.Now())
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("Alert worker run failed: error=%v", err)
+					}
+					break
+				}
+				if n < alertBatchSize {
+					break
+				}
+			}
+			if n, err := pruneAlertNotifications(time.Now()); err != nil {
+				log.Printf("Alert notification pruning failed: error=%v", err)
+			} else if n > 0 {
+				log.Printf("Old alert notifications pruned: rows=%d", n)
+			}
+		}
+	}
+}
+
+// updateSavedSearchAlerts sets which channels a saved search alerts on (POST /api/searches/alerts)
+// Takes one "channel" field per channel and webhook_url with the webhook channel
+// Channels that stay selected keep their delivery history, so nothing is reported twice
+func updateSavedSearchAlerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	id, ok := formID(w, r, "saved search")
+	if !ok {
+		return
+	}
+
+	channels := map[string]bool{}
+	for _, channel := range r.Form["channel"] {
+		if _, known := notifiers[channel]; !known {
+			respondSaved(w, r, http.StatusBadRequest, "Unknown alert channel", "/searches", nil)
+			return
+		}
+		channels[channel] = true
+	}
+	webhookURL := strings.TrimSpace(r.FormValue("webhook_url"))
+	switch {
+	case channels[alertChannelEmail] && !user.Verified:
+		respondSaved(w, r, http.StatusBadRequest, "Please verify your e-mail address before turning on e-mail alerts", "/searches", nil)
+		return
+	case channels[alertChannelWebhook] && !validBookmarkURL(webhookURL):
+		respondSaved(w, r, http.StatusBadRequest, "Enter an http or https webhook URL", "/searches", nil)
+		return
+	}
+
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM saved_searches WHERE id = $1 AND user_id = $2)", id, user.ID).Scan(&exists)
+	if err == nil && !exists {
+		respondSaved(w, r, http.StatusNotFound, "That saved search was not found", "/searches", nil)
+		return
+	}
+
+	var tx *sql.Tx
+	if err == nil {
+		tx, err = db.Begin()
+	}
+	if err == nil {
+		defer tx.Rollback()
+		keep := []string{}
+		for channel := range channels {
+			keep = append(keep, channel)
+		}
+		_, err = tx.Exec("DELETE FROM alert_subscriptions WHERE saved_search_id = $1 AND NOT (channel = ANY($2))",
+			id, pq.Array(keep))
+	}
+	for channel := range channels {
+		if err != nil {
+			break
+		}
+		var target sql.NullString
+		if channel == alertChannelWebhook {
+			target = sql.NullString{String: webhookURL, Valid: true}
+		}
+		_, err = tx.Exec(`INSERT INTO alert_subscriptions (saved_search_id, channel, webhook_url) VALUES ($1, $2, $3)
+			ON CONFLICT (saved_search_id, channel) DO UPDATE SET webhook_url = EXCLUDED.webhook_url`,
+			id, channel, target)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Alert settings failed: username=%s search=%d error=%v", user.Username, id, err)
+		respondSaved(w, r, http.StatusInternalServerError, "Failed to save the alert settings", "/searches", nil)
+		return
+	}
+
+	log.Printf("Alert settings changed: username=%s search=%d channels=%d", user.Username, id, len(channels))
+	message := "Alerts turned off"
+	if len(channels) > 0 {
+		message = "Alerts saved, you'll be notified when new pages match"
+	}
+	respondSaved(w, r, http.StatusOK, message, "/searches", nil)
+}
+
+// InboxNotification is an entry of the in-app inbox
+type InboxNotification struct {
+	ID        int64
+	Title     string
+	Body      string
+	Link      string
+	ReadAt    *time.Time
+	CreatedAt time.Time
+}
+
+// Notifications shown on the inbox page, newest first
+const inboxPageSize = 50
+
+// unreadInboxCount returns how many inbox notifications the user hasn't read
+func unreadInboxCount(userID int) int {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM inbox_notifications WHERE user_id = $1 AND read_at IS NULL", userID).Scan(&count)
+	if err != nil {
+		log.Printf("Failed to count inbox notifications: user=%d error=%v", userID, err)
+	}
+	return count
+}
+
+// inboxPage lists the user's notifications (GET /inbox, behind requireLogin)
+func inboxPage(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	rows, err := db.Query(`SELECT id, title, body, link, read_at, created_at FROM inbox_notifications
+		WHERE user_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2`, user.ID, inboxPageSize)
+	var notifications []InboxNotification
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var n InboxNotification
+			if err = rows.Scan(&n.ID, &n.Title, &n.Body, &n.Link, &n.ReadAt, &n.CreatedAt); err != nil {
+				break
+			}
+			notifications = append(notifications, n)
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if err != nil {
+		log.Printf("Failed to load inbox: username=%s error=%v", user.Username, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := buildViewData(w, r)
+	data["Notifications"] = notifications
+	renderTemplate(w, "inbox.html", data)
+}
+
+// markInboxRead marks all of the user's notifications as read (POST /api/inbox/read)
+func markInboxRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	_, err := db.Exec("UPDATE inbox_notifications SET read_at = NOW() WHERE user_id = $1 AND read_at IS NULL", user.ID)
+	if err != nil {
+		log.Printf("Failed to mark inbox read: username=%s error=%v", user.Username, err)
+		respondSaved(w, r, http.StatusInternalServerError, "Failed to update your inbox", "/inbox", nil)
+		return
+	}
+	respondSaved(w, r, http.StatusOK, "All notifications marked as read", "/inbox", nil)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureNotifier records alerts instead of delivering them, or fails every delivery while err is set
+type captureNotifier struct {
+	mu     sync.Mutex
+	alerts []Alert
+	err    error
+}
+
+func (n *captureNotifier) Notify(alert Alert) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.err != nil {
+		return n.err
+	}
+	n.alerts = append(n.alerts, alert)
+	return nil
+}
+
+// TestIsPublicIP verifies webhooks can't be pointed at loopback, private or link-local addresses
+func TestIsPublicIP(t *testing.T) {
+	tests := map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"10.0.0.5":        false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"::1":             false,
+		"fd00::1":         false,
+		"0.0.0.0":         false,
+	}
+	for raw, want := range tests {
+		if got := isPublicIP(net.ParseIP(raw)); got != want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", raw, got, want)
+		}
+	}
+}
+
+// TestPublicHTTPClient_RejectsLoopback verifies the webhook client refuses to connect to the local machine
+func TestPublicHTTPClient_RejectsLoopback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached a loopback server")
+	}))
+	defer server.Close()
+
+	err := WebhookNotifier{Client: newPublicHTTPClient(alertWebhookTimeout)}.Notify(Alert{WebhookURL: server.URL})
+	if !errors.Is(err, errNonPublicAddress) {
+		t.Errorf("Notify() error = %v, want errNonPublicAddress", err)
+	}
+}
+
+// TestWebhookNotifier verifies the JSON payload and that non-2xx answers are failures
+func TestWebhookNotifier(t *testing.T) {
+	var payload alertWebhookPayload
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Content-Type = %q", r.Header.Get("Content-Type"))
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	notifier := WebhookNotifier{Client: server.Client()}
+	alert := Alert{
+		SearchName: "Go news",
+		Query:      "golang",
+		Language:   "en",
+		WebhookURL: server.URL,
+		Pages:      []Page{{Title: "Go 2", URL: "https://example.com/go2", Language: "en"}},
+	}
+	if err := notifier.Notify(alert); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+	if payload.Event != "saved_search.alert" || payload.Search.Query != "golang" || len(payload.Pages) != 1 || payload.Pages[0].URL != "https://example.com/go2" {
+		t.Errorf("payload = %+v", payload)
+	}
+
+	status = http.StatusInternalServerError
+	if err := notifier.Notify(alert); err == nil {
+		t.Error("Notify() succeeded on a 500 answer")
+	}
+}
+
+// TestEmailNotifier verifies the alert e-mail lists the new pages
+func TestEmailNotifier(t *testing.T) {
+	capture := useCaptureMailer(t)
+
+	err := EmailNotifier{}.Notify(Alert{
+		Username:   "testuser_alert",
+		Email:      "alert@example.com",
+		SearchName: "Go news",
+		Query:      "golang",
+		Language:   "en",
+		Pages:      []Page{{Title: "Go 2", URL: "https://example.com/go2"}},
+	})
+	if err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+	sent := waitForMail(t, capture, 1)
+	if sent[0].To != "alert@example.com" || sent[0].Subject != `1 new result for "Go news"` || !strings.Contains(sent[0].Body, "https://example.com/go2") {
+		t.Errorf("mail = %+v", sent[0])
+	}
+}
+
+// TestSendAlert_Undeliverable verifies unknown channels and unverified e-mail addresses fail without retrying
+func TestSendAlert_Undeliverable(t *testing.T) {
+	for name, alert := range map[string]claimedAlert{
+		"unknown channel": {Channel: "sms", Verified: true},
+		"unverified":      {Channel: alertChannelEmail, Alert: Alert{Email: "alert@example.com"}},
+	} {
+		if err := sendAlert(alert); !errors.Is(err, errAlertUndeliverable) {
+			t.Errorf("%s: sendAlert() error = %v, want errAlertUndeliverable", name, err)
+		}
+	}
+}
+
+// TestUpdateSavedSearchAlerts_Validation verifies unknown channels, unverified e-mail and bad webhook URLs are rejected
+func TestUpdateSavedSearchAlerts_Validation(t *testing.T) {
+	user := &User{ID: 1, Username: "testuser_alert_form"}
+	tests := map[string]url.Values{
+		"unknown channel": {"id": {"1"}, "channel": {"sms"}},
+		"unverified":      {"id": {"1"}, "channel": {"email"}},
+		"webhook url":     {"id": {"1"}, "channel": {"webhook"}, "webhook_url": {"ftp://example.com"}},
+	}
+	for name, form := range tests {
+		req := accountRequest("/api/searches/alerts", form, user, "")
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		updateSavedSearchAlerts(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", name, w.Code)
+		}
+	}
+}
+
+// TestAlerts_Integration verifies subscribing, queueing newly indexed matches, delivery on each channel, deduplication and retries
+func TestAlerts_Integration(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	defer testDB.Exec("DELETE FROM pages WHERE title LIKE 'testuser_alert%'")
+	// Batches left by other ingestion tests would be taken first
+	testDB.Exec("DELETE FROM alert_evaluations")
+
+	capture := useCaptureMailer(t)
+	webhooks := &captureNotifier{}
+	original := notifiers[alertChannelWebhook]
+	notifiers[alertChannelWebhook] = webhooks
+	defer func() { notifiers[alertChannelWebhook] = original }()
+
+	user := &User{Username: "testuser_alert", Verified: true}
+	err := testDB.QueryRow(`INSERT INTO users (username, email, password, registration_ip, verified_at)
+		VALUES ($1, $2, $3, $4, NOW()) RETURNING id`,
+		user.Username, "testuser_alert@example.com", "x", "127.0.0.1").Scan(&user.ID)
+	if err != nil {
+		t.Fatalf("failed to create test user: %v", err)
+	}
+	var searchID int64
+	err = testDB.QueryRow(`INSERT INTO saved_searches (user_id, name, query, language) VALUES ($1, 'Markers', 'qwertzuiop marker', 'en') RETURNING id`,
+		user.ID).Scan(&searchID)
+	if err != nil {
+		t.Fatalf("failed to create saved search: %v", err)
+	}
+
+	req := accountRequest("/api/searches/alerts", url.Values{
+		"id":          {strconv.FormatInt(searchID, 10)},
+		"channel":     {"email", "inbox", "webhook"},
+		"webhook_url": {"https://example.com/hook"},
+	}, user, "")
+	w := httptest.NewRecorder()
+	updateSavedSearchAlerts(w, req)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("subscribe = %d, want 303", w.Code)
+	}
+
+	index := func(titles ...string) []string {
+		var urls []string
+		for _, title := range titles {
+			pageURL := "https://example.com/" + title
+			err := upsertPage(Page{Title: title, URL: pageURL, Language: "en", Content: "qwertzuiop alert marker"})
+			if err != nil {
+				t.Fatalf("failed to index page: %v", err)
+			}
+			urls = append(urls, pageURL)
+		}
+		return urls
+	}
+	// evaluate stores a batch the way batchPages does and lets the worker match it
+	evaluate := func(urls []string) {
+		if err := enqueueAlertEvaluation(urls); err != nil {
+			t.Fatalf("enqueueAlertEvaluation() error = %v", err)
+		}
+		if found, err := evaluateNextAlertBatch(); !found || err != nil {
+			t.Fatalf("evaluateNextAlertBatch() = %v, %v, want the stored batch", found, err)
+		}
+	}
+	deliver := func() {
+		if _, err := deliverDueAlerts(context.Background(), time.Now()); err != nil {
+			t.Fatalf("deliverDueAlerts() error = %v", err)
+		}
+	}
+	inboxCount := func() int {
+		var count int
+		testDB.QueryRow("SELECT COUNT(*) FROM inbox_notifications WHERE user_id = $1", user.ID).Scan(&count)
+		return count
+	}
+
+	evaluate(append(index("testuser_alert_first"), "https://example.com/not-indexed"))
+	if n := inboxCount(); n != 0 {
+		t.Errorf("%d inbox notifications before the worker ran, want none", n)
+	}
+	if found, err := evaluateNextAlertBatch(); found || err != nil {
+		t.Errorf("evaluateNextAlertBatch() = %v, %v after the batch was matched, want nothing left", found, err)
+	}
+	deliver()
+	if n := inboxCount(); n != 1 {
+		t.Errorf("%d inbox notifications after the first batch, want 1", n)
+	}
+	if sent := waitForMail(t, capture, 1); !strings.Contains(sent[0].Body, "testuser_alert_first") {
+		t.Errorf("alert mail = %+v", sent[0])
+	}
+	if len(webhooks.alerts) != 1 || webhooks.alerts[0].WebhookURL != "https://example.com/hook" {
+		t.Errorf("webhook alerts = %+v", webhooks.alerts)
+	}
+
+	t.Run("same page is not reported twice", func(t *testing.T) {
+		evaluate(index("testuser_alert_first", "testuser_alert_second"))
+		deliver()
+		if len(webhooks.alerts) != 2 || len(webhooks.alerts[1].Pages) != 1 || webhooks.alerts[1].Pages[0].Title != "testuser_alert_second" {
+			t.Errorf("second webhook alert = %+v, want only the second page", webhooks.alerts)
+		}
+		evaluate(index("testuser_alert_second"))
+		deliver()
+		if n := inboxCount(); n != 2 {
+			t.Errorf("%d inbox notifications, want 2", n)
+		}
+	})
+
+	t.Run("retries then fails", func(t *testing.T) {
+		webhooks.mu.Lock()
+		webhooks.err = errors.New("webhook answered 503 Service Unavailable")
+		webhooks.mu.Unlock()
+		defer func() {
+			webhooks.mu.Lock()
+			webhooks.err = nil
+			webhooks.mu.Unlock()
+		}()
+
+		evaluate(index("testuser_alert_third"))
+		deliver()
+
+		var id int64
+		var status string
+		var attempts int
+		var next time.Time
+		testDB.QueryRow(`SELECT n.id, n.status, n.attempts, n.next_attempt_at FROM alert_notifications n
+			JOIN alert_subscriptions a ON a.id = n.subscription_id
+			WHERE a.saved_search_id = $1 AND a.channel = 'webhook' ORDER BY n.id DESC LIMIT 1`, searchID).Scan(&id, &status, &attempts, &next)
+		if status != "pending" || attempts != 1 || time.Until(next) < 4*time.Minute {
+			t.Errorf("after one failure status = %s, attempts = %d, next attempt in %s, want pending, 1 and about 5m", status, attempts, time.Until(next))
+		}
+		if n := inboxCount(); n != 3 {
+			t.Errorf("%d inbox notifications, want 3 (other channels are unaffected)", n)
+		}
+
+		testDB.Exec("UPDATE alert_notifications SET attempts = $2, next_attempt_at = NOW() WHERE id = $1", id, maxAlertAttempts-1)
+		deliver()
+		testDB.QueryRow("SELECT status FROM alert_notifications WHERE id = $1", id).Scan(&status)
+		if status != "failed" {
+			t.Errorf("status after the last attempt = %s, want failed", status)
+		}
+	})
+
+	t.Run("inbox", func(t *testing.T) {
+		if n := unreadInboxCount(user.ID); n != 3 {
+			t.Errorf("unreadInboxCount() = %d, want 3", n)
+		}
+		w := httptest.NewRecorder()
+		markInboxRead(w, accountRequest("/api/inbox/read", url.Values{}, user, ""))
+		if n := unreadInboxCount(user.ID); n != 0 {
+			t.Errorf("unreadInboxCount() = %d after marking read, want 0", n)
+		}
+	})
+
+	t.Run("unsubscribe", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		updateSavedSearchAlerts(w, accountRequest("/api/searches/alerts", url.Values{"id": {strconv.FormatInt(searchID, 10)}}, user, ""))
+		searches, err := listSavedSearches(user.ID)
+		if err != nil || len(searches) != 1 || len(searches[0].Alerts) != 0 {
+			t.Errorf("listSavedSearches() = %+v, %v, want no alerts", searches, err)
+		}
+	})
+}
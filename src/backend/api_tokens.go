@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Personal access tokens start with this, so they are easy to recognise in scripts and secret scanners
+const apiTokenPrefix = "wk_"
+
+// Characters of the token kept in plain text to tell tokens apart on the tokens page
+const apiTokenDisplayLength = len(apiTokenPrefix) + 8
+
+// Token names longer than this are rejected
+const maxAPITokenNameLength = 100
+
+// Users can have at most this many unexpired tokens
+const maxAPITokensPerUser = 20
+
+// Requests per token are counted in windows of this length
+const apiTokenRateWindow = time.Minute
+
+// Token scopes, each granting access to one part of the API
+const (
+	scopeSearch = "search"
+	scopeSaved  = "saved"
+)
+
+// apiTokenScope describes a scope on the tokens page
+type apiTokenScope struct {
+	Name        string
+	Description string
+}
+
+// apiTokenScopes lists the scopes a token can be granted, in the order the tokens page shows them
+var apiTokenScopes = []apiTokenScope{
+	{Name: scopeSearch, Description: "Run searches through /api/search"},
+	{Name: scopeSaved, Description: "Read and manage your saved searches and bookmarks"},
+}
+
+// apiTokenLifetimes are the expiry choices, in days, offered when creating a token
+var apiTokenLifetimes = []int{7, 30, 90, 365}
+
+// Lifetime preselected on the tokens page
+const defaultAPITokenLifetime = 30
+
+// The *APIToken a request authenticated with, stored by allowAPIToken
+const apiTokenContextKey contextKey = "api_token"
+
+// APIToken is a personal access token as listed on the tokens page, never holding the token itself
+type APIToken struct {
+	ID         int64
+	Name       string
+	Prefix     string
+	Scopes     []string
+	ExpiresAt  time.Time
+	LastUsedAt *time.Time
+	LastUsedIP string
+	UseCount   int64
+	CreatedAt  time.Time
+}
+
+// Expired reports whether the token can no longer be used
+func (t APIToken) Expired() bool {
+	return !t.ExpiresAt.After(time.Now())
+}
+
+// HasScope reports whether the token was granted scope
+func (t APIToken) HasScope(scope string) bool {
+	for _, granted := range t.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	errAPITokenInvalid = errors.New("invalid or expired token")
+	errAPITokenScope   = errors.New("token lacks the required scope")
+)
+
+// getAPITokenRateLimit returns how many requests one token may make per minute (API_TOKEN_RATE_LIMIT)
+func getAPITokenRateLimit() int {
+	return envInt("API_TOKEN_RATE_LIMIT", 60)
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// currentAPIToken returns the token the request authenticated with, or nil for cookie sessions
+func currentAPIToken(r *http.Request) *APIToken {
+	token, _ := r.Context().Value(apiTokenContextKey).(*APIToken)
+	return token
+}
+
+// newAPIToken generates a token and the hash and display prefix stored for it
+func newAPIToken() (token, tokenHash, prefix string, err error) {
+	random, err := generateToken()
+	if err != nil {
+		return "", "", "", err
+	}
+	token = apiTokenPrefix + strings.TrimRight(random, "=")
+	return token, hashToken(token), token[:apiTokenDisplayLength], nil
+}
+
+// parseAPITokenScopes checks requested scopes against apiTokenScopes and returns them in canonical order
+func parseAPITokenScopes(requested []string) ([]string, bool) {
+	wanted := map[string]bool{}
+	for _, scope := range requested {
+		wanted[scope] = true
+	}
+
+	var scopes []string
+	for _, scope := range apiTokenScopes {
+		if wanted[scope.Name] {
+			scopes = append(scopes, scope.Name)
+			delete(wanted, scope.Name)
+		}
+	}
+	return scopes, len(wanted) == 0 && len(scopes) > 0
+}
+
+// validAPITokenLifetime reports whether days is one of the offered apiTokenLifetimes
+func validAPITokenLifetime(days int) bool {
+	for _, lifetime := range apiTokenLifetimes {
+		if days == lifetime {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateAPIToken resolves a bearer token to its user and counts the request against the token's rate limit
+// A positive wait means the token is over its limit for the current window
+func authenticateAPIToken(token, scope, clientIP string, now time.Time) (*User, *APIToken, time.Duration, error) {
+	// Only tokens we issued are worth a database lookup
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, nil, 0, errAPITokenInvalid
+	}
+
+	apiToken := &APIToken{}
+	var username, scopes string
+	err := db.QueryRow(`SELECT t.id, u.username, t.name, t.token_prefix, t.scopes, t.expires_at
+		FROM api_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1 AND t.expires_at > $2`, hashToken(token), now).
+		Scan(&apiToken.ID, &username, &apiToken.Name, &apiToken.Prefix, &scopes, &apiToken.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil, 0, errAPITokenInvalid
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	apiToken.Scopes = strings.Fields(scopes)
+	if !apiToken.HasScope(scope) {
+		return nil, apiToken, 0, errAPITokenScope
+	}
+
+	// Count the request and start a new window once the current one has passed, in one statement
+	// so concurrent requests can't both slip under the limit
+	var windowStart time.Time
+	var windowCount int
+	err = db.QueryRow(`UPDATE api_tokens SET
+			use_count = use_count + 1,
+			last_used_at = $2,
+			last_used_ip = $3,
+			window_start = CASE WHEN window_start IS NULL OR window_start <= $4 THEN $2 ELSE window_start END,
+			window_count = CASE WHEN window_start IS NULL OR window_start <= $4 THEN 1 ELSE window_count + 1 END
+		WHERE id = $1
+		RETURNING window_start, window_count, use_count`,
+		apiToken.ID, now, clientIP, now.Add(-apiTokenRateWindow)).Scan(&windowStart, &windowCount, &apiToken.UseCount)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if windowCount > getAPITokenRateLimit() {
+		return nil, apiToken, windowStart.Add(apiTokenRateWindow).Sub(now), nil
+	}
+
+	user, err := getUserByUsername(username)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return user, apiToken, 0, nil
+}
+
+// allowAPIToken lets API clients authenticate a handler with a personal access token holding scope
+// Requests without an Authorization header pass through unchanged, so the handler still serves cookie sessions
+func allowAPIToken(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok {
+			handler(w, r)
+			return
+		}
+
+		clientIP := getClientIP(r)
+		user, apiToken, wait, err := authenticateAPIToken(token, scope, clientIP, time.Now())
+		switch {
+		case err == errAPITokenInvalid:
+			log.Printf("API token rejected: ip=%s path=%s reason=invalid_token", clientIP, r.URL.Path)
+			apiTokenRequests.WithLabelValues("invalid").Inc()
+			denyAPIToken(w, http.StatusUnauthorized, `Bearer error="invalid_token"`, "Invalid or expired API token")
+		case err == errAPITokenScope:
+			log.Printf("API token rejected: token=%d ip=%s path=%s reason=missing_scope scope=%s", apiToken.ID, clientIP, r.URL.Path, scope)
+			apiTokenRequests.WithLabelValues("insufficient_scope").Inc()
+			denyAPIToken(w, http.StatusForbidden, `Bearer error="insufficient_scope", scope="`+scope+`"`,
+				"This API token is missing the "+scope+" scope")
+		case err != nil:
+			log.Printf("API token check failed: ip=%s path=%s error=%v", clientIP, r.URL.Path, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		case wait > 0:
+			log.Printf("API token rate limited: token=%d ip=%s path=%s retry_after=%s", apiToken.ID, clientIP, r.URL.Path, wait)
+			apiTokenRequests.WithLabelValues("rate_limited").Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			denyAPIToken(w, http.StatusTooManyRequests, "", "Rate limit exceeded, please try again in "+formatRetryAfter(wait))
+		default:
+			apiTokenRequests.WithLabelValues("ok").Inc()
+			r = withUser(r, user)
+			handler(w, r.WithContext(context.WithValue(r.Context(), apiTokenContextKey, apiToken)))
+		}
+	}
+}
+
+// denyAPIToken answers a rejected bearer token with a JSON error and, for 401 and 403, a WWW-Authenticate challenge
+func denyAPIToken(w http.ResponseWriter, status int, challenge, message string) {
+	if challenge != "" {
+		w.Header().Set("WWW-Authenticate", challenge)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(formErrorResponse{Error: message})
+}
+
+// listAPITokens returns the user's tokens, newest first
+func listAPITokens(userID int) ([]APIToken, error) {
+	rows, err := db.Query(`SELECT id, name, token_prefix, scopes, expires_at, last_used_at, COALESCE(last_used_ip, ''), use_count, created_at
+		FROM api_tokens WHERE user_id = $1 ORDER BY created_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		var token APIToken
+		var scopes string
+		err := rows.Scan(&token.ID, &token.Name, &token.Prefix, &scopes, &token.ExpiresAt,
+			&token.LastUsedAt, &token.LastUsedIP, &token.UseCount, &token.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		token.Scopes = strings.Fields(scopes)
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// apiTokensPage lists the user's personal access tokens (GET /account/tokens, behind requireLogin)
+func apiTokensPage(w http.ResponseWriter, r *http.Request) {
+	renderAPITokensPage(w, r, currentUser(r), http.StatusOK, "", nil, nil, "")
+}
+
+// renderAPITokensPage renders api_tokens.html with the user's tokens, an optional error and the token just created
+// newToken is only ever passed right after creation, the one time it is visible
+func renderAPITokensPage(w http.ResponseWriter, r *http.Request, user *User, status int, message string, fields map[string]string, values map[string]string, newToken string) {
+	if message != "" && wantsJSON(r) {
+		renderFormError(w, r, "api_tokens.html", nil, status, message, fields)
+		return
+	}
+
+	tokens, err := listAPITokens(user.ID)
+	if err != nil {
+		log.Printf("Failed to list API tokens: username=%s error=%v", user.Username, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := buildViewData(w, r)
+	data["Tokens"] = tokens
+	data["Scopes"] = apiTokenScopes
+	data["Lifetimes"] = apiTokenLifetimes
+	data["DefaultLifetime"] = defaultAPITokenLifetime
+	data["RateLimit"] = getAPITokenRateLimit()
+	for key, value := range values {
+		data[key] = value
+	}
+	if message != "" {
+		data["Error"] = message
+		data["FieldErrors"] = fields
+	}
+	if newToken != "" {
+		data["NewToken"] = newToken
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := templates.ExecuteTemplate(w, "api_tokens.html", data); err != nil {
+		log.Printf("Template execution failed: template=api_tokens.html error=%v", err)
+	}
+}
+
+// apiTokenCreatedResponse is returned to API clients that create a token, the only time the token is visible
+type apiTokenCreatedResponse struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Token     string    `json:"token"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// createAPIToken mints a personal access token and shows it once (POST /api/account/tokens)
+func createAPIToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	clientIP := getClientIP(r)
+
+	r.ParseForm()
+	name := strings.TrimSpace(r.FormValue("name"))
+	values := map[string]string{"Name": name}
+
+	fields := map[string]string{}
+	if name == "" {
+		fields["name"] = "Name is required"
+	} else if utf8.RuneCountInString(name) > maxAPITokenNameLength {
+		fields["name"] = "Name must be at most " + strconv.Itoa(maxAPITokenNameLength) + " characters"
+	}
+	scopes, ok := parseAPITokenScopes(r.Form["scope"])
+	if !ok {
+		fields["scope"] = "Choose at least one valid scope"
+	}
+	days, _ := strconv.Atoi(r.FormValue("expires_in"))
+	if !validAPITokenLifetime(days) {
+		fields["expires_in"] = "Choose when the token expires"
+	}
+	if len(fields) > 0 {
+		log.Printf("API token creation failed: username=%s ip=%s reason=invalid_input", user.Username, clientIP)
+		renderAPITokensPage(w, r, user, http.StatusBadRequest, "Please correct the errors below", fields, values, "")
+		return
+	}
+
+	now := time.Now()
+	var active int
+	err := db.QueryRow("SELECT COUNT(*) FROM api_tokens WHERE user_id = $1 AND expires_at > $2", user.ID, now).Scan(&active)
+	if err == nil && active >= maxAPITokensPerUser {
+		log.Printf("API token creation failed: username=%s ip=%s reason=too_many_tokens", user.Username, clientIP)
+		renderAPITokensPage(w, r, user, http.StatusBadRequest,
+			"You already have "+strconv.Itoa(maxAPITokensPerUser)+" active tokens, please revoke one first", nil, values, "")
+		return
+	}
+
+	var token, tokenHash, prefix string
+	if err == nil {
+		token, tokenHash, prefix, err = newAPIToken()
+	}
+	response := apiTokenCreatedResponse{Name: name, Scopes: scopes, ExpiresAt: now.AddDate(0, 0, days)}
+	if err == nil {
+		err = db.QueryRow(`INSERT INTO api_tokens (user_id, name, token_hash, token_prefix, scopes, expires_at, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+			user.ID, name, tokenHash, prefix, strings.Join(scopes, " "), response.ExpiresAt, now).Scan(&response.ID)
+	}
+	if err != nil {
+		log.Printf("API token creation failed: username=%s ip=%s reason=database_error error=%v", user.Username, clientIP, err)
+		renderAPITokensPage(w, r, user, http.StatusInternalServerError, "Failed to create the token", nil, values, "")
+		return
+	}
+
+	log.Printf("API token created: username=%s ip=%s token=%d scopes=%s expires=%s",
+		user.Username, clientIP, response.ID, strings.Join(scopes, ","), response.ExpiresAt.Format(time.RFC3339))
+
+	if wantsJSON(r) {
+		response.Token = token
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	renderAPITokensPage(w, r, user, http.StatusOK, "", nil, nil, token)
+}
+
+// revokeAPIToken deletes one of the user's tokens (POST /api/account/tokens/revoke)
+func revokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	clientIP := getClientIP(r)
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusBadRequest)
+		return
+	}
+
+	// Scoped to the user so one user can't revoke another's token by guessing IDs
+	var name string
+	err = db.QueryRow("DELETE FROM api_tokens WHERE id = $1 AND user_id = $2 RETURNING name", id, user.ID).Scan(&name)
+	if err != nil {
+		log.Printf("API token revoke failed: username=%s ip=%s token=%d error=%v", user.Username, clientIP, id, err)
+		setFlash(w, "That token was not found, it may have been revoked already")
+		http.Redirect(w, r, "/account/tokens", http.StatusSeeOther)
+		return
+	}
+
+	log.Printf("API token revoked: username=%s ip=%s token=%d", user.Username, clientIP, id)
+	setFlash(w, "The token \""+name+"\" has been revoked")
+	http.Redirect(w, r, "/account/tokens", http.StatusSeeOther)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestBearerToken verifies only the Bearer scheme of the Authorization header is read
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+		wantOK bool
+	}{
+		{header: ""},
+		{header: "Basic dXNlcjpwYXNz"},
+		{header: "Bearer"},
+		{header: "Bearer wk_abc", want: "wk_abc", wantOK: true},
+		{header: "bearer  wk_abc ", want: "wk_abc", wantOK: true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/search", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		if got, ok := bearerToken(req); got != tt.want || ok != tt.wantOK {
+			t.Errorf("bearerToken(%q) = %q, %v, want %q, %v", tt.header, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+// TestNewAPIToken verifies tokens carry the prefix and only their hash and display prefix are derived for storage
+func TestNewAPIToken(t *testing.T) {
+	token, tokenHash, prefix, err := newAPIToken()
+	if err != nil {
+		t.Fatalf("newAPIToken() error = %v", err)
+	}
+	if !strings.HasPrefix(token, apiTokenPrefix) || strings.Contains(token, "=") || len(token) < 40 {
+		t.Errorf("token = %q, want %q followed by unpadded random data", token, apiTokenPrefix)
+	}
+	if tokenHash != hashToken(token) || !strings.HasPrefix(token, prefix) || len(prefix) != apiTokenDisplayLength {
+		t.Errorf("hash = %q, prefix = %q for token %q", tokenHash, prefix, token)
+	}
+}
+
+// TestParseAPITokenScopes verifies unknown scopes are rejected and duplicates collapse
+func TestParseAPITokenScopes(t *testing.T) {
+	if scopes, ok := parseAPITokenScopes([]string{scopeSearch, scopeSearch}); !ok || len(scopes) != 1 || scopes[0] != scopeSearch {
+		t.Errorf("parseAPITokenScopes(search, search) = %v, %v", scopes, ok)
+	}
+	if _, ok := parseAPITokenScopes(nil); ok {
+		t.Errorf("no scopes accepted")
+	}
+	if _, ok := parseAPITokenScopes([]string{scopeSearch, "admin"}); ok {
+		t.Errorf("unknown scope accepted")
+	}
+}
+
+// TestAllowAPIToken_WithoutDatabase verifies requests without a token pass through and foreign tokens are refused
+func TestAllowAPIToken_WithoutDatabase(t *testing.T) {
+	passed := false
+	handler := allowAPIToken(scopeSearch, func(w http.ResponseWriter, r *http.Request) { passed = true })
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/api/search?q=go", nil))
+	if !passed {
+		t.Errorf("request without a token was not passed on (status %d)", w.Code)
+	}
+
+	passed = false
+	req := httptest.NewRequest("GET", "/api/search?q=go", nil)
+	req.Header.Set("Authorization", "Bearer ghp_not-one-of-ours")
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if passed || w.Code != http.StatusUnauthorized || !strings.Contains(w.Header().Get("WWW-Authenticate"), "invalid_token") {
+		t.Errorf("foreign token = %d (handler called %v), want 401 with a challenge", w.Code, passed)
+	}
+}
+
+// TestCurrentUser_IgnoresCookieWithBearer verifies a bearer request never falls back to the session cookie,
+// since requireCSRF lets those requests through
+func TestCurrentUser_IgnoresCookieWithBearer(t *testing.T) {
+	req := sessionRequest("some-session")
+	req.Header.Set("Authorization", "Bearer wk_forged")
+	if user := currentUser(req); user != nil {
+		t.Errorf("currentUser() = %+v, want nil", user)
+	}
+}
+
+// TestAPITokens_Integration verifies creation, bearer authentication, scopes, rate limits, expiry and revocation
+func TestAPITokens_Integration(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	templates = template.Must(template.ParseGlob("../templates/*.html"))
+	t.Setenv("API_TOKEN_RATE_LIMIT", "3")
+
+	user := &User{Username: "testuser_tokens"}
+	err := testDB.QueryRow(`INSERT INTO users (username, email, password, registration_ip) VALUES ($1, $2, $3, $4) RETURNING id`,
+		user.Username, "testuser_tokens@example.com", "x", "127.0.0.1").Scan(&user.ID)
+	if err != nil {
+		t.Fatalf("failed to create test user: %v", err)
+	}
+
+	create := func(form url.Values) *httptest.ResponseRecorder {
+		req := accountRequest("/api/account/tokens", form, user, "test-tokens-session")
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		createAPIToken(w, req)
+		return w
+	}
+	searchWith := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/search?q=test&language=en", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		allowAPIToken(scopeSearch, search)(w, req)
+		return w
+	}
+
+	t.Run("invalid input", func(t *testing.T) {
+		w := create(url.Values{"name": {""}, "scope": {"admin"}, "expires_in": {"1000"}})
+		var response formErrorResponse
+		json.NewDecoder(w.Body).Decode(&response)
+		if w.Code != http.StatusBadRequest || len(response.Fields) != 3 {
+			t.Errorf("create = %d %+v, want 400 with name, scope and expires_in errors", w.Code, response)
+		}
+	})
+
+	w := create(url.Values{"name": {"nightly report"}, "scope": {scopeSearch}, "expires_in": {"30"}})
+	var created apiTokenCreatedResponse
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("create = %d, %v", w.Code, err)
+	}
+
+	t.Run("token is only stored hashed", func(t *testing.T) {
+		var plain int
+		testDB.QueryRow("SELECT COUNT(*) FROM api_tokens WHERE token_hash = $1", created.Token).Scan(&plain)
+		if plain != 0 {
+			t.Errorf("raw API token found in the api_tokens table")
+		}
+	})
+
+	t.Run("search with token", func(t *testing.T) {
+		if w := searchWith(created.Token); w.Code != http.StatusOK {
+			t.Errorf("search = %d: %s", w.Code, w.Body.String())
+		}
+		if w := searchWith(created.Token + "x"); w.Code != http.StatusUnauthorized {
+			t.Errorf("search with a wrong token = %d, want 401", w.Code)
+		}
+	})
+
+	t.Run("missing scope", func(t *testing.T) {
+		testDB.Exec("UPDATE api_tokens SET scopes = 'other' WHERE id = $1", created.ID)
+		defer testDB.Exec("UPDATE api_tokens SET scopes = $1 WHERE id = $2", scopeSearch, created.ID)
+		if w := searchWith(created.Token); w.Code != http.StatusForbidden {
+			t.Errorf("search without the scope = %d, want 403", w.Code)
+		}
+	})
+
+	t.Run("rate limit", func(t *testing.T) {
+		testDB.Exec("UPDATE api_tokens SET window_start = NULL, window_count = 0 WHERE id = $1", created.ID)
+		for i := 0; i < 3; i++ {
+			if w := searchWith(created.Token); w.Code != http.StatusOK {
+				t.Fatalf("request %d = %d, want 200", i+1, w.Code)
+			}
+		}
+		w := searchWith(created.Token)
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+			t.Errorf("request over the limit = %d (Retry-After %q), want 429", w.Code, w.Header().Get("Retry-After"))
+		}
+
+		tokens, err := listAPITokens(user.ID)
+		if err != nil || len(tokens) != 1 || tokens[0].UseCount != 5 || tokens[0].LastUsedAt == nil {
+			t.Errorf("listAPITokens() = %+v, %v, want 5 recorded uses", tokens, err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		testDB.Exec("UPDATE api_tokens SET expires_at = NOW() - INTERVAL '1 second', window_count = 0 WHERE id = $1", created.ID)
+		if w := searchWith(created.Token); w.Code != http.StatusUnauthorized {
+			t.Errorf("search with an expired token = %d, want 401", w.Code)
+		}
+		testDB.Exec("UPDATE api_tokens SET expires_at = NOW() + INTERVAL '1 day' WHERE id = $1", created.ID)
+	})
+
+	t.Run("tokens page", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		apiTokensPage(w, withUser(httptest.NewRequest("GET", "/account/tokens", nil), user))
+		body := w.Body.String()
+		if w.Code != http.StatusOK || !strings.Contains(body, "nightly report") || strings.Contains(body, created.Token) {
+			t.Errorf("tokens page = %d:\n%s", w.Code, body)
+		}
+	})
+
+	t.Run("revoke", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		revokeAPIToken(w, accountRequest("/api/account/tokens/revoke",
+			url.Values{"id": {strconv.FormatInt(created.ID, 10)}}, user, "test-tokens-session"))
+		if w.Code != http.StatusSeeOther {
+			t.Errorf("revoke = %d, want 303", w.Code)
+		}
+		if w := searchWith(created.Token); w.Code != http.StatusUnauthorized {
+			t.Errorf("search with a revoked token = %d, want 401", w.Code)
+		}
+	})
+}
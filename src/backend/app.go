@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
@@ -18,7 +21,7 @@ import (
 
 	"github.com/joho/godotenv"
 	"golang.org/x/crypto/bcrypt"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -44,12 +47,33 @@ var (
 	maxTrackedQueries = 100
 )
 
+// Upper bound on batch-pages request bodies (10 MB)
+const maxBatchBodyBytes = 10 << 20
+
+// Characters of page content shown under each result on the search page, pages store much more for matching
+const searchSnippetLength = 250
+
 type Page struct {
 	Title       string `json:"title"`
 	URL         string `json:"url"`
 	Language    string `json:"language"`
 	LastUpdated string `json:"last_updated"`
 	Content     string `json:"content"`
+	ContentType string `json:"content_type"`
+}
+
+// FormatLabel returns a short label for non-HTML documents shown next to search results
+func (p Page) FormatLabel() string {
+	switch p.ContentType {
+	case contentTypePDF:
+		return "PDF"
+	case contentTypeMarkdown:
+		return "Markdown"
+	case contentTypeText:
+		return "Text"
+	default:
+		return ""
+	}
 }
 
 // Weather cache structure
@@ -97,11 +121,42 @@ func generateToken() (string, error) {
 }
 
 // getClientIP extracts the real client IP, considering proxy headers
+// Headers are only believed when the connection comes from a trusted proxy. X-Forwarded-For is
+// walked right to left, skipping trusted hops, since only the entries our own proxies appended
+// can't be forged by the client. X-Real-IP is used when there is no X-Forwarded-For.
 func getClientIP(r *http.Request) string {
-	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-		return forwarded
+	remoteIP := parseHostIP(r.RemoteAddr)
+	if remoteIP == nil {
+		return r.RemoteAddr
+	}
+	if !isTrustedProxy(remoteIP) {
+		return remoteIP.String()
 	}
-	return r.RemoteAddr
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) > 0 {
+		clientIP := remoteIP
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := parseHostIP(hops[i])
+			if ip == nil {
+				// Garbage in the chain, the last valid hop is as far as we can trust
+				break
+			}
+			clientIP = ip
+			if !isTrustedProxy(ip) {
+				break
+			}
+		}
+		return clientIP.String()
+	}
+
+	if ip := parseHostIP(r.Header.Get("X-Real-IP")); ip != nil {
+		return ip.String()
+	}
+	return remoteIP.String()
 }
 
 // getCookieSecure determines if cookies should have Secure flag set
@@ -120,34 +175,106 @@ func setSessionCookie(w http.ResponseWriter, token string) {
 		HttpOnly: true,
 		Secure:   getCookieSecure(),
 		SameSite: http.SameSiteLaxMode,
-		MaxAge:   86400,
+		MaxAge:   int(getSessionMaxLifetime().Seconds()), // The server enforces the shorter idle timeout
+	})
+}
+
+// clearSessionCookie deletes the session cookie from the browser
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session_token",
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   getCookieSecure(),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1, // Negative value deletes the cookie
 	})
 }
 
 // createSession stores a new session in the database
-func createSession(username, token string) error {
-	expiresAt := time.Now().Add(24 * time.Hour)
+// Only the token's hash is stored, so a leaked sessions table can't be replayed as cookies
+func createSession(username, token, userAgent, clientIP string) error {
+	now := time.Now()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
 	_, err := db.Exec(
-		"INSERT INTO sessions (token, username, expires_at) VALUES ($1, $2, $3)",
-		token, username, expiresAt,
+		`INSERT INTO sessions (token_hash, username, expires_at, absolute_expires_at, last_seen_at, user_agent, ip)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		hashToken(token), username, now.Add(getSessionIdleTimeout()), now.Add(getSessionMaxLifetime()), now, userAgent, clientIP,
 	)
 	return err
 }
 
+// startSession logs a fully authenticated user in: creates the session, updates login tracking
+// and sets the cookie. Failures are logged here, callers only render the error
+func startSession(w http.ResponseWriter, r *http.Request, username, clientIP string) error {
+	logger := requestLogger(r)
+
+	// Generate secure random session token
+	token, err := generateToken()
+	if err != nil {
+		logger.Error("Login failed", "username", username, "ip", clientIP, "reason", "token_generation_error", "error", err)
+		return err
+	}
+
+	// Store session in database
+	err = createSession(username, token, r.UserAgent(), clientIP)
+	if err != nil {
+		logger.Error("Login failed", "username", username, "ip", clientIP, "reason", "session_creation_error", "error", err)
+		return err
+	}
+
+	// Update user login tracking
+	_, err = db.Exec(`UPDATE users
+		SET last_login_ip = $1,
+			last_login_date = NOW(),
+			login_count = login_count + 1
+		WHERE username = $2`,
+		clientIP, username)
+	if err != nil {
+		logger.Error("Failed to update login tracking", "username", username, "error", err)
+		// Don't fail login if tracking update fails
+	}
+
+	// Successful login
+	logger.Info("Login success", "username", username, "ip", clientIP)
+
+	// Only cleared once every factor passed, so a known password can't reset the code guessing count
+	if err := resetLoginFailures(username); err != nil {
+		logger.Error("Failed to reset login failures", "username", username, "error", err)
+	}
+
+	// Set secure session cookie
+	setSessionCookie(w, token)
+	return nil
+}
+
 // validateSession checks if a session token is valid and returns the username
+// Valid sessions slide their idle expiry forward, up to the absolute cap set at login
 func validateSession(r *http.Request) (string, error) {
 	cookie, err := r.Cookie("session_token")
 	if err != nil {
 		return "", err
 	}
 
+	now := time.Now()
+	tokenHash := hashToken(cookie.Value)
 	var username string
+	var lastSeenAt time.Time
 	err = db.QueryRow(
-		"SELECT username FROM sessions WHERE token = $1 AND expires_at > $2",
-		cookie.Value, time.Now(),
-	).Scan(&username)
+		"SELECT username, last_seen_at FROM sessions WHERE token_hash = $1 AND expires_at > $2 AND absolute_expires_at > $2",
+		tokenHash, now,
+	).Scan(&username, &lastSeenAt)
+	if err != nil {
+		return "", err
+	}
 
-	return username, err
+	if now.Sub(lastSeenAt) > sessionTouchInterval {
+		touchSession(tokenHash, getClientIP(r), now)
+	}
+	return username, nil
 }
 
 // getTextSearchConfig maps and validates language codes to PostgreSQL text search configs
@@ -164,10 +291,24 @@ func getTextSearchConfig(language string) string {
 	}
 }
 
-// metricsMiddleware wraps HTTP handlers to automatically track endpoint usage
+// searchMatchCondition returns the condition a page must meet to match a search, with the query as $2
+// and its ILIKE pattern as $3. Shared by performSearch and the saved search alerts so both agree
+func searchMatchCondition(tsConfig string) string {
+	return fmt.Sprintf(`(content_tsv @@ plainto_tsquery('%s'::regconfig, $2)
+		       OR title ILIKE $3
+		       OR content ILIKE $3)`, tsConfig)
+}
+
+// metricsMiddleware wraps HTTP handlers to automatically track endpoint usage, latency and response sizes,
+// and writes one access log line per request through the request-scoped logger
 func metricsMiddleware(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Create a response writer wrapper to capture status code
+		inFlight := httpRequestsInFlight.WithLabelValues(endpoint)
+		inFlight.Inc()
+		defer inFlight.Dec()
+		start := time.Now()
+
+		// Create a response writer wrapper to capture status code and body size
 		wrapper := &responseWriterWrapper{
 			ResponseWriter: w,
 			statusCode:     http.StatusOK, // Default to 200 if WriteHeader not called
@@ -176,16 +317,40 @@ func metricsMiddleware(endpoint string, handler http.HandlerFunc) http.HandlerFu
 		// Call the actual handler
 		handler(wrapper, r)
 
+		duration := time.Since(start)
+		method := metricsMethod(r.Method)
+
 		// Track the request with actual status code
 		httpRequestsTotal.WithLabelValues(endpoint, fmt.Sprintf("%d", wrapper.statusCode)).Inc()
+		httpRequestDuration.WithLabelValues(endpoint, method).Observe(duration.Seconds())
+		httpResponseBytes.WithLabelValues(endpoint, method).Observe(float64(wrapper.bytesWritten))
+
+		requestLogger(r).Info("HTTP request",
+			"endpoint", endpoint,
+			"status", wrapper.statusCode,
+			"bytes", wrapper.bytesWritten,
+			"duration_ms", float64(duration.Microseconds())/1000,
+			"ip", getClientIP(r),
+			"user_agent", r.UserAgent())
 	}
 }
 
-// responseWriterWrapper wraps http.ResponseWriter to capture the status code
+// metricsMethod returns the method label for request metrics, folding unknown methods into OTHER
+// so clients can't create label values at will
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "OTHER"
+}
+
+// responseWriterWrapper wraps http.ResponseWriter to capture the status code and the bytes written
 type responseWriterWrapper struct {
 	http.ResponseWriter
 	statusCode    int
 	headerWritten bool
+	bytesWritten  int
 }
 
 func (w *responseWriterWrapper) WriteHeader(statusCode int) {
@@ -201,10 +366,14 @@ func (w *responseWriterWrapper) Write(b []byte) (int, error) {
 	if !w.headerWritten {
 		w.WriteHeader(http.StatusOK)
 	}
-	return w.ResponseWriter.Write(b)
+	n, err := w.ResponseWriter.Write(b)
+	w.bytesWritten += n
+	return n, err
 }
 
-func performSearch(query, language string) ([]Page, error) {
+// performSearch runs a search, logging with the request-scoped logger in ctx
+func performSearch(ctx context.Context, query, language string) ([]Page, error) {
+	logger := contextLogger(ctx)
 	pages := make([]Page, 0)
 
 	if query == "" {
@@ -244,26 +413,24 @@ func performSearch(query, language string) ([]Page, error) {
 	// Build query with tsconfig as literal (not parameter) since PostgreSQL
 	// doesn't support parameterized regconfig values
 	sqlQuery := fmt.Sprintf(`
-		SELECT title, url, language, last_updated, content
+		SELECT title, url, language, last_updated, content, content_type
 		FROM pages
 		WHERE language = $1
-		  AND (content_tsv @@ plainto_tsquery('%s'::regconfig, $2)
-		       OR title ILIKE $3
-		       OR content ILIKE $3)
+		  AND %s
 		ORDER BY ts_rank(content_tsv, plainto_tsquery('%s'::regconfig, $2)) DESC
 		LIMIT 50
-	`, tsConfig, tsConfig)
+	`, searchMatchCondition(tsConfig), tsConfig)
 	rows, err := db.Query(sqlQuery, language, query, searchPattern)
 	if err != nil {
-		log.Printf("Search query failed: query=%s language=%s error=%v", query, language, err)
+		logger.Error("Search query failed", "query", query, "language", language, "error", err)
 		return pages, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var page Page
-		if err := rows.Scan(&page.Title, &page.URL, &page.Language, &page.LastUpdated, &page.Content); err != nil {
-			log.Printf("Search row scan failed: error=%v", err)
+		if err := rows.Scan(&page.Title, &page.URL, &page.Language, &page.LastUpdated, &page.Content, &page.ContentType); err != nil {
+			logger.Error("Search row scan failed", "query", query, "error", err)
 			continue
 		}
 		pages = append(pages, page)
@@ -273,6 +440,7 @@ func performSearch(query, language string) ([]Page, error) {
 	if len(pages) == 0 {
 		searchZeroResults.Inc()
 	}
+	logger.Debug("Search completed", "query", query, "language", language, "results", len(pages))
 
 	return pages, nil
 }
@@ -282,6 +450,9 @@ func main() {
 	// Load .env file
 	_ = godotenv.Load()
 
+	// Structured logging, log.Printf calls go through the same handler
+	slog.SetDefault(newLoggerFromEnv())
+
 	// Check for CLI commands
 	if len(os.Args) > 1 {
 		switch os.Args[1] {
@@ -291,6 +462,12 @@ func main() {
 		case "migration":
 			utils.Migration()
 			return
+		case "crawl":
+			runCrawlCommand(os.Args[2:])
+			return
+		case "ingest-feed":
+			runIngestFeedCommand(os.Args[2:])
+			return
 		}
 	}
 
@@ -300,6 +477,9 @@ func main() {
 		log.Fatal("DATABASE_URL environment variable is required")
 	}
 
+	// Load the cookie signing key now so a production server without one fails at startup, not on the first login
+	getCookieSigningKey()
+
 	// Verify CRAWLER_API_KEY is set
 	if os.Getenv("CRAWLER_API_KEY") == "" {
 		log.Fatal("CRAWLER_API_KEY environment variable is required")
@@ -324,32 +504,122 @@ func main() {
 
 	templates = template.Must(template.ParseGlob("templates/*.html"))
 
-	// Register endpoints with metrics tracking middleware
-	http.HandleFunc("/api/search", metricsMiddleware("/api/search", search))
-	http.HandleFunc("/api/login", metricsMiddleware("/api/login", login))
-	http.HandleFunc("/api/register", metricsMiddleware("/api/register", register))
-	http.HandleFunc("/api/logout", metricsMiddleware("/api/logout", logout))
-	http.HandleFunc("/api/weather", metricsMiddleware("/api/weather", weather))
-	http.HandleFunc("/api/batch-pages", metricsMiddleware("/api/batch-pages", batchPages))
-	http.HandleFunc("/login", metricsMiddleware("/login", login1))
-	http.HandleFunc("/weather", metricsMiddleware("/weather", weather1))
-	http.HandleFunc("/register", metricsMiddleware("/register", register1))
-	http.HandleFunc("/about", metricsMiddleware("/about", about))
-	http.HandleFunc("/", metricsMiddleware("/", index))
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	// Verification and other account e-mails
+	mailer = newMailerFromEnv()
 
-	// Prometheus metrics endpoint
-	http.Handle("/metrics", promhttp.Handler())
+	// Proxies allowed to report the client IP in forwarding headers
+	trustedProxies, err = parseTrustedProxies(envOrDefault("TRUSTED_PROXIES", defaultTrustedProxies))
+	if err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
+	// Remove expired login throttling rows
+	go startLoginAttemptsPruner(context.Background(), time.Hour)
+
+	// Remove expired sessions
+	go startSessionReaper(context.Background(), 10*time.Minute)
+
+	// Remove search history past each user's retention
+	go startSearchHistoryReaper(context.Background(), time.Hour)
+
+	// Deliver queued index events to webhooks
+	go startWebhookWorker(context.Background(), envDuration("WEBHOOK_WORKER_INTERVAL", 10*time.Second))
+
+	// Match indexed pages against saved-search alerts and send the queued notifications
+	go startAlertWorker(context.Background(), envDuration("ALERT_WORKER_INTERVAL", 10*time.Second))
+
+	// Single sign-on through an OpenID Connect provider when configured
+	oidcProvider = newOIDCProviderFromEnv()
+
+	// Recrawl stale pages from the persistent frontier when enabled
+	if scheduler := newCrawlSchedulerFromEnv(); scheduler != nil {
+		go scheduler.Start(context.Background())
+	}
+
+	registerRoutes(http.DefaultServeMux)
 
 	// Mark service as up
 	serviceUp.Set(1)
 
 	log.Println("Starting server on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	if err := http.ListenAndServe(":8080", requestIDMiddleware(http.DefaultServeMux)); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
 
+// registerRoutes adds every endpoint to mux, wrapped with metrics tracking middleware
+// Saved searches, bookmarks, alerts and new API tokens need a verified e-mail address
+func registerRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/api/search", metricsMiddleware("/api/search", allowAPIToken(scopeSearch, search)))
+	mux.HandleFunc("/api/login", metricsMiddleware("/api/login", requireCSRF(login)))
+	mux.HandleFunc("/api/login/2fa", metricsMiddleware("/api/login/2fa", requireCSRF(loginTwoFactor)))
+	mux.HandleFunc("/api/login/2fa/setup", metricsMiddleware("/api/login/2fa/setup", requireCSRF(loginTwoFactorSetup)))
+	mux.HandleFunc("/api/register", metricsMiddleware("/api/register", requireCSRF(register)))
+	mux.HandleFunc("/api/logout", metricsMiddleware("/api/logout", requireCSRF(logout)))
+	mux.HandleFunc("/api/resend-verification", metricsMiddleware("/api/resend-verification", requireCSRF(resendVerification)))
+	mux.HandleFunc("/api/forgot-password", metricsMiddleware("/api/forgot-password", requireCSRF(forgotPassword)))
+	mux.HandleFunc("/api/reset-password", metricsMiddleware("/api/reset-password", requireCSRF(resetPassword)))
+	mux.HandleFunc("/api/account/password", metricsMiddleware("/api/account/password", requireCSRF(requireLogin(changePassword))))
+	mux.HandleFunc("/api/account/email", metricsMiddleware("/api/account/email", requireCSRF(requireLogin(changeEmail))))
+	mux.HandleFunc("/api/account/delete", metricsMiddleware("/api/account/delete", requireCSRF(requireLogin(deleteAccount))))
+	mux.HandleFunc("/api/account/2fa/enable", metricsMiddleware("/api/account/2fa/enable", requireCSRF(requireLogin(enableTwoFactor))))
+	mux.HandleFunc("/api/account/2fa/disable", metricsMiddleware("/api/account/2fa/disable", requireCSRF(requireLogin(disableTwoFactor))))
+	mux.HandleFunc("/api/account/2fa/recovery-codes", metricsMiddleware("/api/account/2fa/recovery-codes", requireCSRF(requireLogin(regenerateRecoveryCodes))))
+	mux.HandleFunc("/api/account/sessions/revoke", metricsMiddleware("/api/account/sessions/revoke", requireCSRF(requireLogin(revokeSession))))
+	mux.HandleFunc("/api/account/sessions/revoke-all", metricsMiddleware("/api/account/sessions/revoke-all", requireCSRF(requireLogin(revokeAllSessions))))
+	mux.HandleFunc("/api/account/tokens", metricsMiddleware("/api/account/tokens", requireCSRF(requireVerifiedUser(createAPIToken))))
+	mux.HandleFunc("/api/account/tokens/revoke", metricsMiddleware("/api/account/tokens/revoke", requireCSRF(requireLogin(revokeAPIToken))))
+	mux.HandleFunc("/api/searches", metricsMiddleware("/api/searches", requireCSRF(allowAPIToken(scopeSaved, requireVerifiedUser(savedSearchesAPI)))))
+	mux.HandleFunc("/api/searches/rename", metricsMiddleware("/api/searches/rename", requireCSRF(allowAPIToken(scopeSaved, requireVerifiedUser(renameSavedSearch)))))
+	mux.HandleFunc("/api/searches/delete", metricsMiddleware("/api/searches/delete", requireCSRF(allowAPIToken(scopeSaved, requireVerifiedUser(deleteSavedSearch)))))
+	mux.HandleFunc("/api/searches/alerts", metricsMiddleware("/api/searches/alerts", requireCSRF(allowAPIToken(scopeSaved, requireVerifiedUser(updateSavedSearchAlerts)))))
+	mux.HandleFunc("/api/inbox/read", metricsMiddleware("/api/inbox/read", requireCSRF(requireLogin(markInboxRead))))
+	mux.HandleFunc("/api/bookmarks", metricsMiddleware("/api/bookmarks", requireCSRF(allowAPIToken(scopeSaved, requireVerifiedUser(bookmarksAPI)))))
+	mux.HandleFunc("/api/bookmarks/update", metricsMiddleware("/api/bookmarks/update", requireCSRF(allowAPIToken(scopeSaved, requireVerifiedUser(updateBookmark)))))
+	mux.HandleFunc("/api/bookmarks/delete", metricsMiddleware("/api/bookmarks/delete", requireCSRF(allowAPIToken(scopeSaved, requireVerifiedUser(deleteBookmark)))))
+	mux.HandleFunc("/api/account/history/settings", metricsMiddleware("/api/account/history/settings", requireCSRF(requireLogin(updateSearchHistorySettings))))
+	mux.HandleFunc("/api/account/history/delete", metricsMiddleware("/api/account/history/delete", requireCSRF(requireLogin(deleteSearchHistoryEntry))))
+	mux.HandleFunc("/api/account/history/clear", metricsMiddleware("/api/account/history/clear", requireCSRF(requireLogin(clearSearchHistory))))
+	mux.HandleFunc("/api/admin/webhooks", metricsMiddleware("/api/admin/webhooks", requireCSRF(requirePermission(permWebhooksManage, adminCreateWebhook))))
+	mux.HandleFunc("/api/admin/webhooks/update", metricsMiddleware("/api/admin/webhooks/update", requireCSRF(requirePermission(permWebhooksManage, adminUpdateWebhook))))
+	mux.HandleFunc("/api/admin/webhooks/redeliver", metricsMiddleware("/api/admin/webhooks/redeliver", requireCSRF(requirePermission(permWebhooksManage, adminRedeliverWebhook))))
+	mux.HandleFunc("/api/admin/users/roles", metricsMiddleware("/api/admin/users/roles", requireCSRF(requirePermission(permUsersManage, adminUserRoles))))
+	mux.HandleFunc("/api/csrf-token", metricsMiddleware("/api/csrf-token", csrfTokenHandler))
+	mux.HandleFunc("/api/weather", metricsMiddleware("/api/weather", weather))
+	mux.HandleFunc("/api/batch-pages", metricsMiddleware("/api/batch-pages", batchPages))
+	mux.HandleFunc("/api/ingest-feed", metricsMiddleware("/api/ingest-feed", ingestFeedHandler))
+	mux.HandleFunc("/api/documents", metricsMiddleware("/api/documents", uploadDocument))
+	mux.HandleFunc("/login", metricsMiddleware("/login", login1))
+	mux.HandleFunc("/login/oidc", metricsMiddleware("/login/oidc", oidcLoginStart))
+	mux.HandleFunc("/login/oidc/callback", metricsMiddleware("/login/oidc/callback", oidcCallback))
+	mux.HandleFunc("/login/2fa", metricsMiddleware("/login/2fa", loginTwoFactorPage))
+	mux.HandleFunc("/login/2fa/setup", metricsMiddleware("/login/2fa/setup", loginTwoFactorSetupPage))
+	mux.HandleFunc("/weather", metricsMiddleware("/weather", weather1))
+	mux.HandleFunc("/register", metricsMiddleware("/register", register1))
+	mux.HandleFunc("/about", metricsMiddleware("/about", about))
+	mux.HandleFunc("/verify-email", metricsMiddleware("/verify-email", verifyEmail))
+	mux.HandleFunc("/forgot-password", metricsMiddleware("/forgot-password", forgotPasswordPage))
+	mux.HandleFunc("/reset-password", metricsMiddleware("/reset-password", resetPasswordPage))
+	mux.HandleFunc("/account", metricsMiddleware("/account", requireLogin(accountPage)))
+	mux.HandleFunc("/account/2fa", metricsMiddleware("/account/2fa", requireLogin(twoFactorPage)))
+	mux.HandleFunc("/account/sessions", metricsMiddleware("/account/sessions", requireLogin(sessionsPage)))
+	mux.HandleFunc("/account/tokens", metricsMiddleware("/account/tokens", requireLogin(apiTokensPage)))
+	mux.HandleFunc("/account/history", metricsMiddleware("/account/history", requireLogin(searchHistoryPage)))
+	mux.HandleFunc("/searches", metricsMiddleware("/searches", requireLogin(savedSearchesPage)))
+	mux.HandleFunc("/inbox", metricsMiddleware("/inbox", requireLogin(inboxPage)))
+	mux.HandleFunc("/admin", metricsMiddleware("/admin", requirePermission(permAdminAccess, adminDashboard)))
+	mux.HandleFunc("/admin/users", metricsMiddleware("/admin/users", requirePermission(permUsersView, adminUsers)))
+	mux.HandleFunc("/admin/pages", metricsMiddleware("/admin/pages", requirePermission(permPagesView, adminPages)))
+	mux.HandleFunc("/admin/ingest", metricsMiddleware("/admin/ingest", requirePermission(permStatsView, adminIngest)))
+	mux.HandleFunc("/admin/search", metricsMiddleware("/admin/search", requirePermission(permStatsView, adminSearch)))
+	mux.HandleFunc("/admin/webhooks", metricsMiddleware("/admin/webhooks", requirePermission(permWebhooksManage, adminWebhooks)))
+	mux.HandleFunc("/", metricsMiddleware("/", index))
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+
+	// Prometheus metrics endpoint
+	mux.Handle("/metrics", promhttp.Handler())
+}
+
 func search(response http.ResponseWriter, request *http.Request) {
 	query := request.URL.Query().Get("q")
 	language := request.URL.Query().Get("language")
@@ -364,11 +634,13 @@ func search(response http.ResponseWriter, request *http.Request) {
 		sessionSearches.mu.Unlock()
 	}
 
-	pages, err := performSearch(query, language)
+	pages, err := performSearch(request.Context(), query, language)
 	if err != nil {
 		http.Error(response, "Search failed", http.StatusInternalServerError)
 		return
 	}
+	recordSearchStats(query, language, len(pages))
+	recordSearchHistory(currentUser(request), query, language, len(pages))
 
 	response.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(response).Encode(pages)
@@ -384,14 +656,30 @@ func login(w http.ResponseWriter, r *http.Request){
 
 	// Get client IP for audit logging
 	clientIP := getClientIP(r)
+	logger := requestLogger(r)
 
 	username := r.FormValue("username")
 	password := r.FormValue("password")
 
+	// Submitted values to preserve when the form is re-rendered (never the password)
+	values := map[string]string{"Username": username}
+
 	// Validate that both fields have values before processing
 	if username == "" || password == "" {
-		log.Printf("Login failed: username=%s ip=%s reason=missing_credentials", username, clientIP)
-		http.Error(w, "Username and password required", http.StatusBadRequest)
+		logger.Warn("Login failed", "username", username, "ip", clientIP, "reason", "missing_credentials")
+		fields := map[string]string{}
+		if username == "" {
+			fields["username"] = "Username is required"
+		}
+		if password == "" {
+			fields["password"] = "Password is required"
+		}
+		renderFormError(w, r, "login.html", values, http.StatusBadRequest, "Username and password required", fields)
+		return
+	}
+
+	// Reject throttled or locked out attempts before spending a bcrypt compare on them
+	if rejectThrottledLogin(w, r, "login.html", values, clientIP, username) {
 		return
 	}
 
@@ -406,8 +694,8 @@ func login(w http.ResponseWriter, r *http.Request){
 		storedPassword = "$2a$10$N9qo8uLOickgx2ZMRZoMye/XYF4w3KW7QO.hHC5dGxDrKVK5n7C0O" // bcrypt hash of "dummy"
 	} else if err != nil {
 		// Database error
-		log.Printf("Login failed: username=%s ip=%s reason=database_error", username, clientIP)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		logger.Error("Login failed", "username", username, "ip", clientIP, "reason", "database_error", "error", err)
+		renderFormError(w, r, "login.html", values, http.StatusInternalServerError, "Internal server error", nil)
 		return
 	} else {
 		userExists = true
@@ -418,45 +706,51 @@ func login(w http.ResponseWriter, r *http.Request){
 
 	if err != nil || !userExists {
 		// Log uniform message to prevent username enumeration
-		log.Printf("Login failed: ip=%s reason=authentication_failed", clientIP)
+		logger.Warn("Login failed", "ip", clientIP, "reason", "authentication_failed")
+
+		if err := recordLoginFailure(clientIP, username, time.Now()); err != nil {
+			logger.Error("Failed to record login failure", "ip", clientIP, "error", err)
+		}
 
-		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		// No field-level error here, pointing at a field would reveal which one was wrong
+		renderFormError(w, r, "login.html", values, http.StatusUnauthorized, "Invalid username or password", nil)
 		return
 	}
 
-	// Generate secure random session token
-	token, err := generateToken()
+	// Unverified accounts past their grace period can't log in until they verify, so mail them a new link
+	expired, err := verificationGraceExpired(username, time.Now())
 	if err != nil {
-		log.Printf("Login failed: username=%s ip=%s reason=token_generation_error", username, clientIP)
-		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		logger.Error("Login failed", "username", username, "ip", clientIP, "reason", "database_error", "error", err)
+		renderFormError(w, r, "login.html", values, http.StatusInternalServerError, "Internal server error", nil)
 		return
 	}
-
-	// Store session in database
-	err = createSession(username, token)
-	if err != nil {
-		log.Printf("Login failed: username=%s ip=%s reason=session_creation_error", username, clientIP)
-		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+	if expired {
+		logger.Warn("Login failed", "username", username, "ip", clientIP, "reason", "email_unverified")
+		if err := remindUnverifiedUser(username, time.Now()); err != nil {
+			logger.Error("Verification e-mail failed", "username", username, "error", err)
+		}
+		renderFormError(w, r, "login.html", values, http.StatusForbidden,
+			"Please verify your e-mail address to log in, we've sent you a new verification link", nil)
 		return
 	}
 
-	// Update user login tracking
-	_, err = db.Exec(`UPDATE users
-		SET last_login_ip = $1,
-			last_login_date = NOW(),
-			login_count = login_count + 1
-		WHERE username = $2`,
-		clientIP, username)
+	// Accounts with two-factor authentication finish logging in on /login/2fa
+	redirected, err := beginSecondFactor(w, r, username, clientIP)
 	if err != nil {
-		log.Printf("Failed to update login tracking: username=%s error=%v", username, err)
-		// Don't fail login if tracking update fails
+		logger.Error("Login failed", "username", username, "ip", clientIP, "reason", "two_factor_error", "error", err)
+		renderFormError(w, r, "login.html", values, http.StatusInternalServerError, "Internal server error", nil)
+		return
+	}
+	if redirected {
+		return
 	}
 
-	// Successful login
-	log.Printf("Login success: username=%s ip=%s", username, clientIP)
+	if err := startSession(w, r, username, clientIP); err != nil {
+		renderFormError(w, r, "login.html", values, http.StatusInternalServerError, "Failed to create session", nil)
+		return
+	}
 
-	// Set secure session cookie
-	setSessionCookie(w, token)
+	setFlash(w, "You were logged in")
 
 	//Here it use w(response writer) to show where to send Redirect
 	//r (the request) needed for  context, and "/" the path to be directed to.
@@ -474,6 +768,7 @@ func register(w http.ResponseWriter, r *http.Request){
 
 	// Get client IP for audit logging
 	clientIP := getClientIP(r)
+	logger := requestLogger(r)
 
 	// Get form values
 	username := r.FormValue("username")
@@ -481,17 +776,50 @@ func register(w http.ResponseWriter, r *http.Request){
 	password := r.FormValue("password")
 	password2 := r.FormValue("password2")
 
+	// Submitted values to preserve when the form is re-rendered (never the passwords)
+	values := map[string]string{"Username": username, "Email": email}
+
 	// Validate all fields are present
 	if username == "" || email == "" || password == "" || password2 == "" {
-		log.Printf("Registration failed: username=%s email=%s ip=%s reason=missing_fields", username, email, clientIP)
-		http.Error(w, "All fields are required", http.StatusBadRequest)
+		logger.Warn("Registration failed", "username", username, "email", email, "ip", clientIP, "reason", "missing_fields")
+		fields := map[string]string{}
+		if username == "" {
+			fields["username"] = "Username is required"
+		}
+		if email == "" {
+			fields["email"] = "E-mail is required"
+		}
+		if password == "" {
+			fields["password"] = "Password is required"
+		}
+		if password2 == "" {
+			fields["password2"] = "Please repeat the password"
+		}
+		renderFormError(w, r, "register.html", values, http.StatusBadRequest, "All fields are required", fields)
+		return
+	}
+
+	// Validate the e-mail address, it's where the verification link is sent
+	if !isValidEmail(email) {
+		logger.Warn("Registration failed", "username", username, "email", email, "ip", clientIP, "reason", "invalid_email")
+		renderFormError(w, r, "register.html", values, http.StatusBadRequest, "Invalid e-mail address",
+			map[string]string{"email": "Please enter a valid e-mail address"})
 		return
 	}
 
 	// Validate passwords match
 	if password != password2 {
-		log.Printf("Registration failed: username=%s email=%s ip=%s reason=password_mismatch", username, email, clientIP)
-		http.Error(w, "Passwords do not match", http.StatusBadRequest)
+		logger.Warn("Registration failed", "username", username, "email", email, "ip", clientIP, "reason", "password_mismatch")
+		renderFormError(w, r, "register.html", values, http.StatusBadRequest, "Passwords do not match",
+			map[string]string{"password2": "Passwords do not match"})
+		return
+	}
+
+	// Enforce the password policy (length, strength, breached passwords)
+	if reasons := checkPasswordPolicy(password, username, email); len(reasons) > 0 {
+		logger.Warn("Registration failed", "username", username, "email", email, "ip", clientIP, "reason", "weak_password")
+		renderFormError(w, r, "register.html", values, http.StatusBadRequest, "Password does not meet the requirements",
+			map[string]string{"password": strings.Join(reasons, " ")})
 		return
 	}
 
@@ -499,71 +827,89 @@ func register(w http.ResponseWriter, r *http.Request){
 	var existingID int
 	err := db.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&existingID)
 	if err == nil {
-		log.Printf("Registration failed: username=%s email=%s ip=%s reason=username_taken", username, email, clientIP)
-		http.Error(w, "Username already taken", http.StatusConflict)
+		logger.Warn("Registration failed", "username", username, "email", email, "ip", clientIP, "reason", "username_taken")
+		renderFormError(w, r, "register.html", values, http.StatusConflict, "Username already taken",
+			map[string]string{"username": "Username already taken"})
 		return
 	} else if err != sql.ErrNoRows {
-		log.Printf("Registration failed: username=%s email=%s ip=%s reason=database_error", username, email, clientIP)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		logger.Error("Registration failed", "username", username, "email", email, "ip", clientIP, "reason", "database_error", "error", err)
+		renderFormError(w, r, "register.html", values, http.StatusInternalServerError, "Internal server error", nil)
 		return
 	}
 
 	// Check if email already exists
 	err = db.QueryRow("SELECT id FROM users WHERE email = $1", email).Scan(&existingID)
 	if err == nil {
-		log.Printf("Registration failed: username=%s email=%s ip=%s reason=email_taken", username, email, clientIP)
-		http.Error(w, "Email already registered", http.StatusConflict)
+		logger.Warn("Registration failed", "username", username, "email", email, "ip", clientIP, "reason", "email_taken")
+		renderFormError(w, r, "register.html", values, http.StatusConflict, "Email already registered",
+			map[string]string{"email": "Email already registered"})
 		return
 	} else if err != sql.ErrNoRows {
-		log.Printf("Registration failed: username=%s email=%s ip=%s reason=database_error", username, email, clientIP)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		logger.Error("Registration failed", "username", username, "email", email, "ip", clientIP, "reason", "database_error", "error", err)
+		renderFormError(w, r, "register.html", values, http.StatusInternalServerError, "Internal server error", nil)
 		return
 	}
 
 	// Hash password with bcrypt
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		log.Printf("Registration failed: username=%s email=%s ip=%s reason=hash_generation_error", username, email, clientIP)
-		http.Error(w, "Failed to create account", http.StatusInternalServerError)
+		logger.Error("Registration failed", "username", username, "email", email, "ip", clientIP, "reason", "hash_generation_error", "error", err)
+		renderFormError(w, r, "register.html", values, http.StatusInternalServerError, "Failed to create account", nil)
 		return
 	}
 
-	// Insert new user
-	_, err = db.Exec("INSERT INTO users (username, email, password, registration_ip) VALUES ($1, $2, $3, $4)",
-		username, email, string(hashedPassword), clientIP)
+	// Insert new user, unverified until the e-mailed link is opened
+	var userID int
+	err = db.QueryRow("INSERT INTO users (username, email, password, registration_ip) VALUES ($1, $2, $3, $4) RETURNING id",
+		username, email, string(hashedPassword), clientIP).Scan(&userID)
 	if err != nil {
-		log.Printf("Registration failed: username=%s email=%s ip=%s reason=insert_error error=%v", username, email, clientIP, err)
-		http.Error(w, "Failed to create account", http.StatusInternalServerError)
+		logger.Error("Registration failed", "username", username, "email", email, "ip", clientIP, "reason", "insert_error", "error", err)
+		renderFormError(w, r, "register.html", values, http.StatusInternalServerError, "Failed to create account", nil)
 		return
 	}
 
-	log.Printf("Registration success: username=%s email=%s ip=%s", username, email, clientIP)
+	logger.Info("Registration success", "username", username, "email", email, "ip", clientIP)
+
+	// Send the verification link, the account stays usable (with restrictions) if this fails
+	if err := sendVerificationEmail(userID, username, email); err != nil {
+		logger.Error("Verification e-mail failed", "username", username, "email", email, "error", err)
+	}
 
 	// Auto-login: create session
 	token, err := generateToken()
 	if err != nil {
-		log.Printf("Auto-login failed after registration: username=%s ip=%s reason=token_generation_error", username, clientIP)
+		logger.Error("Auto-login failed after registration", "username", username, "ip", clientIP, "reason", "token_generation_error", "error", err)
+		setFlash(w, "You were successfully registered and can login now")
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	err = createSession(username, token)
+	err = createSession(username, token, r.UserAgent(), clientIP)
 	if err != nil {
-		log.Printf("Auto-login failed after registration: username=%s ip=%s reason=session_creation_error", username, clientIP)
+		logger.Error("Auto-login failed after registration", "username", username, "ip", clientIP, "reason", "session_creation_error", "error", err)
+		setFlash(w, "You were successfully registered and can login now")
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
 	// Set session cookie
 	setSessionCookie(w, token)
+	setFlash(w, "You were successfully registered, check your e-mail to verify your address")
 
-	log.Printf("Auto-login success after registration: username=%s ip=%s", username, clientIP)
+	logger.Info("Auto-login success after registration", "username", username, "ip", clientIP)
 
 	// Redirect to home page
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func logout(w http.ResponseWriter, r *http.Request){
+	// Only POST, a GET logout could be triggered by any link or image on another site
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
 	// Get client IP for audit logging
 	clientIP := getClientIP(r)
 
@@ -585,23 +931,17 @@ func logout(w http.ResponseWriter, r *http.Request){
 	sessionSearches.mu.Unlock()
 
 	// Delete session from database
-	_, err = db.Exec("DELETE FROM sessions WHERE token = $1", cookie.Value)
+	_, err = db.Exec("DELETE FROM sessions WHERE token_hash = $1", hashToken(cookie.Value))
 	if err != nil {
-		log.Printf("Logout failed: ip=%s reason=session_deletion_error error=%v", clientIP, err)
+		requestLogger(r).Error("Logout failed", "ip", clientIP, "reason", "session_deletion_error", "error", err)
 	} else {
-		log.Printf("Logout success: ip=%s searches=%d", clientIP, searchCount)
+		requestLogger(r).Info("Logout success", "ip", clientIP, "searches", searchCount)
 	}
 
 	// Clear session cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session_token",
-		Value:    "",
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   getCookieSecure(),
-		SameSite: http.SameSiteLaxMode,
-		MaxAge:   -1, // Negative value deletes the cookie
-	})
+	clearSessionCookie(w)
+
+	setFlash(w, "You were logged out")
 
 	// Redirect to login page
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
@@ -784,21 +1124,15 @@ func fetchWeatherFromAPI(apiKey, lat, lon string) (WeatherResponse, error) {
 }
 
 func login1(w http.ResponseWriter, r *http.Request){
-	if err := templates.ExecuteTemplate(w, "login.html", nil); err != nil {
-		log.Printf("Template execution failed: template=login.html error=%v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-	}
+	renderTemplate(w, "login.html", buildViewData(w, r))
 }
 
 func weather1(w http.ResponseWriter, r *http.Request) {
-	templates.ExecuteTemplate(w, "weather.html", nil)
+	renderTemplate(w, "weather.html", buildViewData(w, r))
 }
 
 func register1(w http.ResponseWriter, r *http.Request){
-	if err := templates.ExecuteTemplate(w, "register.html", nil); err != nil {
-		log.Printf("Template execution failed: template=register.html error=%v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-	}
+	renderTemplate(w, "register.html", buildViewData(w, r))
 }
 
 func index(w http.ResponseWriter, r *http.Request){
@@ -808,70 +1142,175 @@ func index(w http.ResponseWriter, r *http.Request){
 		language = "en"
 	}
 
-	pages, err := performSearch(query, language)
+	pages, err := performSearch(r.Context(), query, language)
 	if err != nil {
 		http.Error(w, "Search failed", http.StatusInternalServerError)
 		return
 	}
+	recordSearchStats(query, language, len(pages))
 
-	data := map[string]interface{}{
-		"Query":         query,
-		"SearchResults": pages,
+	// Resolve the user once for the history and the page data
+	user := currentUser(r)
+	if user != nil {
+		r = withUser(r, user)
+		recordSearchHistory(user, query, language, len(pages))
 	}
 
-	if err := templates.ExecuteTemplate(w, "search.html", data); err != nil {
-		log.Printf("Template execution failed: template=search.html error=%v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	// The page shows the start of each result, /api/search clients still get the full text
+	for i := range pages {
+		pages[i].Content = truncateRunes(pages[i].Content, searchSnippetLength)
 	}
+
+	data := buildViewData(w, r)
+	data["Query"] = query
+	data["Language"] = language
+	data["SearchResults"] = pages
+	data["RecentSearches"] = recentSearches(user)
+
+	renderTemplate(w, "search.html", data)
 }
 
 func about(w http.ResponseWriter, r *http.Request){
-	if err := templates.ExecuteTemplate(w, "about.html", nil); err != nil {
-		log.Printf("Template execution failed: template=about.html error=%v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	renderTemplate(w, "about.html", buildViewData(w, r))
+}
+
+// upsertPage inserts a page or refreshes the existing row with the same title
+func upsertPage(page Page) error {
+	_, err := savePage(page)
+	return err
+}
+
+// savePage is upsertPage reporting what it changed for the index webhooks: eventPageCreated,
+// eventPageUpdated, or "" when the stored URL and content were already the same
+func savePage(page Page) (string, error) {
+	// Crawled and batch-submitted pages are HTML unless stated otherwise
+	if page.ContentType == "" {
+		page.ContentType = contentTypeHTML
 	}
+
+	var previousURL, previousContent sql.NullString
+	err := db.QueryRow(`
+    	WITH previous AS (SELECT url, content FROM pages WHERE title = $1)
+    	INSERT INTO pages (title, url, language, content, content_type, last_updated)
+    	VALUES ($1, $2, $3, $4, $5, NOW())
+    	ON CONFLICT (title)
+    	DO UPDATE SET
+        url = EXCLUDED.url,
+        content = EXCLUDED.content,
+        content_type = EXCLUDED.content_type,
+        last_updated = NOW()
+    	RETURNING (SELECT url FROM previous), (SELECT content FROM previous)
+		`, page.Title, page.URL, page.Language, page.Content, page.ContentType).Scan(&previousURL, &previousContent)
+	switch {
+	case err != nil:
+		return "", err
+	case !previousURL.Valid:
+		return eventPageCreated, nil
+	case previousURL.String != page.URL || previousContent.String != page.Content:
+		return eventPageUpdated, nil
+	}
+	return "", nil
 }
 
-func batchPages(w http.ResponseWriter, r *http.Request) {
-	// Only POST allowed
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// deletePages removes the pages with the given URLs from the index and returns what was removed
+func deletePages(urls []string) ([]Page, error) {
+	rows, err := db.Query("DELETE FROM pages WHERE url = ANY($1) RETURNING title, url, language", pq.Array(urls))
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
+
+	var deleted []Page
+	for rows.Next() {
+		var page Page
+		if err := rows.Scan(&page.Title, &page.URL, &page.Language); err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, page)
+	}
+	return deleted, rows.Err()
+}
+
+// readCrawlerRequest authenticates a crawler/ingestion request and returns its raw body
+// Writes the error response itself and returns false when the request is rejected
+func readCrawlerRequest(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	logger := requestLogger(r)
 
 	// Check API key
 	apiKey := r.Header.Get("X-API-Key")
 	expectedKey := os.Getenv("CRAWLER_API_KEY")
 
 	if expectedKey == "" {
-		log.Println("WARNING: CRAWLER_API_KEY not set")
+		logger.Error("Crawler request rejected", "ip", getClientIP(r), "reason", "api_key_not_configured")
 		http.Error(w, "Service misconfigured", http.StatusInternalServerError)
-		return
+		return nil, false
 	}
 
 	if apiKey != expectedKey {
-		log.Printf("Unauthorized crawler request from: %s", getClientIP(r))
+		logger.Warn("Crawler request rejected", "ip", getClientIP(r), "reason", "invalid_api_key")
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	// Read raw body so the signature can be checked against the exact bytes sent
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBodyBytes))
+	if err != nil {
+		// Reject oversized bodies instead of silently parsing a truncated prefix
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			logger.Warn("Crawler request rejected", "ip", getClientIP(r), "reason", "body_too_large", "limit_bytes", tooLarge.Limit)
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return nil, false
+	}
+
+	// Require HMAC signature when a signing secret is configured
+	if secret := getSigningSecret(); secret != "" {
+		if err := verifyRequestSignature(r, body, secret, getSignatureWindow(), time.Now()); err != nil {
+			logger.Warn("Crawler request rejected", "ip", getClientIP(r), "reason", "invalid_signature", "error", err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return nil, false
+		}
+	}
+
+	return body, true
+}
+
+func batchPages(w http.ResponseWriter, r *http.Request) {
+	// Only POST allowed
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger := requestLogger(r)
+	body, ok := readCrawlerRequest(w, r)
+	if !ok {
 		return
 	}
 
-	// Parse JSON
+	// Parse JSON, deleted lists the URLs of pages to drop from the index
 	var req struct {
-		Pages []Page `json:"pages"`
+		Pages   []Page   `json:"pages"`
+		Deleted []string `json:"deleted"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := json.Unmarshal(body, &req); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	if len(req.Pages) == 0 {
+	if len(req.Pages) == 0 && len(req.Deleted) == 0 {
 		http.Error(w, "No pages provided", http.StatusBadRequest)
 		return
 	}
 
 	success := 0
 	errors := 0
+	var indexed []string
+	var events []IndexEvent
 
 	for _, page := range req.Pages {
 		// Validate required fields
@@ -883,24 +1322,43 @@ func batchPages(w http.ResponseWriter, r *http.Request) {
 		if page.Language == "" {
 			page.Language = "en"
 		}
-		_, err := db.Exec(`
-    	INSERT INTO pages (title, url, language, content, last_updated)
-    	VALUES ($1, $2, $3, $4, NOW())
-    	ON CONFLICT (title)
-    	DO UPDATE SET
-        url = EXCLUDED.url,
-        content = EXCLUDED.content,
-        last_updated = NOW()
-		`, page.Title, page.URL, page.Language, page.Content)
+		change, err := savePage(page)
 
 		if err != nil {
-			log.Printf("Error inserting page '%s': %v", page.Title, err)
+			logger.Error("Error inserting page", "title", page.Title, "url", page.URL, "error", err)
 			errors++
 		} else {
 			success++
+			indexed = append(indexed, page.URL)
+			if change != "" {
+				events = append(events, newIndexEvent(change, page))
+			}
 		}
 	}
 
+	var deleted []Page
+	if len(req.Deleted) > 0 {
+		var err error
+		deleted, err = deletePages(req.Deleted)
+		if err != nil {
+			logger.Error("Error deleting pages", "urls", len(req.Deleted), "error", err)
+			errors += len(req.Deleted)
+		}
+		for _, page := range deleted {
+			events = append(events, newIndexEvent(eventPageDeleted, page))
+		}
+	}
+
+	// Queued before answering so a crash can't lose them, the webhook worker delivers them
+	if err := enqueueWebhookEvents(events); err != nil {
+		logger.Error("Failed to queue webhook events", "events", len(events), "error", err)
+	}
+
+	// The alert worker matches the batch against saved searches, storing it means a restart doesn't skip it
+	if err := enqueueAlertEvaluation(indexed); err != nil {
+		logger.Error("Failed to queue alert evaluation", "pages", len(indexed), "error", err)
+	}
+
 	// Update Prometheus metrics
 	pagesIndexed.Add(float64(success))
 
@@ -909,12 +1367,13 @@ func batchPages(w http.ResponseWriter, r *http.Request) {
 		totalPages.Set(float64(count))
 	}
 
-	log.Printf("Batch insert: success=%d errors=%d total=%d", success, errors, len(req.Pages))
+	logger.Info("Batch insert", "success", success, "deleted", len(deleted), "errors", errors, "total", len(req.Pages))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success":  true,
 		"inserted": success,
+		"deleted":  len(deleted),
 		"errors":   errors,
 		"total":    len(req.Pages),
 	})
@@ -6,6 +6,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -57,31 +58,123 @@ func TestGenerateToken_ReturnsUniqueTokens(t *testing.T) {
 
 // TestGetClientIP verifies IP extraction logic
 func TestGetClientIP(t *testing.T) {
+	original := trustedProxies
+	defer func() { trustedProxies = original }()
+
 	tests := []struct {
-		name          string
-		xForwardedFor string
-		remoteAddr    string
-		expectedIP    string
+		name           string
+		trustedProxies string
+		xForwardedFor  []string
+		xRealIP        string
+		remoteAddr     string
+		expectedIP     string
 	}{
 		{
 			name:          "uses X-Forwarded-For when present",
-			xForwardedFor: "192.168.1.1",
+			xForwardedFor: []string{"192.168.1.1"},
 			remoteAddr:    "10.0.0.1:12345",
 			expectedIP:    "192.168.1.1",
 		},
 		{
-			name:          "falls back to RemoteAddr when no header",
-			xForwardedFor: "",
-			remoteAddr:    "10.0.0.1:12345",
-			expectedIP:    "10.0.0.1:12345",
+			name:       "falls back to RemoteAddr when no header",
+			remoteAddr: "10.0.0.1:12345",
+			expectedIP: "10.0.0.1",
+		},
+		{
+			name:          "ignores X-Forwarded-For from an untrusted peer",
+			xForwardedFor: []string{"1.2.3.4"},
+			xRealIP:       "1.2.3.4",
+			remoteAddr:    "203.0.113.7:5000",
+			expectedIP:    "203.0.113.7",
+		},
+		{
+			name:          "takes the rightmost untrusted hop, not the client supplied one",
+			xForwardedFor: []string{"1.2.3.4, 198.51.100.23"},
+			remoteAddr:    "172.18.0.2:41000",
+			expectedIP:    "198.51.100.23",
+		},
+		{
+			name:          "skips trusted hops from the right",
+			xForwardedFor: []string{"198.51.100.23, 10.0.0.5, 172.18.0.3"},
+			remoteAddr:    "172.18.0.2:41000",
+			expectedIP:    "198.51.100.23",
+		},
+		{
+			name:          "joins repeated X-Forwarded-For headers in order",
+			xForwardedFor: []string{"1.2.3.4", "198.51.100.23, 10.0.0.5"},
+			remoteAddr:    "127.0.0.1:41000",
+			expectedIP:    "198.51.100.23",
+		},
+		{
+			name:          "stops at an invalid hop",
+			xForwardedFor: []string{"198.51.100.23, not-an-ip, 10.0.0.5"},
+			remoteAddr:    "172.18.0.2:41000",
+			expectedIP:    "10.0.0.5",
+		},
+		{
+			name:          "strips ports from forwarded entries",
+			xForwardedFor: []string{"198.51.100.23:4711"},
+			remoteAddr:    "172.18.0.2:41000",
+			expectedIP:    "198.51.100.23",
+		},
+		{
+			name:       "uses X-Real-IP from a trusted proxy without X-Forwarded-For",
+			xRealIP:    "198.51.100.23",
+			remoteAddr: "172.18.0.2:41000",
+			expectedIP: "198.51.100.23",
+		},
+		{
+			name:       "ignores an invalid X-Real-IP",
+			xRealIP:    "unknown",
+			remoteAddr: "172.18.0.2:41000",
+			expectedIP: "172.18.0.2",
+		},
+		{
+			name:       "strips brackets and port from an IPv6 RemoteAddr",
+			remoteAddr: "[2001:db8::1]:5000",
+			expectedIP: "2001:db8::1",
+		},
+		{
+			name:          "handles IPv6 hops with and without brackets",
+			xForwardedFor: []string{"2001:db8::dead:beef, [fd00::2]:8080"},
+			remoteAddr:    "[::1]:41000",
+			expectedIP:    "2001:db8::dead:beef",
+		},
+		{
+			name:          "normalizes IPv4-mapped IPv6 addresses",
+			xForwardedFor: []string{"::ffff:198.51.100.23"},
+			remoteAddr:    "[::ffff:127.0.0.1]:41000",
+			expectedIP:    "198.51.100.23",
+		},
+		{
+			name:           "respects a custom trusted proxy list",
+			trustedProxies: "203.0.113.7",
+			xForwardedFor:  []string{"198.51.100.23"},
+			remoteAddr:     "203.0.113.7:5000",
+			expectedIP:     "198.51.100.23",
+		},
+		{
+			name:           "private peers are untrusted when not listed",
+			trustedProxies: "203.0.113.0/24",
+			xForwardedFor:  []string{"198.51.100.23"},
+			remoteAddr:     "10.0.0.1:12345",
+			expectedIP:     "10.0.0.1",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			trustedProxies = original
+			if tt.trustedProxies != "" {
+				trustedProxies = mustParseTrustedProxies(tt.trustedProxies)
+			}
+
 			req := httptest.NewRequest("GET", "/", nil)
-			if tt.xForwardedFor != "" {
-				req.Header.Set("X-Forwarded-For", tt.xForwardedFor)
+			for _, header := range tt.xForwardedFor {
+				req.Header.Add("X-Forwarded-For", header)
+			}
+			if tt.xRealIP != "" {
+				req.Header.Set("X-Real-IP", tt.xRealIP)
 			}
 			req.RemoteAddr = tt.remoteAddr
 
@@ -93,6 +186,23 @@ func TestGetClientIP(t *testing.T) {
 	}
 }
 
+// TestParseTrustedProxies verifies CIDRs and single addresses are accepted and garbage rejected
+func TestParseTrustedProxies(t *testing.T) {
+	networks, err := parseTrustedProxies(" 10.0.0.0/8, 203.0.113.7 ,::1,")
+	if err != nil {
+		t.Fatalf("parseTrustedProxies() error = %v", err)
+	}
+	if len(networks) != 3 {
+		t.Fatalf("parseTrustedProxies() returned %d networks, want 3", len(networks))
+	}
+
+	for _, list := range []string{"10.0.0.0/33", "proxy.local", "10.0.0.1/8/8"} {
+		if _, err := parseTrustedProxies(list); err == nil {
+			t.Errorf("parseTrustedProxies(%q) expected an error", list)
+		}
+	}
+}
+
 // TestGetCookieSecure verifies cookie security settings
 func TestGetCookieSecure(t *testing.T) {
 	tests := []struct {
@@ -206,10 +316,65 @@ func TestSetSessionCookie(t *testing.T) {
 	if cookie.SameSite != http.SameSiteLaxMode {
 		t.Errorf("cookie SameSite = %v, want %v", cookie.SameSite, http.SameSiteLaxMode)
 	}
-	if cookie.MaxAge != 86400 {
-		t.Errorf("cookie MaxAge = %v, want 86400", cookie.MaxAge)
+	if cookie.MaxAge != int(getSessionMaxLifetime().Seconds()) {
+		t.Errorf("cookie MaxAge = %v, want %v", cookie.MaxAge, int(getSessionMaxLifetime().Seconds()))
 	}
 	if cookie.Path != "/" {
 		t.Errorf("cookie Path = %v, want /", cookie.Path)
 	}
 }
+
+// TestMetricsMiddleware verifies the in-flight gauge, the latency and size histograms and the access log line
+func TestMetricsMiddleware(t *testing.T) {
+	buf := captureLogs(t)
+	const endpoint = "/test/metrics-middleware"
+	durationSeries := testutil.CollectAndCount(httpRequestDuration)
+	sizeSeries := testutil.CollectAndCount(httpResponseBytes)
+
+	handler := metricsMiddleware(endpoint, func(w http.ResponseWriter, r *http.Request) {
+		if inFlight := testutil.ToFloat64(httpRequestsInFlight.WithLabelValues(endpoint)); inFlight != 1 {
+			t.Errorf("in-flight requests during the handler = %v, want 1", inFlight)
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+		w.Write([]byte(" world"))
+	})
+	req := httptest.NewRequest("PROPFIND", endpoint, nil)
+	req.Header.Set("User-Agent", "metrics-test")
+	requestIDMiddleware(handler).ServeHTTP(httptest.NewRecorder(), req)
+
+	if inFlight := testutil.ToFloat64(httpRequestsInFlight.WithLabelValues(endpoint)); inFlight != 0 {
+		t.Errorf("in-flight requests afterwards = %v, want 0", inFlight)
+	}
+	if n := testutil.ToFloat64(httpRequestsTotal.WithLabelValues(endpoint, "201")); n != 1 {
+		t.Errorf("requests counted = %v, want 1", n)
+	}
+	if got := testutil.CollectAndCount(httpRequestDuration); got != durationSeries+1 {
+		t.Errorf("duration histogram series = %d, want %d", got, durationSeries+1)
+	}
+	if got := testutil.CollectAndCount(httpResponseBytes); got != sizeSeries+1 {
+		t.Errorf("response size histogram series = %d, want %d", got, sizeSeries+1)
+	}
+
+	records := logRecords(t, buf)
+	if len(records) != 1 {
+		t.Fatalf("access log records = %v, want one", records)
+	}
+	record := records[0]
+	if record["msg"] != "HTTP request" || record["endpoint"] != endpoint || record["status"] != float64(201) ||
+		record["bytes"] != float64(11) || record["user_agent"] != "metrics-test" || record["request_id"] == nil {
+		t.Errorf("access log record = %v", record)
+	}
+	if _, ok := record["duration_ms"].(float64); !ok {
+		t.Errorf("access log record has no duration: %v", record)
+	}
+}
+
+// TestMetricsMethod verifies unknown methods share one label value
+func TestMetricsMethod(t *testing.T) {
+	for method, want := range map[string]string{"GET": "GET", "POST": "POST", "PROPFIND": "OTHER", "get": "OTHER"} {
+		if got := metricsMethod(method); got != want {
+			t.Errorf("metricsMethod(%q) = %q, want %q", method, got, want)
+		}
+	}
+}
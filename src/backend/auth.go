@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// contextKey namespaces values stored in a request context
+type contextKey string
+
+// The authenticated *User, stored by requireLogin and requireVerifiedUser
+const userContextKey contextKey = "user"
+
+// withUser returns a copy of the request carrying the authenticated user
+func withUser(r *http.Request, user *User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+}
+
+// requireLogin restricts a handler to logged-in users
+// The handler can read the user with currentUser(r) without another session lookup
+func requireLogin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		if user == nil {
+			denyAccess(w, r, http.StatusUnauthorized, "Please log in first", "/login")
+			return
+		}
+		handler(w, withUser(r, user))
+	}
+}
+
+// requireVerifiedUser restricts a handler to logged-in users with a verified e-mail address
+// Unverified accounts can log in, search and manage their account, but not use features wrapped with this
+func requireVerifiedUser(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		switch {
+		case user == nil:
+			denyAccess(w, r, http.StatusUnauthorized, "Please log in first", "/login")
+		case !user.Verified:
+			denyAccess(w, r, http.StatusForbidden, "Please verify your e-mail address first", "/")
+		default:
+			handler(w, withUser(r, user))
+		}
+	}
+}
+
+// denyAccess answers API requests with a JSON error and redirects browsers with a flash message
+func denyAccess(w http.ResponseWriter, r *http.Request, status int, message, location string) {
+	if wantsJSON(r) || strings.HasPrefix(r.URL.Path, "/api/") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(formErrorResponse{Error: message})
+		return
+	}
+
+	setFlash(w, message)
+	http.Redirect(w, r, location, http.StatusSeeOther)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Proxies trusted by default: loopback and the private ranges nginx reaches us from inside Docker
+const defaultTrustedProxies = "127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7"
+
+// Networks whose X-Forwarded-For / X-Real-IP headers are believed, set from TRUSTED_PROXIES in main
+var trustedProxies = mustParseTrustedProxies(defaultTrustedProxies)
+
+// parseTrustedProxies parses a comma separated list of CIDRs or single IPs
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func mustParseTrustedProxies(list string) []*net.IPNet {
+	networks, err := parseTrustedProxies(list)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
+
+// isTrustedProxy reports whether ip belongs to one of the trusted proxy networks
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHostIP parses an address that may carry a port or IPv6 brackets,
+// e.g. "203.0.113.7", "203.0.113.7:5000", "2001:db8::1" or "[2001:db8::1]:5000"
+func parseHostIP(address string) net.IP {
+	address = strings.TrimSpace(address)
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+
+	// Drop IPv6 zones ("fe80::1%eth0"), they mean nothing outside this host
+	if i := strings.IndexByte(address, '%'); i >= 0 {
+		address = address[:i]
+	}
+
+	ip := net.ParseIP(address)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// envOrDefault returns the environment variable or fallback when unset
+func envOrDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envInt reads a positive integer from the environment, or returns fallback
+func envInt(key string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return fallback
+}
+
+// envDuration reads a positive duration like "15m" from the environment, or returns fallback
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return fallback
+}
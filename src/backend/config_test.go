@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestEnvHelpers verifies set values are parsed and unset, invalid or non-positive ones fall back
+func TestEnvHelpers(t *testing.T) {
+	t.Setenv("TEST_CONFIG_STRING", "value")
+	t.Setenv("TEST_CONFIG_INT", "42")
+	t.Setenv("TEST_CONFIG_DURATION", "90s")
+	t.Setenv("TEST_CONFIG_NEGATIVE", "-5")
+	t.Setenv("TEST_CONFIG_INVALID", "soon")
+
+	if got := envOrDefault("TEST_CONFIG_STRING", "fallback"); got != "value" {
+		t.Errorf("envOrDefault() = %q, want value", got)
+	}
+	if got := envOrDefault("TEST_CONFIG_UNSET", "fallback"); got != "fallback" {
+		t.Errorf("envOrDefault() for an unset key = %q, want fallback", got)
+	}
+
+	if got := envInt("TEST_CONFIG_INT", 7); got != 42 {
+		t.Errorf("envInt() = %d, want 42", got)
+	}
+	for _, key := range []string{"TEST_CONFIG_NEGATIVE", "TEST_CONFIG_INVALID", "TEST_CONFIG_UNSET"} {
+		if got := envInt(key, 7); got != 7 {
+			t.Errorf("envInt(%s) = %d, want the fallback 7", key, got)
+		}
+	}
+
+	if got := envDuration("TEST_CONFIG_DURATION", time.Minute); got != 90*time.Second {
+		t.Errorf("envDuration() = %s, want 1m30s", got)
+	}
+	for _, key := range []string{"TEST_CONFIG_NEGATIVE", "TEST_CONFIG_INVALID", "TEST_CONFIG_UNSET"} {
+		if got := envDuration(key, time.Minute); got != time.Minute {
+			t.Errorf("envDuration(%s) = %s, want the fallback 1m", key, got)
+		}
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+	"whoknows/utils"
+
+	"github.com/lib/pq"
+)
+
+// Recrawl intervals adapt between these bounds depending on how often a page changes
+const (
+	initialRecrawlInterval = 24 * time.Hour
+	minRecrawlInterval     = time.Hour
+	maxRecrawlInterval     = 30 * 24 * time.Hour
+	maxCrawlFailures       = 5
+	staleClaimTimeout      = 15 * time.Minute
+)
+
+// CrawlScheduler fetches due URLs from the persistent crawl_queue frontier
+type CrawlScheduler struct {
+	crawler   *Crawler
+	interval  time.Duration // How often the queue is polled
+	batchSize int           // URLs claimed per poll
+	maxDepth  int
+	sameHost  bool
+}
+
+// queuedURL is a claimed row from crawl_queue
+type queuedURL struct {
+	URL          string
+	Depth        int
+	FailureCount int
+}
+
+// crawlState is the stored fetch history for a URL
+type crawlState struct {
+	ETag            string
+	LastModified    string
+	ContentHash     string
+	RecrawlInterval time.Duration
+}
+
+// newCrawlSchedulerFromEnv builds a scheduler, returning nil when CRAWL_SCHEDULER_INTERVAL is unset
+func newCrawlSchedulerFromEnv() *CrawlScheduler {
+	interval, err := time.ParseDuration(os.Getenv("CRAWL_SCHEDULER_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return nil
+	}
+
+	batchSize, err := strconv.Atoi(os.Getenv("CRAWL_SCHEDULER_BATCH"))
+	if err != nil || batchSize <= 0 {
+		batchSize = 10
+	}
+
+	maxDepth, err := strconv.Atoi(os.Getenv("CRAWL_MAX_DEPTH"))
+	if err != nil || maxDepth < 0 {
+		maxDepth = 2
+	}
+
+	return &CrawlScheduler{
+		crawler:   newCrawler(CrawlConfig{Delay: time.Second}, nil),
+		interval:  interval,
+		batchSize: batchSize,
+		maxDepth:  maxDepth,
+		sameHost:  true,
+	}
+}
+
+// Start polls the frontier until ctx is cancelled
+func (s *CrawlScheduler) Start(ctx context.Context) {
+	log.Printf("Crawl scheduler started: interval=%s batch=%d max_depth=%d", s.interval, s.batchSize, s.maxDepth)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.RunOnce(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Crawl scheduler run failed: error=%v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce claims and processes one batch of due URLs, returning how many were processed
+func (s *CrawlScheduler) RunOnce(ctx context.Context) (int, error) {
+	// Rows left in_progress by a crashed or restarted process become due again
+	if err := releaseStaleClaims(staleClaimTimeout); err != nil {
+		return 0, err
+	}
+
+	items, err := claimDueURLs(s.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, item := range items {
+		if ctx.Err() != nil {
+			// Hand unprocessed claims straight back to the queue
+			for _, rest := range items[i:] {
+				releaseClaim(rest.URL)
+			}
+			return i, ctx.Err()
+		}
+		s.process(ctx, item)
+	}
+
+	return len(items), nil
+}
+
+// process fetches a claimed URL and records the outcome in crawl_queue/crawl_state
+func (s *CrawlScheduler) process(ctx context.Context, item queuedURL) {
+	state, err := loadCrawlState(item.URL)
+	if err != nil {
+		log.Printf("Crawl state load failed: url=%s error=%v", item.URL, err)
+		markCrawlFailed(item, err)
+		return
+	}
+
+	result, err := s.crawler.fetchConditional(ctx, item.URL, fetchValidators{
+		ETag:         state.ETag,
+		LastModified: state.LastModified,
+	})
+
+	switch {
+	case errors.Is(err, errRobotsDisallowed) || errors.Is(err, errNotHTML):
+		crawlFetches.WithLabelValues("blocked").Inc()
+		markCrawlBlocked(item.URL, err)
+		return
+	case err != nil:
+		if ctx.Err() != nil {
+			releaseClaim(item.URL)
+			return
+		}
+		log.Printf("Crawl fetch failed: url=%s failures=%d error=%v", item.URL, item.FailureCount+1, err)
+		crawlFetches.WithLabelValues("failed").Inc()
+		markCrawlFailed(item, err)
+		return
+	}
+
+	hash := state.ContentHash
+	changed := false
+	if !result.NotModified {
+		// Hash the text as stored, the crawl command only has the stored page when it records its fetches
+		hash = contentHash(truncateRunes(result.Doc.Text, s.crawler.config.MaxContentLength))
+		changed = hash != state.ContentHash
+	}
+
+	if changed {
+		if page, ok := s.crawler.pageFromDocument(item.URL, result.Doc); ok {
+			// Keep the old hash and validators so the retry fetches and stores the page again
+			if err := upsertPage(page); err != nil {
+				log.Printf("Crawl store failed: url=%s title=%s failures=%d error=%v", item.URL, page.Title, item.FailureCount+1, err)
+				crawlFetches.WithLabelValues("failed").Inc()
+				markCrawlFailed(item, err)
+				return
+			}
+		}
+		crawlFetches.WithLabelValues("changed").Inc()
+	} else {
+		crawlFetches.WithLabelValues("unchanged").Inc()
+	}
+
+	interval := nextRecrawlInterval(state.RecrawlInterval, changed)
+	if err := saveCrawlState(item.URL, result, hash, changed, interval); err != nil {
+		log.Printf("Crawl state save failed: url=%s error=%v", item.URL, err)
+	}
+	if err := markCrawled(item.URL, time.Now().Add(interval)); err != nil {
+		log.Printf("Crawl queue update failed: url=%s error=%v", item.URL, err)
+	}
+
+	if !result.NotModified && !result.Doc.NoFollow && item.Depth < s.maxDepth {
+		links := s.filterLinks(item.URL, result.Doc.Links)
+		if _, err := enqueueURLs(links, item.Depth+1); err != nil {
+			log.Printf("Crawl enqueue failed: url=%s error=%v", item.URL, err)
+		}
+	}
+}
+
+// filterLinks normalizes links and applies the same-host policy
+func (s *CrawlScheduler) filterLinks(pageURL string, links []string) []string {
+	page, _ := url.Parse(pageURL)
+	filtered := make([]string, 0, len(links))
+	for _, link := range links {
+		normalized := normalizeCrawlURL(link)
+		if normalized == "" {
+			continue
+		}
+		if s.sameHost {
+			parsed, _ := url.Parse(normalized)
+			if page == nil || parsed.Host != page.Host {
+				continue
+			}
+		}
+		filtered = append(filtered, normalized)
+	}
+	return filtered
+}
+
+// nextRecrawlInterval halves the interval for pages that changed and grows it for stable ones
+func nextRecrawlInterval(current time.Duration, changed bool) time.Duration {
+	if current <= 0 {
+		return initialRecrawlInterval
+	}
+
+	next := current * 3 / 2
+	if changed {
+		next = current / 2
+	}
+
+	if next < minRecrawlInterval {
+		return minRecrawlInterval
+	}
+	if next > maxRecrawlInterval {
+		return maxRecrawlInterval
+	}
+	return next
+}
+
+// failureBackoff returns the retry delay after n consecutive failures (5m, 10m, 20m ... capped at 24h)
+func failureBackoff(failures int) time.Duration {
+	if failures < 1 {
+		failures = 1
+	}
+	backoff := 5 * time.Minute
+	for i := 1; i < failures && backoff < 24*time.Hour; i++ {
+		backoff *= 2
+	}
+	if backoff > 24*time.Hour {
+		backoff = 24 * time.Hour
+	}
+	return backoff
+}
+
+// contentHash fingerprints extracted text to detect changes between fetches
+func contentHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// enqueueURLs adds URLs to the frontier, ignoring ones that are already known
+func enqueueURLs(urls []string, depth int) (int, error) {
+	if len(urls) == 0 {
+		return 0, nil
+	}
+
+	res, err := db.Exec(`
+		INSERT INTO crawl_queue (url, depth)
+		SELECT unnest($1::text[]), $2
+		ON CONFLICT (url) DO NOTHING
+	`, pq.Array(urls), depth)
+	if err != nil {
+		return 0, err
+	}
+
+	added, _ := res.RowsAffected()
+	return int(added), nil
+}
+
+// claimDueURLs marks up to limit due URLs as in_progress and returns them
+// SKIP LOCKED lets several app instances share the queue without double fetching
+func claimDueURLs(limit int) ([]queuedURL, error) {
+	rows, err := db.Query(`
+		UPDATE crawl_queue
+		SET status = 'in_progress', claimed_at = NOW()
+		WHERE url IN (
+			SELECT url FROM crawl_queue
+			WHERE status IN ('pending', 'done', 'blocked') AND next_fetch_at <= NOW()
+			ORDER BY next_fetch_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING url, depth, failure_count
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []queuedURL
+	for rows.Next() {
+		var item queuedURL
+		if err := rows.Scan(&item.URL, &item.Depth, &item.FailureCount); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// releaseStaleClaims returns rows stuck in_progress for longer than timeout to the queue
+func releaseStaleClaims(timeout time.Duration) error {
+	_, err := db.Exec(`
+		UPDATE crawl_queue SET status = 'pending', claimed_at = NULL
+		WHERE status = 'in_progress' AND claimed_at < $1
+	`, time.Now().Add(-timeout))
+	return err
+}
+
+// releaseClaim puts a claimed URL back without counting it as an attempt
+func releaseClaim(pageURL string) {
+	if _, err := db.Exec(`UPDATE crawl_queue SET status = 'pending', claimed_at = NULL WHERE url = $1`, pageURL); err != nil {
+		log.Printf("Crawl claim release failed: url=%s error=%v", pageURL, err)
+	}
+}
+
+// loadCrawlState returns stored validators and interval, or zero values for new URLs
+func loadCrawlState(pageURL string) (crawlState, error) {
+	var state crawlState
+	var etag, lastModified, hash sql.NullString
+	var intervalSeconds int64
+
+	err := db.QueryRow(`
+		SELECT etag, last_modified, content_hash, recrawl_interval_seconds
+		FROM crawl_state WHERE url = $1
+	`, pageURL).Scan(&etag, &lastModified, &hash, &intervalSeconds)
+	if err == sql.ErrNoRows {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	state.ETag = etag.String
+	state.LastModified = lastModified.String
+	state.ContentHash = hash.String
+	state.RecrawlInterval = time.Duration(intervalSeconds) * time.Second
+	return state, nil
+}
+
+// saveCrawlState records validators, content hash and the new recrawl interval
+func saveCrawlState(pageURL string, result fetchResult, hash string, changed bool, interval time.Duration) error {
+	_, err := db.Exec(`
+		INSERT INTO crawl_state (url, etag, last_modified, content_hash, last_fetched_at,
+			last_changed_at, recrawl_interval_seconds, fetch_count, change_count)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4, NOW(),
+			CASE WHEN $5::boolean THEN NOW() END, $6, 1, CASE WHEN $5::boolean THEN 1 ELSE 0 END)
+		ON CONFLICT (url) DO UPDATE SET
+			etag = COALESCE(EXCLUDED.etag, crawl_state.etag),
+			last_modified = COALESCE(EXCLUDED.last_modified, crawl_state.last_modified),
+			content_hash = EXCLUDED.content_hash,
+			last_fetched_at = NOW(),
+			last_changed_at = COALESCE(EXCLUDED.last_changed_at, crawl_state.last_changed_at),
+			recrawl_interval_seconds = EXCLUDED.recrawl_interval_seconds,
+			fetch_count = crawl_state.fetch_count + 1,
+			change_count = crawl_state.change_count + EXCLUDED.change_count
+	`, pageURL, result.ETag, result.LastModified, hash, changed, int64(interval/time.Second))
+	return err
+}
+
+// markCrawled schedules the next fetch and clears failure tracking
+func markCrawled(pageURL string, nextFetch time.Time) error {
+	_, err := db.Exec(`
+		UPDATE crawl_queue
+		SET status = 'done', next_fetch_at = $2, failure_count = 0, last_error = NULL, claimed_at = NULL
+		WHERE url = $1
+	`, pageURL, nextFetch)
+	return err
+}
+
+// recordCrawledPages notes pages stored by the crawl command in crawl_queue and crawl_state, so the
+// scheduler recrawls them on the usual interval instead of treating them as never fetched
+func recordCrawledPages(pages []Page) error {
+	for _, page := range pages {
+		_, err := db.Exec(`INSERT INTO crawl_queue (url, depth) VALUES ($1, $2) ON CONFLICT (url) DO NOTHING`,
+			page.URL, utils.RecrawlOnlyDepth)
+		if err != nil {
+			return err
+		}
+
+		state, err := loadCrawlState(page.URL)
+		if err != nil {
+			return err
+		}
+		hash := contentHash(page.Content)
+		changed := hash != state.ContentHash
+		interval := nextRecrawlInterval(state.RecrawlInterval, changed)
+
+		if err := saveCrawlState(page.URL, fetchResult{}, hash, changed, interval); err != nil {
+			return err
+		}
+		if err := markCrawled(page.URL, time.Now().Add(interval)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markCrawlFailed backs off exponentially and gives up after maxCrawlFailures attempts
+func markCrawlFailed(item queuedURL, fetchErr error) {
+	failures := item.FailureCount + 1
+	status := "pending"
+	if failures >= maxCrawlFailures {
+		status = "failed"
+	}
+
+	_, err := db.Exec(`
+		UPDATE crawl_queue
+		SET status = $2, next_fetch_at = $3, failure_count = $4, last_error = $5, claimed_at = NULL
+		WHERE url = $1
+	`, item.URL, status, time.Now().Add(failureBackoff(failures)), failures, fetchErr.Error())
+	if err != nil {
+		log.Printf("Crawl queue update failed: url=%s error=%v", item.URL, err)
+	}
+}
+
+// markCrawlBlocked parks URLs we may not fetch, re-checking them after the longest interval
+func markCrawlBlocked(pageURL string, reason error) {
+	_, err := db.Exec(`
+		UPDATE crawl_queue
+		SET status = 'blocked', next_fetch_at = $2, last_error = $3, claimed_at = NULL
+		WHERE url = $1
+	`, pageURL, time.Now().Add(maxRecrawlInterval), reason.Error())
+	if err != nil {
+		log.Printf("Crawl queue update failed: url=%s error=%v", pageURL, err)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"whoknows/utils"
+)
+
+// TestNextRecrawlInterval verifies intervals adapt to change frequency within bounds
+func TestNextRecrawlInterval(t *testing.T) {
+	tests := []struct {
+		name    string
+		current time.Duration
+		changed bool
+		want    time.Duration
+	}{
+		{"new url starts at initial interval", 0, true, initialRecrawlInterval},
+		{"changed page halves interval", 24 * time.Hour, true, 12 * time.Hour},
+		{"unchanged page grows interval", 24 * time.Hour, false, 36 * time.Hour},
+		{"never below minimum", time.Hour, true, minRecrawlInterval},
+		{"never above maximum", maxRecrawlInterval, false, maxRecrawlInterval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextRecrawlInterval(tt.current, tt.changed); got != tt.want {
+				t.Errorf("nextRecrawlInterval(%v, %v) = %v, want %v", tt.current, tt.changed, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestFailureBackoff verifies exponential backoff is capped at a day
+func TestFailureBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 5 * time.Minute},
+		{2, 10 * time.Minute},
+		{3, 20 * time.Minute},
+		{20, 24 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := failureBackoff(tt.failures); got != tt.want {
+			t.Errorf("failureBackoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+// TestCrawlScheduler_Integration verifies the frontier persists state and sends conditional requests
+func TestCrawlScheduler_Integration(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	conditionalHits := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", http.NotFound)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditionalHits++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><head><title>testuser scheduler page</title></head><body><p>Scheduled content</p></body></html>`)
+	})
+	site := httptest.NewServer(mux)
+	defer site.Close()
+
+	pageURL := site.URL + "/"
+	defer testDB.Exec("DELETE FROM crawl_queue WHERE url = $1", pageURL)
+	defer testDB.Exec("DELETE FROM pages WHERE url = $1", pageURL)
+
+	if _, err := enqueueURLs([]string{pageURL}, 0); err != nil {
+		t.Fatalf("enqueueURLs() returned error: %v", err)
+	}
+
+	scheduler := &CrawlScheduler{
+		crawler:   newCrawler(CrawlConfig{}, site.Client()),
+		interval:  time.Minute,
+		batchSize: 10,
+		maxDepth:  0,
+		sameHost:  true,
+	}
+
+	if _, err := scheduler.RunOnce(context.Background()); err != nil {
+		t.Fatalf("RunOnce() returned error: %v", err)
+	}
+
+	var status, etag string
+	err := testDB.QueryRow(`
+		SELECT q.status, s.etag FROM crawl_queue q JOIN crawl_state s ON s.url = q.url
+		WHERE q.url = $1
+	`, pageURL).Scan(&status, &etag)
+	if err != nil {
+		t.Fatalf("failed to read crawl state: %v", err)
+	}
+	if status != "done" || etag != `"v1"` {
+		t.Errorf("status=%q etag=%q, want done and \"v1\"", status, etag)
+	}
+
+	// Make the URL due again and verify the recrawl is conditional
+	testDB.Exec("UPDATE crawl_queue SET next_fetch_at = NOW() - INTERVAL '1 minute' WHERE url = $1", pageURL)
+	if _, err := scheduler.RunOnce(context.Background()); err != nil {
+		t.Fatalf("second RunOnce() returned error: %v", err)
+	}
+	if conditionalHits != 1 {
+		t.Errorf("conditional requests = %d, want 1", conditionalHits)
+	}
+}
+
+// TestCrawlScheduler_StoreFailure_Integration verifies a page that can't be stored is retried rather than recorded as crawled
+func TestCrawlScheduler_StoreFailure_Integration(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", http.NotFound)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><head><title>testuser scheduler renamed</title></head><body><p>Scheduled content</p></body></html>`)
+	})
+	site := httptest.NewServer(mux)
+	defer site.Close()
+
+	pageURL := site.URL + "/"
+	defer testDB.Exec("DELETE FROM crawl_state WHERE url = $1", pageURL)
+	defer testDB.Exec("DELETE FROM crawl_queue WHERE url = $1", pageURL)
+	defer testDB.Exec("DELETE FROM pages WHERE url = $1", pageURL)
+
+	// The URL already belongs to a page with another title, so storing the crawled page fails
+	if err := upsertPage(Page{Title: "testuser scheduler original", URL: pageURL, Language: "en", Content: "old"}); err != nil {
+		t.Fatalf("upsertPage() error = %v", err)
+	}
+	if _, err := enqueueURLs([]string{pageURL}, 0); err != nil {
+		t.Fatalf("enqueueURLs() returned error: %v", err)
+	}
+
+	scheduler := &CrawlScheduler{
+		crawler:   newCrawler(CrawlConfig{}, site.Client()),
+		interval:  time.Minute,
+		batchSize: 10,
+		sameHost:  true,
+	}
+	if _, err := scheduler.RunOnce(context.Background()); err != nil {
+		t.Fatalf("RunOnce() returned error: %v", err)
+	}
+
+	var status string
+	var failures int
+	testDB.QueryRow("SELECT status, failure_count FROM crawl_queue WHERE url = $1", pageURL).Scan(&status, &failures)
+	if status != "pending" || failures != 1 {
+		t.Errorf("status=%q failures=%d, want pending and 1", status, failures)
+	}
+	var saved int
+	testDB.QueryRow("SELECT COUNT(*) FROM crawl_state WHERE url = $1 AND etag IS NOT NULL", pageURL).Scan(&saved)
+	if saved != 0 {
+		t.Error("validators were saved for a page that wasn't stored")
+	}
+}
+
+// TestRecordCrawledPages_Integration verifies pages from the crawl command are handed to the scheduler for recrawling
+func TestRecordCrawledPages_Integration(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	pageURL := "https://example.com/testuser_recorded"
+	defer testDB.Exec("DELETE FROM crawl_queue WHERE url = $1", pageURL)
+	page := Page{Title: "testuser recorded page", URL: pageURL, Language: "en", Content: "Recorded content"}
+
+	for _, wantInterval := range []time.Duration{initialRecrawlInterval, initialRecrawlInterval * 3 / 2} {
+		if err := recordCrawledPages([]Page{page}); err != nil {
+			t.Fatalf("recordCrawledPages() returned error: %v", err)
+		}
+
+		var status, hash string
+		var depth int
+		var intervalSeconds int64
+		var nextFetch time.Time
+		err := testDB.QueryRow(`
+			SELECT q.status, q.depth, q.next_fetch_at, s.content_hash, s.recrawl_interval_seconds
+			FROM crawl_queue q JOIN crawl_state s ON s.url = q.url
+			WHERE q.url = $1
+		`, pageURL).Scan(&status, &depth, &nextFetch, &hash, &intervalSeconds)
+		if err != nil {
+			t.Fatalf("failed to read crawl state: %v", err)
+		}
+		if status != "done" || depth != utils.RecrawlOnlyDepth || hash != contentHash(page.Content) {
+			t.Errorf("status=%q depth=%d hash=%q, want done, recrawl-only depth and the content hash", status, depth, hash)
+		}
+		if got := time.Duration(intervalSeconds) * time.Second; got != wantInterval || time.Until(nextFetch) < wantInterval-time.Minute {
+			t.Errorf("interval=%s next fetch in %s, want %s", got, time.Until(nextFetch), wantInterval)
+		}
+	}
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults match the settings the Node crawler in crawler-local/ has used so far
+const (
+	defaultCrawlSeed      = "https://en.wikipedia.org/wiki/DevOps"
+	defaultCrawlUserAgent = "OggoleCrawler/1.0 (Educational purposes)"
+	maxCrawlBodyBytes     = 5 << 20
+	robotsCacheTTL        = 24 * time.Hour
+)
+
+// defaultMaxContentLength is the characters of text stored per page, enough for full-text search to see
+// the body of an article rather than its first paragraph. Overridden with CRAWL_MAX_CONTENT_LENGTH
+const defaultMaxContentLength = 20000
+
+var (
+	errRobotsDisallowed = errors.New("disallowed by robots.txt")
+	errNotHTML          = errors.New("response is not HTML")
+)
+
+// CrawlConfig controls a single crawl run
+type CrawlConfig struct {
+	Seeds            []string
+	MaxDepth         int           // Link hops followed from a seed (0 = seeds only)
+	MaxPages         int           // Pages fetched before stopping
+	Delay            time.Duration // Minimum time between requests to the same host
+	UserAgent        string
+	SameHost         bool // Only follow links that stay on a seed host
+	BatchSize        int  // Pages buffered before writing to the database
+	MaxContentLength int  // Characters of extracted text stored per page
+}
+
+// CrawlResult summarises what a crawl run did
+type CrawlResult struct {
+	Fetched int
+	Stored  int
+	Skipped int
+	Failed  int
+}
+
+// Crawler does breadth-first crawling with robots.txt and per-host politeness
+type Crawler struct {
+	config    CrawlConfig
+	client    *http.Client
+	robots    map[string]*robotsRules
+	lastFetch map[string]time.Time
+}
+
+type crawlItem struct {
+	url   string
+	depth int
+}
+
+// newCrawler fills in config defaults and returns a ready crawler
+func newCrawler(config CrawlConfig, client *http.Client) *Crawler {
+	if config.UserAgent == "" {
+		config.UserAgent = defaultCrawlUserAgent
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 10
+	}
+	if config.MaxContentLength <= 0 {
+		config.MaxContentLength = maxContentLength()
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &Crawler{
+		config:    config,
+		client:    client,
+		robots:    make(map[string]*robotsRules),
+		lastFetch: make(map[string]time.Time),
+	}
+}
+
+// Run crawls from the configured seeds and hands pages to store in batches
+func (c *Crawler) Run(ctx context.Context, store func([]Page) (int, error)) (CrawlResult, error) {
+	var result CrawlResult
+
+	seedHosts := make(map[string]bool)
+	visited := make(map[string]bool)
+	queue := make([]crawlItem, 0, len(c.config.Seeds))
+
+	for _, seed := range c.config.Seeds {
+		normalized := normalizeCrawlURL(seed)
+		if normalized == "" {
+			log.Printf("Crawl seed ignored: url=%s reason=invalid_url", seed)
+			continue
+		}
+		parsed, _ := url.Parse(normalized)
+		seedHosts[parsed.Host] = true
+		if !visited[normalized] {
+			visited[normalized] = true
+			queue = append(queue, crawlItem{url: normalized, depth: 0})
+		}
+	}
+
+	batch := make([]Page, 0, c.config.BatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		stored, err := store(batch)
+		result.Stored += stored
+		result.Failed += len(batch) - stored
+		batch = batch[:0]
+		return err
+	}
+
+	for len(queue) > 0 && (c.config.MaxPages <= 0 || result.Fetched < c.config.MaxPages) {
+		if err := ctx.Err(); err != nil {
+			flush()
+			return result, err
+		}
+
+		item := queue[0]
+		queue = queue[1:]
+
+		doc, err := c.fetch(ctx, item.url)
+		if err != nil {
+			if errors.Is(err, errRobotsDisallowed) || errors.Is(err, errNotHTML) {
+				result.Skipped++
+			} else {
+				log.Printf("Crawl fetch failed: url=%s error=%v", item.url, err)
+				result.Failed++
+			}
+			continue
+		}
+		result.Fetched++
+
+		if page, ok := c.pageFromDocument(item.url, doc); ok {
+			batch = append(batch, page)
+			if len(batch) >= c.config.BatchSize {
+				if err := flush(); err != nil {
+					return result, err
+				}
+			}
+		} else {
+			result.Skipped++
+		}
+
+		if doc.NoFollow || item.depth >= c.config.MaxDepth {
+			continue
+		}
+
+		for _, link := range doc.Links {
+			normalized := normalizeCrawlURL(link)
+			if normalized == "" || visited[normalized] {
+				continue
+			}
+			if c.config.SameHost {
+				parsed, _ := url.Parse(normalized)
+				if !seedHosts[parsed.Host] {
+					continue
+				}
+			}
+			visited[normalized] = true
+			queue = append(queue, crawlItem{url: normalized, depth: item.depth + 1})
+		}
+	}
+
+	return result, flush()
+}
+
+// pageFromDocument turns an extracted document into a storable page
+func (c *Crawler) pageFromDocument(pageURL string, doc HTMLDocument) (Page, bool) {
+	if doc.NoIndex || doc.Title == "" || doc.Text == "" {
+		return Page{}, false
+	}
+
+	return Page{
+		Title:    doc.Title,
+		URL:      pageURL,
+		Language: doc.Language,
+		Content:  truncateRunes(doc.Text, c.config.MaxContentLength),
+	}, true
+}
+
+// fetchValidators are cache validators from an earlier fetch, sent as conditional headers
+type fetchValidators struct {
+	ETag         string
+	LastModified string
+}
+
+// fetchResult is the outcome of fetching a single page
+type fetchResult struct {
+	Doc          HTMLDocument
+	NotModified  bool
+	ETag         string
+	LastModified string
+}
+
+// fetch downloads and extracts a single page, honouring robots.txt and politeness delays
+func (c *Crawler) fetch(ctx context.Context, pageURL string) (HTMLDocument, error) {
+	result, err := c.fetchConditional(ctx, pageURL, fetchValidators{})
+	return result.Doc, err
+}
+
+// fetchConditional is fetch with If-None-Match/If-Modified-Since support for recrawls
+func (c *Crawler) fetchConditional(ctx context.Context, pageURL string, validators fetchValidators) (fetchResult, error) {
+	var result fetchResult
+
+	parsed, err := url.Parse(pageURL)
+	if err != nil {
+		return result, err
+	}
+
+	rules, err := c.robotsFor(ctx, parsed)
+	if err != nil {
+		return result, err
+	}
+	if !rules.allowed(parsed.RequestURI()) {
+		return result, errRobotsDisallowed
+	}
+
+	header := make(http.Header)
+	if validators.ETag != "" {
+		header.Set("If-None-Match", validators.ETag)
+	}
+	if validators.LastModified != "" {
+		header.Set("If-Modified-Since", validators.LastModified)
+	}
+
+	resp, err := c.get(ctx, parsed, rules.crawlDelay, header)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	result.ETag = resp.Header.Get("ETag")
+	result.LastModified = resp.Header.Get("Last-Modified")
+
+	if resp.StatusCode == http.StatusNotModified {
+		result.NotModified = true
+		return result, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "" && mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return result, errNotHTML
+	}
+
+	// Resolve relative links against the final URL after redirects
+	result.Doc, err = extractHTML(io.LimitReader(resp.Body, maxCrawlBodyBytes), resp.Request.URL)
+	return result, err
+}
+
+// robotsFor returns cached robots.txt rules for the URL's host, fetching them on first use
+func (c *Crawler) robotsFor(ctx context.Context, pageURL *url.URL) (*robotsRules, error) {
+	host := pageURL.Scheme + "://" + pageURL.Host
+	if rules, ok := c.robots[host]; ok && time.Since(rules.fetchedAt) < robotsCacheTTL {
+		return rules, nil
+	}
+
+	robotsURL, _ := url.Parse(host + "/robots.txt")
+	resp, err := c.get(ctx, robotsURL, 0, nil)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// Unreachable robots.txt: be conservative and skip the host
+		log.Printf("robots.txt fetch failed: host=%s error=%v", pageURL.Host, err)
+		rules := &robotsRules{disallowAll: true, fetchedAt: time.Now()}
+		c.robots[host] = rules
+		return rules, nil
+	}
+	defer resp.Body.Close()
+
+	var rules *robotsRules
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		rules = parseRobots(io.LimitReader(resp.Body, 512<<10), c.config.UserAgent)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		// No robots.txt means everything is allowed
+		rules = &robotsRules{}
+	default:
+		rules = &robotsRules{disallowAll: true}
+	}
+
+	rules.fetchedAt = time.Now()
+	c.robots[host] = rules
+	return rules, nil
+}
+
+// get performs a GET request after waiting out the politeness delay for the host
+func (c *Crawler) get(ctx context.Context, target *url.URL, crawlDelay time.Duration, header http.Header) (*http.Response, error) {
+	delay := c.config.Delay
+	if crawlDelay > delay {
+		delay = crawlDelay
+	}
+
+	if last, ok := c.lastFetch[target.Host]; ok {
+		if wait := time.Until(last.Add(delay)); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case <-timer.C:
+			}
+		}
+	}
+	c.lastFetch[target.Host] = time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("User-Agent", c.config.UserAgent)
+
+	return c.client.Do(req)
+}
+
+// normalizeCrawlURL returns a canonical form used for de-duplication, or "" if unusable
+func normalizeCrawlURL(raw string) string {
+	parsed, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return ""
+	}
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	parsed.Host = strings.ToLower(parsed.Host)
+	parsed.Fragment = ""
+	if parsed.Path == "" {
+		parsed.Path = "/"
+	}
+	return parsed.String()
+}
+
+// truncateRunes cuts s to at most n characters without splitting UTF-8 sequences
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return strings.TrimSpace(string(runes[:n]))
+}
+
+// robotsRules holds the robots.txt group that applies to our user agent
+type robotsRules struct {
+	allow       []string
+	disallow    []string
+	crawlDelay  time.Duration
+	disallowAll bool
+	fetchedAt   time.Time
+}
+
+// parseRobots picks the group matching userAgent (or "*") from a robots.txt file
+func parseRobots(r io.Reader, userAgent string) *robotsRules {
+	token := strings.ToLower(userAgent)
+	if i := strings.IndexAny(token, "/ "); i >= 0 {
+		token = token[:i]
+	}
+
+	specific := &robotsRules{}
+	wildcard := &robotsRules{}
+	var matchedSpecific bool
+
+	// Rules in the current group apply to every user-agent line that started it
+	var current []*robotsRules
+	inAgentLines := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if key == "user-agent" {
+			if !inAgentLines {
+				current = nil
+				inAgentLines = true
+			}
+			agent := strings.ToLower(value)
+			switch {
+			case agent == "*":
+				current = append(current, wildcard)
+			case agent == token:
+				matchedSpecific = true
+				current = append(current, specific)
+			}
+			continue
+		}
+		inAgentLines = false
+
+		for _, rules := range current {
+			switch key {
+			case "allow":
+				if value != "" {
+					rules.allow = append(rules.allow, value)
+				}
+			case "disallow":
+				if value != "" {
+					rules.disallow = append(rules.disallow, value)
+				}
+			case "crawl-delay":
+				if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+					rules.crawlDelay = time.Duration(seconds * float64(time.Second))
+				}
+			}
+		}
+	}
+
+	if matchedSpecific {
+		return specific
+	}
+	return wildcard
+}
+
+// allowed applies longest-match precedence, with Allow winning ties
+func (rr *robotsRules) allowed(path string) bool {
+	if rr.disallowAll {
+		return false
+	}
+
+	longestAllow := -1
+	for _, pattern := range rr.allow {
+		if robotsPatternMatches(pattern, path) && len(pattern) > longestAllow {
+			longestAllow = len(pattern)
+		}
+	}
+	longestDisallow := -1
+	for _, pattern := range rr.disallow {
+		if robotsPatternMatches(pattern, path) && len(pattern) > longestDisallow {
+			longestDisallow = len(pattern)
+		}
+	}
+
+	return longestDisallow < 0 || longestAllow >= longestDisallow
+}
+
+// robotsPatternMatches supports the "*" wildcard and "$" end anchor from RFC 9309
+func robotsPatternMatches(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = strings.TrimSuffix(pattern, "$")
+	}
+
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	pos := len(parts[0])
+
+	for i := 1; i < len(parts); i++ {
+		part := parts[i]
+		if i == len(parts)-1 && anchored {
+			return strings.HasSuffix(path[pos:], part)
+		}
+		idx := strings.Index(path[pos:], part)
+		if idx < 0 {
+			return false
+		}
+		pos += idx + len(part)
+	}
+
+	return !anchored || pos == len(path)
+}
+
+// maxContentLength returns the characters of text stored per crawled or ingested page
+func maxContentLength() int {
+	return envInt("CRAWL_MAX_CONTENT_LENGTH", defaultMaxContentLength)
+}
+
+// storePages writes a batch of crawled pages with one multi-row upsert, returning how many were stored
+// If the statement fails, e.g. because one page's URL already belongs to another title, the pages are
+// upserted one at a time so a single bad row doesn't lose the rest of the batch
+func storePages(pages []Page) (int, error) {
+	if len(pages) == 0 {
+		return 0, nil
+	}
+
+	// A row may only be upserted once per statement, so a title seen twice keeps its last version
+	latest := make(map[string]int, len(pages))
+	for i, page := range pages {
+		latest[page.Title] = i
+	}
+
+	unique := make([]Page, 0, len(latest))
+	values := make([]string, 0, len(latest))
+	args := make([]interface{}, 0, len(latest)*5)
+	for i, page := range pages {
+		if latest[page.Title] != i {
+			continue
+		}
+		if page.ContentType == "" {
+			page.ContentType = contentTypeHTML
+		}
+		unique = append(unique, page)
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, NOW())", n+1, n+2, n+3, n+4, n+5))
+		args = append(args, page.Title, page.URL, page.Language, page.Content, page.ContentType)
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO pages (title, url, language, content, content_type, last_updated)
+		VALUES `+strings.Join(values, ", ")+`
+		ON CONFLICT (title)
+		DO UPDATE SET
+			url = EXCLUDED.url,
+			content = EXCLUDED.content,
+			content_type = EXCLUDED.content_type,
+			last_updated = NOW()`, args...)
+	if err == nil {
+		stored, err := result.RowsAffected()
+		return int(stored), err
+	}
+	log.Printf("Batch upsert failed, storing pages one at a time: pages=%d error=%v", len(unique), err)
+
+	stored := 0
+	for _, page := range unique {
+		if err := upsertPage(page); err != nil {
+			log.Printf("Error inserting page '%s': %v", page.Title, err)
+			continue
+		}
+		stored++
+	}
+	return stored, nil
+}
+
+// runCrawlCommand implements the "crawl" CLI subcommand
+func runCrawlCommand(args []string) {
+	flags := flag.NewFlagSet("crawl", flag.ExitOnError)
+	seeds := flags.String("seeds", envOrDefault("CRAWL_SEEDS", defaultCrawlSeed), "comma separated start URLs")
+	maxDepth := flags.Int("depth", 2, "maximum link depth from a seed")
+	maxPages := flags.Int("max-pages", 20, "maximum pages to fetch")
+	delay := flags.Duration("delay", time.Second, "minimum delay between requests to the same host")
+	sameHost := flags.Bool("same-host", true, "only follow links on the seed hosts")
+	batchSize := flags.Int("batch", 10, "pages per database batch")
+	maxContent := flags.Int("max-content", maxContentLength(), "characters of text stored per page")
+	enqueue := flags.Bool("enqueue", false, "add seeds to the persistent crawl_queue for the scheduler instead of crawling now")
+	flags.Parse(args)
+
+	openCommandDatabase()
+	defer db.Close()
+
+	if *enqueue {
+		added, err := enqueueURLs(normalizeSeeds(strings.Split(*seeds, ",")), 0)
+		if err != nil {
+			log.Fatalf("Failed to enqueue seeds: %v", err)
+		}
+		log.Printf("Crawl seeds enqueued: added=%d", added)
+		return
+	}
+
+	config := CrawlConfig{
+		Seeds:            strings.Split(*seeds, ","),
+		MaxDepth:         *maxDepth,
+		MaxPages:         *maxPages,
+		Delay:            *delay,
+		SameHost:         *sameHost,
+		BatchSize:        *batchSize,
+		MaxContentLength: *maxContent,
+	}
+
+	// Stop cleanly on Ctrl-C, flushing whatever is buffered
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	log.Printf("Crawl started: seeds=%s depth=%d max_pages=%d", *seeds, *maxDepth, *maxPages)
+
+	// Record what was fetched so the crawl scheduler takes over recrawling these pages
+	store := func(pages []Page) (int, error) {
+		stored, err := storePages(pages)
+		if err != nil {
+			return stored, err
+		}
+		if err := recordCrawledPages(pages); err != nil {
+			log.Printf("Crawl state save failed: error=%v", err)
+		}
+		return stored, nil
+	}
+
+	result, err := newCrawler(config, nil).Run(ctx, store)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Printf("Crawl aborted: error=%v", err)
+	}
+
+	log.Printf("Crawl finished: fetched=%d stored=%d skipped=%d failed=%d",
+		result.Fetched, result.Stored, result.Skipped, result.Failed)
+}
+
+// openCommandDatabase connects the global db for CLI subcommands, exiting on failure
+func openCommandDatabase() {
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		log.Fatal("DATABASE_URL environment variable is required")
+	}
+
+	var err error
+	db, err = sql.Open("postgres", dbURL)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+
+	if err = db.Ping(); err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+}
+
+// normalizeSeeds drops invalid seed URLs and returns the rest in canonical form
+func normalizeSeeds(seeds []string) []string {
+	normalized := make([]string, 0, len(seeds))
+	for _, seed := range seeds {
+		if u := normalizeCrawlURL(seed); u != "" {
+			normalized = append(normalized, u)
+		}
+	}
+	return normalized
+}
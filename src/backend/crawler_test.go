@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// newTestSite serves a small linked site with a robots.txt
+func newTestSite(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	pages := map[string]string{
+		"/":         `<html lang="en"><head><title>Home</title></head><body><nav><a href="/nav-only">Nav</a></nav><p>Welcome home</p><a href="/a">A</a><a href="/private/secret">Secret</a><a href="https://elsewhere.example/">Off-site</a></body></html>`,
+		"/a":        `<html><head><title>Page A</title></head><body><p>Alpha content</p><a href="/b">B</a><a href="/a#top">Self</a></body></html>`,
+		"/b":        `<html lang="da"><head><title>Page B</title></head><body><p>Bravo indhold</p><a href="/c">C</a></body></html>`,
+		"/c":        `<html><head><title>Page C</title></head><body><p>Charlie content</p></body></html>`,
+		"/nav-only": `<html><head><title>Nav</title><meta name="robots" content="noindex"></head><body><p>Hidden</p></body></html>`,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "User-agent: *\nDisallow: /private/\n")
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/private/") {
+			t.Errorf("crawler fetched robots.txt disallowed path %s", r.URL.Path)
+		}
+		body, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, body)
+	})
+
+	return httptest.NewServer(mux)
+}
+
+// TestCrawler_Run verifies BFS crawling respects robots.txt, depth and host limits
+func TestCrawler_Run(t *testing.T) {
+	site := newTestSite(t)
+	defer site.Close()
+
+	var stored []Page
+	store := func(pages []Page) (int, error) {
+		stored = append(stored, pages...)
+		return len(pages), nil
+	}
+
+	crawler := newCrawler(CrawlConfig{
+		Seeds:     []string{site.URL + "/"},
+		MaxDepth:  2,
+		MaxPages:  10,
+		SameHost:  true,
+		BatchSize: 2,
+	}, site.Client())
+
+	result, err := crawler.Run(context.Background(), store)
+	if err != nil {
+		t.Fatalf("Run() returned error: %v", err)
+	}
+
+	var titles []string
+	for _, page := range stored {
+		titles = append(titles, page.Title)
+	}
+	sort.Strings(titles)
+
+	// Page C is three hops away, nav-only is noindex, private is disallowed
+	want := []string{"Home", "Page A", "Page B"}
+	if strings.Join(titles, ",") != strings.Join(want, ",") {
+		t.Errorf("stored titles = %v, want %v", titles, want)
+	}
+	if result.Stored != len(want) {
+		t.Errorf("result.Stored = %d, want %d", result.Stored, len(want))
+	}
+	if result.Skipped < 2 {
+		t.Errorf("result.Skipped = %d, want at least 2 (noindex + robots)", result.Skipped)
+	}
+
+	for _, page := range stored {
+		if page.Title == "Page B" && page.Language != "da" {
+			t.Errorf("Page B language = %q, want da", page.Language)
+		}
+	}
+}
+
+// TestCrawler_RunRespectsMaxPages verifies the page limit stops the crawl
+func TestCrawler_RunRespectsMaxPages(t *testing.T) {
+	site := newTestSite(t)
+	defer site.Close()
+
+	crawler := newCrawler(CrawlConfig{
+		Seeds:    []string{site.URL + "/"},
+		MaxDepth: 5,
+		MaxPages: 2,
+		SameHost: true,
+	}, site.Client())
+
+	result, err := crawler.Run(context.Background(), func(pages []Page) (int, error) {
+		return len(pages), nil
+	})
+	if err != nil {
+		t.Fatalf("Run() returned error: %v", err)
+	}
+	if result.Fetched != 2 {
+		t.Errorf("result.Fetched = %d, want 2", result.Fetched)
+	}
+}
+
+// TestRobotsRules verifies group selection and longest-match precedence
+func TestRobotsRules(t *testing.T) {
+	robots := `
+# Comment line
+User-agent: *
+Disallow: /
+
+User-agent: OggoleCrawler
+Disallow: /private/
+Allow: /private/open
+Disallow: /*.pdf$
+Crawl-delay: 2
+`
+	rules := parseRobots(strings.NewReader(robots), defaultCrawlUserAgent)
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/", true},
+		{"/wiki/DevOps", true},
+		{"/private/data", false},
+		{"/private/open/page", true},
+		{"/files/report.pdf", false},
+		{"/files/report.pdf?download=1", true},
+	}
+
+	for _, tt := range tests {
+		if got := rules.allowed(tt.path); got != tt.want {
+			t.Errorf("allowed(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	if rules.crawlDelay.Seconds() != 2 {
+		t.Errorf("crawlDelay = %v, want 2s", rules.crawlDelay)
+	}
+
+	other := parseRobots(strings.NewReader(robots), "SomeOtherBot/1.0")
+	if other.allowed("/wiki/DevOps") {
+		t.Errorf("wildcard group should disallow everything for other agents")
+	}
+}
+
+// TestExtractHTML verifies title, language, text and link extraction
+func TestExtractHTML(t *testing.T) {
+	page := `<!DOCTYPE html>
+<html lang="da-DK">
+<head><title> Test   Page </title><script>var x = 1;</script></head>
+<body>
+<header>Site header</header>
+<main><h1>Heading</h1><p>First paragraph.</p><p>Second<br>line.</p>
+<a href="/relative#frag">Rel</a> <a href="mailto:x@example.com">Mail</a> <a href="https://other.example/page">Abs</a>
+</main>
+<footer>Copyright</footer>
+</body></html>`
+
+	base, _ := url.Parse("https://example.com/dir/index.html")
+	doc, err := extractHTML(strings.NewReader(page), base)
+	if err != nil {
+		t.Fatalf("extractHTML() returned error: %v", err)
+	}
+
+	if doc.Title != "Test Page" {
+		t.Errorf("Title = %q, want %q", doc.Title, "Test Page")
+	}
+	if doc.Language != "da" {
+		t.Errorf("Language = %q, want da", doc.Language)
+	}
+	if doc.Text != "Heading First paragraph. Second line. Rel Mail Abs" {
+		t.Errorf("Text = %q", doc.Text)
+	}
+	if strings.Contains(doc.Text, "Site header") || strings.Contains(doc.Text, "Copyright") {
+		t.Errorf("Text contains boilerplate: %q", doc.Text)
+	}
+
+	wantLinks := []string{"https://example.com/relative", "https://other.example/page"}
+	if strings.Join(doc.Links, ",") != strings.Join(wantLinks, ",") {
+		t.Errorf("Links = %v, want %v", doc.Links, wantLinks)
+	}
+}
+
+// TestStorePages_Integration verifies a batch is upserted in one statement, keeping the last version of a repeated title,
+// and that a page whose URL belongs to another title doesn't stop the rest of the batch
+func TestStorePages_Integration(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	defer testDB.Exec("DELETE FROM pages WHERE title LIKE 'testuser_store%'")
+
+	if err := upsertPage(Page{Title: "testuser_store_existing", URL: "https://example.com/old", Language: "en", Content: "old"}); err != nil {
+		t.Fatalf("upsertPage() error = %v", err)
+	}
+
+	stored, err := storePages([]Page{
+		{Title: "testuser_store_existing", URL: "https://example.com/existing", Language: "en", Content: "updated"},
+		{Title: "testuser_store_new", URL: "https://example.com/new", Language: "en", Content: "first"},
+		{Title: "testuser_store_new", URL: "https://example.com/new", Language: "en", Content: "second"},
+	})
+	if err != nil || stored != 2 {
+		t.Fatalf("storePages() = %d, %v, want 2", stored, err)
+	}
+
+	for title, want := range map[string]string{"testuser_store_existing": "updated", "testuser_store_new": "second"} {
+		var content string
+		testDB.QueryRow("SELECT content FROM pages WHERE title = $1", title).Scan(&content)
+		if content != want {
+			t.Errorf("%s content = %q, want %q", title, content, want)
+		}
+	}
+
+	stored, err = storePages([]Page{
+		{Title: "testuser_store_conflict", URL: "https://example.com/new", Language: "en", Content: "taken url"},
+		{Title: "testuser_store_other", URL: "https://example.com/other", Language: "en", Content: "other"},
+	})
+	if err != nil || stored != 1 {
+		t.Fatalf("storePages() with a taken URL = %d, %v, want 1", stored, err)
+	}
+	var count int
+	testDB.QueryRow("SELECT COUNT(*) FROM pages WHERE title = 'testuser_store_other'").Scan(&count)
+	if count != 1 {
+		t.Error("page after the conflicting one was not stored")
+	}
+}
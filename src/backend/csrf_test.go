@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testCSRFToken = "test-csrf-token-0123456789abcdefghijklmnop"
+
+// TestRequireCSRF verifies state-changing requests need the cookie token echoed back
+func TestRequireCSRF(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		cookie     string
+		field      string
+		header     string
+		bearer     string
+		wantPassed bool
+	}{
+		{name: "GET passes without token", method: "GET", wantPassed: true},
+		{name: "POST without cookie", method: "POST", field: testCSRFToken},
+		{name: "POST without token", method: "POST", cookie: testCSRFToken},
+		{name: "POST with wrong token", method: "POST", cookie: testCSRFToken, field: "forged"},
+		{name: "POST with form token", method: "POST", cookie: testCSRFToken, field: testCSRFToken, wantPassed: true},
+		{name: "POST with header token", method: "POST", cookie: testCSRFToken, header: testCSRFToken, wantPassed: true},
+		{name: "DELETE without token", method: "DELETE", cookie: testCSRFToken},
+		{name: "POST with API token", method: "POST", bearer: "wk_abc", wantPassed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"username": {"someone"}}
+			if tt.field != "" {
+				form.Set(csrfFieldName, tt.field)
+			}
+			req := httptest.NewRequest(tt.method, "/api/login", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: tt.cookie})
+			}
+			if tt.header != "" {
+				req.Header.Set(csrfHeaderName, tt.header)
+			}
+			if tt.bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+
+			passed := false
+			w := httptest.NewRecorder()
+			requireCSRF(func(w http.ResponseWriter, r *http.Request) { passed = true })(w, req)
+
+			if passed != tt.wantPassed {
+				t.Errorf("handler called = %v, want %v (status %d)", passed, tt.wantPassed, w.Code)
+			}
+		})
+	}
+}
+
+// TestRequireCSRF_Rejection verifies API clients get a 403 and browsers go back to the form on this site
+func TestRequireCSRF_Rejection(t *testing.T) {
+	handler := requireCSRF(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("handler called without a CSRF token")
+	})
+
+	req := httptest.NewRequest("POST", "/api/login", nil)
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	var body formErrorResponse
+	if w.Code != http.StatusForbidden || json.NewDecoder(w.Body).Decode(&body) != nil || body.Error == "" {
+		t.Errorf("JSON rejection = %d %q", w.Code, w.Body.String())
+	}
+
+	for referer, want := range map[string]string{
+		"http://localhost:8080/login?next=x":  "/login?next=x",
+		"https://evil.example/phish":          "/phish",
+		"http://localhost:8080//evil.example": "/",
+		"":                                    "/",
+	} {
+		req := httptest.NewRequest("POST", "/api/login", nil)
+		req.Header.Set("Referer", referer)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != want {
+			t.Errorf("Referer %q: redirect = %d to %q, want %q", referer, w.Code, w.Header().Get("Location"), want)
+		}
+	}
+}
+
+// TestCSRFToken_IssuedOnceAndRendered verifies pages embed the cookie's token in their forms
+func TestCSRFToken_IssuedOnceAndRendered(t *testing.T) {
+	templates = template.Must(template.ParseGlob("../templates/*.html"))
+
+	w := httptest.NewRecorder()
+	login1(w, httptest.NewRequest("GET", "/login", nil))
+
+	var issued string
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == csrfCookieName {
+			issued = cookie.Value
+		}
+	}
+	if issued == "" {
+		t.Fatalf("no CSRF cookie issued")
+	}
+	if !strings.Contains(w.Body.String(), `name="csrf_token" value="`+issued+`"`) {
+		t.Errorf("login form does not carry the issued token")
+	}
+
+	// An existing token is reused rather than rotated, so other open tabs keep working
+	req := httptest.NewRequest("GET", "/login", nil)
+	req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: testCSRFToken})
+	w = httptest.NewRecorder()
+	login1(w, req)
+	if len(w.Result().Cookies()) != 0 {
+		t.Errorf("CSRF cookie was reissued: %v", w.Result().Cookies())
+	}
+	if !strings.Contains(w.Body.String(), testCSRFToken) {
+		t.Errorf("login form does not carry the existing token")
+	}
+}
+
+// TestLogout_RequiresPost verifies logout can't be triggered by a link or image
+func TestLogout_RequiresPost(t *testing.T) {
+	w := httptest.NewRecorder()
+	logout(w, httptest.NewRequest("GET", "/api/logout", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /api/logout status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+)
+
+// Document content types stored in pages.content_type
+const (
+	contentTypeHTML     = "text/html"
+	contentTypeMarkdown = "text/markdown"
+	contentTypeText     = "text/plain"
+	contentTypePDF      = "application/pdf"
+)
+
+// Titles longer than this are cut when derived from the first line of a document
+const maxDerivedTitleLength = 120
+
+// defaultMaxDocumentLength is the characters of extracted text stored per uploaded document, roughly a hundred
+// pages of a report. Much more than crawled pages keep, since the whole document should be searchable, but still
+// well within what Postgres can build a tsvector from. Overridden with DOCUMENT_MAX_CONTENT_LENGTH
+const defaultMaxDocumentLength = 200000
+
+var (
+	errUnsupportedDocument = errors.New("unsupported document type")
+	errInvalidPDF          = errors.New("invalid PDF")
+)
+
+// ExtractedDocument is the title and text pulled out of an uploaded file
+type ExtractedDocument struct {
+	Title    string
+	Text     string
+	Language string
+}
+
+// detectDocumentType picks a content type from the file extension, declared type or content sniffing
+func detectDocumentType(filename, declared string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".pdf":
+		return contentTypePDF
+	case ".md", ".markdown":
+		return contentTypeMarkdown
+	case ".txt", ".text":
+		return contentTypeText
+	case ".html", ".htm", ".xhtml":
+		return contentTypeHTML
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(declared)
+	switch mediaType {
+	case contentTypePDF, contentTypeMarkdown, contentTypeText, contentTypeHTML:
+		return mediaType
+	case "text/x-markdown":
+		return contentTypeMarkdown
+	case "application/xhtml+xml":
+		return contentTypeHTML
+	}
+
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	switch sniffed {
+	case contentTypePDF, contentTypeHTML, contentTypeText:
+		return sniffed
+	}
+	return ""
+}
+
+// extractDocument dispatches to the extractor for contentType
+func extractDocument(data []byte, contentType string, base *url.URL) (ExtractedDocument, error) {
+	switch contentType {
+	case contentTypeHTML:
+		doc, err := extractHTML(bytes.NewReader(data), base)
+		return ExtractedDocument{Title: doc.Title, Text: doc.Text, Language: doc.Language}, err
+	case contentTypeMarkdown:
+		return extractMarkdown(string(data)), nil
+	case contentTypeText:
+		return extractPlainText(string(data)), nil
+	case contentTypePDF:
+		return extractPDF(data)
+	default:
+		return ExtractedDocument{}, errUnsupportedDocument
+	}
+}
+
+// extractPlainText uses the first line as title; form feeds are treated as page breaks
+func extractPlainText(text string) ExtractedDocument {
+	pages := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\f")
+	lines := removeBoilerplateLines(splitPageLines(pages))
+
+	return ExtractedDocument{
+		Title: firstLineTitle(lines),
+		Text:  collapseWhitespace(strings.Join(lines, "\n")),
+	}
+}
+
+var (
+	markdownHeading   = regexp.MustCompile(`^#{1,6}\s+(.*?)\s*#*\s*$`)
+	markdownSetext    = regexp.MustCompile(`^(=+|-+)\s*$`)
+	markdownRule      = regexp.MustCompile(`^\s*([-*_]\s*){3,}$`)
+	markdownRefDef    = regexp.MustCompile(`^\s*\[[^\]]+\]:\s*\S+`)
+	markdownListItem  = regexp.MustCompile(`^\s*([-*+]|\d+[.)])\s+`)
+	markdownQuote     = regexp.MustCompile(`^\s*(>\s?)+`)
+	markdownImage     = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLink      = regexp.MustCompile(`\[([^\]]+)\](\([^)]*\)|\[[^\]]*\])`)
+	markdownHTMLTag   = regexp.MustCompile(`<[^>]+>`)
+	markdownEmphasis  = regexp.MustCompile("(\\*{1,3}|_{2,3}|~~|`+)")
+	markdownTableRule = regexp.MustCompile(`^\s*\|?\s*:?-{3,}:?\s*(\|\s*:?-{3,}:?\s*)*\|?\s*$`)
+)
+
+// extractMarkdown strips Markdown syntax, taking the title from front matter or the first heading
+func extractMarkdown(source string) ExtractedDocument {
+	var doc ExtractedDocument
+	source = strings.ReplaceAll(source, "\r\n", "\n")
+
+	// YAML front matter may carry title and lang
+	if strings.HasPrefix(source, "---\n") {
+		if end := strings.Index(source[4:], "\n---"); end >= 0 {
+			for _, line := range strings.Split(source[4:4+end], "\n") {
+				key, value, found := strings.Cut(line, ":")
+				if !found {
+					continue
+				}
+				value = strings.Trim(strings.TrimSpace(value), `"'`)
+				switch strings.TrimSpace(strings.ToLower(key)) {
+				case "title":
+					doc.Title = value
+				case "lang", "language":
+					doc.Language = normalizeLanguage(value)
+				}
+			}
+			source = source[4+end+4:]
+		}
+	}
+
+	lines := strings.Split(source, "\n")
+	var out []string
+	inFence := false
+
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			out = append(out, line)
+			continue
+		}
+
+		if markdownRule.MatchString(line) || markdownRefDef.MatchString(line) || markdownTableRule.MatchString(line) {
+			continue
+		}
+
+		// Setext heading: "Title" followed by "====="
+		if i+1 < len(lines) && trimmed != "" && markdownSetext.MatchString(lines[i+1]) {
+			if doc.Title == "" && strings.HasPrefix(strings.TrimSpace(lines[i+1]), "=") {
+				doc.Title = cleanMarkdownInline(trimmed)
+			}
+			out = append(out, cleanMarkdownInline(trimmed))
+			continue
+		}
+		if markdownSetext.MatchString(line) && i > 0 && strings.TrimSpace(lines[i-1]) != "" {
+			continue
+		}
+
+		if m := markdownHeading.FindStringSubmatch(line); m != nil {
+			heading := cleanMarkdownInline(m[1])
+			if doc.Title == "" && strings.HasPrefix(trimmed, "# ") {
+				doc.Title = heading
+			}
+			out = append(out, heading)
+			continue
+		}
+
+		line = markdownQuote.ReplaceAllString(line, "")
+		line = markdownListItem.ReplaceAllString(line, "")
+		line = strings.ReplaceAll(line, "|", " ")
+		out = append(out, cleanMarkdownInline(line))
+	}
+
+	if doc.Title == "" {
+		doc.Title = firstLineTitle(out)
+	}
+	doc.Text = collapseWhitespace(strings.Join(out, "\n"))
+	return doc
+}
+
+// cleanMarkdownInline removes inline Markdown markup, keeping link and image text
+func cleanMarkdownInline(s string) string {
+	s = markdownImage.ReplaceAllString(s, "$1")
+	s = markdownLink.ReplaceAllString(s, "$1")
+	s = markdownHTMLTag.ReplaceAllString(s, "")
+	s = markdownEmphasis.ReplaceAllString(s, "")
+	return strings.TrimSpace(s)
+}
+
+// extractPDF pulls text from uncompressed and Flate-compressed content streams
+// Fonts with custom encodings (CMaps) are not decoded, so some PDFs yield little text
+func extractPDF(data []byte) (ExtractedDocument, error) {
+	var doc ExtractedDocument
+
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return doc, errInvalidPDF
+	}
+
+	var pages []string
+	for _, stream := range pdfStreams(data) {
+		if text := pdfContentText(stream); strings.TrimSpace(text) != "" {
+			pages = append(pages, text)
+		}
+	}
+
+	lines := removeBoilerplateLines(splitPageLines(pages))
+	doc.Title = pdfInfoTitle(data)
+	if doc.Title == "" {
+		doc.Title = firstLineTitle(lines)
+	}
+	doc.Text = collapseWhitespace(strings.Join(lines, "\n"))
+	return doc, nil
+}
+
+var pdfStreamPattern = regexp.MustCompile(`(?s)<<(.*?)>>\s*stream\r?\n`)
+
+// pdfStreams returns decoded stream bodies, skipping images, fonts and other binary data
+func pdfStreams(data []byte) [][]byte {
+	var streams [][]byte
+
+	for _, loc := range pdfStreamPattern.FindAllSubmatchIndex(data, -1) {
+		dict := data[loc[2]:loc[3]]
+		start := loc[1]
+		end := bytes.Index(data[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		raw := bytes.TrimRight(data[start:start+end], "\r\n")
+
+		if bytes.Contains(dict, []byte("/Image")) || bytes.Contains(dict, []byte("/Length1")) ||
+			bytes.Contains(dict, []byte("/FontFile")) || bytes.Contains(dict, []byte("/XRef")) ||
+			bytes.Contains(dict, []byte("/ObjStm")) {
+			continue
+		}
+
+		if bytes.Contains(dict, []byte("/Filter")) {
+			if !bytes.Contains(dict, []byte("/FlateDecode")) {
+				continue
+			}
+			reader, err := zlib.NewReader(bytes.NewReader(raw))
+			if err != nil {
+				continue
+			}
+			decoded, err := io.ReadAll(io.LimitReader(reader, maxCrawlBodyBytes))
+			reader.Close()
+			if err != nil && len(decoded) == 0 {
+				continue
+			}
+			raw = decoded
+		}
+
+		streams = append(streams, raw)
+	}
+
+	return streams
+}
+
+// pdfContentText interprets the text showing operators (Tj, TJ, ', ") of a content stream
+func pdfContentText(stream []byte) string {
+	var sb strings.Builder
+	var operands [][]byte
+	inArray := false
+	var arrayParts []string
+	inText := false
+
+	i := 0
+	for i < len(stream) {
+		c := stream[i]
+		switch {
+		case c == '%':
+			for i < len(stream) && stream[i] != '\n' && stream[i] != '\r' {
+				i++
+			}
+		case c == '(':
+			str, next := readPDFLiteral(stream, i)
+			if inArray {
+				arrayParts = append(arrayParts, decodePDFText(str))
+			} else {
+				operands = append(operands, str)
+			}
+			i = next
+			continue
+		case c == '<' && i+1 < len(stream) && stream[i+1] == '<':
+			i += 2
+			continue
+		case c == '>' && i+1 < len(stream) && stream[i+1] == '>':
+			i += 2
+			continue
+		case c == '<':
+			end := bytes.IndexByte(stream[i:], '>')
+			if end < 0 {
+				return sb.String()
+			}
+			str := decodePDFHex(stream[i+1 : i+end])
+			if inArray {
+				arrayParts = append(arrayParts, decodePDFText(str))
+			} else {
+				operands = append(operands, str)
+			}
+			i += end + 1
+			continue
+		case c == '[':
+			inArray = true
+			arrayParts = arrayParts[:0]
+		case c == ']':
+			inArray = false
+		case isPDFNumberStart(c):
+			start := i
+			for i < len(stream) && isPDFNumberStart(stream[i]) {
+				i++
+			}
+			// Large negative kerning inside TJ arrays usually separates words
+			if inArray {
+				if n, err := strconv.ParseFloat(string(stream[start:i]), 64); err == nil && n < -200 {
+					arrayParts = append(arrayParts, " ")
+				}
+			}
+			continue
+		case isPDFRegular(c):
+			start := i
+			for i < len(stream) && isPDFRegular(stream[i]) {
+				i++
+			}
+			op := string(stream[start:i])
+			switch op {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+				sb.WriteString("\n")
+			case "Tj":
+				if inText && len(operands) > 0 {
+					sb.WriteString(decodePDFText(operands[len(operands)-1]))
+				}
+			case "'", "\"":
+				if inText && len(operands) > 0 {
+					sb.WriteString("\n")
+					sb.WriteString(decodePDFText(operands[len(operands)-1]))
+				}
+			case "TJ":
+				if inText {
+					sb.WriteString(strings.Join(arrayParts, ""))
+				}
+				arrayParts = arrayParts[:0]
+			case "Td", "TD", "T*", "Tm":
+				if inText {
+					sb.WriteString("\n")
+				}
+			}
+			operands = operands[:0]
+			continue
+		}
+		i++
+	}
+
+	return sb.String()
+}
+
+// readPDFLiteral reads a (balanced) literal string starting at stream[start] == '('
+func readPDFLiteral(stream []byte, start int) ([]byte, int) {
+	var out []byte
+	depth := 0
+	i := start
+	for i < len(stream) {
+		c := stream[i]
+		switch c {
+		case '(':
+			if depth > 0 {
+				out = append(out, c)
+			}
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return out, i + 1
+			}
+			out = append(out, c)
+		case '\\':
+			i++
+			if i >= len(stream) {
+				return out, i
+			}
+			switch e := stream[i]; e {
+			case 'n':
+				out = append(out, '\n')
+			case 'r':
+				out = append(out, '\r')
+			case 't':
+				out = append(out, '\t')
+			case 'b', 'f':
+				// Backspace and form feed carry no text
+			case '\r', '\n':
+				// Line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					value := 0
+					n := 0
+					for n < 3 && i < len(stream) && stream[i] >= '0' && stream[i] <= '7' {
+						value = value*8 + int(stream[i]-'0')
+						i++
+						n++
+					}
+					out = append(out, byte(value))
+					continue
+				}
+				out = append(out, e)
+			}
+		default:
+			out = append(out, c)
+		}
+		i++
+	}
+	return out, i
+}
+
+// decodePDFHex decodes a <hex> string, padding an odd final digit with 0
+func decodePDFHex(hex []byte) []byte {
+	var digits []byte
+	for _, c := range hex {
+		if unicode.Is(unicode.ASCII_Hex_Digit, rune(c)) {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+
+	out := make([]byte, 0, len(digits)/2)
+	for i := 0; i < len(digits); i += 2 {
+		v, _ := strconv.ParseUint(string(digits[i:i+2]), 16, 8)
+		out = append(out, byte(v))
+	}
+	return out
+}
+
+// decodePDFText converts UTF-16BE (with BOM) or single-byte PDF strings to UTF-8
+func decodePDFText(b []byte) string {
+	if len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff {
+		units := make([]uint16, 0, len(b)/2)
+		for i := 2; i+1 < len(b); i += 2 {
+			units = append(units, uint16(b[i])<<8|uint16(b[i+1]))
+		}
+		return string(utf16.Decode(units))
+	}
+
+	// PDFDocEncoding matches Latin-1 for printable characters
+	runes := make([]rune, 0, len(b))
+	for _, c := range b {
+		if c >= 0x20 || c == '\n' || c == '\t' {
+			runes = append(runes, rune(c))
+		}
+	}
+	return string(runes)
+}
+
+var (
+	pdfTitleLiteral = regexp.MustCompile(`/Title\s*\(`)
+	pdfTitleHex     = regexp.MustCompile(`/Title\s*<([0-9A-Fa-f\s]+)>`)
+)
+
+// pdfInfoTitle reads /Title from the document information dictionary
+func pdfInfoTitle(data []byte) string {
+	if loc := pdfTitleLiteral.FindIndex(data); loc != nil {
+		str, _ := readPDFLiteral(data, loc[1]-1)
+		return collapseWhitespace(decodePDFText(str))
+	}
+	if m := pdfTitleHex.FindSubmatch(data); m != nil {
+		return collapseWhitespace(decodePDFText(decodePDFHex(m[1])))
+	}
+	return ""
+}
+
+func isPDFNumberStart(c byte) bool {
+	return (c >= '0' && c <= '9') || c == '-' || c == '+' || c == '.'
+}
+
+func isPDFRegular(c byte) bool {
+	switch c {
+	case ' ', '\t', '\r', '\n', '\f', 0, '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return false
+	}
+	return !isPDFNumberStart(c)
+}
+
+var pageNumberLine = regexp.MustCompile(`(?i)^(page\s+)?\d+(\s*(of|/)\s*\d+)?$`)
+
+// splitPageLines splits each page into trimmed, non-empty lines
+func splitPageLines(pages []string) [][]string {
+	result := make([][]string, 0, len(pages))
+	for _, page := range pages {
+		var lines []string
+		for _, line := range strings.Split(page, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		result = append(result, lines)
+	}
+	return result
+}
+
+// removeBoilerplateLines drops page numbers and running headers/footers that repeat on most pages
+func removeBoilerplateLines(pages [][]string) []string {
+	pageCount := make(map[string]int)
+	for _, lines := range pages {
+		seen := make(map[string]bool)
+		for _, line := range lines {
+			if !seen[line] {
+				seen[line] = true
+				pageCount[line]++
+			}
+		}
+	}
+
+	var out []string
+	for _, lines := range pages {
+		for _, line := range lines {
+			if pageNumberLine.MatchString(line) {
+				continue
+			}
+			if len(pages) >= 3 && pageCount[line]*2 > len(pages) {
+				continue
+			}
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+// firstLineTitle derives a title from the first non-empty line
+func firstLineTitle(lines []string) string {
+	for _, line := range lines {
+		if line = collapseWhitespace(line); line != "" {
+			return truncateRunes(line, maxDerivedTitleLength)
+		}
+	}
+	return ""
+}
+
+// maxDocumentLength returns the characters of extracted text stored per uploaded document
+func maxDocumentLength() int {
+	return envInt("DOCUMENT_MAX_CONTENT_LENGTH", defaultMaxDocumentLength)
+}
+
+// uploadDocument accepts a multipart file upload, extracts its text and stores it as a page
+// Authenticated like batch-pages since it writes straight into the index
+func uploadDocument(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, ok := readCrawlerRequest(w, r)
+	if !ok {
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	if err := r.ParseMultipartForm(maxBatchBodyBytes); err != nil {
+		http.Error(w, "Invalid multipart request", http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "File is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	pageURL, err := url.Parse(r.FormValue("url"))
+	if err != nil || (pageURL.Scheme != "http" && pageURL.Scheme != "https") || pageURL.Host == "" {
+		http.Error(w, "A valid http(s) url is required", http.StatusBadRequest)
+		return
+	}
+
+	contentType := detectDocumentType(header.Filename, header.Header.Get("Content-Type"), data)
+	doc, err := extractDocument(data, contentType, pageURL)
+	if err != nil {
+		log.Printf("Document extraction failed: file=%s content_type=%s error=%v", header.Filename, contentType, err)
+		http.Error(w, "Unsupported or unreadable document", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if title := strings.TrimSpace(r.FormValue("title")); title != "" {
+		doc.Title = title
+	}
+	language := r.FormValue("language")
+	if language == "" {
+		language = doc.Language
+	}
+	if language != "da" {
+		language = "en"
+	}
+
+	if doc.Title == "" || doc.Text == "" {
+		http.Error(w, "No text could be extracted from the document", http.StatusUnprocessableEntity)
+		return
+	}
+
+	page := Page{
+		Title:       doc.Title,
+		URL:         pageURL.String(),
+		Language:    language,
+		Content:     truncateRunes(doc.Text, maxDocumentLength()),
+		ContentType: contentType,
+	}
+	if err := upsertPage(page); err != nil {
+		log.Printf("Error inserting page '%s': %v", page.Title, err)
+		http.Error(w, "Failed to store document", http.StatusInternalServerError)
+		return
+	}
+	pagesIndexed.Inc()
+
+	chars := len([]rune(doc.Text))
+	truncated := chars > maxDocumentLength()
+	log.Printf("Document uploaded: title=%s content_type=%s chars=%d truncated=%t", page.Title, contentType, chars, truncated)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":      true,
+		"title":        page.Title,
+		"url":          page.URL,
+		"content_type": contentType,
+		"truncated":    truncated,
+	})
+}
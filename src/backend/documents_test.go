@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// buildTestPDF writes a minimal PDF with one Flate-compressed content stream per page
+func buildTestPDF(title string, pages [][]string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+
+	for i, lines := range pages {
+		var content bytes.Buffer
+		content.WriteString("BT /F1 12 Tf 72 720 Td\n")
+		for _, line := range lines {
+			fmt.Fprintf(&content, "(%s) Tj 0 -14 Td\n", line)
+		}
+		content.WriteString("ET\n")
+
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		zw.Write(content.Bytes())
+		zw.Close()
+
+		fmt.Fprintf(&buf, "%d 0 obj\n<< /Length %d /Filter /FlateDecode >>\nstream\n", i+1, compressed.Len())
+		buf.Write(compressed.Bytes())
+		buf.WriteString("\nendstream\nendobj\n")
+	}
+
+	fmt.Fprintf(&buf, "%d 0 obj\n<< /Title (%s) >>\nendobj\n%%%%EOF\n", len(pages)+1, title)
+	return buf.Bytes()
+}
+
+// TestExtractPDF verifies text, info title and header/footer removal
+func TestExtractPDF(t *testing.T) {
+	pdf := buildTestPDF("Annual \\(2024\\) Report", [][]string{
+		{"ACME Corp Confidential", "Revenue grew strongly.", "1"},
+		{"ACME Corp Confidential", "Costs were flat.", "2"},
+		{"ACME Corp Confidential", "Outlook is positive.", "Page 3 of 3"},
+	})
+
+	doc, err := extractPDF(pdf)
+	if err != nil {
+		t.Fatalf("extractPDF() returned error: %v", err)
+	}
+
+	if doc.Title != "Annual (2024) Report" {
+		t.Errorf("Title = %q", doc.Title)
+	}
+	if doc.Text != "Revenue grew strongly. Costs were flat. Outlook is positive." {
+		t.Errorf("Text = %q", doc.Text)
+	}
+}
+
+// TestExtractPDF_RejectsNonPDF verifies the header check
+func TestExtractPDF_RejectsNonPDF(t *testing.T) {
+	if _, err := extractPDF([]byte("hello")); err != errInvalidPDF {
+		t.Errorf("extractPDF() error = %v, want %v", err, errInvalidPDF)
+	}
+}
+
+// TestPDFContentText verifies TJ arrays, hex strings and escapes
+func TestPDFContentText(t *testing.T) {
+	stream := []byte(`BT [(Hel) 20 (lo) -300 (World)] TJ T* <4869> Tj (\(esc\)\101) ' ET`)
+	got := collapseWhitespace(pdfContentText(stream))
+	if got != "Hello World Hi (esc)A" {
+		t.Errorf("pdfContentText() = %q", got)
+	}
+}
+
+// TestExtractMarkdown verifies syntax stripping and title detection
+func TestExtractMarkdown(t *testing.T) {
+	source := "---\ntitle: \"Front Matter Title\"\nlang: da\n---\n" +
+		"# Heading One\n\nSome **bold** and _plain_ text with a [link](https://example.com).\n\n" +
+		"- item one\n- item `two`\n\n> quoted\n\n```go\nfmt.Println()\n```\n\n---\n![logo](logo.png)\n"
+
+	doc := extractMarkdown(source)
+
+	if doc.Title != "Front Matter Title" {
+		t.Errorf("Title = %q", doc.Title)
+	}
+	if doc.Language != "da" {
+		t.Errorf("Language = %q, want da", doc.Language)
+	}
+	want := "Heading One Some bold and _plain_ text with a link. item one item two quoted fmt.Println() logo"
+	if doc.Text != want {
+		t.Errorf("Text = %q, want %q", doc.Text, want)
+	}
+
+	setext := extractMarkdown("Setext Title\n============\n\nBody text.\n")
+	if setext.Title != "Setext Title" || setext.Text != "Setext Title Body text." {
+		t.Errorf("setext doc = %+v", setext)
+	}
+}
+
+// TestExtractPlainText verifies first-line title and form feed page handling
+func TestExtractPlainText(t *testing.T) {
+	doc := extractPlainText("\n  Release Notes  \nFixed bugs.\n")
+	if doc.Title != "Release Notes" || doc.Text != "Release Notes Fixed bugs." {
+		t.Errorf("doc = %+v", doc)
+	}
+}
+
+// TestDetectDocumentType verifies extension, declared type and sniffing fallbacks
+func TestDetectDocumentType(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		declared string
+		data     string
+		want     string
+	}{
+		{"pdf extension", "report.PDF", "", "", contentTypePDF},
+		{"markdown extension", "README.md", "application/octet-stream", "", contentTypeMarkdown},
+		{"declared markdown", "notes", "text/x-markdown", "", contentTypeMarkdown},
+		{"sniffed pdf", "upload", "", "%PDF-1.7 ...", contentTypePDF},
+		{"sniffed html", "upload", "", "<!DOCTYPE html><html></html>", contentTypeHTML},
+		{"sniffed text", "upload", "", "just words", contentTypeText},
+		{"unsupported", "image.png", "", "\x89PNG\r\n\x1a\n", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectDocumentType(tt.filename, tt.declared, []byte(tt.data)); got != tt.want {
+				t.Errorf("detectDocumentType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestPageFormatLabel verifies the label shown next to non-HTML results
+func TestPageFormatLabel(t *testing.T) {
+	if got := (Page{ContentType: contentTypePDF}).FormatLabel(); got != "PDF" {
+		t.Errorf("FormatLabel() = %q, want PDF", got)
+	}
+	if got := (Page{ContentType: contentTypeHTML}).FormatLabel(); got != "" {
+		t.Errorf("FormatLabel() = %q, want empty for HTML", got)
+	}
+}
+
+// TestUploadDocument_StoresFullText verifies long documents are stored whole, up to the configurable document limit
+func TestUploadDocument_StoresFullText(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	defer testDB.Exec("DELETE FROM pages WHERE title LIKE 'testuser_document%'")
+	t.Setenv("CRAWLER_API_KEY", "test-api-key")
+	t.Setenv("CRAWLER_SIGNING_SECRET", "")
+
+	upload := func(name, text string) map[string]interface{} {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", name+".txt")
+		part.Write([]byte(name + "\n" + text))
+		form.WriteField("url", "https://example.com/"+name)
+		form.Close()
+
+		req := httptest.NewRequest("POST", "/api/documents", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("X-API-Key", "test-api-key")
+		w := httptest.NewRecorder()
+		uploadDocument(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("uploadDocument(%s) = %d: %s", name, w.Code, w.Body.String())
+		}
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response
+	}
+	storedLength := func(title string) int {
+		var length int
+		testDB.QueryRow("SELECT length(content) FROM pages WHERE title = $1", title).Scan(&length)
+		return length
+	}
+
+	text := strings.Repeat("report words ", 5000)
+	if response := upload("testuser_document_full", text); response["truncated"] != false {
+		t.Errorf("response = %v, want truncated false", response)
+	}
+	if got := storedLength("testuser_document_full"); got < len(strings.TrimSpace(text)) {
+		t.Errorf("stored %d characters, want the whole %d character document", got, len(text))
+	}
+
+	t.Setenv("DOCUMENT_MAX_CONTENT_LENGTH", "1000")
+	if response := upload("testuser_document_capped", text); response["truncated"] != true {
+		t.Errorf("response = %v, want truncated true", response)
+	}
+	if got := storedLength("testuser_document_capped"); got != 1000 {
+		t.Errorf("stored %d characters, want 1000", got)
+	}
+}
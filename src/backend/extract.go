@@ -0,0 +1,228 @@
+package main
+
+import (
+	"io"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTMLDocument holds the parts of an HTML page we index
+type HTMLDocument struct {
+	Title    string
+	Language string
+	Text     string
+	Links    []string
+	NoIndex  bool
+	NoFollow bool
+}
+
+// Elements whose text is boilerplate rather than page content
+var skippedElements = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Noscript: true,
+	atom.Nav:      true,
+	atom.Header:   true,
+	atom.Footer:   true,
+	atom.Aside:    true,
+	atom.Form:     true,
+	atom.Template: true,
+	atom.Svg:      true,
+}
+
+// Elements that end a run of text so words don't get glued together
+var blockElements = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.Br: true, atom.Li: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Td: true, atom.Th: true, atom.Tr: true, atom.Section: true, atom.Article: true,
+	atom.Blockquote: true, atom.Pre: true, atom.Dd: true, atom.Dt: true,
+}
+
+// extractHTML parses an HTML document, resolving links against base
+func extractHTML(r io.Reader, base *url.URL) (HTMLDocument, error) {
+	var doc HTMLDocument
+
+	root, err := html.Parse(r)
+	if err != nil {
+		return doc, err
+	}
+
+	var h1 string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.DataAtom {
+			case atom.Html:
+				doc.Language = normalizeLanguage(getAttr(n, "lang"))
+			case atom.Title:
+				if doc.Title == "" {
+					doc.Title = collapseWhitespace(nodeText(n))
+				}
+			case atom.H1:
+				if h1 == "" {
+					h1 = collapseWhitespace(nodeText(n))
+				}
+			case atom.Meta:
+				if strings.EqualFold(getAttr(n, "name"), "robots") {
+					content := strings.ToLower(getAttr(n, "content"))
+					doc.NoIndex = doc.NoIndex || strings.Contains(content, "noindex") || strings.Contains(content, "none")
+					doc.NoFollow = doc.NoFollow || strings.Contains(content, "nofollow") || strings.Contains(content, "none")
+				}
+			case atom.A:
+				if link := resolveLink(base, getAttr(n, "href")); link != "" && !strings.Contains(getAttr(n, "rel"), "nofollow") {
+					doc.Links = append(doc.Links, link)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(root)
+
+	// Prefer <main>/<article> content, falling back to the whole body
+	content := findElement(root, atom.Main)
+	if content == nil {
+		content = findElement(root, atom.Article)
+	}
+	if content == nil {
+		content = findElement(root, atom.Body)
+	}
+	if content != nil {
+		doc.Text = collapseWhitespace(visibleText(content))
+	}
+
+	if doc.Title == "" {
+		doc.Title = h1
+	}
+	doc.Links = dedupeStrings(doc.Links)
+
+	return doc, nil
+}
+
+// normalizeLanguage maps an HTML lang attribute to a supported pages.language value
+func normalizeLanguage(lang string) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if lang == "da" || strings.HasPrefix(lang, "da-") {
+		return "da"
+	}
+	return "en"
+}
+
+// resolveLink turns an href into an absolute http(s) URL without fragment
+func resolveLink(base *url.URL, href string) string {
+	href = strings.TrimSpace(href)
+	if href == "" || strings.HasPrefix(href, "#") {
+		return ""
+	}
+
+	ref, err := url.Parse(href)
+	if err != nil {
+		return ""
+	}
+
+	resolved := ref
+	if base != nil {
+		resolved = base.ResolveReference(ref)
+	}
+	if resolved.Scheme != "http" && resolved.Scheme != "https" {
+		return ""
+	}
+	resolved.Fragment = ""
+	return resolved.String()
+}
+
+// getAttr returns the value of an attribute or "" when missing
+func getAttr(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if strings.EqualFold(attr.Key, key) {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// hasAttr reports whether an attribute is present, even when empty
+func hasAttr(n *html.Node, key string) bool {
+	for _, attr := range n.Attr {
+		if strings.EqualFold(attr.Key, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// findElement returns the first element of the given type in document order
+func findElement(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findElement(c, a); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// nodeText concatenates all text below n
+func nodeText(n *html.Node) string {
+	var sb strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return sb.String()
+}
+
+// visibleText concatenates text below n, skipping boilerplate elements
+func visibleText(n *html.Node) string {
+	var sb strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch n.Type {
+		case html.TextNode:
+			sb.WriteString(n.Data)
+			return
+		case html.ElementNode:
+			if skippedElements[n.DataAtom] || hasAttr(n, "hidden") || strings.EqualFold(getAttr(n, "aria-hidden"), "true") {
+				return
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+		if n.Type == html.ElementNode && blockElements[n.DataAtom] {
+			sb.WriteString("\n")
+		}
+	}
+	walk(n)
+	return sb.String()
+}
+
+// collapseWhitespace replaces runs of whitespace with a single space
+func collapseWhitespace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// dedupeStrings removes duplicates while keeping first-seen order
+func dedupeStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	result := values[:0]
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html/charset"
+)
+
+// Limits follow the sitemaps.org protocol (50 MB uncompressed, 50 000 URLs per file)
+const (
+	maxFeedBytes         = 50 << 20
+	maxSitemapURLs       = 50000
+	maxSitemapsPerIngest = 50
+	maxSitemapDepth      = 2
+)
+
+// Ingest modes: seed queues URLs for the crawler, pages stores feed entries directly
+const (
+	feedModeSeed  = "seed"
+	feedModePages = "pages"
+)
+
+var errUnknownFeedFormat = errors.New("unrecognised feed format")
+
+// FeedDocument is the parsed content of a sitemap, sitemap index, RSS or Atom file
+type FeedDocument struct {
+	Kind     string // "sitemap", "sitemapindex", "rss" or "atom"
+	URLs     []string
+	Sitemaps []string
+	Entries  []FeedEntry
+}
+
+// FeedEntry is a single RSS item or Atom entry
+type FeedEntry struct {
+	Title    string
+	URL      string
+	Content  string
+	Language string
+}
+
+// FeedIngestResult summarises what an ingest run did
+type FeedIngestResult struct {
+	Sitemaps int `json:"sitemaps"`
+	Seeded   int `json:"seeded"`
+	Stored   int `json:"stored"`
+	Skipped  int `json:"skipped"`
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+type sitemapURLSet struct {
+	URLs []sitemapLoc `xml:"url"`
+}
+
+type sitemapIndexDocument struct {
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type rssDocument struct {
+	Channel struct {
+		Language string `xml:"language"`
+		Items    []struct {
+			Title          string `xml:"title"`
+			Link           string `xml:"link"`
+			GUID           string `xml:"guid"`
+			Description    string `xml:"description"`
+			ContentEncoded string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",innerxml"`
+}
+
+type atomFeed struct {
+	Lang    string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+	Entries []struct {
+		Lang  string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+		Title string `xml:"title"`
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+		Summary atomText `xml:"summary"`
+		Content atomText `xml:"content"`
+	} `xml:"entry"`
+}
+
+// parseFeed detects the document type from its root element and parses it
+func parseFeed(data []byte) (FeedDocument, error) {
+	var doc FeedDocument
+
+	root, err := rootElementName(data)
+	if err != nil {
+		return doc, err
+	}
+
+	switch root {
+	case "urlset":
+		var set sitemapURLSet
+		if err := unmarshalFeedXML(data, &set); err != nil {
+			return doc, err
+		}
+		doc.Kind = "sitemap"
+		for _, u := range set.URLs {
+			if loc := strings.TrimSpace(u.Loc); loc != "" && len(doc.URLs) < maxSitemapURLs {
+				doc.URLs = append(doc.URLs, loc)
+			}
+		}
+
+	case "sitemapindex":
+		var index sitemapIndexDocument
+		if err := unmarshalFeedXML(data, &index); err != nil {
+			return doc, err
+		}
+		doc.Kind = "sitemapindex"
+		for _, s := range index.Sitemaps {
+			if loc := strings.TrimSpace(s.Loc); loc != "" {
+				doc.Sitemaps = append(doc.Sitemaps, loc)
+			}
+		}
+
+	case "rss":
+		var rss rssDocument
+		if err := unmarshalFeedXML(data, &rss); err != nil {
+			return doc, err
+		}
+		doc.Kind = "rss"
+		language := normalizeLanguage(rss.Channel.Language)
+		for _, item := range rss.Channel.Items {
+			link := strings.TrimSpace(item.Link)
+			if link == "" && strings.HasPrefix(item.GUID, "http") {
+				link = strings.TrimSpace(item.GUID)
+			}
+			content := item.ContentEncoded
+			if content == "" {
+				content = item.Description
+			}
+			doc.Entries = append(doc.Entries, FeedEntry{
+				Title:    collapseWhitespace(item.Title),
+				URL:      link,
+				Content:  htmlToText(content),
+				Language: language,
+			})
+		}
+
+	case "feed":
+		var feed atomFeed
+		if err := unmarshalFeedXML(data, &feed); err != nil {
+			return doc, err
+		}
+		doc.Kind = "atom"
+		for _, entry := range feed.Entries {
+			var link string
+			for _, l := range entry.Links {
+				if l.Rel == "" || l.Rel == "alternate" {
+					link = strings.TrimSpace(l.Href)
+					break
+				}
+			}
+			lang := entry.Lang
+			if lang == "" {
+				lang = feed.Lang
+			}
+			content := atomTextContent(entry.Content)
+			if content == "" {
+				content = atomTextContent(entry.Summary)
+			}
+			doc.Entries = append(doc.Entries, FeedEntry{
+				Title:    collapseWhitespace(entry.Title),
+				URL:      link,
+				Content:  content,
+				Language: normalizeLanguage(lang),
+			})
+		}
+
+	default:
+		return doc, errUnknownFeedFormat
+	}
+
+	return doc, nil
+}
+
+// rootElementName returns the local name of the first XML element
+func rootElementName(data []byte) (string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.CharsetReader = charset.NewReaderLabel
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if err == io.EOF {
+				return "", errUnknownFeedFormat
+			}
+			return "", err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local, nil
+		}
+	}
+}
+
+// unmarshalFeedXML decodes XML, accepting non UTF-8 encodings declared in the prolog
+func unmarshalFeedXML(data []byte, v any) error {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.CharsetReader = charset.NewReaderLabel
+	return decoder.Decode(v)
+}
+
+// atomTextContent returns plain text for an Atom text construct
+func atomTextContent(t atomText) string {
+	body := t.Body
+	if t.Type != "xhtml" {
+		// Plain and escaped HTML content arrive entity-encoded inside the element
+		var unescaped string
+		if err := xml.Unmarshal([]byte("<x>"+body+"</x>"), &unescaped); err == nil {
+			body = unescaped
+		}
+	}
+	return htmlToText(body)
+}
+
+// htmlToText strips markup from an HTML fragment
+func htmlToText(fragment string) string {
+	if !strings.Contains(fragment, "<") {
+		return collapseWhitespace(fragment)
+	}
+	doc, err := extractHTML(strings.NewReader("<body>"+fragment+"</body>"), nil)
+	if err != nil {
+		return collapseWhitespace(fragment)
+	}
+	return doc.Text
+}
+
+// fetchFeed downloads a feed or sitemap, transparently decompressing gzip
+func fetchFeed(ctx context.Context, client *http.Client, feedURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", defaultCrawlUserAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFeedBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	return maybeGunzip(data)
+}
+
+// maybeGunzip decompresses data that starts with the gzip magic bytes (e.g. sitemap.xml.gz)
+func maybeGunzip(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		return data, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(io.LimitReader(reader, maxFeedBytes))
+}
+
+// ingestFeed fetches a sitemap or feed, following sitemap indexes, and seeds or stores what it finds
+func ingestFeed(ctx context.Context, client *http.Client, feedURL, mode string) (FeedIngestResult, error) {
+	var result FeedIngestResult
+
+	if mode != feedModeSeed && mode != feedModePages {
+		return result, fmt.Errorf("unknown mode %q", mode)
+	}
+
+	type pending struct {
+		url   string
+		depth int
+	}
+	queue := []pending{{url: feedURL, depth: 0}}
+	seen := map[string]bool{feedURL: true}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		data, err := fetchFeed(ctx, client, current.url)
+		if err != nil {
+			// Only the requested URL is fatal, broken child sitemaps are skipped
+			if current.depth == 0 {
+				return result, err
+			}
+			log.Printf("Feed fetch failed: url=%s error=%v", current.url, err)
+			result.Skipped++
+			continue
+		}
+
+		doc, err := parseFeed(data)
+		if err != nil {
+			if current.depth == 0 {
+				return result, err
+			}
+			log.Printf("Feed parse failed: url=%s error=%v", current.url, err)
+			result.Skipped++
+			continue
+		}
+
+		switch doc.Kind {
+		case "sitemapindex":
+			for _, child := range doc.Sitemaps {
+				if seen[child] || current.depth >= maxSitemapDepth || len(seen) >= maxSitemapsPerIngest {
+					result.Skipped++
+					continue
+				}
+				seen[child] = true
+				queue = append(queue, pending{url: child, depth: current.depth + 1})
+			}
+
+		case "sitemap":
+			result.Sitemaps++
+			seeded, err := enqueueURLs(normalizeSeeds(doc.URLs), 0)
+			if err != nil {
+				return result, err
+			}
+			result.Seeded += seeded
+
+		case "rss", "atom":
+			if err := ingestFeedEntries(doc.Entries, mode, &result); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// ingestFeedEntries stores entries as pages or queues their links for crawling
+func ingestFeedEntries(entries []FeedEntry, mode string, result *FeedIngestResult) error {
+	if mode == feedModeSeed {
+		links := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			links = append(links, entry.URL)
+		}
+		seeded, err := enqueueURLs(normalizeSeeds(links), 0)
+		result.Seeded += seeded
+		return err
+	}
+
+	stored := 0
+	for _, entry := range entries {
+		if entry.Title == "" || entry.URL == "" || entry.Content == "" {
+			result.Skipped++
+			continue
+		}
+		page := Page{
+			Title:    entry.Title,
+			URL:      entry.URL,
+			Language: entry.Language,
+			Content:  truncateRunes(entry.Content, maxContentLength()),
+		}
+		if err := upsertPage(page); err != nil {
+			log.Printf("Error inserting page '%s': %v", page.Title, err)
+			result.Skipped++
+			continue
+		}
+		stored++
+	}
+	// result accumulates over every feed in an ingest, only count what this call stored
+	result.Stored += stored
+	pagesIndexed.Add(float64(stored))
+	return nil
+}
+
+// ingestFeedHandler lets the crawler/admin trigger an ingest over HTTP with the crawler API key
+func ingestFeedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, ok := readCrawlerRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		URL  string `json:"url"`
+		Mode string `json:"mode"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || normalizeCrawlURL(req.URL) == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = feedModeSeed
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+
+	result, err := ingestFeed(ctx, &http.Client{Timeout: 30 * time.Second}, req.URL, req.Mode)
+	if err != nil {
+		log.Printf("Feed ingest failed: url=%s mode=%s error=%v", req.URL, req.Mode, err)
+		http.Error(w, "Feed ingest failed", http.StatusBadGateway)
+		return
+	}
+
+	log.Printf("Feed ingest: url=%s mode=%s sitemaps=%d seeded=%d stored=%d skipped=%d",
+		req.URL, req.Mode, result.Sitemaps, result.Seeded, result.Stored, result.Skipped)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// runIngestFeedCommand implements the "ingest-feed" CLI subcommand
+func runIngestFeedCommand(args []string) {
+	flags := flag.NewFlagSet("ingest-feed", flag.ExitOnError)
+	feedURL := flags.String("url", "", "sitemap, sitemap index, RSS or Atom URL")
+	mode := flags.String("mode", feedModeSeed, "seed: queue URLs for the crawler, pages: store feed entries as pages")
+	flags.Parse(args)
+
+	if *feedURL == "" {
+		log.Fatal("-url is required")
+	}
+
+	openCommandDatabase()
+	defer db.Close()
+
+	result, err := ingestFeed(context.Background(), &http.Client{Timeout: 30 * time.Second}, *feedURL, *mode)
+	if err != nil {
+		log.Fatalf("Feed ingest failed: %v", err)
+	}
+
+	log.Printf("Feed ingest finished: sitemaps=%d seeded=%d stored=%d skipped=%d",
+		result.Sitemaps, result.Seeded, result.Stored, result.Skipped)
+}
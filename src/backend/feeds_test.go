@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestParseFeed verifies sitemap, sitemap index, RSS and Atom detection and parsing
+func TestParseFeed(t *testing.T) {
+	t.Run("sitemap", func(t *testing.T) {
+		doc, err := parseFeed([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc> https://example.com/a </loc></url>
+  <url><loc>https://example.com/b</loc></url>
+</urlset>`))
+		if err != nil {
+			t.Fatalf("parseFeed() returned error: %v", err)
+		}
+		if doc.Kind != "sitemap" || strings.Join(doc.URLs, ",") != "https://example.com/a,https://example.com/b" {
+			t.Errorf("got kind=%q urls=%v", doc.Kind, doc.URLs)
+		}
+	})
+
+	t.Run("sitemap index", func(t *testing.T) {
+		doc, err := parseFeed([]byte(`<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>https://example.com/sitemap1.xml.gz</loc></sitemap>
+</sitemapindex>`))
+		if err != nil {
+			t.Fatalf("parseFeed() returned error: %v", err)
+		}
+		if doc.Kind != "sitemapindex" || len(doc.Sitemaps) != 1 {
+			t.Errorf("got kind=%q sitemaps=%v", doc.Kind, doc.Sitemaps)
+		}
+	})
+
+	t.Run("rss", func(t *testing.T) {
+		doc, err := parseFeed([]byte(`<?xml version="1.0" encoding="ISO-8859-1"?>
+<rss version="2.0"><channel><language>da-dk</language>
+  <item><title>Nyhed</title><link>https://example.dk/nyhed</link>
+  <description><![CDATA[<p>Det er <b>nyt</b></p>]]></description></item>
+</channel></rss>`))
+		if err != nil {
+			t.Fatalf("parseFeed() returned error: %v", err)
+		}
+		if doc.Kind != "rss" || len(doc.Entries) != 1 {
+			t.Fatalf("got kind=%q entries=%d", doc.Kind, len(doc.Entries))
+		}
+		entry := doc.Entries[0]
+		if entry.Title != "Nyhed" || entry.URL != "https://example.dk/nyhed" || entry.Content != "Det er nyt" || entry.Language != "da" {
+			t.Errorf("entry = %+v", entry)
+		}
+	})
+
+	t.Run("atom", func(t *testing.T) {
+		doc, err := parseFeed([]byte(`<feed xmlns="http://www.w3.org/2005/Atom" xml:lang="en">
+  <entry>
+    <title>Release notes</title>
+    <link rel="self" href="https://example.com/self"/>
+    <link href="https://example.com/release"/>
+    <summary type="html">&lt;p&gt;Version &lt;em&gt;2&lt;/em&gt; is out&lt;/p&gt;</summary>
+  </entry>
+</feed>`))
+		if err != nil {
+			t.Fatalf("parseFeed() returned error: %v", err)
+		}
+		if doc.Kind != "atom" || len(doc.Entries) != 1 {
+			t.Fatalf("got kind=%q entries=%d", doc.Kind, len(doc.Entries))
+		}
+		entry := doc.Entries[0]
+		if entry.URL != "https://example.com/release" || entry.Content != "Version 2 is out" || entry.Language != "en" {
+			t.Errorf("entry = %+v", entry)
+		}
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		if _, err := parseFeed([]byte(`<html><body>nope</body></html>`)); err != errUnknownFeedFormat {
+			t.Errorf("parseFeed() error = %v, want %v", err, errUnknownFeedFormat)
+		}
+	})
+}
+
+// TestMaybeGunzip verifies gzip payloads are detected by magic bytes
+func TestMaybeGunzip(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("<urlset></urlset>"))
+	gz.Close()
+
+	got, err := maybeGunzip(buf.Bytes())
+	if err != nil {
+		t.Fatalf("maybeGunzip() returned error: %v", err)
+	}
+	if string(got) != "<urlset></urlset>" {
+		t.Errorf("maybeGunzip() = %q", got)
+	}
+
+	plain := []byte("<rss></rss>")
+	if got, _ := maybeGunzip(plain); !bytes.Equal(got, plain) {
+		t.Errorf("maybeGunzip() changed uncompressed input: %q", got)
+	}
+}
+
+// TestIngestFeed_Integration verifies a gzipped child sitemap is followed and seeded
+func TestIngestFeed_Integration(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	var site *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sitemap.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<sitemapindex><sitemap><loc>` + site.URL + `/pages.xml.gz</loc></sitemap></sitemapindex>`))
+	})
+	mux.HandleFunc("/pages.xml.gz", func(w http.ResponseWriter, r *http.Request) {
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(`<urlset><url><loc>` + site.URL + `/testuser-feed-page</loc></url></urlset>`))
+		gz.Close()
+	})
+	site = httptest.NewServer(mux)
+	defer site.Close()
+	defer testDB.Exec("DELETE FROM crawl_queue WHERE url LIKE $1", site.URL+"%")
+
+	result, err := ingestFeed(context.Background(), site.Client(), site.URL+"/sitemap.xml", feedModeSeed)
+	if err != nil {
+		t.Fatalf("ingestFeed() returned error: %v", err)
+	}
+	if result.Sitemaps != 1 || result.Seeded != 1 {
+		t.Errorf("result = %+v, want 1 sitemap and 1 seeded URL", result)
+	}
+}
+
+// TestIngestFeed_CountsIndexedPagesOnce verifies pages from several feeds in one ingest are counted once each
+func TestIngestFeed_CountsIndexedPagesOnce(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	defer testDB.Exec("DELETE FROM pages WHERE title LIKE 'testuser_feed_count%'")
+
+	var site *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sitemap.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<sitemapindex><sitemap><loc>` + site.URL + `/one.xml</loc></sitemap><sitemap><loc>` + site.URL + `/two.xml</loc></sitemap></sitemapindex>`))
+	})
+	for _, name := range []string{"one", "two"} {
+		name := name
+		mux.HandleFunc("/"+name+".xml", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`<rss version="2.0"><channel><language>en</language><item><title>testuser_feed_count_` + name +
+				`</title><link>` + site.URL + `/` + name + `</link><description>Feed entry ` + name + `</description></item></channel></rss>`))
+		})
+	}
+	site = httptest.NewServer(mux)
+	defer site.Close()
+
+	before := testutil.ToFloat64(pagesIndexed)
+	result, err := ingestFeed(context.Background(), site.Client(), site.URL+"/sitemap.xml", feedModePages)
+	if err != nil {
+		t.Fatalf("ingestFeed() returned error: %v", err)
+	}
+	if result.Stored != 2 {
+		t.Errorf("result = %+v, want 2 stored pages", result)
+	}
+	if delta := testutil.ToFloat64(pagesIndexed) - before; delta != 2 {
+		t.Errorf("pages indexed counter grew by %v, want 2", delta)
+	}
+}
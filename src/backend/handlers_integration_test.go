@@ -3,13 +3,13 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"html/template"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
 	"testing"
-	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -36,9 +36,13 @@ func setupTestDB(t *testing.T) (*sql.DB, func()) {
 	// Set the global db variable for handlers to use
 	db = testDB
 
+	// Parse templates for handlers that re-render forms on failure
+	templates = template.Must(template.ParseGlob("../templates/*.html"))
+
 	cleanup := func() {
 		// Clean up test data
 		testDB.Exec("DELETE FROM sessions WHERE username LIKE 'testuser%'")
+		testDB.Exec("DELETE FROM login_attempts WHERE key LIKE 'user:testuser%' OR key LIKE 'ip:192.0.2.%'")
 		testDB.Exec("DELETE FROM users WHERE username LIKE 'testuser%'")
 		testDB.Close()
 	}
@@ -121,11 +125,7 @@ func TestLogoutHandler_Integration(t *testing.T) {
 
 	// Create session
 	token := "test-session-token-12345"
-	expiresAt := time.Now().Add(24 * time.Hour)
-	_, err = testDB.Exec(`
-		INSERT INTO sessions (token, username, expires_at)
-		VALUES ($1, $2, $3)
-	`, token, "testuser_logout", expiresAt)
+	err = createSession("testuser_logout", token, "Go-http-client/1.1", "127.0.0.1")
 
 	if err != nil {
 		t.Fatalf("failed to create test session: %v", err)
@@ -148,7 +148,7 @@ func TestLogoutHandler_Integration(t *testing.T) {
 
 	// Verify session was deleted from database
 	var count int
-	err = testDB.QueryRow("SELECT COUNT(*) FROM sessions WHERE token = $1", token).Scan(&count)
+	err = testDB.QueryRow("SELECT COUNT(*) FROM sessions WHERE token_hash = $1", hashToken(token)).Scan(&count)
 	if err != nil {
 		t.Fatalf("failed to query sessions: %v", err)
 	}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// requestIDHeader carries the ID that ties a request's log lines together. An ID sent by a proxy or another
+// service is kept so the request can be followed across them, otherwise one is assigned; either way it's
+// echoed in the response so users can quote it
+const requestIDHeader = "X-Request-ID"
+
+// Request-scoped logger and ID set by requestIDMiddleware
+const (
+	loggerContextKey    contextKey = "logger"
+	requestIDContextKey contextKey = "request_id"
+)
+
+// Incoming IDs are only trusted when they look like IDs, anything else could forge log fields
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// newLoggerFromEnv builds the process logger from LOG_LEVEL (debug, info, warn, error; default info)
+// and LOG_FORMAT (json or text; default json)
+func newLoggerFromEnv() *slog.Logger {
+	return newLogger(os.Stderr, os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT"))
+}
+
+// newLogger returns a JSON logger, or a text logger when format is "text", writing records at level and above
+func newLogger(w io.Writer, level, format string) *slog.Logger {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		minLevel = slog.LevelInfo
+	}
+
+	options := &slog.HandlerOptions{Level: minLevel}
+	if strings.EqualFold(format, "text") {
+		return slog.New(slog.NewTextHandler(w, options))
+	}
+	return slog.New(slog.NewJSONHandler(w, options))
+}
+
+// newRequestID returns a random 128-bit hex ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestIDMiddleware assigns or propagates X-Request-ID and gives the request a logger carrying it
+// Wraps the whole mux, so every handler and middleware below can use requestLogger
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		logger := slog.Default().With("request_id", id, "method", r.Method, "path", r.URL.Path)
+		ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+		ctx = context.WithValue(ctx, loggerContextKey, logger)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestID returns the ID assigned by requestIDMiddleware, or "" outside of it
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// contextLogger returns the request-scoped logger stored in ctx, or the default logger
+func contextLogger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// requestLogger returns the logger for r, its lines carry the request ID, method and path
+func requestLogger(r *http.Request) *slog.Logger {
+	return contextLogger(r.Context())
+}
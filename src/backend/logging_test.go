@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// captureLogs swaps the default logger for a JSON logger writing to the returned buffer for the duration of a test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	original := slog.Default()
+	slog.SetDefault(newLogger(&buf, "debug", "json"))
+	t.Cleanup(func() { slog.SetDefault(original) })
+	return &buf
+}
+
+// logRecords decodes the JSON lines written by a captured logger
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("log line is not JSON: %q", line)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// TestNewLogger verifies the level filter and the json and text formats
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(&buf, "warn", "json")
+	logger.Info("hidden")
+	logger.Warn("shown", "key", "value")
+	if strings.Contains(buf.String(), "hidden") || !strings.Contains(buf.String(), `"key":"value"`) {
+		t.Errorf("warn level JSON logger wrote %q", buf.String())
+	}
+
+	buf.Reset()
+	logger = newLogger(&buf, "", "text")
+	logger.Debug("hidden")
+	logger.Info("shown", "key", "value")
+	if strings.Contains(buf.String(), "hidden") || !strings.Contains(buf.String(), "key=value") {
+		t.Errorf("default level text logger wrote %q", buf.String())
+	}
+
+	buf.Reset()
+	newLogger(&buf, "nonsense", "json").Info("shown")
+	if !strings.Contains(buf.String(), "shown") {
+		t.Errorf("an unknown level should fall back to info, got %q", buf.String())
+	}
+}
+
+// TestRequestIDMiddleware verifies IDs are assigned, propagated when valid and attached to the request logger
+func TestRequestIDMiddleware(t *testing.T) {
+	buf := captureLogs(t)
+	var seen string
+	handler := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestID(r)
+		requestLogger(r).Info("handled")
+	}))
+
+	tests := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{"assigned", "", false},
+		{"propagated", "edge-4f1c.7", true},
+		{"invalid replaced", "bad id\n{\"forged\":true}", false},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		req := httptest.NewRequest("GET", "/about", nil)
+		if tt.incoming != "" {
+			req.Header.Set(requestIDHeader, tt.incoming)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		id := w.Header().Get(requestIDHeader)
+		if id == "" || id != seen {
+			t.Errorf("%s: response ID %q, handler saw %q", tt.name, id, seen)
+		}
+		if (id == tt.incoming) != tt.keep {
+			t.Errorf("%s: response ID %q for incoming %q", tt.name, id, tt.incoming)
+		}
+		records := logRecords(t, buf)
+		if len(records) != 1 || records[0]["request_id"] != id || records[0]["path"] != "/about" {
+			t.Errorf("%s: log records = %v", tt.name, records)
+		}
+	}
+}
+
+// TestLogin_LogsRequestID verifies login failures are logged with the request's ID
+func TestLogin_LogsRequestID(t *testing.T) {
+	templates = template.Must(template.ParseGlob("../templates/*.html"))
+	buf := captureLogs(t)
+
+	req := httptest.NewRequest("POST", "/api/login", strings.NewReader(url.Values{"username": {"testuser_logs"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(requestIDHeader, "login-test-1")
+	w := httptest.NewRecorder()
+	requestIDMiddleware(http.HandlerFunc(login)).ServeHTTP(w, req)
+
+	records := logRecords(t, buf)
+	if len(records) != 1 {
+		t.Fatalf("log records = %v, want one", records)
+	}
+	record := records[0]
+	if record["msg"] != "Login failed" || record["level"] != "WARN" || record["request_id"] != "login-test-1" ||
+		record["reason"] != "missing_credentials" || record["username"] != "testuser_logs" {
+		t.Errorf("log record = %v", record)
+	}
+}
+
+// TestReadCrawlerRequest_LogsRequestID verifies rejected crawler requests are logged with the request's ID and reason
+func TestReadCrawlerRequest_LogsRequestID(t *testing.T) {
+	t.Setenv("CRAWLER_API_KEY", "expected-key")
+	buf := captureLogs(t)
+
+	req := httptest.NewRequest("POST", "/api/batch-pages", strings.NewReader("{}"))
+	req.Header.Set("X-API-Key", "wrong-key")
+	req.Header.Set(requestIDHeader, "crawler-test-1")
+	w := httptest.NewRecorder()
+	requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readCrawlerRequest(w, r)
+	})).ServeHTTP(w, req)
+
+	records := logRecords(t, buf)
+	if w.Code != http.StatusUnauthorized || len(records) != 1 {
+		t.Fatalf("status = %d, log records = %v, want 401 and one record", w.Code, records)
+	}
+	record := records[0]
+	if record["msg"] != "Crawler request rejected" || record["level"] != "WARN" || record["request_id"] != "crawler-test-1" ||
+		record["reason"] != "invalid_api_key" {
+		t.Errorf("log record = %v", record)
+	}
+}
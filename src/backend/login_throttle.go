@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rate limiting scopes, also used as the label of loginAttemptsBlocked
+const (
+	throttleScopeIP       = "ip"
+	throttleScopeUsername = "username"
+)
+
+// LoginThrottle decides how long a login key (one IP or one username) is blocked after failures
+// The first FreeAttempts failures cost nothing, then each failure doubles the delay up to MaxDelay,
+// and LockoutThreshold failures within Window lock the key for LockoutDuration
+type LoginThrottle struct {
+	FreeAttempts     int
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	Window           time.Duration
+}
+
+// getLoginThrottle returns the throttle for a scope
+// IPs get a higher threshold than usernames since many users can share one address (NAT, offices)
+func getLoginThrottle(scope string) LoginThrottle {
+	throttle := LoginThrottle{
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         5 * time.Minute,
+		LockoutThreshold: envInt("LOGIN_LOCKOUT_THRESHOLD", 10),
+		LockoutDuration:  envDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		Window:           time.Hour,
+	}
+	if scope == throttleScopeIP {
+		throttle.FreeAttempts = 10
+		throttle.LockoutThreshold = envInt("LOGIN_IP_LOCKOUT_THRESHOLD", 50)
+	}
+	return throttle
+}
+
+// blockFor returns how long to block the key after its nth consecutive failure
+func (t LoginThrottle) blockFor(failures int) time.Duration {
+	if failures >= t.LockoutThreshold {
+		return t.LockoutDuration
+	}
+	if failures <= t.FreeAttempts {
+		return 0
+	}
+	delay := float64(t.BaseDelay) * math.Pow(2, float64(failures-t.FreeAttempts-1))
+	return time.Duration(math.Min(delay, float64(t.MaxDelay)))
+}
+
+// loginThrottleKeys returns the attempt keys for a login, usernames are case-folded
+func loginThrottleKeys(clientIP, username string) map[string]string {
+	return map[string]string{
+		throttleScopeIP:       "ip:" + clientIP,
+		throttleScopeUsername: "user:" + strings.ToLower(username),
+	}
+}
+
+// checkLoginThrottle returns how long the login must wait, and which scope is blocked
+// Checked before the password is compared so blocked attempts don't cost a bcrypt run
+func checkLoginThrottle(clientIP, username string, now time.Time) (time.Duration, string, error) {
+	var longest time.Duration
+	var blockedScope string
+
+	for scope, key := range loginThrottleKeys(clientIP, username) {
+		var lockedUntil sql.NullTime
+		err := db.QueryRow("SELECT locked_until FROM login_attempts WHERE key = $1", key).Scan(&lockedUntil)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return 0, "", err
+		}
+		if wait := lockedUntil.Time.Sub(now); lockedUntil.Valid && wait > longest {
+			longest, blockedScope = wait, scope
+		}
+	}
+	return longest, blockedScope, nil
+}
+
+// recordLoginFailure counts a failed login against the IP and the username and applies the backoff
+// Unknown usernames are counted too, so lockouts don't reveal which accounts exist
+func recordLoginFailure(clientIP, username string, now time.Time) error {
+	for scope, key := range loginThrottleKeys(clientIP, username) {
+		throttle := getLoginThrottle(scope)
+
+		// Failures older than the window start a fresh count
+		var failures int
+		err := db.QueryRow(`INSERT INTO login_attempts (key, failure_count, last_failure_at)
+			VALUES ($1, 1, $2)
+			ON CONFLICT (key) DO UPDATE SET
+				failure_count = CASE WHEN login_attempts.last_failure_at < $3 THEN 1 ELSE login_attempts.failure_count + 1 END,
+				last_failure_at = $2
+			RETURNING failure_count`,
+			key, now, now.Add(-throttle.Window)).Scan(&failures)
+		if err != nil {
+			return err
+		}
+
+		if block := throttle.blockFor(failures); block > 0 {
+			if failures >= throttle.LockoutThreshold {
+				log.Printf("Login lockout: scope=%s key=%s failures=%d duration=%s", scope, key, failures, block)
+			}
+			_, err = db.Exec("UPDATE login_attempts SET locked_until = $1 WHERE key = $2", now.Add(block), key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resetLoginFailures clears the username's failures after a successful login
+// The IP count is left to expire on its own, otherwise one valid account would reset a credential stuffing run
+func resetLoginFailures(username string) error {
+	_, err := db.Exec("DELETE FROM login_attempts WHERE key = $1", loginThrottleKeys("", username)[throttleScopeUsername])
+	return err
+}
+
+// formatRetryAfter describes a wait for the 429 message, rounded up to whole seconds or minutes
+func formatRetryAfter(wait time.Duration) string {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds <= 1 {
+		return "1 second"
+	}
+	if seconds < 60 {
+		return fmt.Sprintf("%d seconds", seconds)
+	}
+	minutes := (seconds + 59) / 60
+	if minutes == 1 {
+		return "1 minute"
+	}
+	return fmt.Sprintf("%d minutes", minutes)
+}
+
+// startLoginAttemptsPruner periodically deletes attempt rows that no longer block or count
+func startLoginAttemptsPruner(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now()
+			result, err := db.Exec(`DELETE FROM login_attempts
+				WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < $2)`,
+				now.Add(-getLoginThrottle(throttleScopeIP).Window), now)
+			if err != nil {
+				log.Printf("Login attempts pruning failed: error=%v", err)
+				continue
+			}
+			if n, _ := result.RowsAffected(); n > 0 {
+				log.Printf("Login attempts pruned: rows=%d", n)
+			}
+		}
+	}
+}
+
+// rejectThrottledLogin answers 429 with Retry-After when the IP or username is currently blocked
+// Returns true when the request was rejected. Throttling errors fail open, an outage shouldn't lock everyone out
+func rejectThrottledLogin(w http.ResponseWriter, r *http.Request, page string, values map[string]string, clientIP, username string) bool {
+	wait, scope, err := checkLoginThrottle(clientIP, username, time.Now())
+	if err != nil {
+		log.Printf("Login throttle check failed: ip=%s error=%v", clientIP, err)
+		return false
+	}
+	if wait <= 0 {
+		return false
+	}
+
+	log.Printf("Login blocked: username=%s ip=%s scope=%s retry_after=%s", username, clientIP, scope, wait)
+	loginAttemptsBlocked.WithLabelValues(scope).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	renderFormError(w, r, page, values, http.StatusTooManyRequests,
+		"Too many failed login attempts, please try again in "+formatRetryAfter(wait), nil)
+	return true
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mail is a plain-text e-mail
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers e-mails, swap implementations with MAILER (smtp, log)
+type Mailer interface {
+	Send(mail Mail) error
+}
+
+// mailer is used by every handler that sends e-mail, main replaces it with newMailerFromEnv()
+var mailer Mailer = LogMailer{}
+
+// newMailerFromEnv returns an SMTPMailer when MAILER=smtp, otherwise a LogMailer
+func newMailerFromEnv() Mailer {
+	from := envOrDefault("MAIL_FROM", "Oggole <no-reply@localhost>")
+
+	if strings.ToLower(os.Getenv("MAILER")) == "smtp" {
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			log.Fatal("MAILER=smtp requires SMTP_HOST")
+		}
+		return SMTPMailer{
+			Host:     host,
+			Port:     envOrDefault("SMTP_PORT", "587"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+	}
+
+	log.Println("Using log mailer, e-mails are not delivered (set MAILER=smtp to send them)")
+	return LogMailer{Dir: os.Getenv("MAIL_DIR"), From: from}
+}
+
+// SMTPMailer sends mail through an SMTP server, upgrading to TLS with STARTTLS when offered
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// Send delivers the mail, authenticating when a username is configured
+func (m SMTPMailer) Send(mail Mail) error {
+	message, err := buildMailMessage(m.From, mail, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	return smtp.SendMail(net.JoinHostPort(m.Host, m.Port), auth, mailAddress(m.From), []string{mail.To}, message)
+}
+
+// LogMailer writes mail to the log, or to an .eml file per message when Dir is set
+// Meant for local development and tests, where links can be copied from the output
+type LogMailer struct {
+	Dir  string
+	From string
+}
+
+// Send logs or stores the mail instead of delivering it
+func (m LogMailer) Send(mail Mail) error {
+	message, err := buildMailMessage(m.From, mail, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if m.Dir == "" {
+		log.Printf("Mail not sent (log mailer): to=%s subject=%q\n%s", mail.To, mail.Subject, mail.Body)
+		return nil
+	}
+
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), randomHex(4))
+	path := filepath.Join(m.Dir, name)
+	if err := os.WriteFile(path, message, 0o600); err != nil {
+		return err
+	}
+	log.Printf("Mail written: to=%s subject=%q path=%s", mail.To, mail.Subject, path)
+	return nil
+}
+
+// buildMailMessage renders an RFC 5322 message, rejecting header values that contain line breaks
+func buildMailMessage(from string, mail Mail, now time.Time) ([]byte, error) {
+	if from == "" {
+		from = "Oggole <no-reply@localhost>"
+	}
+	for _, value := range []string{from, mail.To, mail.Subject} {
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("mail header contains a line break: %q", value)
+		}
+	}
+
+	domain := "localhost"
+	if _, host, found := strings.Cut(mailAddress(from), "@"); found {
+		domain = host
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", mail.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", randomHex(16), domain)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(mail.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(b.String()), nil
+}
+
+// mailAddress extracts the bare address from "Name <addr>"
+func mailAddress(from string) string {
+	if start := strings.LastIndex(from, "<"); start != -1 {
+		if end := strings.LastIndex(from, ">"); end > start {
+			return from[start+1 : end]
+		}
+	}
+	return strings.TrimSpace(from)
+}
+
+// randomHex returns n random bytes as hex, for file names and message IDs
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -14,6 +14,26 @@ var (
 		Help: "Total HTTP requests by endpoint and status",
 	}, []string{"endpoint", "status"})
 
+	// httpRequestDuration measures how long handlers take by endpoint and method
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "oggole_http_request_duration_seconds",
+		Help:    "HTTP request latency by endpoint and method",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint", "method"})
+
+	// httpResponseBytes measures response body sizes by endpoint and method (256B up to 4MB)
+	httpResponseBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "oggole_http_response_size_bytes",
+		Help:    "HTTP response body size by endpoint and method",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 8),
+	}, []string{"endpoint", "method"})
+
+	// httpRequestsInFlight counts requests currently being handled per endpoint
+	httpRequestsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "oggole_http_requests_in_flight",
+		Help: "HTTP requests currently being served by endpoint",
+	}, []string{"endpoint"})
+
 	// Feature health metrics - Search tracking
 
 	// searchQueries counts total search queries
@@ -41,12 +61,39 @@ var (
 		Buckets: []float64{1, 2, 3, 5, 10, 20, 50},
 	})
 
+	// Security metrics
+
+	// loginAttemptsBlocked counts logins rejected by rate limiting, by the scope that was blocked (ip, username)
+	loginAttemptsBlocked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "oggole_login_attempts_blocked_total",
+		Help: "Login attempts rejected by rate limiting or lockout",
+	}, []string{"scope"})
+
+	// apiTokenRequests counts requests authenticated with a personal access token, by result
+	// (ok, invalid, insufficient_scope, rate_limited)
+	apiTokenRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "oggole_api_token_requests_total",
+		Help: "Requests made with personal API tokens by result",
+	}, []string{"result"})
+
+	// alertNotifications counts saved-search alert attempts by channel (email, webhook, inbox) and result (sent, retry, failed)
+	alertNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "oggole_alert_notifications_total",
+		Help: "Saved-search alert notification attempts by channel and result",
+	}, []string{"channel", "result"})
+
+	// webhookDeliveries counts index event webhook attempts by result (delivered, retry, failed)
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "oggole_webhook_deliveries_total",
+		Help: "Index event webhook delivery attempts by result",
+	}, []string{"result"})
+
 	// Crawler/Indexing metrics
 
-	// pagesIndexed counts pages successfully indexed via batch-pages API
+	// pagesIndexed counts pages successfully indexed via batch-pages, feed ingestion and document uploads
 	pagesIndexed = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "oggole_pages_indexed_total",
-		Help: "Total pages indexed via batch-pages API",
+		Help: "Total pages indexed via batch-pages, feed ingestion and document uploads",
 	})
 
 	// totalPages tracks current number of pages in database
@@ -55,6 +102,12 @@ var (
 		Help: "Current number of pages in database",
 	})
 
+	// crawlFetches counts scheduled recrawls by outcome (changed, unchanged, failed, blocked)
+	crawlFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "oggole_crawl_fetches_total",
+		Help: "Scheduled crawl fetches by result",
+	}, []string{"result"})
+
 	// Operational metrics
 
 	// serviceUp tracks service health (1=up, 0=down)
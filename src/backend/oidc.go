@@ -0,0 +1,816 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Single sign-on uses the OpenID Connect authorization code flow with PKCE:
+// /login/oidc sends the browser to the provider, /login/oidc/callback exchanges the code for an
+// ID token, verifies it against the provider's published keys and logs the linked account in.
+
+// The state, nonce and PKCE verifier wait this long for the provider to send the browser back
+const oidcLoginTTL = 10 * time.Minute
+
+// Name of the cookie carrying the state, nonce and PKCE verifier of a login in progress
+const oidcLoginCookieName = "oidc_login"
+
+// Purpose stored in the OIDC login cookie so other signed values can't be passed off as one
+const tokenPurposeOIDCLogin = "oidc-login"
+
+// How long discovery documents and signing keys are reused before fetching them again
+const oidcCacheTTL = time.Hour
+
+// Signing keys are refetched for an unknown key ID at most this often, so bogus tokens can't hammer the provider
+const oidcKeyRefetchInterval = time.Minute
+
+// Allowed clock difference when checking ID token times
+const oidcClockSkew = time.Minute
+
+// Largest discovery, JWKS or token response read from the provider
+const maxOIDCResponseBytes = 1 << 20
+
+// Usernames created from provider claims are cut to this length
+const maxOIDCUsernameLength = 32
+
+// Reasons an identity can't be linked to an account
+var (
+	errOIDCLinkedElsewhere = errors.New("identity linked to another account")
+	errOIDCNoEmail         = errors.New("no e-mail address in ID token")
+	errOIDCEmailInUse      = errors.New("e-mail address belongs to an account that can't be linked automatically")
+	errOIDCSignupDisabled  = errors.New("no account for identity and sign-up disabled")
+)
+
+// What the user is told for each of the reasons above
+var oidcLinkMessages = map[error]string{
+	errOIDCLinkedElsewhere: "This identity is already connected to another account",
+	errOIDCNoEmail:         "Your identity provider did not share an e-mail address",
+	errOIDCEmailInUse:      "An account with your e-mail address already exists, log in with your password and connect single sign-on from your account page",
+	errOIDCSignupDisabled:  "There is no account for this identity, ask an admin to create one",
+}
+
+// oidcProvider is the configured identity provider, nil when single sign-on is off (set in main)
+var oidcProvider *OIDCProvider
+
+// OIDCProvider talks to one OpenID Connect provider and caches its discovery document and keys
+type OIDCProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	Name         string // shown on the login button
+	AllowSignup  bool   // create accounts for identities that match no user
+
+	client *http.Client
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	discoveredAt  time.Time
+	keys          map[string]jsonWebKey
+	keysFetchedAt time.Time
+}
+
+// oidcDiscovery is the part of /.well-known/openid-configuration the login flow uses
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// jsonWebKey is one RSA or P-256 key from the provider's JWKS
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// oidcClaims are the ID token claims the login flow checks or uses
+type oidcClaims struct {
+	Issuer            string       `json:"iss"`
+	Subject           string       `json:"sub"`
+	Audience          oidcAudience `json:"aud"`
+	AuthorizedParty   string       `json:"azp"`
+	ExpiresAt         int64        `json:"exp"`
+	IssuedAt          int64        `json:"iat"`
+	Nonce             string       `json:"nonce"`
+	Email             string       `json:"email"`
+	EmailVerified     oidcBool     `json:"email_verified"`
+	PreferredUsername string       `json:"preferred_username"`
+	Name              string       `json:"name"`
+}
+
+// oidcAudience accepts the aud claim as a single string or a list
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = oidcAudience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// contains reports whether the audience includes clientID
+func (a oidcAudience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcBool accepts true as a JSON boolean or the string "true", which some providers send for email_verified
+type oidcBool bool
+
+func (b *oidcBool) UnmarshalJSON(data []byte) error {
+	var value bool
+	if err := json.Unmarshal(data, &value); err == nil {
+		*b = oidcBool(value)
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	*b = oidcBool(strings.EqualFold(text, "true"))
+	return nil
+}
+
+// oidcLogin is the signed payload of the OIDC login cookie
+type oidcLogin struct {
+	Purpose   string `json:"p"`
+	State     string `json:"s"`
+	Nonce     string `json:"n"`
+	Verifier  string `json:"v"`
+	ExpiresAt int64  `json:"x"`
+}
+
+// newOIDCProviderFromEnv builds the provider, returning nil when OIDC_ISSUER or OIDC_CLIENT_ID is unset
+func newOIDCProviderFromEnv() *OIDCProvider {
+	issuer := os.Getenv("OIDC_ISSUER")
+	clientID := os.Getenv("OIDC_CLIENT_ID")
+	if issuer == "" || clientID == "" {
+		return nil
+	}
+
+	return &OIDCProvider{
+		Issuer:       issuer,
+		ClientID:     clientID,
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  envOrDefault("OIDC_REDIRECT_URL", getBaseURL()+"/login/oidc/callback"),
+		Scopes:       strings.Fields(envOrDefault("OIDC_SCOPES", "openid email profile")),
+		Name:         envOrDefault("OIDC_PROVIDER_NAME", "single sign-on"),
+		AllowSignup:  strings.ToLower(os.Getenv("OIDC_ALLOW_SIGNUP")) != "false",
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// getJSON fetches a provider document into v
+func (p *OIDCProvider) getJSON(ctx context.Context, endpoint string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %d", endpoint, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxOIDCResponseBytes)).Decode(v)
+}
+
+// discover returns the provider's endpoints, fetching the discovery document when the cached one is stale
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil && time.Since(p.discoveredAt) < oidcCacheTTL {
+		return p.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	if err := p.getJSON(ctx, strings.TrimRight(p.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("discovery: %v", err)
+	}
+	// A document naming another issuer could make us accept that issuer's tokens
+	if discovery.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discovery: issuer %q does not match the configured %q", discovery.Issuer, p.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("discovery: document is missing endpoints")
+	}
+
+	p.discovery = &discovery
+	p.discoveredAt = time.Now()
+	return p.discovery, nil
+}
+
+// authCodeURL returns where to send the browser to log in
+func (p *OIDCProvider) authCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	authURL, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", p.RedirectURL)
+	query.Set("scope", strings.Join(p.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", pkceChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+	return authURL.String(), nil
+}
+
+// pkceChallenge derives the S256 code challenge sent with the authorization request
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// exchange trades the authorization code for the raw ID token
+func (p *OIDCProvider) exchange(ctx context.Context, code, verifier string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	// Public clients identify themselves in the body, confidential ones with client_secret_basic
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxOIDCResponseBytes)).Decode(&token); err != nil {
+		return "", fmt.Errorf("token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || token.Error != "" {
+		return "", fmt.Errorf("token endpoint: status %d: %s %s", resp.StatusCode, token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return token.IDToken, nil
+}
+
+// signingKey returns the provider key with the given ID, refetching the JWKS when the key is unknown
+// Providers rotate keys by publishing the new one first, so an unknown key ID usually means a stale cache
+func (p *OIDCProvider) signingKey(ctx context.Context, kid, kty string) (jsonWebKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	find := func() (jsonWebKey, bool) {
+		if key, ok := p.keys[kid]; ok && key.Kty == kty {
+			return key, true
+		}
+		// Tokens without a key ID are fine as long as only one key could have signed them
+		if kid == "" {
+			var match jsonWebKey
+			matches := 0
+			for _, key := range p.keys {
+				if key.Kty == kty {
+					match = key
+					matches++
+				}
+			}
+			return match, matches == 1
+		}
+		return jsonWebKey{}, false
+	}
+
+	stale := time.Since(p.keysFetchedAt) > oidcCacheTTL
+	if !stale {
+		if key, ok := find(); ok {
+			return key, nil
+		}
+		if time.Since(p.keysFetchedAt) < oidcKeyRefetchInterval {
+			return jsonWebKey{}, fmt.Errorf("unknown signing key %q", kid)
+		}
+	}
+
+	// Discovery takes the same lock, so read the cached endpoint directly
+	if p.discovery == nil {
+		return jsonWebKey{}, errors.New("provider not discovered")
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.discovery.JWKSURI, &jwks); err != nil {
+		return jsonWebKey{}, fmt.Errorf("jwks: %v", err)
+	}
+
+	p.keys = map[string]jsonWebKey{}
+	for _, key := range jwks.Keys {
+		if key.Use == "" || key.Use == "sig" {
+			p.keys[key.Kid] = key
+		}
+	}
+	p.keysFetchedAt = time.Now()
+
+	if key, ok := find(); ok {
+		return key, nil
+	}
+	return jsonWebKey{}, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// decodeBigInt decodes a base64url JWK number
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid key number")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// verifySignature checks signature over signed with the key, for RS256 and ES256
+func (k jsonWebKey) verifySignature(alg string, signed, signature []byte) error {
+	digest := sha256.Sum256(signed)
+
+	switch alg {
+	case "RS256":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31 {
+			return errors.New("invalid RSA exponent")
+		}
+		key := &rsa.PublicKey{N: n, E: int(e.Int64())}
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+
+	case "ES256":
+		if k.Crv != "P-256" {
+			return fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return err
+		}
+		// Reject points that aren't on the curve before using the key
+		point := make([]byte, 65)
+		point[0] = 4
+		x.FillBytes(point[1:33])
+		y.FillBytes(point[33:])
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return errors.New("invalid EC key")
+		}
+		if len(signature) != 64 {
+			return errors.New("invalid ES256 signature length")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// verifyIDToken checks the ID token's signature, issuer, audience, lifetime and nonce, and returns its claims
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, rawToken, nonce string, now time.Time) (*oidcClaims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed ID token header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, errors.New("malformed ID token header")
+	}
+
+	// Only asymmetric algorithms: "none" and HMAC would let anyone who knows the client ID forge tokens
+	kty := map[string]string{"RS256": "RSA", "ES256": "EC"}[header.Alg]
+	if kty == "" {
+		return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+	key, err := p.signingKey(ctx, header.Kid, kty)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ID token signature")
+	}
+	if err := key.verifySignature(header.Alg, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, fmt.Errorf("ID token signature: %v", err)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed ID token payload")
+	}
+	var claims oidcClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("malformed ID token payload")
+	}
+
+	switch {
+	case claims.Issuer != p.Issuer:
+		return nil, fmt.Errorf("ID token issuer %q does not match", claims.Issuer)
+	case !claims.Audience.contains(p.ClientID):
+		return nil, errors.New("ID token was not issued for this client")
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID:
+		return nil, errors.New("ID token authorized party does not match")
+	case claims.Subject == "":
+		return nil, errors.New("ID token has no subject")
+	case claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(oidcClockSkew)):
+		return nil, errors.New("ID token expired")
+	case claims.IssuedAt > 0 && time.Unix(claims.IssuedAt, 0).After(now.Add(oidcClockSkew)):
+		return nil, errors.New("ID token issued in the future")
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, errors.New("ID token nonce does not match")
+	}
+	return &claims, nil
+}
+
+// setOIDCLogin remembers the state, nonce and PKCE verifier until the provider redirects back
+func setOIDCLogin(w http.ResponseWriter, login oidcLogin) error {
+	payload, err := json.Marshal(login)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcLoginCookieName,
+		Value:    signCookieValue(string(payload)),
+		Path:     "/login/oidc",
+		HttpOnly: true,
+		Secure:   getCookieSecure(),
+		// Lax, not Strict: the callback is a cross-site navigation from the provider
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+	})
+	return nil
+}
+
+// popOIDCLogin returns the login in progress if its cookie is genuine and not expired, and clears the cookie
+func popOIDCLogin(w http.ResponseWriter, r *http.Request, now time.Time) (oidcLogin, bool) {
+	var login oidcLogin
+
+	cookie, err := r.Cookie(oidcLoginCookieName)
+	if err != nil {
+		return login, false
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcLoginCookieName,
+		Value:    "",
+		Path:     "/login/oidc",
+		HttpOnly: true,
+		Secure:   getCookieSecure(),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	})
+
+	payload, ok := verifyCookieValue(cookie.Value)
+	if !ok {
+		return login, false
+	}
+	if err := json.Unmarshal([]byte(payload), &login); err != nil || login.Purpose != tokenPurposeOIDCLogin {
+		return login, false
+	}
+	return login, now.Unix() <= login.ExpiresAt
+}
+
+// oidcLoginStart sends the browser to the identity provider (GET /login/oidc)
+func oidcLoginStart(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	clientIP := getClientIP(r)
+	login := oidcLogin{Purpose: tokenPurposeOIDCLogin, ExpiresAt: time.Now().Add(oidcLoginTTL).Unix()}
+	var err error
+	for _, value := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+		if *value, err = generateToken(); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = setOIDCLogin(w, login)
+	}
+	var authURL string
+	if err == nil {
+		authURL, err = oidcProvider.authCodeURL(r.Context(), login.State, login.Nonce, login.Verifier)
+	}
+	if err != nil {
+		log.Printf("SSO login failed: ip=%s reason=start_error error=%v", clientIP, err)
+		setFlash(w, "Single sign-on is unavailable right now, please try again later")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcCallback finishes the login when the provider sends the browser back (GET /login/oidc/callback)
+// The state must match the cookie set by oidcLoginStart, so another site can't log the browser into its own account
+func oidcCallback(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	clientIP := getClientIP(r)
+	query := r.URL.Query()
+	fail := func(reason, message string, err error) {
+		log.Printf("SSO login failed: ip=%s reason=%s error=%v", clientIP, reason, err)
+		setFlash(w, message)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	}
+
+	login, ok := popOIDCLogin(w, r, time.Now())
+	if !ok {
+		fail("missing_login_cookie", "Your single sign-on attempt expired, please try again", nil)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(login.State)) != 1 {
+		fail("state_mismatch", "Single sign-on failed, please try again", nil)
+		return
+	}
+	if providerError := query.Get("error"); providerError != "" {
+		fail("provider_error", "Single sign-on was cancelled or denied", errors.New(providerError+": "+query.Get("error_description")))
+		return
+	}
+	if query.Get("code") == "" {
+		fail("missing_code", "Single sign-on failed, please try again", nil)
+		return
+	}
+
+	rawToken, err := oidcProvider.exchange(r.Context(), query.Get("code"), login.Verifier)
+	if err != nil {
+		fail("token_exchange_error", "Single sign-on failed, please try again", err)
+		return
+	}
+	claims, err := oidcProvider.verifyIDToken(r.Context(), rawToken, login.Nonce, time.Now())
+	if err != nil {
+		fail("invalid_id_token", "Single sign-on failed, please try again", err)
+		return
+	}
+
+	current := currentUser(r)
+	username, outcome, err := linkOIDCIdentity(oidcProvider, claims, current, clientIP)
+	if message, refused := oidcLinkMessages[err]; refused {
+		fail("link_refused", message, err)
+		return
+	} else if err != nil {
+		fail("database_error", "Internal server error", err)
+		return
+	}
+	log.Printf("SSO identity resolved: username=%s ip=%s subject=%s outcome=%s", username, clientIP, claims.Subject, outcome)
+
+	// Connecting an identity from the account page keeps the current session
+	if current != nil && outcome == "linked" {
+		setFlash(w, "Single sign-on is now connected to your account")
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+
+	// Accounts with two-factor authentication still enter their code
+	redirected, err := beginSecondFactor(w, r, username, clientIP)
+	if err != nil {
+		fail("two_factor_error", "Internal server error", err)
+		return
+	}
+	if redirected {
+		return
+	}
+
+	if err := startSession(w, r, username, clientIP); err != nil {
+		fail("session_error", "Failed to create session", err)
+		return
+	}
+	setFlash(w, "You were logged in")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// linkOIDCIdentity finds the account for a verified identity, in order: an already linked account, the logged-in
+// user, or an account with the same verified e-mail address. Otherwise it creates one when sign-up is allowed.
+// outcome is "existing", "linked" or "created"
+func linkOIDCIdentity(provider *OIDCProvider, claims *oidcClaims, current *User, clientIP string) (username string, outcome string, err error) {
+	var userID int
+	err = db.QueryRow(`SELECT users.id, users.username FROM user_identities
+		JOIN users ON users.id = user_identities.user_id
+		WHERE user_identities.issuer = $1 AND user_identities.subject = $2`,
+		claims.Issuer, claims.Subject).Scan(&userID, &username)
+	switch {
+	case err == nil:
+		if current != nil && current.ID != userID {
+			return "", "", errOIDCLinkedElsewhere
+		}
+		_, err = db.Exec(`UPDATE user_identities SET last_login_at = NOW(), email = $3
+			WHERE issuer = $1 AND subject = $2`, claims.Issuer, claims.Subject, claims.Email)
+		return username, "existing", err
+	case err != sql.ErrNoRows:
+		return "", "", err
+	}
+
+	if current != nil {
+		return current.Username, "linked", insertOIDCIdentity(db, current.ID, claims)
+	}
+
+	email := strings.TrimSpace(claims.Email)
+	if email == "" || !isValidEmail(email) {
+		return "", "", errOIDCNoEmail
+	}
+
+	// Only link by e-mail when both sides proved they own the address, otherwise
+	// whoever registers the address first at either end could take over the account
+	var verified bool
+	err = db.QueryRow("SELECT id, username, verified_at IS NOT NULL FROM users WHERE LOWER(email) = LOWER($1)",
+		email).Scan(&userID, &username, &verified)
+	switch {
+	case err == nil:
+		if !verified || !bool(claims.EmailVerified) {
+			return "", "", errOIDCEmailInUse
+		}
+		return username, "linked", insertOIDCIdentity(db, userID, claims)
+	case err != sql.ErrNoRows:
+		return "", "", err
+	}
+
+	if !provider.AllowSignup {
+		return "", "", errOIDCSignupDisabled
+	}
+
+	username, err = availableUsername(oidcUsernameBase(claims))
+	if err != nil {
+		return "", "", err
+	}
+	// The account has no usable password until the user sets one with "forgot password"
+	password, err := generateToken()
+	if err == nil {
+		password, err = hashPassword(password)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`INSERT INTO users (username, email, password, registration_ip, verified_at)
+		VALUES ($1, $2, $3, $4, CASE WHEN $5::boolean THEN NOW() END) RETURNING id`,
+		username, email, password, clientIP, bool(claims.EmailVerified)).Scan(&userID)
+	if err == nil {
+		err = insertOIDCIdentity(tx, userID, claims)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return "", "", err
+	}
+	log.Printf("Registration success: username=%s email=%s ip=%s method=sso", username, email, clientIP)
+
+	if !claims.EmailVerified {
+		if err := sendVerificationEmail(userID, username, email); err != nil {
+			log.Printf("Verification e-mail failed: username=%s email=%s error=%v", username, email, err)
+		}
+	}
+	return username, "created", nil
+}
+
+// sqlExecer is satisfied by *sql.DB and *sql.Tx
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertOIDCIdentity links the identity to an account
+func insertOIDCIdentity(exec sqlExecer, userID int, claims *oidcClaims) error {
+	_, err := exec.Exec(`INSERT INTO user_identities (user_id, issuer, subject, email, last_login_at)
+		VALUES ($1, $2, $3, $4, NOW())`, userID, claims.Issuer, claims.Subject, claims.Email)
+	return err
+}
+
+// oidcUsernameBase picks a username for a new account from the preferred username or the e-mail's local part
+func oidcUsernameBase(claims *oidcClaims) string {
+	candidate := claims.PreferredUsername
+	if candidate == "" {
+		candidate, _, _ = strings.Cut(claims.Email, "@")
+	}
+
+	var b strings.Builder
+	for _, c := range candidate {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+			b.WriteRune(c)
+		}
+		if b.Len() >= maxOIDCUsernameLength {
+			break
+		}
+	}
+	if b.Len() == 0 {
+		return "user"
+	}
+	return b.String()
+}
+
+// availableUsername returns base, or base with a number appended when it is taken
+func availableUsername(base string) (string, error) {
+	for i := 1; i <= 100; i++ {
+		candidate := base
+		if i > 1 {
+			candidate = fmt.Sprintf("%s%d", base, i)
+		}
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)", candidate).Scan(&exists); err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no free username for %q", base)
+}
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// mockOIDCProvider is a local OpenID Connect provider: discovery, JWKS, an authorize endpoint that
+// approves every request as the configured user, and a token endpoint that checks the PKCE verifier
+type mockOIDCProvider struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+	secret   string
+
+	mu     sync.Mutex
+	codes  map[string]url.Values // authorization request by code
+	claims map[string]interface{}
+}
+
+// newMockOIDCProvider starts the mock and installs a matching oidcProvider for the test
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	mock := &mockOIDCProvider{
+		key:      key,
+		clientID: "test-client",
+		secret:   "test-secret",
+		codes:    map[string]url.Values{},
+		claims:   map[string]interface{}{"sub": "subject-1"},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 mock.server.URL,
+			"authorization_endpoint": mock.server.URL + "/authorize",
+			"token_endpoint":         mock.server.URL + "/token",
+			"jwks_uri":               mock.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test-key",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		code, _ := generateToken()
+		mock.mu.Lock()
+		mock.codes[code] = query
+		mock.mu.Unlock()
+
+		redirect, _ := url.Parse(query.Get("redirect_uri"))
+		redirect.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		tokenError := func(code string) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": code})
+		}
+
+		if id, secret, ok := r.BasicAuth(); !ok || id != mock.clientID || secret != mock.secret {
+			tokenError("invalid_client")
+			return
+		}
+		mock.mu.Lock()
+		authorization, ok := mock.codes[r.FormValue("code")]
+		delete(mock.codes, r.FormValue("code"))
+		mock.mu.Unlock()
+		if !ok || r.FormValue("redirect_uri") != authorization.Get("redirect_uri") {
+			tokenError("invalid_grant")
+			return
+		}
+		if pkceChallenge(r.FormValue("code_verifier")) != authorization.Get("code_challenge") {
+			tokenError("invalid_grant")
+			return
+		}
+
+		claims := mock.standardClaims()
+		claims["nonce"] = authorization.Get("nonce")
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "test-access-token",
+			"token_type":   "Bearer",
+			"id_token":     mock.sign(t, "RS256", "test-key", claims),
+		})
+	})
+	mock.server = httptest.NewServer(mux)
+	t.Cleanup(mock.server.Close)
+
+	previous := oidcProvider
+	oidcProvider = &OIDCProvider{
+		Issuer:       mock.server.URL,
+		ClientID:     mock.clientID,
+		ClientSecret: mock.secret,
+		RedirectURL:  "http://localhost:8080/login/oidc/callback",
+		Scopes:       []string{"openid", "email", "profile"},
+		Name:         "Test IdP",
+		AllowSignup:  true,
+		client:       mock.server.Client(),
+	}
+	t.Cleanup(func() { oidcProvider = previous })
+	return mock
+}
+
+// setClaims replaces the user the mock logs in, on top of iss, aud, iat and exp
+func (m *mockOIDCProvider) setClaims(claims map[string]interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.claims = claims
+}
+
+// standardClaims returns a valid claim set for the configured user, without a nonce
+func (m *mockOIDCProvider) standardClaims() map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": m.server.URL,
+		"aud": m.clientID,
+		"iat": now.Unix(),
+		"exp": now.Add(5 * time.Minute).Unix(),
+	}
+	for name, value := range m.claims {
+		claims[name] = value
+	}
+	return claims
+}
+
+// sign builds a JWT with the mock's RSA key, or an unsigned one for alg "none"
+func (m *mockOIDCProvider) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	if alg == "none" {
+		return signed + "."
+	}
+
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// oidcFlow runs /login/oidc, lets the mock approve the login and returns the callback's response
+func oidcFlow(t *testing.T, mock *mockOIDCProvider, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+
+	start := httptest.NewRecorder()
+	oidcLoginStart(start, httptest.NewRequest("GET", "/login/oidc", nil))
+	if start.Code != http.StatusFound {
+		t.Fatalf("login start = %d, flash %q", start.Code, flashFrom(start))
+	}
+
+	client := mock.server.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(start.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("authorize request failed: %v", err)
+	}
+	resp.Body.Close()
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+
+	req := httptest.NewRequest("GET", "/login/oidc/callback?"+callback.RawQuery, nil)
+	for _, cookie := range append(start.Result().Cookies(), cookies...) {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	oidcCallback(w, req)
+	return w
+}
+
+// TestOIDCLoginStart verifies the authorization request carries state, nonce and an S256 PKCE challenge
+func TestOIDCLoginStart(t *testing.T) {
+	mock := newMockOIDCProvider(t)
+
+	w := httptest.NewRecorder()
+	oidcLoginStart(w, httptest.NewRequest("GET", "/login/oidc", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("status code = %d, want %d", w.Code, http.StatusFound)
+	}
+
+	location, _ := url.Parse(w.Header().Get("Location"))
+	query := location.Query()
+	if location.Path != "/authorize" || !strings.HasPrefix(location.String(), mock.server.URL) {
+		t.Errorf("redirected to %q, want the provider's authorization endpoint", location)
+	}
+	for name, want := range map[string]string{
+		"response_type":         "code",
+		"client_id":             "test-client",
+		"redirect_uri":          "http://localhost:8080/login/oidc/callback",
+		"scope":                 "openid email profile",
+		"code_challenge_method": "S256",
+	} {
+		if query.Get(name) != want {
+			t.Errorf("%s = %q, want %q", name, query.Get(name), want)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/login/oidc/callback", nil)
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	login, ok := popOIDCLogin(httptest.NewRecorder(), req, time.Now())
+	if !ok {
+		t.Fatalf("login cookie not set or invalid")
+	}
+	if query.Get("state") != login.State || query.Get("nonce") != login.Nonce || login.State == login.Nonce {
+		t.Errorf("state/nonce in the request don't match the cookie")
+	}
+	if query.Get("code_challenge") != pkceChallenge(login.Verifier) || strings.Contains(location.RawQuery, login.Verifier) {
+		t.Errorf("code_challenge is not the S256 hash of the verifier, or the verifier leaked")
+	}
+
+	if _, ok := popOIDCLogin(httptest.NewRecorder(), req, time.Now().Add(oidcLoginTTL+time.Second)); ok {
+		t.Errorf("expired login cookie accepted")
+	}
+}
+
+// TestOIDCLoginStart_Disabled verifies the SSO routes don't exist without configuration
+func TestOIDCLoginStart_Disabled(t *testing.T) {
+	previous := oidcProvider
+	oidcProvider = nil
+	defer func() { oidcProvider = previous }()
+
+	for _, handler := range []http.HandlerFunc{oidcLoginStart, oidcCallback} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/login/oidc", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("status code = %d, want %d", w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+// TestOIDCDiscovery_IssuerMismatch verifies a discovery document for another issuer is refused
+func TestOIDCDiscovery_IssuerMismatch(t *testing.T) {
+	newMockOIDCProvider(t)
+	oidcProvider.Issuer += "/other"
+
+	if _, err := oidcProvider.discover(context.Background()); err == nil {
+		t.Errorf("discover() accepted a document for another issuer")
+	}
+}
+
+// TestVerifyIDToken verifies signature, issuer, audience, lifetime and nonce checks
+func TestVerifyIDToken(t *testing.T) {
+	mock := newMockOIDCProvider(t)
+	if _, err := oidcProvider.discover(context.Background()); err != nil {
+		t.Fatalf("discover() error = %v", err)
+	}
+
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := mock.standardClaims()
+		c["nonce"] = "test-nonce"
+		c["email"] = "sso@example.com"
+		c["email_verified"] = "true"
+		for name, value := range changes {
+			if value == nil {
+				delete(c, name)
+			} else {
+				c[name] = value
+			}
+		}
+		return c
+	}
+	tamper := func(token string) string {
+		parts := strings.Split(token, ".")
+		payload, _ := json.Marshal(claims(map[string]interface{}{"sub": "someone-else"}))
+		return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"valid", mock.sign(t, "RS256", "test-key", claims(nil)), true},
+		{"audience list with azp", mock.sign(t, "RS256", "test-key", claims(map[string]interface{}{"aud": []string{"other", "test-client"}, "azp": "test-client"})), true},
+		{"audience list without azp", mock.sign(t, "RS256", "test-key", claims(map[string]interface{}{"aud": []string{"other", "test-client"}})), false},
+		{"wrong audience", mock.sign(t, "RS256", "test-key", claims(map[string]interface{}{"aud": "other"})), false},
+		{"wrong issuer", mock.sign(t, "RS256", "test-key", claims(map[string]interface{}{"iss": "https://evil.example"})), false},
+		{"expired", mock.sign(t, "RS256", "test-key", claims(map[string]interface{}{"exp": now.Add(-2 * oidcClockSkew).Unix()})), false},
+		{"issued in the future", mock.sign(t, "RS256", "test-key", claims(map[string]interface{}{"iat": now.Add(2 * oidcClockSkew).Unix()})), false},
+		{"wrong nonce", mock.sign(t, "RS256", "test-key", claims(map[string]interface{}{"nonce": "other"})), false},
+		{"no nonce", mock.sign(t, "RS256", "test-key", claims(map[string]interface{}{"nonce": nil})), false},
+		{"no subject", mock.sign(t, "RS256", "test-key", claims(map[string]interface{}{"sub": nil})), false},
+		{"unknown key", mock.sign(t, "RS256", "other-key", claims(nil)), false},
+		{"alg none", mock.sign(t, "none", "test-key", claims(nil)), false},
+		{"tampered payload", tamper(mock.sign(t, "RS256", "test-key", claims(nil))), false},
+		{"malformed", "not-a-jwt", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := oidcProvider.verifyIDToken(context.Background(), tt.token, "test-nonce", now)
+			if tt.valid && err != nil {
+				t.Fatalf("verifyIDToken() error = %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatalf("verifyIDToken() accepted an invalid token")
+			}
+			if tt.valid && (got.Subject != "subject-1" || got.Email != "sso@example.com" || !bool(got.EmailVerified)) {
+				t.Errorf("claims = %+v", got)
+			}
+		})
+	}
+}
+
+// TestJSONWebKey_ES256 verifies P-256 signatures and rejects points off the curve
+func TestJSONWebKey_ES256(t *testing.T) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	key := jsonWebKey{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(private.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(private.Y.FillBytes(make([]byte, 32))),
+	}
+
+	signed := []byte("header.payload")
+	digest := sha256.Sum256(signed)
+	r, s, err := ecdsa.Sign(rand.Reader, private, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+
+	if err := key.verifySignature("ES256", signed, signature); err != nil {
+		t.Errorf("valid signature rejected: %v", err)
+	}
+	if err := key.verifySignature("ES256", []byte("header.other"), signature); err == nil {
+		t.Errorf("signature over other data accepted")
+	}
+
+	offCurve := key
+	offCurve.Y = base64.RawURLEncoding.EncodeToString(new(big.Int).Add(private.Y, big.NewInt(1)).FillBytes(make([]byte, 32)))
+	if err := offCurve.verifySignature("ES256", signed, signature); err == nil {
+		t.Errorf("key off the curve accepted")
+	}
+}
+
+// TestOIDCExchange_RequiresVerifier verifies the code is only redeemed with the matching PKCE verifier
+func TestOIDCExchange_RequiresVerifier(t *testing.T) {
+	mock := newMockOIDCProvider(t)
+
+	authURL, err := oidcProvider.authCodeURL(context.Background(), "state", "nonce", "the-right-verifier-0123456789012345678901234")
+	if err != nil {
+		t.Fatalf("authCodeURL() error = %v", err)
+	}
+	client := mock.server.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorize request failed: %v", err)
+	}
+	resp.Body.Close()
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+	code := callback.Query().Get("code")
+
+	if _, err := oidcProvider.exchange(context.Background(), code, "a-wrong-verifier-01234567890123456789012345"); err == nil {
+		t.Errorf("code redeemed with the wrong verifier")
+	}
+}
+
+// TestOIDCCallback_Rejects verifies callbacks without the login cookie, with another state or a provider error
+func TestOIDCCallback_Rejects(t *testing.T) {
+	newMockOIDCProvider(t)
+
+	start := httptest.NewRecorder()
+	oidcLoginStart(start, httptest.NewRequest("GET", "/login/oidc", nil))
+	location, _ := url.Parse(start.Header().Get("Location"))
+	state := location.Query().Get("state")
+
+	tests := []struct {
+		name    string
+		query   string
+		cookies bool
+		flash   string
+	}{
+		{"no login cookie", "code=abc&state=" + state, false, "expired"},
+		{"state mismatch", "code=abc&state=forged", true, "Single sign-on failed"},
+		{"provider error", "error=access_denied&state=" + state, true, "cancelled or denied"},
+		{"no code", "state=" + state, true, "Single sign-on failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/login/oidc/callback?"+tt.query, nil)
+			if tt.cookies {
+				for _, cookie := range start.Result().Cookies() {
+					req.AddCookie(cookie)
+				}
+			}
+			w := httptest.NewRecorder()
+			oidcCallback(w, req)
+
+			if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+				t.Errorf("callback = %d to %q, want a redirect to /login", w.Code, w.Header().Get("Location"))
+			}
+			if !strings.Contains(flashFrom(w), tt.flash) {
+				t.Errorf("flash = %q, want it to mention %q", flashFrom(w), tt.flash)
+			}
+			for _, cookie := range w.Result().Cookies() {
+				if cookie.Name == "session_token" {
+					t.Errorf("session cookie set on a rejected callback")
+				}
+			}
+		})
+	}
+}
+
+// TestOIDCUsernameBase verifies usernames for new accounts are derived from safe characters only
+func TestOIDCUsernameBase(t *testing.T) {
+	tests := []struct {
+		claims oidcClaims
+		want   string
+	}{
+		{oidcClaims{PreferredUsername: "jane.doe", Email: "jd@example.com"}, "jane.doe"},
+		{oidcClaims{Email: "jane+news@example.com"}, "janenews"},
+		{oidcClaims{PreferredUsername: "Jane Doe <script>"}, "JaneDoescript"},
+		{oidcClaims{PreferredUsername: "ææ"}, "user"},
+		{oidcClaims{PreferredUsername: strings.Repeat("a", 50)}, strings.Repeat("a", maxOIDCUsernameLength)},
+	}
+
+	for _, tt := range tests {
+		if got := oidcUsernameBase(&tt.claims); got != tt.want {
+			t.Errorf("oidcUsernameBase(%+v) = %q, want %q", tt.claims, got, tt.want)
+		}
+	}
+}
+
+// TestLoginPage_ShowsSSO verifies the login page offers single sign-on only when it is configured
+func TestLoginPage_ShowsSSO(t *testing.T) {
+	templates = template.Must(template.ParseGlob("../templates/*.html"))
+	newMockOIDCProvider(t)
+
+	w := httptest.NewRecorder()
+	login1(w, httptest.NewRequest("GET", "/login", nil))
+	if !strings.Contains(w.Body.String(), `href="/login/oidc">Log in with Test IdP`) {
+		t.Errorf("login page has no single sign-on link")
+	}
+
+	oidcProvider = nil
+	w = httptest.NewRecorder()
+	login1(w, httptest.NewRequest("GET", "/login", nil))
+	if strings.Contains(w.Body.String(), "/login/oidc") {
+		t.Errorf("login page links to single sign-on while it is off")
+	}
+}
+
+// TestOIDCLogin_Integration verifies account creation, repeat logins, linking by e-mail and the 2FA step
+func TestOIDCLogin_Integration(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	mock := newMockOIDCProvider(t)
+	capture := useCaptureMailer(t)
+
+	sessionUser := func(w *httptest.ResponseRecorder) string {
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == "session_token" && cookie.Value != "" {
+				username, _ := validateSession(sessionRequest(cookie.Value))
+				return username
+			}
+		}
+		return ""
+	}
+
+	t.Run("new identity creates an account", func(t *testing.T) {
+		mock.setClaims(map[string]interface{}{
+			"sub": "testuser-sso-1", "email": "testuser_sso@example.com", "email_verified": true, "preferred_username": "testuser_sso",
+		})
+		w := oidcFlow(t, mock)
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+			t.Fatalf("callback = %d to %q, flash %q", w.Code, w.Header().Get("Location"), flashFrom(w))
+		}
+		if got := sessionUser(w); got != "testuser_sso" {
+			t.Errorf("logged in as %q, want testuser_sso", got)
+		}
+
+		var verified bool
+		var identities int
+		testDB.QueryRow("SELECT verified_at IS NOT NULL FROM users WHERE username = 'testuser_sso'").Scan(&verified)
+		testDB.QueryRow(`SELECT COUNT(*) FROM user_identities WHERE subject = 'testuser-sso-1' AND issuer = $1`, mock.server.URL).Scan(&identities)
+		if !verified || identities != 1 {
+			t.Errorf("verified=%v identities=%d, want a verified account with one identity", verified, identities)
+		}
+	})
+
+	t.Run("same identity logs into the same account", func(t *testing.T) {
+		// A changed preferred username must not create a second account
+		mock.setClaims(map[string]interface{}{
+			"sub": "testuser-sso-1", "email": "testuser_sso@example.com", "email_verified": true, "preferred_username": "testuser_renamed",
+		})
+		w := oidcFlow(t, mock)
+		if got := sessionUser(w); got != "testuser_sso" {
+			t.Errorf("logged in as %q, flash %q, want testuser_sso", got, flashFrom(w))
+		}
+	})
+
+	t.Run("taken username gets a suffix", func(t *testing.T) {
+		mock.setClaims(map[string]interface{}{
+			"sub": "testuser-sso-2", "email": "testuser_sso_two@example.com", "email_verified": false, "preferred_username": "testuser_sso",
+		})
+		w := oidcFlow(t, mock)
+		if got := sessionUser(w); got != "testuser_sso2" {
+			t.Errorf("logged in as %q, flash %q, want testuser_sso2", got, flashFrom(w))
+		}
+		// Unverified at the provider, so the address is verified by mail like a normal registration
+		if len(capture.sent) != 1 {
+			t.Errorf("sent %d verification mails, want 1", len(capture.sent))
+		}
+	})
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	_, err := testDB.Exec(`INSERT INTO users (username, email, password, registration_ip, verified_at) VALUES
+		('testuser_sso_local', 'testuser_sso_local@example.com', $1, '127.0.0.1', NOW()),
+		('testuser_sso_unverified', 'testuser_sso_unverified@example.com', $1, '127.0.0.1', NULL)`, string(hashedPassword))
+	if err != nil {
+		t.Fatalf("failed to create test users: %v", err)
+	}
+
+	t.Run("verified e-mail links an existing account", func(t *testing.T) {
+		mock.setClaims(map[string]interface{}{
+			"sub": "testuser-sso-3", "email": "TestUser_SSO_Local@example.com", "email_verified": true,
+		})
+		w := oidcFlow(t, mock)
+		if got := sessionUser(w); got != "testuser_sso_local" {
+			t.Errorf("logged in as %q, flash %q, want testuser_sso_local", got, flashFrom(w))
+		}
+	})
+
+	t.Run("unverified e-mail doesn't link", func(t *testing.T) {
+		mock.setClaims(map[string]interface{}{
+			"sub": "testuser-sso-4", "email": "testuser_sso_unverified@example.com", "email_verified": true,
+		})
+		w := oidcFlow(t, mock)
+		if got := sessionUser(w); got != "" || !strings.Contains(flashFrom(w), "already exists") {
+			t.Errorf("logged in as %q, flash %q, want a refusal", got, flashFrom(w))
+		}
+	})
+
+	t.Run("logged-in user connects an identity", func(t *testing.T) {
+		createSession("testuser_sso_unverified", "test-sso-connect", "Go-http-client/1.1", "127.0.0.1")
+		mock.setClaims(map[string]interface{}{"sub": "testuser-sso-5", "email": "elsewhere@example.com"})
+
+		w := oidcFlow(t, mock, &http.Cookie{Name: "session_token", Value: "test-sso-connect"})
+		if w.Header().Get("Location") != "/account" || !strings.Contains(flashFrom(w), "connected") {
+			t.Fatalf("callback = %d to %q, flash %q", w.Code, w.Header().Get("Location"), flashFrom(w))
+		}
+
+		// The identity now logs into that account, another logged-in user can't claim it
+		w = oidcFlow(t, mock)
+		if got := sessionUser(w); got != "testuser_sso_unverified" {
+			t.Errorf("logged in as %q, want testuser_sso_unverified", got)
+		}
+		createSession("testuser_sso_local", "test-sso-other", "Go-http-client/1.1", "127.0.0.1")
+		w = oidcFlow(t, mock, &http.Cookie{Name: "session_token", Value: "test-sso-other"})
+		if !strings.Contains(flashFrom(w), "another account") {
+			t.Errorf("flash = %q, want a refusal", flashFrom(w))
+		}
+	})
+
+	t.Run("two-factor accounts still enter a code", func(t *testing.T) {
+		testDB.Exec("UPDATE users SET totp_secret = 'JBSWY3DPEHPK3PXP', totp_enabled_at = NOW() WHERE username = 'testuser_sso_local'")
+		mock.setClaims(map[string]interface{}{"sub": "testuser-sso-3", "email": "testuser_sso_local@example.com", "email_verified": true})
+
+		w := oidcFlow(t, mock)
+		if w.Header().Get("Location") != "/login/2fa" || sessionUser(w) != "" {
+			t.Errorf("callback = %d to %q, want the 2FA step without a session", w.Code, w.Header().Get("Location"))
+		}
+	})
+
+	t.Run("sign-up disabled", func(t *testing.T) {
+		oidcProvider.AllowSignup = false
+		mock.setClaims(map[string]interface{}{"sub": "testuser-sso-6", "email": "testuser_sso_new@example.com", "email_verified": true})
+
+		w := oidcFlow(t, mock)
+		var exists bool
+		testDB.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE email = 'testuser_sso_new@example.com')").Scan(&exists)
+		if exists || !strings.Contains(flashFrom(w), "no account") {
+			t.Errorf("account created=%v, flash %q", exists, flashFrom(w))
+		}
+	})
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Reset links stay valid for one hour
+const passwordResetTTL = time.Hour
+
+// Minimum time between reset e-mails for the same account
+const passwordResetInterval = time.Minute
+
+// Shown for every forgot-password request so the response doesn't reveal whether an account exists
+const passwordResetSentMessage = "If an account exists for that e-mail address, we've sent a link to reset the password"
+
+// hashToken returns the SHA-256 of a token, the form in which tokens are stored
+// A leaked database dump then can't be used to reset passwords
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// forgotPasswordPage renders the form asking for the account's e-mail address
+func forgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+	renderTemplate(w, "forgot_password.html", buildViewData(w, r))
+}
+
+// forgotPassword issues a reset token and mails it (POST /api/forgot-password)
+func forgotPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientIP := getClientIP(r)
+	email := strings.TrimSpace(r.FormValue("email"))
+	values := map[string]string{"Email": email}
+
+	if !isValidEmail(email) {
+		renderFormError(w, r, "forgot_password.html", values, http.StatusBadRequest, "Invalid e-mail address",
+			map[string]string{"email": "Please enter a valid e-mail address"})
+		return
+	}
+
+	var userID int
+	var username, accountEmail string
+	err := db.QueryRow("SELECT id, username, email FROM users WHERE LOWER(email) = LOWER($1)", email).
+		Scan(&userID, &username, &accountEmail)
+	switch {
+	case err == sql.ErrNoRows:
+		log.Printf("Password reset requested: ip=%s result=unknown_email", clientIP)
+	case err != nil:
+		log.Printf("Password reset failed: ip=%s reason=database_error error=%v", clientIP, err)
+		renderFormError(w, r, "forgot_password.html", values, http.StatusInternalServerError, "Internal server error", nil)
+		return
+	default:
+		if err := issuePasswordReset(userID, username, accountEmail, clientIP); err != nil {
+			log.Printf("Password reset failed: username=%s ip=%s error=%v", username, clientIP, err)
+		}
+	}
+
+	setFlash(w, passwordResetSentMessage)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// issuePasswordReset stores a hashed reset token and mails the link in the background
+// Mailing asynchronously keeps the response time the same for known and unknown addresses
+func issuePasswordReset(userID int, username, email, clientIP string) error {
+	var recent bool
+	err := db.QueryRow(`SELECT EXISTS (
+		SELECT 1 FROM password_resets WHERE user_id = $1 AND created_at > $2
+	)`, userID, time.Now().Add(-passwordResetInterval)).Scan(&recent)
+	if err != nil {
+		return err
+	}
+	if recent {
+		log.Printf("Password reset requested: username=%s ip=%s result=throttled", username, clientIP)
+		return nil
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`INSERT INTO password_resets (token_hash, user_id, email, expires_at, requested_ip)
+		VALUES ($1, $2, $3, $4, $5)`,
+		hashToken(token), userID, email, time.Now().Add(passwordResetTTL), clientIP)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Password reset requested: username=%s ip=%s result=sent", username, clientIP)
+
+	link := getBaseURL() + "/reset-password?token=" + token
+	go func() {
+		err := mailer.Send(Mail{
+			To:      email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Hi %s,\n\n"+
+				"Someone asked to reset the password for your ¿Who Knows? account. Choose a new password here:\n\n%s\n\n"+
+				"The link expires in %d minutes and can only be used once. "+
+				"If you didn't ask for this, you can ignore this e-mail, your password is unchanged.\n",
+				username, link, int(passwordResetTTL.Minutes())),
+		})
+		if err != nil {
+			log.Printf("Password reset e-mail failed: username=%s error=%v", username, err)
+		}
+	}()
+	return nil
+}
+
+// passwordResetValid reports whether a reset token can still be used
+func passwordResetValid(token string) (bool, error) {
+	var valid bool
+	err := db.QueryRow(`SELECT EXISTS (
+		SELECT 1 FROM password_resets pr JOIN users u ON u.id = pr.user_id
+		WHERE pr.token_hash = $1 AND pr.used_at IS NULL AND pr.expires_at > $2 AND pr.email = u.email
+	)`, hashToken(token), time.Now()).Scan(&valid)
+	return valid, err
+}
+
+// resetPasswordPage renders the new password form for the token in the e-mailed link
+func resetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	data := buildViewData(w, r)
+	token := r.URL.Query().Get("token")
+
+	valid, err := passwordResetValid(token)
+	if err != nil {
+		log.Printf("Password reset lookup failed: error=%v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if valid {
+		data["Token"] = token
+	} else {
+		data["Error"] = "This reset link is invalid or has expired"
+	}
+	renderTemplate(w, "reset_password.html", data)
+}
+
+// resetPassword sets a new password from a reset token (POST /api/reset-password)
+// The token and any other outstanding ones are used up and all of the user's sessions are ended
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientIP := getClientIP(r)
+	token := r.FormValue("token")
+	password := r.FormValue("password")
+	password2 := r.FormValue("password2")
+	values := map[string]string{"Token": token}
+
+	if password == "" || password2 == "" {
+		renderFormError(w, r, "reset_password.html", values, http.StatusBadRequest, "Both password fields are required", nil)
+		return
+	}
+	if password != password2 {
+		renderFormError(w, r, "reset_password.html", values, http.StatusBadRequest, "Passwords do not match",
+			map[string]string{"password2": "Passwords do not match"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Password reset failed: ip=%s reason=database_error error=%v", clientIP, err)
+		renderFormError(w, r, "reset_password.html", values, http.StatusInternalServerError, "Internal server error", nil)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the token row so two concurrent submissions can't both use it
+	var userID int
+	var username, email string
+	err = tx.QueryRow(`SELECT u.id, u.username, u.email
+		FROM password_resets pr JOIN users u ON u.id = pr.user_id
+		WHERE pr.token_hash = $1 AND pr.used_at IS NULL AND pr.expires_at > $2 AND pr.email = u.email
+		FOR UPDATE OF pr`,
+		hashToken(token), time.Now()).Scan(&userID, &username, &email)
+	if err == sql.ErrNoRows {
+		log.Printf("Password reset failed: ip=%s reason=invalid_token", clientIP)
+		renderFormError(w, r, "reset_password.html", nil, http.StatusBadRequest, "This reset link is invalid or has expired", nil)
+		return
+	} else if err != nil {
+		log.Printf("Password reset failed: ip=%s reason=database_error error=%v", clientIP, err)
+		renderFormError(w, r, "reset_password.html", values, http.StatusInternalServerError, "Internal server error", nil)
+		return
+	}
+
+	if reasons := checkPasswordPolicy(password, username, email); len(reasons) > 0 {
+		renderFormError(w, r, "reset_password.html", values, http.StatusBadRequest, "Password does not meet the requirements",
+			map[string]string{"password": strings.Join(reasons, " ")})
+		return
+	}
+
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		log.Printf("Password reset failed: username=%s ip=%s reason=hash_generation_error", username, clientIP)
+		renderFormError(w, r, "reset_password.html", values, http.StatusInternalServerError, "Failed to reset password", nil)
+		return
+	}
+
+	// Opening the e-mailed link proves ownership of the address, so it also counts as verification
+	_, err = tx.Exec("UPDATE users SET password = $1, verified_at = COALESCE(verified_at, NOW()) WHERE id = $2",
+		hashedPassword, userID)
+	if err == nil {
+		// Use up this token and any other outstanding ones
+		_, err = tx.Exec("UPDATE password_resets SET used_at = NOW() WHERE user_id = $1 AND used_at IS NULL", userID)
+	}
+	if err == nil {
+		// Log out everywhere, in case the old password was known to someone else
+		_, err = tx.Exec("DELETE FROM sessions WHERE username = $1", username)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Password reset failed: username=%s ip=%s reason=database_error error=%v", username, clientIP, err)
+		renderFormError(w, r, "reset_password.html", values, http.StatusInternalServerError, "Failed to reset password", nil)
+		return
+	}
+
+	log.Printf("Password reset success: username=%s ip=%s", username, clientIP)
+
+	// Clear this browser's session cookie too, its session was just deleted
+	clearSessionCookie(w)
+	setFlash(w, "Your password has been reset, please log in with the new password")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// postForm sends a form POST to a handler and returns the recorded response
+func postForm(handler http.HandlerFunc, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+// flashFrom decodes the flash message set on a response
+func flashFrom(w *httptest.ResponseRecorder) string {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == flashCookieName {
+			message, _ := verifyCookieValue(cookie.Value)
+			return message
+		}
+	}
+	return ""
+}
+
+// waitForMail waits for the background sender to deliver n mails
+func waitForMail(t *testing.T, capture *captureMailer, n int) []Mail {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		capture.mu.Lock()
+		sent := append([]Mail(nil), capture.sent...)
+		capture.mu.Unlock()
+		if len(sent) >= n {
+			return sent
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d mails, none arrived in time", n)
+	return nil
+}
+
+// TestResetPassword_MismatchKeepsToken verifies validation errors keep the token in the form
+func TestResetPassword_MismatchKeepsToken(t *testing.T) {
+	templates = template.Must(template.ParseGlob("../templates/*.html"))
+
+	w := postForm(resetPassword, "/api/reset-password", url.Values{
+		"token":     {"abc123-token"},
+		"password":  {"first-password"},
+		"password2": {"second-password"},
+	})
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status code = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `name="token" value="abc123-token"`) {
+		t.Errorf("re-rendered form lost the reset token")
+	}
+	if !strings.Contains(body, "Passwords do not match") {
+		t.Errorf("re-rendered form does not show the mismatch")
+	}
+}
+
+// TestPasswordReset_Integration verifies the full forgot/reset flow
+func TestPasswordReset_Integration(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	capture := useCaptureMailer(t)
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("old-password"), bcrypt.MinCost)
+	_, err := testDB.Exec(`INSERT INTO users (username, email, password, registration_ip) VALUES ($1, $2, $3, $4)`,
+		"testuser_reset", "testuser_reset@example.com", string(hashedPassword), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed to create test user: %v", err)
+	}
+	for _, token := range []string{"test-reset-session-1", "test-reset-session-2"} {
+		createSession("testuser_reset", token, "Go-http-client/1.1", "127.0.0.1")
+	}
+
+	// Known and unknown addresses get the same response
+	known := postForm(forgotPassword, "/api/forgot-password", url.Values{"email": {"TestUser_Reset@example.com"}})
+	unknown := postForm(forgotPassword, "/api/forgot-password", url.Values{"email": {"testuser_nobody@example.com"}})
+	if known.Code != unknown.Code || known.Header().Get("Location") != unknown.Header().Get("Location") || flashFrom(known) != flashFrom(unknown) {
+		t.Errorf("responses differ: known=%d %q unknown=%d %q", known.Code, flashFrom(known), unknown.Code, flashFrom(unknown))
+	}
+
+	sent := waitForMail(t, capture, 1)
+	if len(sent) != 1 || sent[0].To != "testuser_reset@example.com" {
+		t.Fatalf("expected one reset e-mail to the account address, got %+v", sent)
+	}
+	start := strings.Index(sent[0].Body, "/reset-password?token=")
+	token := strings.Fields(strings.TrimPrefix(sent[0].Body[start:], "/reset-password?token="))[0]
+
+	// Only the hash is stored
+	var stored int
+	testDB.QueryRow("SELECT COUNT(*) FROM password_resets WHERE token_hash = $1", token).Scan(&stored)
+	if stored != 0 {
+		t.Errorf("reset token stored in plain text")
+	}
+
+	w := postForm(resetPassword, "/api/reset-password", url.Values{
+		"token":     {token},
+		"password":  {"violet-canoe-42-ladder"},
+		"password2": {"violet-canoe-42-ladder"},
+	})
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+		t.Fatalf("reset response = %d %s, body=%s", w.Code, w.Header().Get("Location"), w.Body.String())
+	}
+
+	var newHash string
+	testDB.QueryRow("SELECT password FROM users WHERE username = $1", "testuser_reset").Scan(&newHash)
+	if bcrypt.CompareHashAndPassword([]byte(newHash), []byte("violet-canoe-42-ladder")) != nil {
+		t.Errorf("password was not changed")
+	}
+
+	var sessions int
+	testDB.QueryRow("SELECT COUNT(*) FROM sessions WHERE username = $1", "testuser_reset").Scan(&sessions)
+	if sessions != 0 {
+		t.Errorf("sessions = %d after reset, want 0", sessions)
+	}
+
+	// The link is single-use
+	if valid, _ := passwordResetValid(token); valid {
+		t.Errorf("reset token still valid after use")
+	}
+}
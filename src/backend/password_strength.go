@@ -0,0 +1,336 @@
+package main
+
+import (
+	_ "embed"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Commonly used passwords, most frequent first, used as the strength estimator's dictionary
+//
+//go:embed common_passwords.txt
+var commonPasswordsList string
+
+// commonPasswordRanks maps each common password to its frequency rank (1 = most common)
+var commonPasswordRanks = func() map[string]int {
+	ranks := make(map[string]int)
+	for _, line := range strings.Split(commonPasswordsList, "\n") {
+		word := strings.ToLower(strings.TrimSpace(line))
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		if _, exists := ranks[word]; !exists {
+			ranks[word] = len(ranks) + 1
+		}
+	}
+	return ranks
+}()
+
+// Keyboard rows used to detect patterns like "qwerty" or "asdf"
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+// Reverse common l33t substitutions before dictionary lookups
+var leetSubstitutions = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '@': 'a', '$': 's', '!': 'i',
+}
+
+// Minimum lengths before a run counts as a pattern rather than random characters
+const (
+	minDictionaryMatch = 3
+	minRepeatMatch     = 3
+	minSequenceMatch   = 3
+	minKeyboardMatch   = 4
+)
+
+// Pattern names, also used to choose the feedback shown to the user
+const (
+	patternUserInput = "user_input"
+	patternWord      = "dictionary"
+	patternKeyboard  = "keyboard"
+	patternSequence  = "sequence"
+	patternRepeat    = "repeat"
+	patternYear      = "year"
+)
+
+// Feedback per pattern, ordered from most to least important
+var strengthWarnings = []struct {
+	pattern string
+	warning string
+}{
+	{patternUserInput, "avoid using your username or e-mail"},
+	{patternWord, "avoid common passwords and words"},
+	{patternKeyboard, "avoid keyboard patterns like qwerty"},
+	{patternSequence, "avoid sequences like abc or 123"},
+	{patternRepeat, "avoid repeated characters"},
+	{patternYear, "avoid years and dates"},
+}
+
+// strengthMatch is a guessable pattern covering password runes [start, end)
+type strengthMatch struct {
+	start   int
+	end     int
+	guesses float64
+	pattern string
+}
+
+// PasswordStrength is a zxcvbn-style estimate: Score runs from 0 (trivial) to 4 (very strong)
+type PasswordStrength struct {
+	Score   int
+	Guesses float64
+	Warning string
+}
+
+// estimatePasswordStrength estimates how many guesses an attacker needs, modelled on zxcvbn:
+// the password is split into the cheapest sequence of known patterns and random characters
+// userInputs (username, e-mail) are treated as the most likely dictionary words
+func estimatePasswordStrength(password string, userInputs ...string) PasswordStrength {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return PasswordStrength{}
+	}
+
+	matches := findStrengthMatches(runes, userInputs)
+
+	// Brute forcing one character costs the size of the character classes in use
+	charGuesses := math.Log10(float64(bruteforceCardinality(runes)))
+
+	// best[i] is the minimal log10(guesses) for the first i runes, via[i] the match that ends there
+	best := make([]float64, len(runes)+1)
+	via := make([]*strengthMatch, len(runes)+1)
+	for i := 1; i <= len(runes); i++ {
+		best[i] = best[i-1] + charGuesses
+		via[i] = nil
+		for j := range matches {
+			m := &matches[j]
+			if m.end != i {
+				continue
+			}
+			if cost := best[m.start] + math.Log10(m.guesses); cost < best[i] {
+				best[i] = cost
+				via[i] = m
+			}
+		}
+	}
+
+	// Walk back through the chosen segmentation to collect the patterns it used
+	used := make(map[string]bool)
+	for i := len(runes); i > 0; {
+		if m := via[i]; m != nil {
+			used[m.pattern] = true
+			i = m.start
+		} else {
+			i--
+		}
+	}
+
+	strength := PasswordStrength{Guesses: math.Pow(10, best[len(runes)])}
+	switch log := best[len(runes)]; {
+	case log < 3:
+		strength.Score = 0
+	case log < 6:
+		strength.Score = 1
+	case log < 8:
+		strength.Score = 2
+	case log < 10:
+		strength.Score = 3
+	default:
+		strength.Score = 4
+	}
+
+	for _, w := range strengthWarnings {
+		if used[w.pattern] {
+			strength.Warning = w.warning
+			break
+		}
+	}
+	return strength
+}
+
+// findStrengthMatches returns every dictionary, keyboard, sequence, repeat and year pattern in the password
+func findStrengthMatches(runes []rune, userInputs []string) []strengthMatch {
+	lower := []rune(strings.ToLower(string(runes)))
+	unleet := make([]rune, len(lower))
+	for i, r := range lower {
+		if sub, ok := leetSubstitutions[r]; ok {
+			unleet[i] = sub
+		} else {
+			unleet[i] = r
+		}
+	}
+
+	inputs := make(map[string]bool)
+	for _, input := range userInputs {
+		input = strings.ToLower(strings.TrimSpace(input))
+		if local, _, found := strings.Cut(input, "@"); found {
+			inputs[local] = true
+		}
+		inputs[input] = true
+	}
+
+	var matches []strengthMatch
+
+	// Dictionary words and user inputs, with extra guesses for capitalisation and l33t
+	for i := 0; i < len(lower); i++ {
+		for j := i + minDictionaryMatch; j <= len(lower); j++ {
+			candidates := []string{string(lower[i:j])}
+			if deleeted := string(unleet[i:j]); deleeted != candidates[0] {
+				candidates = append(candidates, deleeted)
+			}
+			for k, candidate := range candidates {
+				variations := uppercaseVariations(runes[i:j])
+				if k > 0 {
+					variations *= 2
+				}
+				if inputs[candidate] {
+					matches = append(matches, strengthMatch{i, j, variations, patternUserInput})
+				} else if rank, ok := commonPasswordRanks[candidate]; ok {
+					matches = append(matches, strengthMatch{i, j, float64(rank) * variations, patternWord})
+				}
+			}
+		}
+	}
+
+	// Runs of the same character
+	for i := 0; i < len(lower); {
+		j := i + 1
+		for j < len(lower) && lower[j] == lower[i] {
+			j++
+		}
+		if j-i >= minRepeatMatch {
+			matches = append(matches, strengthMatch{i, j, float64(bruteforceCardinality(lower[i:i+1]) * (j - i)), patternRepeat})
+		}
+		i = j
+	}
+
+	// Ascending or descending letters and digits, e.g. abcd or 9876
+	for i := 0; i+1 < len(lower); {
+		delta := lower[i+1] - lower[i]
+		j := i + 1
+		if (delta == 1 || delta == -1) && sameSequenceClass(lower[i], lower[i+1]) {
+			for j+1 < len(lower) && lower[j+1]-lower[j] == delta && sameSequenceClass(lower[j], lower[j+1]) {
+				j++
+			}
+			if length := j - i + 1; length >= minSequenceMatch {
+				base := 26.0
+				if unicode.IsDigit(lower[i]) {
+					base = 10
+				}
+				if strings.ContainsRune("az019", lower[i]) {
+					base = 4 // obvious starting points
+				}
+				if delta == -1 {
+					base *= 2
+				}
+				matches = append(matches, strengthMatch{i, j + 1, base * float64(length), patternSequence})
+			}
+		}
+		i = j
+	}
+
+	// Straight runs along a keyboard row, forwards or backwards
+	for i := 0; i < len(lower); i++ {
+		for j := len(lower); j >= i+minKeyboardMatch; j-- {
+			run := string(lower[i:j])
+			if onKeyboardRow(run) {
+				matches = append(matches, strengthMatch{i, j, 40 * float64(j-i), patternKeyboard})
+				break
+			}
+		}
+	}
+
+	// Recent years
+	for i := 0; i+4 <= len(lower); i++ {
+		year := string(lower[i : i+4])
+		if (strings.HasPrefix(year, "19") || strings.HasPrefix(year, "20")) && isDigits(year) {
+			matches = append(matches, strengthMatch{i, i + 4, 120, patternYear})
+		}
+	}
+
+	return matches
+}
+
+// uppercaseVariations returns how many capitalisation guesses a word needs
+func uppercaseVariations(word []rune) float64 {
+	upper := 0
+	for _, r := range word {
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+	switch {
+	case upper == 0:
+		return 1
+	case upper == len(word), upper == 1 && unicode.IsUpper(word[0]):
+		return 2
+	default:
+		return math.Min(math.Pow(2, float64(upper)), 1000)
+	}
+}
+
+// bruteforceCardinality returns the combined size of the character classes used
+func bruteforceCardinality(runes []rune) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	cardinality := 0
+	if lower {
+		cardinality += 26
+	}
+	if upper {
+		cardinality += 26
+	}
+	if digit {
+		cardinality += 10
+	}
+	if symbol {
+		cardinality += 33
+	}
+	if other {
+		cardinality += 100
+	}
+	return cardinality
+}
+
+// sameSequenceClass reports whether both runes are letters or both are digits
+func sameSequenceClass(a, b rune) bool {
+	return (unicode.IsLetter(a) && unicode.IsLetter(b) && a < unicode.MaxASCII && b < unicode.MaxASCII) ||
+		(unicode.IsDigit(a) && unicode.IsDigit(b))
+}
+
+// onKeyboardRow reports whether run appears as-is or reversed on a keyboard row
+func onKeyboardRow(run string) bool {
+	reversed := []rune(run)
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+	for _, row := range keyboardRows {
+		if strings.Contains(row, run) || strings.Contains(row, string(reversed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDigits reports whether s consists only of ASCII digits
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
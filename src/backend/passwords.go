@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Default password policy, overridable with PASSWORD_MIN_LENGTH and PASSWORD_MIN_STRENGTH
+const (
+	defaultPasswordMinLength   = 8
+	defaultPasswordMinStrength = 2
+	// bcrypt only uses the first 72 bytes and GenerateFromPassword rejects anything longer
+	maxPasswordBytes = 72
+)
+
+// PasswordPolicy is the set of rules a new password must satisfy
+type PasswordPolicy struct {
+	MinLength   int
+	MinStrength int    // 0-4, see estimatePasswordStrength
+	BreachedDir string // directory of k-anonymity range files, empty disables the check
+}
+
+// getPasswordPolicy reads the policy from the environment
+func getPasswordPolicy() PasswordPolicy {
+	policy := PasswordPolicy{
+		MinLength:   defaultPasswordMinLength,
+		MinStrength: defaultPasswordMinStrength,
+		BreachedDir: os.Getenv("BREACHED_PASSWORDS_DIR"),
+	}
+	if value, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && value > 0 {
+		policy.MinLength = value
+	}
+	if value, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_STRENGTH")); err == nil && value >= 0 && value <= 4 {
+		policy.MinStrength = value
+	}
+	return policy
+}
+
+// checkPasswordPolicy validates a new password against the configured policy
+// Every place that sets a password (registration, password change, reset) must call this
+func checkPasswordPolicy(password string, userInputs ...string) []string {
+	return getPasswordPolicy().Check(password, userInputs...)
+}
+
+// Check returns the reasons the password is rejected, or nil when it's acceptable
+// userInputs (username, e-mail) make passwords built from them score lower
+func (p PasswordPolicy) Check(password string, userInputs ...string) []string {
+	if length := utf8.RuneCountInString(password); length < p.MinLength {
+		return []string{fmt.Sprintf("Password must be at least %d characters.", p.MinLength)}
+	}
+	if len(password) > maxPasswordBytes {
+		return []string{fmt.Sprintf("Password must be at most %d bytes.", maxPasswordBytes)}
+	}
+
+	var reasons []string
+
+	if strength := estimatePasswordStrength(password, userInputs...); strength.Score < p.MinStrength {
+		reason := "Password is too easy to guess"
+		if strength.Warning != "" {
+			reason += ", " + strength.Warning
+		}
+		reasons = append(reasons, reason+".")
+	}
+
+	if p.BreachedDir != "" {
+		count, err := breachedPasswordCount(p.BreachedDir, password)
+		if err != nil {
+			// Fail open, a missing or unreadable range file shouldn't block sign ups
+			log.Printf("Breached password check failed: dir=%s error=%v", p.BreachedDir, err)
+		} else if count > 0 {
+			reasons = append(reasons, "Password has appeared in a data breach, please choose another.")
+		}
+	}
+
+	return reasons
+}
+
+// hashPassword bcrypt-hashes a password that already passed checkPasswordPolicy
+func hashPassword(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hashed), err
+}
+
+// breachedPasswordCount looks the password up in a local copy of the Pwned Passwords range files
+// Like the k-anonymity API, dir holds one file per 5 character SHA-1 prefix (e.g. 5BAA6.txt)
+// containing "<35 character suffix>:<count>" lines, so only one small file is read per check
+func breachedPasswordCount(dir, password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := os.Open(filepath.Join(dir, prefix+".txt"))
+	if os.IsNotExist(err) {
+		file, err = os.Open(filepath.Join(dir, prefix))
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		candidate, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !strings.EqualFold(candidate, suffix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil {
+			// Files without counts still mark the hash as breached
+			return 1, nil
+		}
+		// Padding entries copied from the API carry a count of 0
+		return n, nil
+	}
+	return 0, scanner.Err()
+}
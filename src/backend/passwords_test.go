@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestEstimatePasswordStrength verifies common patterns score low and random passwords score high
+func TestEstimatePasswordStrength(t *testing.T) {
+	tests := []struct {
+		password    string
+		maxScore    int
+		minScore    int
+		wantWarning string
+	}{
+		{"password", 0, 0, "avoid common passwords and words"},
+		{"P@ssw0rd", 0, 0, "avoid common passwords and words"},
+		{"aaaaaaaaaa", 0, 0, "avoid repeated characters"},
+		{"abcdefghij", 0, 0, "avoid sequences like abc or 123"},
+		{"asdfghjkl", 0, 0, "avoid keyboard patterns like qwerty"},
+		{"testuser_strength1", 1, 0, "avoid using your username or e-mail"},
+		{"correcthorsebatterystaple", 4, 4, ""},
+		{"kL9#mq2!Xz", 4, 4, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			got := estimatePasswordStrength(tt.password, "testuser_strength", "strength@example.com")
+			if got.Score < tt.minScore || got.Score > tt.maxScore {
+				t.Errorf("Score = %d, want between %d and %d", got.Score, tt.minScore, tt.maxScore)
+			}
+			if got.Warning != tt.wantWarning {
+				t.Errorf("Warning = %q, want %q", got.Warning, tt.wantWarning)
+			}
+		})
+	}
+}
+
+// writeBreachedRange writes a k-anonymity range file containing the given passwords
+func writeBreachedRange(t *testing.T, dir string, passwords ...string) {
+	t.Helper()
+	for _, password := range passwords {
+		sum := sha1.Sum([]byte(password))
+		hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+		path := filepath.Join(dir, hash[:5]+".txt")
+
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			t.Fatalf("failed to write range file: %v", err)
+		}
+		file.WriteString("0018A45C4D1DEF81644B54AB7F969B88D65:3\r\n" + hash[5:] + ":42\r\n")
+		file.Close()
+	}
+}
+
+// TestPasswordPolicy_Check verifies length, strength and breach reasons
+func TestPasswordPolicy_Check(t *testing.T) {
+	dir := t.TempDir()
+	writeBreachedRange(t, dir, "Xk7#pL9mQ2vZ")
+	policy := PasswordPolicy{MinLength: 8, MinStrength: 2, BreachedDir: dir}
+
+	tests := []struct {
+		name     string
+		password string
+		want     string
+	}{
+		{"too short", "a", "at least 8 characters"},
+		{"too long for bcrypt", strings.Repeat("x9!", 25), "at most 72 bytes"},
+		{"too weak", "password1", "too easy to guess"},
+		{"breached", "Xk7#pL9mQ2vZ", "data breach"},
+		{"acceptable", "violet-canoe-42-ladder", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reasons := policy.Check(tt.password, "testuser_policy")
+			got := strings.Join(reasons, " ")
+			if tt.want == "" && len(reasons) > 0 {
+				t.Errorf("Check() = %v, want no reasons", reasons)
+			}
+			if tt.want != "" && !strings.Contains(got, tt.want) {
+				t.Errorf("Check() = %q, want reason containing %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestBreachedPasswordCount verifies lookups and a missing range file
+func TestBreachedPasswordCount(t *testing.T) {
+	dir := t.TempDir()
+	writeBreachedRange(t, dir, "hunter2")
+
+	if count, err := breachedPasswordCount(dir, "hunter2"); err != nil || count != 42 {
+		t.Errorf("breachedPasswordCount() = %d, %v, want 42", count, err)
+	}
+	if _, err := breachedPasswordCount(dir, "not-in-any-range"); !os.IsNotExist(err) {
+		t.Errorf("breachedPasswordCount() error = %v, want not exist", err)
+	}
+}
+
+// TestRegister_RejectsWeakPassword verifies policy reasons are shown on the password field
+func TestRegister_RejectsWeakPassword(t *testing.T) {
+	templates = template.Must(template.ParseGlob("../templates/*.html"))
+
+	form := url.Values{}
+	form.Set("username", "testuser_weak")
+	form.Set("email", "weak@example.com")
+	form.Set("password", "a")
+	form.Set("password2", "a")
+
+	req := httptest.NewRequest("POST", "/api/register", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	register(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status code = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if !strings.Contains(w.Body.String(), `<div class="field-error">Password must be at least 8 characters.</div>`) {
+		t.Errorf("response does not explain the rejected password")
+	}
+}
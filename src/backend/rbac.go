@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+// Permissions granted through roles (role_permissions.permission)
+// The built-in roles are seeded in utils/init_db.go: admin holds all of them, analyst the read-only ones
+const (
+	permAdminAccess = "admin.access" // open the admin console at all
+	permUsersView   = "users.view"
+	permUsersManage = "users.manage" // grant and revoke roles
+	permPagesView   = "pages.view"
+	permStatsView   = "stats.view" // ingest stats and search analytics
+
+	permWebhooksManage = "webhooks.manage" // configure index event webhooks and read their delivery log
+)
+
+// Permission sets loaded by requirePermission, so handlers and templates can check more without another query
+const permissionsContextKey contextKey = "permissions"
+
+// adminAccessCondition is true for users with a role granting admin.access, for use in queries on users
+const adminAccessCondition = `EXISTS (SELECT 1 FROM user_roles
+	JOIN role_permissions ON role_permissions.role_id = user_roles.role_id
+	WHERE user_roles.user_id = users.id AND role_permissions.permission = '` + permAdminAccess + `')`
+
+// Permissions is the set of permissions a user holds through all of their roles
+type Permissions map[string]bool
+
+// Has reports whether the set contains permission, templates call it as {{.Permissions.Has "users.manage"}}
+func (p Permissions) Has(permission string) bool {
+	return p[permission]
+}
+
+// getUserPermissions returns the union of the permissions granted by the user's roles
+func getUserPermissions(userID int) (Permissions, error) {
+	rows, err := db.Query(`SELECT DISTINCT role_permissions.permission
+		FROM user_roles
+		JOIN role_permissions ON role_permissions.role_id = user_roles.role_id
+		WHERE user_roles.user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		permissions[permission] = true
+	}
+	return permissions, rows.Err()
+}
+
+// currentPermissions returns the permissions loaded by requirePermission, or an empty set
+func currentPermissions(r *http.Request) Permissions {
+	if permissions, ok := r.Context().Value(permissionsContextKey).(Permissions); ok {
+		return permissions
+	}
+	return Permissions{}
+}
+
+// requirePermission restricts a handler to logged-in users holding permission through one of their roles
+// Checked on every request against the database, so revoking a role takes effect immediately
+func requirePermission(permission string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		if user == nil {
+			denyAccess(w, r, http.StatusUnauthorized, "Please log in first", "/login")
+			return
+		}
+
+		permissions, err := getUserPermissions(user.ID)
+		if err != nil {
+			log.Printf("Failed to load permissions: username=%s error=%v", user.Username, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !permissions.Has(permission) {
+			log.Printf("Access denied: username=%s ip=%s path=%s permission=%s", user.Username, getClientIP(r), r.URL.Path, permission)
+			denyAccess(w, r, http.StatusForbidden, "You don't have access to that page", "/")
+			return
+		}
+
+		r = withUser(r, user)
+		handler(w, r.WithContext(context.WithValue(r.Context(), permissionsContextKey, permissions)))
+	}
+}
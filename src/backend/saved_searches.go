@@ -0,0 +1,568 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// Users can save at most this many searches, since the My searches page re-runs every one of them
+const maxSavedSearches = 50
+
+// Users can keep at most this many bookmarks
+const maxBookmarks = 500
+
+// Results shown per saved search on the My searches page, new ones are counted across all results
+const savedSearchResultsShown = 10
+
+// Saved search names and bookmark titles longer than this are rejected
+const maxSavedNameLength = 200
+
+// Bookmark notes longer than this are rejected
+const maxBookmarkNoteLength = 1000
+
+// SavedSearch is a query a user saved to re-run from the My searches page
+type SavedSearch struct {
+	ID           int64      `json:"id"`
+	Name         string     `json:"name"`
+	Query        string     `json:"query"`
+	Language     string     `json:"language"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastViewedAt *time.Time `json:"last_viewed_at"`
+	Alerts       []string   `json:"alerts"`
+	WebhookURL   string     `json:"webhook_url,omitempty"`
+	seenURLs     []string
+}
+
+// HasAlert reports whether the search alerts on channel
+func (s SavedSearch) HasAlert(channel string) bool {
+	for _, alert := range s.Alerts {
+		if alert == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// SearchURL links to the search page for the saved query
+func (s SavedSearch) SearchURL() string {
+	return "/?" + url.Values{"q": {s.Query}, "language": {s.Language}}.Encode()
+}
+
+// SavedSearchResult is a result of a re-run saved search, New when it wasn't there on the last visit
+type SavedSearchResult struct {
+	Page
+	New bool
+}
+
+// SavedSearchView is a saved search with its current results for the My searches page
+type SavedSearchView struct {
+	SavedSearch
+	Results  []SavedSearchResult
+	Total    int
+	NewCount int
+	Error    bool
+}
+
+// Bookmark is a search result a user bookmarked, with an optional note
+type Bookmark struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Title     string    `json:"title"`
+	Note      string    `json:"note"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// validSearchLanguage reports whether performSearch has a text search configuration for language
+func validSearchLanguage(language string) bool {
+	return language == "en" || language == "da"
+}
+
+// validBookmarkURL reports whether raw is an absolute http(s) URL worth linking to
+func validBookmarkURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// markNewResults flags the pages whose URL isn't in seen and returns how many were new
+func markNewResults(pages []Page, seen []string) ([]SavedSearchResult, int) {
+	seenSet := make(map[string]bool, len(seen))
+	for _, u := range seen {
+		seenSet[u] = true
+	}
+
+	results := make([]SavedSearchResult, 0, len(pages))
+	newCount := 0
+	for _, page := range pages {
+		isNew := !seenSet[page.URL]
+		if isNew {
+			newCount++
+		}
+		results = append(results, SavedSearchResult{Page: page, New: isNew})
+	}
+	return results, newCount
+}
+
+// resultURLs returns the URLs of pages, as stored in saved_searches.seen_urls
+func resultURLs(pages []Page) []string {
+	urls := make([]string, 0, len(pages))
+	for _, page := range pages {
+		urls = append(urls, page.URL)
+	}
+	return urls
+}
+
+// respondSaved answers API clients with JSON and browsers with a flash message and a redirect
+// payload is only sent on success, errors carry message in a formErrorResponse
+func respondSaved(w http.ResponseWriter, r *http.Request, status int, message, location string, payload interface{}) {
+	if wantsJSON(r) || currentAPIToken(r) != nil {
+		if status >= http.StatusBadRequest {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(formErrorResponse{Error: message})
+			return
+		}
+		if payload == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(payload)
+		return
+	}
+
+	setFlash(w, message)
+	http.Redirect(w, r, location, http.StatusSeeOther)
+}
+
+// formID parses the id form field, answering 400 when it is missing or malformed
+func formID(w http.ResponseWriter, r *http.Request, what string) (int64, bool) {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		respondSaved(w, r, http.StatusBadRequest, "Invalid "+what, "/searches", nil)
+		return 0, false
+	}
+	return id, true
+}
+
+// listSavedSearches returns the user's saved searches, oldest first so the page keeps a stable order
+func listSavedSearches(userID int) ([]SavedSearch, error) {
+	rows, err := db.Query(`SELECT s.id, s.name, s.query, s.language, s.created_at, s.last_viewed_at, s.seen_urls,
+			ARRAY(SELECT channel FROM alert_subscriptions WHERE saved_search_id = s.id ORDER BY channel),
+			COALESCE((SELECT webhook_url FROM alert_subscriptions WHERE saved_search_id = s.id AND channel = $2), '')
+		FROM saved_searches s WHERE s.user_id = $1 ORDER BY s.created_at, s.id`, userID, alertChannelWebhook)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	searches := []SavedSearch{}
+	for rows.Next() {
+		var search SavedSearch
+		err := rows.Scan(&search.ID, &search.Name, &search.Query, &search.Language,
+			&search.CreatedAt, &search.LastViewedAt, pq.Array(&search.seenURLs), pq.Array(&search.Alerts), &search.WebhookURL)
+		if err != nil {
+			return nil, err
+		}
+		searches = append(searches, search)
+	}
+	return searches, rows.Err()
+}
+
+// listBookmarks returns the user's bookmarks, newest first
+func listBookmarks(userID int) ([]Bookmark, error) {
+	rows, err := db.Query(`SELECT id, url, title, note, created_at
+		FROM bookmarks WHERE user_id = $1 ORDER BY created_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bookmarks := []Bookmark{}
+	for rows.Next() {
+		var bookmark Bookmark
+		if err := rows.Scan(&bookmark.ID, &bookmark.URL, &bookmark.Title, &bookmark.Note, &bookmark.CreatedAt); err != nil {
+			return nil, err
+		}
+		bookmarks = append(bookmarks, bookmark)
+	}
+	return bookmarks, rows.Err()
+}
+
+// savedSearchesPage re-runs the user's saved searches and lists their bookmarks (GET /searches, behind requireLogin)
+// Results missing from the previous visit are marked as new, then the current results become the seen set
+func savedSearchesPage(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	searches, err := listSavedSearches(user.ID)
+	var bookmarks []Bookmark
+	if err == nil {
+		bookmarks, err = listBookmarks(user.ID)
+	}
+	if err != nil {
+		log.Printf("Failed to load saved searches: username=%s error=%v", user.Username, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	views := make([]SavedSearchView, 0, len(searches))
+	for _, search := range searches {
+		view := SavedSearchView{SavedSearch: search}
+
+		// Not recorded in search_stats, re-running saved queries isn't a visitor searching
+		pages, err := performSearch(r.Context(), search.Query, search.Language)
+		if err != nil {
+			// Keep the previous seen set so the new results still show next time
+			view.Error = true
+			views = append(views, view)
+			continue
+		}
+
+		results, newCount := markNewResults(pages, search.seenURLs)
+		view.Total = len(results)
+		view.NewCount = newCount
+		if len(results) > savedSearchResultsShown {
+			results = results[:savedSearchResultsShown]
+		}
+		view.Results = results
+		views = append(views, view)
+
+		_, err = db.Exec("UPDATE saved_searches SET seen_urls = $1, last_viewed_at = $2 WHERE id = $3",
+			pq.Array(resultURLs(pages)), now, search.ID)
+		if err != nil {
+			log.Printf("Failed to update saved search: username=%s search=%d error=%v", user.Username, search.ID, err)
+		}
+	}
+
+	data := buildViewData(w, r)
+	data["SavedSearches"] = views
+	data["UnreadInbox"] = unreadInboxCount(user.ID)
+	data["Bookmarks"] = bookmarks
+	renderTemplate(w, "searches.html", data)
+}
+
+// savedSearchesAPI lists the user's saved searches on GET and saves a query on POST (/api/searches)
+func savedSearchesAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		user := currentUser(r)
+		searches, err := listSavedSearches(user.ID)
+		if err != nil {
+			log.Printf("Failed to list saved searches: username=%s error=%v", user.Username, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(searches)
+	case "POST":
+		createSavedSearch(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createSavedSearch saves the q and language form fields, with an optional name defaulting to the query
+// The current results count as seen, so only results indexed afterwards show up as new
+func createSavedSearch(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	clientIP := getClientIP(r)
+
+	query := strings.Join(strings.Fields(r.FormValue("q")), " ")
+	language := r.FormValue("language")
+	if language == "" {
+		language = "en"
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		name = query
+	}
+
+	switch {
+	case query == "":
+		respondSaved(w, r, http.StatusBadRequest, "Enter a search to save", localReferer(r, "/"), nil)
+		return
+	case !validSearchLanguage(language):
+		respondSaved(w, r, http.StatusBadRequest, "Unsupported search language", localReferer(r, "/"), nil)
+		return
+	case utf8.RuneCountInString(query) > maxStatsQueryLength || utf8.RuneCountInString(name) > maxSavedNameLength:
+		respondSaved(w, r, http.StatusBadRequest, "That search is too long to save", localReferer(r, "/"), nil)
+		return
+	}
+
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM saved_searches WHERE user_id = $1", user.ID).Scan(&count)
+	if err == nil && count >= maxSavedSearches {
+		log.Printf("Saved search rejected: username=%s ip=%s reason=too_many_searches", user.Username, clientIP)
+		respondSaved(w, r, http.StatusBadRequest,
+			"You already have "+strconv.Itoa(maxSavedSearches)+" saved searches, please delete one first", "/searches", nil)
+		return
+	}
+
+	var pages []Page
+	if err == nil {
+		pages, err = performSearch(r.Context(), query, language)
+	}
+	search := SavedSearch{Name: name, Query: query, Language: language}
+	if err == nil {
+		err = db.QueryRow(`INSERT INTO saved_searches (user_id, name, query, language, seen_urls, last_viewed_at)
+			VALUES ($1, $2, $3, $4, $5, NOW())
+			ON CONFLICT (user_id, query, language) DO NOTHING
+			RETURNING id, created_at, last_viewed_at`,
+			user.ID, name, query, language, pq.Array(resultURLs(pages))).Scan(&search.ID, &search.CreatedAt, &search.LastViewedAt)
+	}
+	if err == sql.ErrNoRows {
+		respondSaved(w, r, http.StatusConflict, "You already saved this search", "/searches", nil)
+		return
+	}
+	if err != nil {
+		log.Printf("Saved search failed: username=%s ip=%s error=%v", user.Username, clientIP, err)
+		respondSaved(w, r, http.StatusInternalServerError, "Failed to save the search", localReferer(r, "/"), nil)
+		return
+	}
+
+	log.Printf("Search saved: username=%s ip=%s search=%d", user.Username, clientIP, search.ID)
+	respondSaved(w, r, http.StatusCreated, "Search saved", "/searches", search)
+}
+
+// renameSavedSearch changes a saved search's name (POST /api/searches/rename)
+func renameSavedSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	id, ok := formID(w, r, "saved search")
+	if !ok {
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || utf8.RuneCountInString(name) > maxSavedNameLength {
+		respondSaved(w, r, http.StatusBadRequest,
+			"Name must be 1 to "+strconv.Itoa(maxSavedNameLength)+" characters", "/searches", nil)
+		return
+	}
+
+	// Scoped to the user so one user can't rename another's search by guessing IDs
+	result, err := db.Exec("UPDATE saved_searches SET name = $1 WHERE id = $2 AND user_id = $3", name, id, user.ID)
+	if err == nil {
+		if n, _ := result.RowsAffected(); n == 0 {
+			err = sql.ErrNoRows
+		}
+	}
+	if err == sql.ErrNoRows {
+		respondSaved(w, r, http.StatusNotFound, "That saved search was not found", "/searches", nil)
+		return
+	}
+	if err != nil {
+		log.Printf("Saved search rename failed: username=%s search=%d error=%v", user.Username, id, err)
+		respondSaved(w, r, http.StatusInternalServerError, "Failed to rename the search", "/searches", nil)
+		return
+	}
+	respondSaved(w, r, http.StatusOK, "Search renamed", "/searches", nil)
+}
+
+// deleteSavedSearch removes one of the user's saved searches (POST /api/searches/delete)
+func deleteSavedSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	id, ok := formID(w, r, "saved search")
+	if !ok {
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM saved_searches WHERE id = $1 AND user_id = $2", id, user.ID)
+	if err == nil {
+		if n, _ := result.RowsAffected(); n == 0 {
+			err = sql.ErrNoRows
+		}
+	}
+	if err == sql.ErrNoRows {
+		respondSaved(w, r, http.StatusNotFound, "That saved search was not found", "/searches", nil)
+		return
+	}
+	if err != nil {
+		log.Printf("Saved search delete failed: username=%s search=%d error=%v", user.Username, id, err)
+		respondSaved(w, r, http.StatusInternalServerError, "Failed to delete the search", "/searches", nil)
+		return
+	}
+
+	log.Printf("Saved search deleted: username=%s search=%d", user.Username, id)
+	respondSaved(w, r, http.StatusOK, "Saved search deleted", "/searches", nil)
+}
+
+// bookmarksAPI lists the user's bookmarks on GET and bookmarks a result on POST (/api/bookmarks)
+func bookmarksAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		user := currentUser(r)
+		bookmarks, err := listBookmarks(user.ID)
+		if err != nil {
+			log.Printf("Failed to list bookmarks: username=%s error=%v", user.Username, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bookmarks)
+	case "POST":
+		createBookmark(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createBookmark bookmarks the url form field with its title and an optional note
+// Browsers go back to the results they bookmarked from
+func createBookmark(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	back := localReferer(r, "/searches")
+
+	bookmark := Bookmark{
+		URL:   strings.TrimSpace(r.FormValue("url")),
+		Title: strings.TrimSpace(r.FormValue("title")),
+		Note:  strings.TrimSpace(r.FormValue("note")),
+	}
+	if bookmark.Title == "" {
+		bookmark.Title = bookmark.URL
+	}
+	switch {
+	case !validBookmarkURL(bookmark.URL):
+		respondSaved(w, r, http.StatusBadRequest, "Only http and https links can be bookmarked", back, nil)
+		return
+	case utf8.RuneCountInString(bookmark.Title) > maxSavedNameLength:
+		respondSaved(w, r, http.StatusBadRequest, "Title must be at most "+strconv.Itoa(maxSavedNameLength)+" characters", back, nil)
+		return
+	case utf8.RuneCountInString(bookmark.Note) > maxBookmarkNoteLength:
+		respondSaved(w, r, http.StatusBadRequest, "Note must be at most "+strconv.Itoa(maxBookmarkNoteLength)+" characters", back, nil)
+		return
+	}
+
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM bookmarks WHERE user_id = $1", user.ID).Scan(&count)
+	if err == nil && count >= maxBookmarks {
+		respondSaved(w, r, http.StatusBadRequest,
+			"You already have "+strconv.Itoa(maxBookmarks)+" bookmarks, please delete one first", back, nil)
+		return
+	}
+	if err == nil {
+		err = db.QueryRow(`INSERT INTO bookmarks (user_id, url, title, note) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id, url) DO NOTHING
+			RETURNING id, created_at`,
+			user.ID, bookmark.URL, bookmark.Title, bookmark.Note).Scan(&bookmark.ID, &bookmark.CreatedAt)
+	}
+	if err == sql.ErrNoRows {
+		respondSaved(w, r, http.StatusConflict, "You already bookmarked that page", back, nil)
+		return
+	}
+	if err != nil {
+		log.Printf("Bookmark failed: username=%s error=%v", user.Username, err)
+		respondSaved(w, r, http.StatusInternalServerError, "Failed to save the bookmark", back, nil)
+		return
+	}
+	respondSaved(w, r, http.StatusCreated, "Bookmark saved", back, bookmark)
+}
+
+// updateBookmark changes a bookmark's title and note (POST /api/bookmarks/update)
+// Fields left out of the request keep their value
+func updateBookmark(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	id, ok := formID(w, r, "bookmark")
+	if !ok {
+		return
+	}
+
+	r.ParseForm()
+	var title, note *string
+	if _, ok := r.Form["title"]; ok {
+		value := strings.TrimSpace(r.FormValue("title"))
+		if value == "" || utf8.RuneCountInString(value) > maxSavedNameLength {
+			respondSaved(w, r, http.StatusBadRequest,
+				"Title must be 1 to "+strconv.Itoa(maxSavedNameLength)+" characters", "/searches", nil)
+			return
+		}
+		title = &value
+	}
+	if _, ok := r.Form["note"]; ok {
+		value := strings.TrimSpace(r.FormValue("note"))
+		if utf8.RuneCountInString(value) > maxBookmarkNoteLength {
+			respondSaved(w, r, http.StatusBadRequest,
+				"Note must be at most "+strconv.Itoa(maxBookmarkNoteLength)+" characters", "/searches", nil)
+			return
+		}
+		note = &value
+	}
+
+	result, err := db.Exec(`UPDATE bookmarks SET title = COALESCE($1, title), note = COALESCE($2, note)
+		WHERE id = $3 AND user_id = $4`, title, note, id, user.ID)
+	if err == nil {
+		if n, _ := result.RowsAffected(); n == 0 {
+			err = sql.ErrNoRows
+		}
+	}
+	if err == sql.ErrNoRows {
+		respondSaved(w, r, http.StatusNotFound, "That bookmark was not found", "/searches", nil)
+		return
+	}
+	if err != nil {
+		log.Printf("Bookmark update failed: username=%s bookmark=%d error=%v", user.Username, id, err)
+		respondSaved(w, r, http.StatusInternalServerError, "Failed to update the bookmark", "/searches", nil)
+		return
+	}
+	respondSaved(w, r, http.StatusOK, "Bookmark updated", "/searches", nil)
+}
+
+// deleteBookmark removes one of the user's bookmarks (POST /api/bookmarks/delete)
+func deleteBookmark(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	id, ok := formID(w, r, "bookmark")
+	if !ok {
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM bookmarks WHERE id = $1 AND user_id = $2", id, user.ID)
+	if err == nil {
+		if n, _ := result.RowsAffected(); n == 0 {
+			err = sql.ErrNoRows
+		}
+	}
+	if err == sql.ErrNoRows {
+		respondSaved(w, r, http.StatusNotFound, "That bookmark was not found", localReferer(r, "/searches"), nil)
+		return
+	}
+	if err != nil {
+		log.Printf("Bookmark delete failed: username=%s bookmark=%d error=%v", user.Username, id, err)
+		respondSaved(w, r, http.StatusInternalServerError, "Failed to delete the bookmark", localReferer(r, "/searches"), nil)
+		return
+	}
+	respondSaved(w, r, http.StatusOK, "Bookmark deleted", localReferer(r, "/searches"), nil)
+}
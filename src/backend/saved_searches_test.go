@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestMarkNewResults verifies only results missing from the previous visit are flagged
+func TestMarkNewResults(t *testing.T) {
+	pages := []Page{{URL: "https://a.example/"}, {URL: "https://b.example/"}, {URL: "https://c.example/"}}
+	results, newCount := markNewResults(pages, []string{"https://a.example/", "https://gone.example/"})
+
+	if newCount != 2 || len(results) != 3 {
+		t.Fatalf("markNewResults() = %d results, %d new, want 3 and 2", len(results), newCount)
+	}
+	if results[0].New || !results[1].New || !results[2].New {
+		t.Errorf("New flags = %v, %v, %v, want false, true, true", results[0].New, results[1].New, results[2].New)
+	}
+}
+
+// TestValidBookmarkURL verifies only absolute http(s) links can be bookmarked
+func TestValidBookmarkURL(t *testing.T) {
+	tests := map[string]bool{
+		"https://example.com/page": true,
+		"http://example.com":       true,
+		"javascript:alert(1)":      false,
+		"/relative/path":           false,
+		"ftp://example.com/file":   false,
+		"https://":                 false,
+		"":                         false,
+	}
+	for raw, want := range tests {
+		if got := validBookmarkURL(raw); got != want {
+			t.Errorf("validBookmarkURL(%q) = %v, want %v", raw, got, want)
+		}
+	}
+}
+
+// TestRespondSaved verifies API clients get JSON while browsers get a flash and a redirect
+func TestRespondSaved(t *testing.T) {
+	req := httptest.NewRequest("POST", "/api/bookmarks", nil)
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	respondSaved(w, req, http.StatusConflict, "You already bookmarked that page", "/", nil)
+
+	var response formErrorResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusConflict || response.Error != "You already bookmarked that page" {
+		t.Errorf("JSON response = %d %+v", w.Code, response)
+	}
+
+	w = httptest.NewRecorder()
+	respondSaved(w, httptest.NewRequest("POST", "/api/bookmarks", nil), http.StatusConflict, "You already bookmarked that page", "/?q=go", nil)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/?q=go" || flashFrom(w) != "You already bookmarked that page" {
+		t.Errorf("browser response = %d to %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+// TestSearchPage_SaveForms verifies logged-in users can save the search and bookmark results
+func TestSearchPage_SaveForms(t *testing.T) {
+	templates = template.Must(template.ParseGlob("../templates/*.html"))
+	data := map[string]interface{}{
+		"Query":         "devops",
+		"Language":      "en",
+		"SearchResults": []Page{{Title: "DevOps", URL: "https://en.wikipedia.org/wiki/DevOps"}},
+	}
+
+	var anonymous strings.Builder
+	if err := templates.ExecuteTemplate(&anonymous, "search.html", data); err != nil {
+		t.Fatalf("search.html failed to render: %v", err)
+	}
+	if strings.Contains(anonymous.String(), "/api/searches") || strings.Contains(anonymous.String(), "/api/bookmarks") {
+		t.Errorf("anonymous visitors were offered save forms")
+	}
+
+	data["User"] = &User{Username: "testuser_forms", Verified: true}
+	var body strings.Builder
+	if err := templates.ExecuteTemplate(&body, "search.html", data); err != nil {
+		t.Fatalf("search.html failed to render: %v", err)
+	}
+	for _, want := range []string{`action="/api/searches"`, `name="q" value="devops"`, `action="/api/bookmarks"`, `value="https://en.wikipedia.org/wiki/DevOps"`} {
+		if !strings.Contains(body.String(), want) {
+			t.Errorf("search page is missing %s", want)
+		}
+	}
+}
+
+// TestSavedSearches_Integration verifies saved search and bookmark CRUD, ownership checks and new result highlighting
+func TestSavedSearches_Integration(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	defer testDB.Exec("DELETE FROM pages WHERE title LIKE 'testuser_saved%'")
+
+	users := map[string]*User{}
+	for _, username := range []string{"testuser_saved", "testuser_saved_other"} {
+		user := &User{Username: username, Verified: true}
+		err := testDB.QueryRow(`INSERT INTO users (username, email, password, registration_ip) VALUES ($1, $2, $3, $4) RETURNING id`,
+			username, username+"@example.com", "x", "127.0.0.1").Scan(&user.ID)
+		if err != nil {
+			t.Fatalf("failed to create test user: %v", err)
+		}
+		users[username] = user
+	}
+	user := users["testuser_saved"]
+	insertPage := func(title string) {
+		_, err := testDB.Exec(`INSERT INTO pages (title, url, language, content) VALUES ($1, $2, 'en', $3)`,
+			title, "https://example.com/"+title, "zyxwvutsrq saved search marker")
+		if err != nil {
+			t.Fatalf("failed to insert page: %v", err)
+		}
+	}
+	call := func(handler http.HandlerFunc, path string, form url.Values, as *User) *httptest.ResponseRecorder {
+		req := accountRequest(path, form, as, "")
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	insertPage("testuser_saved_first")
+
+	w := call(savedSearchesAPI, "/api/searches", url.Values{"q": {"  zyxwvutsrq   marker "}}, user)
+	var saved SavedSearch
+	if err := json.NewDecoder(w.Body).Decode(&saved); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("save search = %d, %v", w.Code, err)
+	}
+	if saved.Query != "zyxwvutsrq marker" || saved.Name != saved.Query || saved.Language != "en" {
+		t.Errorf("saved search = %+v, want the normalized query as its name", saved)
+	}
+
+	t.Run("duplicate", func(t *testing.T) {
+		if w := call(savedSearchesAPI, "/api/searches", url.Values{"q": {"zyxwvutsrq marker"}}, user); w.Code != http.StatusConflict {
+			t.Errorf("saving the same search again = %d, want 409", w.Code)
+		}
+	})
+
+	t.Run("new results highlighted", func(t *testing.T) {
+		insertPage("testuser_saved_second")
+
+		w := httptest.NewRecorder()
+		savedSearchesPage(w, withUser(httptest.NewRequest("GET", "/searches", nil), user))
+		body := w.Body.String()
+		if w.Code != http.StatusOK || strings.Count(body, `class="new-result"`) != 1 || !strings.Contains(body, "1 new") {
+			t.Errorf("first visit = %d, want exactly the second page marked new:\n%s", w.Code, body)
+		}
+
+		w = httptest.NewRecorder()
+		savedSearchesPage(w, withUser(httptest.NewRequest("GET", "/searches", nil), user))
+		if strings.Contains(w.Body.String(), `class="new-result"`) {
+			t.Errorf("second visit still marks results as new")
+		}
+	})
+
+	t.Run("other users can't change it", func(t *testing.T) {
+		id := strconv.FormatInt(saved.ID, 10)
+		other := users["testuser_saved_other"]
+		if w := call(renameSavedSearch, "/api/searches/rename", url.Values{"id": {id}, "name": {"mine"}}, other); w.Code != http.StatusNotFound {
+			t.Errorf("rename by another user = %d, want 404", w.Code)
+		}
+		if w := call(deleteSavedSearch, "/api/searches/delete", url.Values{"id": {id}}, other); w.Code != http.StatusNotFound {
+			t.Errorf("delete by another user = %d, want 404", w.Code)
+		}
+	})
+
+	t.Run("rename and delete", func(t *testing.T) {
+		id := strconv.FormatInt(saved.ID, 10)
+		if w := call(renameSavedSearch, "/api/searches/rename", url.Values{"id": {id}, "name": {"Markers"}}, user); w.Code != http.StatusNoContent {
+			t.Errorf("rename = %d, want 204", w.Code)
+		}
+		searches, err := listSavedSearches(user.ID)
+		if err != nil || len(searches) != 1 || searches[0].Name != "Markers" {
+			t.Errorf("listSavedSearches() = %+v, %v", searches, err)
+		}
+		if w := call(deleteSavedSearch, "/api/searches/delete", url.Values{"id": {id}}, user); w.Code != http.StatusNoContent {
+			t.Errorf("delete = %d, want 204", w.Code)
+		}
+	})
+
+	t.Run("bookmarks", func(t *testing.T) {
+		if w := call(bookmarksAPI, "/api/bookmarks", url.Values{"url": {"javascript:alert(1)"}}, user); w.Code != http.StatusBadRequest {
+			t.Errorf("bookmarking a javascript: URL = %d, want 400", w.Code)
+		}
+
+		w := call(bookmarksAPI, "/api/bookmarks", url.Values{"url": {"https://example.com/testuser_saved_first"}, "title": {"First"}}, user)
+		var bookmark Bookmark
+		if err := json.NewDecoder(w.Body).Decode(&bookmark); err != nil || w.Code != http.StatusCreated {
+			t.Fatalf("bookmark = %d, %v", w.Code, err)
+		}
+		if w := call(bookmarksAPI, "/api/bookmarks", url.Values{"url": {bookmark.URL}}, user); w.Code != http.StatusConflict {
+			t.Errorf("bookmarking twice = %d, want 409", w.Code)
+		}
+
+		id := strconv.FormatInt(bookmark.ID, 10)
+		if w := call(updateBookmark, "/api/bookmarks/update", url.Values{"id": {id}, "note": {"read later"}}, user); w.Code != http.StatusNoContent {
+			t.Errorf("update = %d, want 204", w.Code)
+		}
+		bookmarks, err := listBookmarks(user.ID)
+		if err != nil || len(bookmarks) != 1 || bookmarks[0].Note != "read later" || bookmarks[0].Title != "First" {
+			t.Errorf("listBookmarks() = %+v, %v, want the note set and the title kept", bookmarks, err)
+		}
+
+		if w := call(deleteBookmark, "/api/bookmarks/delete", url.Values{"id": {id}}, users["testuser_saved_other"]); w.Code != http.StatusNotFound {
+			t.Errorf("delete by another user = %d, want 404", w.Code)
+		}
+		if w := call(deleteBookmark, "/api/bookmarks/delete", url.Values{"id": {id}}, user); w.Code != http.StatusNoContent {
+			t.Errorf("delete = %d, want 204", w.Code)
+		}
+	})
+}
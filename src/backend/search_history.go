@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// searchHistoryRetentions are the retention choices, in days, offered on the history page
+var searchHistoryRetentions = []int{7, 30, 90, 365}
+
+// Entries shown on the history page, newest first
+const searchHistoryPageSize = 100
+
+// Distinct recent queries offered in the search box
+const recentSearchesShown = 8
+
+// SearchHistoryEntry is one recorded search on the history page
+type SearchHistoryEntry struct {
+	ID         int64
+	Query      string
+	Language   string
+	Results    int
+	SearchedAt time.Time
+}
+
+// SearchURL links to the search page to run the query again
+func (e SearchHistoryEntry) SearchURL() string {
+	return SavedSearch{Query: e.Query, Language: e.Language}.SearchURL()
+}
+
+// validSearchHistoryRetention reports whether days is one of the offered searchHistoryRetentions
+func validSearchHistoryRetention(days int) bool {
+	for _, retention := range searchHistoryRetentions {
+		if days == retention {
+			return true
+		}
+	}
+	return false
+}
+
+// recordSearchHistory stores a search in the user's history when they opted in
+// Called next to recordSearchStats, so re-runs of saved searches aren't recorded either
+func recordSearchHistory(user *User, query, language string, results int) {
+	if user == nil || !user.SearchHistory {
+		return
+	}
+	normalized := normalizeSearchQuery(query)
+	if normalized == "" {
+		return
+	}
+
+	_, err := db.Exec("INSERT INTO search_history (user_id, query, language, results) VALUES ($1, $2, $3, $4)",
+		user.ID, normalized, language, results)
+	if err != nil {
+		log.Printf("Failed to record search history: username=%s error=%v", user.Username, err)
+	}
+}
+
+// recentSearches returns the user's latest distinct queries for the search box, most recent first
+func recentSearches(user *User) []string {
+	if user == nil || !user.SearchHistory {
+		return nil
+	}
+
+	rows, err := db.Query(`SELECT query FROM search_history WHERE user_id = $1
+		GROUP BY query ORDER BY MAX(searched_at) DESC LIMIT $2`, user.ID, recentSearchesShown)
+	if err != nil {
+		log.Printf("Failed to load recent searches: username=%s error=%v", user.Username, err)
+		return nil
+	}
+	defer rows.Close()
+
+	var queries []string
+	for rows.Next() {
+		var query string
+		if err := rows.Scan(&query); err != nil {
+			log.Printf("Failed to load recent searches: username=%s error=%v", user.Username, err)
+			return nil
+		}
+		queries = append(queries, query)
+	}
+	return queries
+}
+
+// listSearchHistory returns the user's most recent searches
+func listSearchHistory(userID int, limit int) ([]SearchHistoryEntry, error) {
+	rows, err := db.Query(`SELECT id, query, language, results, searched_at FROM search_history
+		WHERE user_id = $1 ORDER BY searched_at DESC, id DESC LIMIT $2`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []SearchHistoryEntry
+	for rows.Next() {
+		var entry SearchHistoryEntry
+		if err := rows.Scan(&entry.ID, &entry.Query, &entry.Language, &entry.Results, &entry.SearchedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// searchHistoryPage shows the history settings and the recorded searches (GET /account/history, behind requireLogin)
+func searchHistoryPage(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	var retention int
+	err := db.QueryRow("SELECT search_history_days FROM users WHERE id = $1", user.ID).Scan(&retention)
+	var entries []SearchHistoryEntry
+	if err == nil {
+		entries, err = listSearchHistory(user.ID, searchHistoryPageSize)
+	}
+	if err != nil {
+		log.Printf("Failed to load search history: username=%s error=%v", user.Username, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := buildViewData(w, r)
+	data["History"] = entries
+	data["Retention"] = retention
+	data["Retentions"] = searchHistoryRetentions
+	renderTemplate(w, "search_history.html", data)
+}
+
+// updateSearchHistorySettings turns the history on or off and sets its retention (POST /api/account/history/settings)
+// Turning it off deletes what was recorded, so nothing is kept the user can't see
+func updateSearchHistorySettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	clientIP := getClientIP(r)
+
+	enabled := r.FormValue("enabled") == "on" || r.FormValue("enabled") == "true"
+	retention, err := strconv.Atoi(r.FormValue("retention_days"))
+	if err != nil || !validSearchHistoryRetention(retention) {
+		respondSaved(w, r, http.StatusBadRequest, "Choose how long to keep your search history", "/account/history", nil)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err == nil {
+		defer tx.Rollback()
+		_, err = tx.Exec("UPDATE users SET search_history_enabled = $1, search_history_days = $2 WHERE id = $3",
+			enabled, retention, user.ID)
+	}
+	if err == nil && !enabled {
+		_, err = tx.Exec("DELETE FROM search_history WHERE user_id = $1", user.ID)
+	}
+	if err == nil {
+		// Apply a shorter retention right away instead of waiting for the reaper
+		_, err = tx.Exec("DELETE FROM search_history WHERE user_id = $1 AND searched_at < $2",
+			user.ID, time.Now().AddDate(0, 0, -retention))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Search history settings failed: username=%s ip=%s error=%v", user.Username, clientIP, err)
+		respondSaved(w, r, http.StatusInternalServerError, "Failed to save your search history settings", "/account/history", nil)
+		return
+	}
+
+	log.Printf("Search history settings changed: username=%s ip=%s enabled=%t retention_days=%d", user.Username, clientIP, enabled, retention)
+	message := "Search history is off and your history has been deleted"
+	if enabled {
+		message = "Search history is on, searches are kept for " + strconv.Itoa(retention) + " days"
+	}
+	respondSaved(w, r, http.StatusOK, message, "/account/history", nil)
+}
+
+// deleteSearchHistoryEntry removes one search from the user's history (POST /api/account/history/delete)
+func deleteSearchHistoryEntry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		respondSaved(w, r, http.StatusBadRequest, "Invalid search", "/account/history", nil)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM search_history WHERE id = $1 AND user_id = $2", id, user.ID)
+	if err != nil {
+		log.Printf("Search history delete failed: username=%s entry=%d error=%v", user.Username, id, err)
+		respondSaved(w, r, http.StatusInternalServerError, "Failed to delete the search", "/account/history", nil)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		respondSaved(w, r, http.StatusNotFound, "That search was not found in your history", "/account/history", nil)
+		return
+	}
+	respondSaved(w, r, http.StatusOK, "The search was removed from your history", "/account/history", nil)
+}
+
+// clearSearchHistory deletes all of the user's recorded searches (POST /api/account/history/clear)
+func clearSearchHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	clientIP := getClientIP(r)
+
+	result, err := db.Exec("DELETE FROM search_history WHERE user_id = $1", user.ID)
+	if err != nil {
+		log.Printf("Search history clear failed: username=%s ip=%s error=%v", user.Username, clientIP, err)
+		respondSaved(w, r, http.StatusInternalServerError, "Failed to clear your search history", "/account/history", nil)
+		return
+	}
+
+	n, _ := result.RowsAffected()
+	log.Printf("Search history cleared: username=%s ip=%s rows=%d", user.Username, clientIP, n)
+	respondSaved(w, r, http.StatusOK, "Your search history has been cleared", "/account/history", nil)
+}
+
+// reapSearchHistory deletes entries older than their user's retention and returns how many were removed
+func reapSearchHistory(now time.Time) (int64, error) {
+	result, err := db.Exec(`DELETE FROM search_history h USING users u
+		WHERE h.user_id = u.id AND h.searched_at < $1 - u.search_history_days * INTERVAL '1 day'`, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// startSearchHistoryReaper periodically applies each user's search history retention
+func startSearchHistoryReaper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := reapSearchHistory(time.Now())
+			if err != nil {
+				log.Printf("Search history reaping failed: error=%v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("Expired search history reaped: rows=%d", n)
+			}
+		}
+	}
+}
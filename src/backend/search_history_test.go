@@ -0,0 +1,156 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRecordSearchHistory_OptIn verifies nothing is recorded for visitors or users who didn't opt in
+// db is never touched here, so a query would panic on the nil handle
+func TestRecordSearchHistory_OptIn(t *testing.T) {
+	recordSearchHistory(nil, "go", "en", 1)
+	recordSearchHistory(&User{ID: 1, Username: "testuser_history_off"}, "go", "en", 1)
+
+	if queries := recentSearches(&User{ID: 1, Username: "testuser_history_off"}); queries != nil {
+		t.Errorf("recentSearches() = %v for a user without history, want nil", queries)
+	}
+}
+
+// TestValidSearchHistoryRetention verifies only the offered retention periods are accepted
+func TestValidSearchHistoryRetention(t *testing.T) {
+	for days, want := range map[int]bool{7: true, 90: true, 365: true, 0: false, 1000: false} {
+		if got := validSearchHistoryRetention(days); got != want {
+			t.Errorf("validSearchHistoryRetention(%d) = %v, want %v", days, got, want)
+		}
+	}
+}
+
+// TestSearchPage_RecentSearches verifies recent searches are offered as suggestions in the search box
+func TestSearchPage_RecentSearches(t *testing.T) {
+	templates = template.Must(template.ParseGlob("../templates/*.html"))
+
+	var body strings.Builder
+	err := templates.ExecuteTemplate(&body, "search.html", map[string]interface{}{
+		"User":           &User{Username: "testuser_recent", Verified: true, SearchHistory: true},
+		"RecentSearches": []string{"golang generics", "devops"},
+	})
+	if err != nil {
+		t.Fatalf("search.html failed to render: %v", err)
+	}
+	for _, want := range []string{`list="recent-searches"`, `<option value="golang generics">`, `<option value="devops">`} {
+		if !strings.Contains(body.String(), want) {
+			t.Errorf("search page is missing %s", want)
+		}
+	}
+}
+
+// TestSearchHistory_Integration verifies opting in, recording, recent searches, removal, retention and opting out
+func TestSearchHistory_Integration(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ids := map[string]int{}
+	for _, username := range []string{"testuser_history", "testuser_history_other"} {
+		var id int
+		err := testDB.QueryRow(`INSERT INTO users (username, email, password, registration_ip) VALUES ($1, $2, $3, $4) RETURNING id`,
+			username, username+"@example.com", "x", "127.0.0.1").Scan(&id)
+		if err != nil {
+			t.Fatalf("failed to create test user: %v", err)
+		}
+		ids[username] = id
+	}
+	createSession("testuser_history", "test-history-session", "Go-http-client/1.1", "127.0.0.1")
+	user := &User{ID: ids["testuser_history"], Username: "testuser_history"}
+
+	searchAs := func(query string) *httptest.ResponseRecorder {
+		req := sessionRequest("test-history-session")
+		req.URL.RawQuery = url.Values{"q": {query}}.Encode()
+		w := httptest.NewRecorder()
+		index(w, req)
+		return w
+	}
+	countEntries := func(userID int) int {
+		var count int
+		testDB.QueryRow("SELECT COUNT(*) FROM search_history WHERE user_id = $1", userID).Scan(&count)
+		return count
+	}
+	settings := func(form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		updateSearchHistorySettings(w, accountRequest("/api/account/history/settings", form, user, "test-history-session"))
+		return w
+	}
+
+	searchAs("before opting in")
+	if n := countEntries(user.ID); n != 0 {
+		t.Fatalf("%d searches recorded before opting in", n)
+	}
+
+	if w := settings(url.Values{"enabled": {"on"}, "retention_days": {"30"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("enable history = %d, want 303", w.Code)
+	}
+
+	t.Run("recorded and suggested", func(t *testing.T) {
+		searchAs("Go   Generics")
+		w := searchAs("devops")
+		if n := countEntries(user.ID); n != 2 {
+			t.Errorf("%d searches recorded, want 2", n)
+		}
+		if !strings.Contains(w.Body.String(), `<option value="go generics">`) {
+			t.Errorf("search page doesn't offer the recent search:\n%s", w.Body.String())
+		}
+	})
+
+	t.Run("remove one entry", func(t *testing.T) {
+		testDB.Exec("INSERT INTO search_history (user_id, query, language) VALUES ($1, 'other user', 'en')", ids["testuser_history_other"])
+		var otherID, ownID int64
+		testDB.QueryRow("SELECT id FROM search_history WHERE user_id = $1", ids["testuser_history_other"]).Scan(&otherID)
+		testDB.QueryRow("SELECT id FROM search_history WHERE user_id = $1 AND query = 'devops'", user.ID).Scan(&ownID)
+
+		w := httptest.NewRecorder()
+		deleteSearchHistoryEntry(w, accountRequest("/api/account/history/delete",
+			url.Values{"id": {strconv.FormatInt(otherID, 10)}}, user, "test-history-session"))
+		if countEntries(ids["testuser_history_other"]) != 1 {
+			t.Errorf("another user's history entry was deleted")
+		}
+
+		w = httptest.NewRecorder()
+		deleteSearchHistoryEntry(w, accountRequest("/api/account/history/delete",
+			url.Values{"id": {strconv.FormatInt(ownID, 10)}}, user, "test-history-session"))
+		if n := countEntries(user.ID); n != 1 {
+			t.Errorf("%d entries left after removing one, want 1", n)
+		}
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		testDB.Exec("INSERT INTO search_history (user_id, query, language, searched_at) VALUES ($1, 'old', 'en', $2)",
+			user.ID, time.Now().AddDate(0, 0, -31))
+		testDB.Exec("INSERT INTO search_history (user_id, query, language, searched_at) VALUES ($1, 'kept', 'en', $2)",
+			ids["testuser_history_other"], time.Now().AddDate(0, 0, -31))
+
+		if _, err := reapSearchHistory(time.Now()); err != nil {
+			t.Fatalf("reapSearchHistory() error = %v", err)
+		}
+		var old, kept int
+		testDB.QueryRow("SELECT COUNT(*) FROM search_history WHERE user_id = $1 AND query = 'old'", user.ID).Scan(&old)
+		testDB.QueryRow("SELECT COUNT(*) FROM search_history WHERE user_id = $1 AND query = 'kept'", ids["testuser_history_other"]).Scan(&kept)
+		if old != 0 || kept != 1 {
+			t.Errorf("after reaping old = %d (30 day retention), kept = %d (default 90 days), want 0 and 1", old, kept)
+		}
+	})
+
+	t.Run("opting out deletes history", func(t *testing.T) {
+		if w := settings(url.Values{"retention_days": {"30"}}); w.Code != http.StatusSeeOther {
+			t.Fatalf("disable history = %d, want 303", w.Code)
+		}
+		searchAs("after opting out")
+		if n := countEntries(user.ID); n != 0 {
+			t.Errorf("%d entries left after opting out, want 0", n)
+		}
+	})
+}
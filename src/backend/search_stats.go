@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"unicode/utf8"
+)
+
+// Queries longer than this are cut before aggregating, so pasted documents don't bloat search_stats
+const maxStatsQueryLength = 200
+
+// normalizeSearchQuery folds case and whitespace so "Go  Lang" and "go lang" count as one query
+func normalizeSearchQuery(query string) string {
+	normalized := strings.ToLower(strings.Join(strings.Fields(query), " "))
+	if len(normalized) > maxStatsQueryLength {
+		normalized = normalized[:maxStatsQueryLength]
+		// Don't leave half a UTF-8 sequence at the cut
+		for !utf8.ValidString(normalized) {
+			normalized = normalized[:len(normalized)-1]
+		}
+	}
+	return normalized
+}
+
+// recordSearchStats counts a search made by a visitor in search_stats for the admin analytics
+// Only the search page and /api/search call it, so internal re-runs of queries don't skew the numbers
+func recordSearchStats(query, language string, results int) {
+	normalized := normalizeSearchQuery(query)
+	if normalized == "" {
+		return
+	}
+
+	zero := 0
+	if results == 0 {
+		zero = 1
+	}
+	_, err := db.Exec(`INSERT INTO search_stats (query, language, search_count, zero_result_count)
+		VALUES ($1, $2, 1, $3)
+		ON CONFLICT (query, language) DO UPDATE SET
+			search_count = search_stats.search_count + 1,
+			zero_result_count = search_stats.zero_result_count + EXCLUDED.zero_result_count,
+			last_searched_at = NOW()`, normalized, language, zero)
+	if err != nil {
+		log.Printf("Failed to record search stats: query=%s language=%s error=%v", normalized, language, err)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A session's idle expiry is pushed forward at most this often, so browsing doesn't write on every request
+const sessionTouchInterval = time.Minute
+
+// User agents longer than this are cut before storing
+const maxUserAgentLength = 512
+
+// Session is one logged-in browser as listed on the active sessions page
+type Session struct {
+	ID         int64
+	UserAgent  string
+	IP         string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	Current    bool
+}
+
+// getSessionIdleTimeout returns how long a session survives without requests (SESSION_IDLE_TIMEOUT)
+func getSessionIdleTimeout() time.Duration {
+	return envDuration("SESSION_IDLE_TIMEOUT", 24*time.Hour)
+}
+
+// getSessionMaxLifetime returns how long a session can live at most, however active (SESSION_MAX_LIFETIME)
+func getSessionMaxLifetime() time.Duration {
+	return envDuration("SESSION_MAX_LIFETIME", 7*24*time.Hour)
+}
+
+// touchSession slides the idle expiry forward and records where the session was last seen from
+func touchSession(tokenHash, clientIP string, now time.Time) {
+	_, err := db.Exec(`UPDATE sessions
+		SET last_seen_at = $1, expires_at = LEAST($2, absolute_expires_at), ip = $3
+		WHERE token_hash = $4`,
+		now, now.Add(getSessionIdleTimeout()), clientIP, tokenHash)
+	if err != nil {
+		log.Printf("Failed to refresh session: ip=%s error=%v", clientIP, err)
+	}
+}
+
+// Device describes the session's browser and OS, like "Firefox on Linux"
+func (s Session) Device() string {
+	ua := s.UserAgent
+	if ua == "" {
+		return "Unknown device"
+	}
+
+	browser := "Unknown browser"
+	for _, candidate := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(ua, candidate.token) {
+			browser = candidate.name
+			break
+		}
+	}
+
+	for _, candidate := range []struct{ token, name string }{
+		{"Windows", "Windows"},
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iOS"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, candidate.token) {
+			return browser + " on " + candidate.name
+		}
+	}
+	return browser
+}
+
+// listSessions returns the user's unexpired sessions, most recently used first
+func listSessions(username, currentToken string, now time.Time) ([]Session, error) {
+	rows, err := db.Query(`SELECT id, token_hash, COALESCE(user_agent, ''), COALESCE(ip, ''), created_at, last_seen_at, expires_at
+		FROM sessions
+		WHERE username = $1 AND expires_at > $2 AND absolute_expires_at > $2
+		ORDER BY last_seen_at DESC`, username, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	currentHash := hashToken(currentToken)
+	var sessions []Session
+	for rows.Next() {
+		var session Session
+		var tokenHash string
+		err := rows.Scan(&session.ID, &tokenHash, &session.UserAgent, &session.IP,
+			&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		session.Current = tokenHash == currentHash
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// sessionsPage lists the user's active sessions (GET /account/sessions, behind requireLogin)
+func sessionsPage(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	sessions, err := listSessions(user.Username, currentSessionToken(r), time.Now())
+	if err != nil {
+		log.Printf("Failed to list sessions: username=%s error=%v", user.Username, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := buildViewData(w, r)
+	data["Sessions"] = sessions
+	renderTemplate(w, "sessions.html", data)
+}
+
+// revokeSession logs one of the user's sessions out (POST /api/account/sessions/revoke)
+func revokeSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	clientIP := getClientIP(r)
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid session", http.StatusBadRequest)
+		return
+	}
+
+	// Scoped to the username so one user can't revoke another's session by guessing IDs
+	var tokenHash string
+	err = db.QueryRow("DELETE FROM sessions WHERE id = $1 AND username = $2 RETURNING token_hash",
+		id, user.Username).Scan(&tokenHash)
+	if err != nil {
+		log.Printf("Session revoke failed: username=%s ip=%s session=%d error=%v", user.Username, clientIP, id, err)
+		setFlash(w, "That session was not found, it may have expired already")
+		http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+		return
+	}
+
+	log.Printf("Session revoked: username=%s ip=%s session=%d", user.Username, clientIP, id)
+
+	if tokenHash == hashToken(currentSessionToken(r)) {
+		clearSessionCookie(w)
+		setFlash(w, "You were logged out")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	setFlash(w, "The session has been logged out")
+	http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+}
+
+// revokeAllSessions logs the user out everywhere, including this browser (POST /api/account/sessions/revoke-all)
+func revokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	clientIP := getClientIP(r)
+
+	result, err := db.Exec("DELETE FROM sessions WHERE username = $1", user.Username)
+	if err != nil {
+		log.Printf("Logout everywhere failed: username=%s ip=%s error=%v", user.Username, clientIP, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	n, _ := result.RowsAffected()
+	log.Printf("Logout everywhere: username=%s ip=%s sessions=%d", user.Username, clientIP, n)
+
+	clearSessionCookie(w)
+	setFlash(w, "You were logged out on all devices")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// startSessionReaper periodically deletes sessions past their idle or absolute expiry
+func startSessionReaper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now()
+			result, err := db.Exec("DELETE FROM sessions WHERE expires_at < $1 OR absolute_expires_at < $1", now)
+			if err != nil {
+				log.Printf("Session reaping failed: error=%v", err)
+				continue
+			}
+			if n, _ := result.RowsAffected(); n > 0 {
+				log.Printf("Expired sessions reaped: rows=%d", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestSession_Device verifies user agents are summarised for the sessions page
+func TestSession_Device(t *testing.T) {
+	tests := map[string]string{
+		"": "Unknown device",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0":                                                                  "Firefox on Linux",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36 Edg/126.0.0.0":           "Edge on Windows",
+		"Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Mobile Safari/537.36":                            "Chrome on Android",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1": "Safari on iOS",
+		"curl/8.5.0": "curl",
+	}
+	for ua, want := range tests {
+		if got := (Session{UserAgent: ua}).Device(); got != want {
+			t.Errorf("Device(%q) = %q, want %q", ua, got, want)
+		}
+	}
+}
+
+// sessionRequest builds a GET request carrying a session cookie
+func sessionRequest(token string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "session_token", Value: token})
+	return req
+}
+
+// TestSessions_Integration verifies hashing at rest, sliding expiry, the absolute cap and revocation
+func TestSessions_Integration(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	for _, username := range []string{"testuser_sessions", "testuser_sessions_other"} {
+		_, err := testDB.Exec(`INSERT INTO users (username, email, password, registration_ip) VALUES ($1, $2, $3, $4)`,
+			username, username+"@example.com", "x", "127.0.0.1")
+		if err != nil {
+			t.Fatalf("failed to create test user: %v", err)
+		}
+	}
+	for _, token := range []string{"test-sessions-current", "test-sessions-laptop"} {
+		createSession("testuser_sessions", token, "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0", "198.51.100.7")
+	}
+	createSession("testuser_sessions_other", "test-sessions-other", "curl/8.5.0", "198.51.100.8")
+	user := &User{Username: "testuser_sessions"}
+
+	t.Run("token is only stored hashed", func(t *testing.T) {
+		var plain int
+		testDB.QueryRow("SELECT COUNT(*) FROM sessions WHERE token_hash = $1", "test-sessions-current").Scan(&plain)
+		if plain != 0 {
+			t.Errorf("raw session token found in the sessions table")
+		}
+	})
+
+	t.Run("sliding expiry", func(t *testing.T) {
+		testDB.Exec(`UPDATE sessions SET last_seen_at = NOW() - INTERVAL '2 minutes', expires_at = NOW() + INTERVAL '1 minute'
+			WHERE token_hash = $1`, hashToken("test-sessions-current"))
+
+		if username, err := validateSession(sessionRequest("test-sessions-current")); err != nil || username != "testuser_sessions" {
+			t.Fatalf("validateSession() = %q, %v", username, err)
+		}
+
+		var expiresAt, absoluteExpiresAt time.Time
+		testDB.QueryRow("SELECT expires_at, absolute_expires_at FROM sessions WHERE token_hash = $1",
+			hashToken("test-sessions-current")).Scan(&expiresAt, &absoluteExpiresAt)
+		if time.Until(expiresAt) < time.Hour || expiresAt.After(absoluteExpiresAt) {
+			t.Errorf("expires_at = %v (absolute %v), want slid forward within the cap", expiresAt, absoluteExpiresAt)
+		}
+	})
+
+	t.Run("absolute cap", func(t *testing.T) {
+		testDB.Exec(`UPDATE sessions SET absolute_expires_at = NOW() - INTERVAL '1 second' WHERE token_hash = $1`,
+			hashToken("test-sessions-laptop"))
+		if _, err := validateSession(sessionRequest("test-sessions-laptop")); err == nil {
+			t.Errorf("session past its absolute expiry was accepted")
+		}
+		testDB.Exec(`UPDATE sessions SET absolute_expires_at = NOW() + INTERVAL '1 day' WHERE token_hash = $1`,
+			hashToken("test-sessions-laptop"))
+	})
+
+	sessions, err := listSessions("testuser_sessions", "test-sessions-current", time.Now())
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("listSessions() = %d sessions, %v", len(sessions), err)
+	}
+	var current, laptop Session
+	for _, session := range sessions {
+		if session.Current {
+			current = session
+		} else {
+			laptop = session
+		}
+	}
+	if current.ID == 0 || current.IP != "198.51.100.7" || current.Device() != "Firefox on Linux" {
+		t.Errorf("current session = %+v", current)
+	}
+
+	t.Run("revoke another user's session", func(t *testing.T) {
+		var otherID int64
+		testDB.QueryRow("SELECT id FROM sessions WHERE username = $1", "testuser_sessions_other").Scan(&otherID)
+
+		w := httptest.NewRecorder()
+		revokeSession(w, accountRequest("/api/account/sessions/revoke",
+			url.Values{"id": {strconv.FormatInt(otherID, 10)}}, user, "test-sessions-current"))
+
+		var count int
+		testDB.QueryRow("SELECT COUNT(*) FROM sessions WHERE id = $1", otherID).Scan(&count)
+		if count != 1 {
+			t.Errorf("another user's session was revoked")
+		}
+	})
+
+	t.Run("revoke one session", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		revokeSession(w, accountRequest("/api/account/sessions/revoke",
+			url.Values{"id": {strconv.FormatInt(laptop.ID, 10)}}, user, "test-sessions-current"))
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/account/sessions" {
+			t.Fatalf("revoke = %d to %q", w.Code, w.Header().Get("Location"))
+		}
+		if _, err := validateSession(sessionRequest("test-sessions-laptop")); err == nil {
+			t.Errorf("revoked session still valid")
+		}
+		if _, err := validateSession(sessionRequest("test-sessions-current")); err != nil {
+			t.Errorf("current session was revoked too: %v", err)
+		}
+	})
+
+	t.Run("log out everywhere", func(t *testing.T) {
+		createSession("testuser_sessions", "test-sessions-phone", "", "198.51.100.9")
+
+		w := httptest.NewRecorder()
+		revokeAllSessions(w, accountRequest("/api/account/sessions/revoke-all", url.Values{}, user, "test-sessions-current"))
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+			t.Fatalf("revoke all = %d to %q", w.Code, w.Header().Get("Location"))
+		}
+
+		var mine, others int
+		testDB.QueryRow("SELECT COUNT(*) FROM sessions WHERE username = $1", "testuser_sessions").Scan(&mine)
+		testDB.QueryRow("SELECT COUNT(*) FROM sessions WHERE username = $1", "testuser_sessions_other").Scan(&others)
+		if mine != 0 || others != 1 {
+			t.Errorf("after logout everywhere: mine=%d others=%d, want 0 and 1", mine, others)
+		}
+	})
+
+	t.Run("reaper", func(t *testing.T) {
+		testDB.Exec(`UPDATE sessions SET expires_at = NOW() - INTERVAL '1 second' WHERE username = $1`, "testuser_sessions_other")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go startSessionReaper(ctx, 10*time.Millisecond)
+
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			var count int
+			testDB.QueryRow("SELECT COUNT(*) FROM sessions WHERE username = $1", "testuser_sessions_other").Scan(&count)
+			if count == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expired session was not reaped")
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/hmac"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"whoknows/utils"
+)
+
+// Default time a signed request stays valid on either side of server time
+const defaultSignatureWindow = 5 * time.Minute
+
+var (
+	errMissingSignature = errors.New("missing signature headers")
+	errInvalidTimestamp = errors.New("invalid timestamp")
+	errExpiredSignature = errors.New("timestamp outside allowed window")
+	errInvalidSignature = errors.New("signature mismatch")
+	errReplayedRequest  = errors.New("signature already used")
+)
+
+// Remembers signatures seen inside the window so an intercepted request
+// can't be replayed while its timestamp is still fresh
+type SignatureReplayCache struct {
+	seen map[string]time.Time
+	mu   sync.Mutex
+}
+
+var signatureReplays = &SignatureReplayCache{
+	seen: make(map[string]time.Time),
+}
+
+// getSigningSecret returns the shared HMAC secret, signing is disabled when empty
+func getSigningSecret() string {
+	return os.Getenv("CRAWLER_SIGNING_SECRET")
+}
+
+// getSignatureWindow reads CRAWLER_SIGNATURE_WINDOW (e.g. "5m"), falling back to the default
+func getSignatureWindow() time.Duration {
+	if value := os.Getenv("CRAWLER_SIGNATURE_WINDOW"); value != "" {
+		if window, err := time.ParseDuration(value); err == nil && window > 0 {
+			return window
+		}
+	}
+	return defaultSignatureWindow
+}
+
+// verifyRequestSignature checks the timestamp and HMAC headers against the raw body
+func verifyRequestSignature(r *http.Request, body []byte, secret string, window time.Duration, now time.Time) error {
+	timestamp := r.Header.Get(utils.TimestampHeader)
+	signature := r.Header.Get(utils.SignatureHeader)
+	if timestamp == "" || signature == "" {
+		return errMissingSignature
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errInvalidTimestamp
+	}
+
+	signedAt := time.Unix(unix, 0)
+	if signedAt.Before(now.Add(-window)) || signedAt.After(now.Add(window)) {
+		return errExpiredSignature
+	}
+
+	expected := utils.ComputeSignature(secret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errInvalidSignature
+	}
+
+	if !signatureReplays.remember(signature, signedAt.Add(window), now) {
+		return errReplayedRequest
+	}
+
+	return nil
+}
+
+// remember records a signature until expiresAt, returning false if it was already seen
+func (c *SignatureReplayCache) remember(signature string, expiresAt, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Prune expired entries so the map stays bounded by the window
+	for sig, expiry := range c.seen {
+		if now.After(expiry) {
+			delete(c.seen, sig)
+		}
+	}
+
+	if _, exists := c.seen[signature]; exists {
+		return false
+	}
+	c.seen[signature] = expiresAt
+	return true
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+	"whoknows/utils"
+)
+
+const testSigningSecret = "test-signing-secret"
+
+// TestVerifyRequestSignature verifies signatures produced by utils.SignRequest
+func TestVerifyRequestSignature(t *testing.T) {
+	body := []byte(`{"pages":[]}`)
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		prepare func(req *http.Request)
+		wantErr error
+	}{
+		{
+			name: "accepts valid signature",
+			prepare: func(req *http.Request) {
+				utils.SignRequest(req, body, testSigningSecret)
+			},
+			wantErr: nil,
+		},
+		{
+			name:    "rejects missing headers",
+			prepare: func(req *http.Request) {},
+			wantErr: errMissingSignature,
+		},
+		{
+			name: "rejects wrong secret",
+			prepare: func(req *http.Request) {
+				utils.SignRequest(req, body, "other-secret")
+			},
+			wantErr: errInvalidSignature,
+		},
+		{
+			name: "rejects tampered body",
+			prepare: func(req *http.Request) {
+				utils.SignRequest(req, []byte(`{"pages":[{}]}`), testSigningSecret)
+			},
+			wantErr: errInvalidSignature,
+		},
+		{
+			name: "rejects timestamp outside window",
+			prepare: func(req *http.Request) {
+				old := strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10)
+				req.Header.Set(utils.TimestampHeader, old)
+				req.Header.Set(utils.SignatureHeader, utils.ComputeSignature(testSigningSecret, old, body))
+			},
+			wantErr: errExpiredSignature,
+		},
+		{
+			name: "rejects non-numeric timestamp",
+			prepare: func(req *http.Request) {
+				req.Header.Set(utils.TimestampHeader, "yesterday")
+				req.Header.Set(utils.SignatureHeader, "abc")
+			},
+			wantErr: errInvalidTimestamp,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/batch-pages", bytes.NewReader(body))
+			tt.prepare(req)
+
+			err := verifyRequestSignature(req, body, testSigningSecret, 5*time.Minute, now)
+			if err != tt.wantErr {
+				t.Errorf("verifyRequestSignature() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestVerifyRequestSignature_RejectsReplay verifies the same signed request can't be used twice
+func TestVerifyRequestSignature_RejectsReplay(t *testing.T) {
+	body := []byte(`{"pages":[{"title":"replay"}]}`)
+	req := httptest.NewRequest("POST", "/api/batch-pages", bytes.NewReader(body))
+	utils.SignRequest(req, body, testSigningSecret)
+
+	now := time.Now()
+	if err := verifyRequestSignature(req, body, testSigningSecret, 5*time.Minute, now); err != nil {
+		t.Fatalf("first request error = %v, want nil", err)
+	}
+	if err := verifyRequestSignature(req, body, testSigningSecret, 5*time.Minute, now); err != errReplayedRequest {
+		t.Errorf("replayed request error = %v, want %v", err, errReplayedRequest)
+	}
+}
+
+// TestBatchPages_RequiresSignature verifies unsigned requests are rejected when a secret is set
+func TestBatchPages_RequiresSignature(t *testing.T) {
+	originalKey := os.Getenv("CRAWLER_API_KEY")
+	originalSecret := os.Getenv("CRAWLER_SIGNING_SECRET")
+	defer os.Setenv("CRAWLER_API_KEY", originalKey)
+	defer os.Setenv("CRAWLER_SIGNING_SECRET", originalSecret)
+
+	os.Setenv("CRAWLER_API_KEY", "test-api-key")
+	os.Setenv("CRAWLER_SIGNING_SECRET", testSigningSecret)
+
+	req := httptest.NewRequest("POST", "/api/batch-pages", bytes.NewReader([]byte(`{"pages":[]}`)))
+	req.Header.Set("X-API-Key", "test-api-key")
+	w := httptest.NewRecorder()
+
+	batchPages(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status code = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+// TestBatchPages_RejectsOversizedBody verifies bodies over the limit get a 413 instead of being truncated
+func TestBatchPages_RejectsOversizedBody(t *testing.T) {
+	t.Setenv("CRAWLER_API_KEY", "test-api-key")
+	t.Setenv("CRAWLER_SIGNING_SECRET", "")
+
+	body := append([]byte(`{"pages":[{"title":"`), bytes.Repeat([]byte("a"), maxBatchBodyBytes)...)
+	req := httptest.NewRequest("POST", "/api/batch-pages", bytes.NewReader(body))
+	req.Header.Set("X-API-Key", "test-api-key")
+	w := httptest.NewRecorder()
+
+	batchPages(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status code = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
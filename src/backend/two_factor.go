@@ -0,0 +1,730 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"rsc.io/qr"
+)
+
+// TOTP parameters, the RFC 6238 defaults every authenticator app supports
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1 // steps accepted on either side of the current one, for clock drift
+)
+
+// Issuer shown next to the account in authenticator apps
+const totpIssuer = "Who Knows"
+
+// Number of recovery codes issued when 2FA is enabled or the codes are regenerated
+const recoveryCodeCount = 10
+
+// A password-verified login waits this long for its second factor
+const pendingLoginTTL = 5 * time.Minute
+
+// Name of the cookie carrying a login that still needs its second factor
+const pendingLoginCookieName = "login_2fa"
+
+// Purpose stored in the pending login cookie so other signed values can't be passed off as one
+const tokenPurposeLogin2FA = "login-2fa"
+
+// Second factor methods, as logged
+const (
+	secondFactorTOTP         = "totp"
+	secondFactorRecoveryCode = "recovery_code"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// pendingLogin is the signed payload of the pending login cookie
+// Enroll is set when the account must set up 2FA before it may log in
+type pendingLogin struct {
+	Purpose   string `json:"p"`
+	Username  string `json:"u"`
+	Enroll    bool   `json:"n,omitempty"`
+	ExpiresAt int64  `json:"x"`
+}
+
+// twoFactorState is the 2FA configuration of one account
+type twoFactorState struct {
+	Secret            string
+	Enabled           bool
+	IsAdmin           bool
+	RecoveryCodesLeft int
+}
+
+// twoFactorSetup is what the enrollment form shows: the QR code and the same secret for manual entry
+type twoFactorSetup struct {
+	Secret string
+	URI    template.URL
+	QRCode template.URL
+}
+
+// requireAdminTwoFactor reports whether admins, users with a role granting admin.access, must use 2FA (REQUIRE_ADMIN_2FA=true)
+func requireAdminTwoFactor() bool {
+	return strings.ToLower(os.Getenv("REQUIRE_ADMIN_2FA")) == "true"
+}
+
+// generateTOTPSecret returns a random 160-bit secret, base32 encoded as authenticator apps expect
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpCode computes the code for a time step (RFC 6238 with HMAC-SHA1)
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation (RFC 4226 section 5.3)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits))), nil
+}
+
+// validateTOTP checks a code against the steps around now and returns the step it matched
+func validateTOTP(secret, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// otpauthURI builds the key URI authenticator apps import, as a QR code or pasted
+func otpauthURI(secret, username string) string {
+	params := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+username) + "?" + params.Encode()
+}
+
+// qrCodeDataURI renders text as a QR code PNG inlined in a data: URI
+func qrCodeDataURI(text string) (template.URL, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return "", err
+	}
+	code.Scale = 4
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(code.PNG())), nil
+}
+
+// generateRecoveryCodes returns single-use codes like "k3f9a-x7p2m" with 50 bits of entropy each
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		encoded := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes[i] = encoded[:5] + "-" + encoded[5:]
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode makes codes typed with other case, spaces or without the dash match
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(code)))
+}
+
+// getTwoFactorState loads the account's 2FA configuration
+func getTwoFactorState(userID int) (twoFactorState, error) {
+	var state twoFactorState
+	err := db.QueryRow(`SELECT COALESCE(totp_secret, ''), totp_enabled_at IS NOT NULL, `+adminAccessCondition+`,
+			(SELECT COUNT(*) FROM recovery_codes WHERE user_id = users.id AND used_at IS NULL)
+		FROM users WHERE id = $1`, userID).Scan(&state.Secret, &state.Enabled, &state.IsAdmin, &state.RecoveryCodesLeft)
+	return state, err
+}
+
+// ensureTOTPSecret returns the secret being enrolled, generating one on first use
+// The secret is kept until enrollment is confirmed, so reloading the page doesn't invalidate a scanned code
+func ensureTOTPSecret(userID int, state twoFactorState) (string, error) {
+	if state.Secret != "" {
+		return state.Secret, nil
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec("UPDATE users SET totp_secret = $1 WHERE id = $2 AND totp_enabled_at IS NULL", secret, userID)
+	return secret, err
+}
+
+// replaceRecoveryCodes stores hashes of a fresh set of recovery codes, voiding the old ones
+func replaceRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		_, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)",
+			userID, hashToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// activateTwoFactor turns on 2FA after the first code was confirmed and returns the recovery codes
+// The confirming step is stored as used so the same code can't log in right after
+func activateTwoFactor(userID int, step int64) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE users SET totp_enabled_at = NOW(), totp_last_step = $1
+		WHERE id = $2 AND totp_secret IS NOT NULL AND totp_enabled_at IS NULL`, step, userID)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		return nil, fmt.Errorf("two-factor authentication already enabled")
+	}
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// verifySecondFactor checks a TOTP or recovery code and returns the method used, "" when the code is wrong
+// Both are single-use: a TOTP step at or before the last accepted one is a replay
+func verifySecondFactor(userID int, secret, code string, now time.Time) (string, error) {
+	if step, ok := validateTOTP(secret, code, now); ok {
+		result, err := db.Exec(`UPDATE users SET totp_last_step = $1
+			WHERE id = $2 AND (totp_last_step IS NULL OR totp_last_step < $1)`, step, userID)
+		if err != nil {
+			return "", err
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			return secondFactorTOTP, nil
+		}
+		return "", nil
+	}
+
+	normalized := normalizeRecoveryCode(code)
+	if normalized == "" {
+		return "", nil
+	}
+	result, err := db.Exec(`UPDATE recovery_codes SET used_at = $1
+		WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL`, now, userID, hashToken(normalized))
+	if err != nil {
+		return "", err
+	}
+	if n, _ := result.RowsAffected(); n == 1 {
+		return secondFactorRecoveryCode, nil
+	}
+	return "", nil
+}
+
+// loginNeedsTwoFactor decides what a password-verified login still needs
+// Returns needed when a code must be entered, enroll when an admin must first set up 2FA
+func loginNeedsTwoFactor(username string) (needed bool, enroll bool, err error) {
+	var enabled, isAdmin bool
+	err = db.QueryRow("SELECT totp_enabled_at IS NOT NULL, "+adminAccessCondition+" FROM users WHERE username = $1",
+		username).Scan(&enabled, &isAdmin)
+	if err != nil {
+		return false, false, err
+	}
+	if enabled {
+		return true, false, nil
+	}
+	if isAdmin && requireAdminTwoFactor() {
+		return true, true, nil
+	}
+	return false, false, nil
+}
+
+// beginSecondFactor sends a login that still needs its second factor to /login/2fa, or to /login/2fa/setup
+// when the account must enroll first. Returns true when it redirected, the caller must not start a session then
+func beginSecondFactor(w http.ResponseWriter, r *http.Request, username, clientIP string) (bool, error) {
+	needed, enroll, err := loginNeedsTwoFactor(username)
+	if err != nil || !needed {
+		return false, err
+	}
+	if err := setPendingLogin(w, username, enroll, time.Now()); err != nil {
+		return false, err
+	}
+
+	if enroll {
+		log.Printf("Login pending: username=%s ip=%s reason=two_factor_enrollment_required", username, clientIP)
+		setFlash(w, "Admin accounts must use two-factor authentication, please set it up to continue")
+		http.Redirect(w, r, "/login/2fa/setup", http.StatusSeeOther)
+	} else {
+		log.Printf("Login pending: username=%s ip=%s reason=two_factor_required", username, clientIP)
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+	}
+	return true, nil
+}
+
+// setPendingLogin remembers a password-verified login until the second factor is entered
+func setPendingLogin(w http.ResponseWriter, username string, enroll bool, now time.Time) error {
+	payload, err := json.Marshal(pendingLogin{
+		Purpose:   tokenPurposeLogin2FA,
+		Username:  username,
+		Enroll:    enroll,
+		ExpiresAt: now.Add(pendingLoginTTL).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     pendingLoginCookieName,
+		Value:    signCookieValue(string(payload)),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   getCookieSecure(),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(pendingLoginTTL.Seconds()),
+	})
+	return nil
+}
+
+// getPendingLogin returns the pending login from the cookie if it is genuine and not expired
+func getPendingLogin(r *http.Request, now time.Time) (pendingLogin, bool) {
+	var pending pendingLogin
+
+	cookie, err := r.Cookie(pendingLoginCookieName)
+	if err != nil {
+		return pending, false
+	}
+	payload, ok := verifyCookieValue(cookie.Value)
+	if !ok {
+		return pending, false
+	}
+	if err := json.Unmarshal([]byte(payload), &pending); err != nil || pending.Purpose != tokenPurposeLogin2FA {
+		return pending, false
+	}
+	return pending, now.Unix() <= pending.ExpiresAt
+}
+
+// clearPendingLogin deletes the pending login cookie
+func clearPendingLogin(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     pendingLoginCookieName,
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   getCookieSecure(),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	})
+}
+
+// pendingLoginUser resolves the pending login to its account, or sends the browser back to /login
+func pendingLoginUser(w http.ResponseWriter, r *http.Request, enroll bool) (*User, bool) {
+	pending, ok := getPendingLogin(r, time.Now())
+	if ok && pending.Enroll == enroll {
+		user, err := getUserByUsername(pending.Username)
+		if err == nil {
+			return user, true
+		}
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to load user: username=%s error=%v", pending.Username, err)
+		}
+	}
+
+	clearPendingLogin(w)
+	setFlash(w, "Your login has expired, please log in again")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+	return nil, false
+}
+
+// renderTwoFactorPage renders two_factor.html for the account's current 2FA state, with an optional error
+// loginSetup renders the enrollment step of a login (admins required to use 2FA) instead of the account page
+func renderTwoFactorPage(w http.ResponseWriter, r *http.Request, user *User, loginSetup bool, status int, message string, fields map[string]string) {
+	if message != "" && wantsJSON(r) {
+		renderFormError(w, r, "two_factor.html", nil, status, message, fields)
+		return
+	}
+
+	state, err := getTwoFactorState(user.ID)
+	if err == nil && !state.Enabled {
+		state.Secret, err = ensureTOTPSecret(user.ID, state)
+	}
+	if err != nil {
+		log.Printf("Failed to load two-factor state: username=%s error=%v", user.Username, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := buildViewData(w, r)
+	data["LoginSetup"] = loginSetup
+	data["TwoFactorEnabled"] = state.Enabled
+	data["RecoveryCodesLeft"] = state.RecoveryCodesLeft
+	data["AdminRequired"] = state.IsAdmin && requireAdminTwoFactor()
+	if message != "" {
+		data["Error"] = message
+		data["FieldErrors"] = fields
+	}
+
+	if !state.Enabled {
+		uri := otpauthURI(state.Secret, user.Username)
+		qrCode, err := qrCodeDataURI(uri)
+		if err != nil {
+			// The secret and URI are still shown for manual entry
+			log.Printf("QR code generation failed: username=%s error=%v", user.Username, err)
+		}
+		data["Setup"] = twoFactorSetup{Secret: state.Secret, URI: template.URL(uri), QRCode: qrCode}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := templates.ExecuteTemplate(w, "two_factor.html", data); err != nil {
+		log.Printf("Template execution failed: template=two_factor.html error=%v", err)
+	}
+}
+
+// renderRecoveryCodes shows newly issued recovery codes, the only time they are visible
+func renderRecoveryCodes(w http.ResponseWriter, r *http.Request, user *User, codes []string) {
+	data := buildViewData(w, r)
+	data["User"] = user
+	data["RecoveryCodes"] = codes
+	w.Header().Set("Cache-Control", "no-store")
+	renderTemplate(w, "two_factor.html", data)
+}
+
+// loginTwoFactorPage asks for the authentication code of a password-verified login (GET /login/2fa)
+func loginTwoFactorPage(w http.ResponseWriter, r *http.Request) {
+	if _, ok := pendingLoginUser(w, r, false); !ok {
+		return
+	}
+	renderTemplate(w, "login_2fa.html", buildViewData(w, r))
+}
+
+// loginTwoFactor checks the TOTP or recovery code and creates the session (POST /api/login/2fa)
+// Wrong codes count as failed logins, so the username throttle limits guessing
+func loginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := pendingLoginUser(w, r, false)
+	if !ok {
+		return
+	}
+	clientIP := getClientIP(r)
+
+	if rejectThrottledLogin(w, r, "login_2fa.html", nil, clientIP, user.Username) {
+		return
+	}
+
+	state, err := getTwoFactorState(user.ID)
+	if err != nil {
+		log.Printf("Login failed: username=%s ip=%s reason=database_error error=%v", user.Username, clientIP, err)
+		renderFormError(w, r, "login_2fa.html", nil, http.StatusInternalServerError, "Internal server error", nil)
+		return
+	}
+
+	method := ""
+	if state.Enabled {
+		method, err = verifySecondFactor(user.ID, state.Secret, r.FormValue("code"), time.Now())
+		if err != nil {
+			log.Printf("Login failed: username=%s ip=%s reason=database_error error=%v", user.Username, clientIP, err)
+			renderFormError(w, r, "login_2fa.html", nil, http.StatusInternalServerError, "Internal server error", nil)
+			return
+		}
+	}
+	if method == "" {
+		log.Printf("Login failed: username=%s ip=%s reason=invalid_second_factor", user.Username, clientIP)
+		if err := recordLoginFailure(clientIP, user.Username, time.Now()); err != nil {
+			log.Printf("Failed to record login failure: ip=%s error=%v", clientIP, err)
+		}
+		renderFormError(w, r, "login_2fa.html", nil, http.StatusUnauthorized, "Invalid authentication code",
+			map[string]string{"code": "Enter the current code from your app or an unused recovery code"})
+		return
+	}
+
+	if err := startSession(w, r, user.Username, clientIP); err != nil {
+		renderFormError(w, r, "login_2fa.html", nil, http.StatusInternalServerError, "Failed to create session", nil)
+		return
+	}
+	clearPendingLogin(w)
+
+	if method == secondFactorRecoveryCode {
+		log.Printf("Recovery code used: username=%s ip=%s remaining=%d", user.Username, clientIP, state.RecoveryCodesLeft-1)
+		setFlash(w, fmt.Sprintf("You were logged in with a recovery code, %d left", state.RecoveryCodesLeft-1))
+	} else {
+		setFlash(w, "You were logged in")
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// loginTwoFactorSetupPage shows 2FA enrollment to an admin who must enable it before logging in (GET /login/2fa/setup)
+func loginTwoFactorSetupPage(w http.ResponseWriter, r *http.Request) {
+	user, ok := pendingLoginUser(w, r, true)
+	if !ok {
+		return
+	}
+	renderTwoFactorPage(w, r, user, true, http.StatusOK, "", nil)
+}
+
+// loginTwoFactorSetup confirms the enrollment of a required 2FA and finishes the login (POST /api/login/2fa/setup)
+func loginTwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := pendingLoginUser(w, r, true)
+	if !ok {
+		return
+	}
+	clientIP := getClientIP(r)
+
+	if rejectThrottledLogin(w, r, "login_2fa.html", nil, clientIP, user.Username) {
+		return
+	}
+
+	codes, ok := confirmTwoFactorEnrollment(w, r, user, true)
+	if !ok {
+		if err := recordLoginFailure(clientIP, user.Username, time.Now()); err != nil {
+			log.Printf("Failed to record login failure: ip=%s error=%v", clientIP, err)
+		}
+		return
+	}
+
+	if err := startSession(w, r, user.Username, clientIP); err != nil {
+		renderFormError(w, r, "login_2fa.html", nil, http.StatusInternalServerError, "Failed to create session", nil)
+		return
+	}
+	clearPendingLogin(w)
+
+	renderRecoveryCodes(w, r, user, codes)
+}
+
+// confirmTwoFactorEnrollment checks the first code from the app and enables 2FA
+// Writes the error response itself and returns false when the code is wrong
+func confirmTwoFactorEnrollment(w http.ResponseWriter, r *http.Request, user *User, loginSetup bool) ([]string, bool) {
+	clientIP := getClientIP(r)
+
+	state, err := getTwoFactorState(user.ID)
+	if err != nil {
+		log.Printf("Two-factor enrollment failed: username=%s ip=%s reason=database_error error=%v", user.Username, clientIP, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if state.Enabled {
+		renderTwoFactorPage(w, r, user, loginSetup, http.StatusConflict, "Two-factor authentication is already enabled", nil)
+		return nil, false
+	}
+
+	step, ok := validateTOTP(state.Secret, r.FormValue("code"), time.Now())
+	if state.Secret == "" || !ok {
+		log.Printf("Two-factor enrollment failed: username=%s ip=%s reason=invalid_code", user.Username, clientIP)
+		renderTwoFactorPage(w, r, user, loginSetup, http.StatusBadRequest, "Invalid authentication code",
+			map[string]string{"code": "Enter the 6-digit code your app shows for this account"})
+		return nil, false
+	}
+
+	codes, err := activateTwoFactor(user.ID, step)
+	if err != nil {
+		log.Printf("Two-factor enrollment failed: username=%s ip=%s reason=database_error error=%v", user.Username, clientIP, err)
+		renderTwoFactorPage(w, r, user, loginSetup, http.StatusInternalServerError, "Failed to enable two-factor authentication", nil)
+		return nil, false
+	}
+
+	log.Printf("Two-factor enabled: username=%s ip=%s", user.Username, clientIP)
+	return codes, true
+}
+
+// twoFactorPage shows 2FA enrollment, or its status when enabled (GET /account/2fa, behind requireLogin)
+func twoFactorPage(w http.ResponseWriter, r *http.Request) {
+	renderTwoFactorPage(w, r, currentUser(r), false, http.StatusOK, "", nil)
+}
+
+// enableTwoFactor confirms enrollment from the account page (POST /api/account/2fa/enable)
+func enableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	codes, ok := confirmTwoFactorEnrollment(w, r, user, false)
+	if !ok {
+		return
+	}
+	renderRecoveryCodes(w, r, user, codes)
+}
+
+// disableTwoFactor turns 2FA off after checking the password and a code (POST /api/account/2fa/disable)
+// Admins can't turn it off while REQUIRE_ADMIN_2FA is set
+func disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	clientIP := getClientIP(r)
+
+	state, ok := checkTwoFactorChange(w, r, user, "disable")
+	if !ok {
+		return
+	}
+	if state.IsAdmin && requireAdminTwoFactor() {
+		renderTwoFactorPage(w, r, user, false, http.StatusForbidden, "Two-factor authentication is required for admin accounts", nil)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err == nil {
+		defer tx.Rollback()
+		_, err = tx.Exec(`UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = NULL
+			WHERE id = $1`, user.ID)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", user.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Two-factor disable failed: username=%s ip=%s reason=database_error error=%v", user.Username, clientIP, err)
+		renderTwoFactorPage(w, r, user, false, http.StatusInternalServerError, "Failed to disable two-factor authentication", nil)
+		return
+	}
+
+	log.Printf("Two-factor disabled: username=%s ip=%s", user.Username, clientIP)
+	setFlash(w, "Two-factor authentication has been disabled")
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// regenerateRecoveryCodes replaces the recovery codes after checking the password and a code
+// (POST /api/account/2fa/recovery-codes)
+func regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	clientIP := getClientIP(r)
+
+	if _, ok := checkTwoFactorChange(w, r, user, "regenerate"); !ok {
+		return
+	}
+
+	var codes []string
+	tx, err := db.Begin()
+	if err == nil {
+		defer tx.Rollback()
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Recovery code regeneration failed: username=%s ip=%s reason=database_error error=%v", user.Username, clientIP, err)
+		renderTwoFactorPage(w, r, user, false, http.StatusInternalServerError, "Failed to generate recovery codes", nil)
+		return
+	}
+
+	log.Printf("Recovery codes regenerated: username=%s ip=%s", user.Username, clientIP)
+	renderRecoveryCodes(w, r, user, codes)
+}
+
+// checkTwoFactorChange verifies the password (<prefix>_password) and a code (<prefix>_code)
+// before 2FA settings change, so a hijacked session alone can't weaken the account
+// Writes the error response itself and returns false when a check fails
+func checkTwoFactorChange(w http.ResponseWriter, r *http.Request, user *User, prefix string) (twoFactorState, bool) {
+	clientIP := getClientIP(r)
+
+	state, err := getTwoFactorState(user.ID)
+	if err != nil {
+		log.Printf("Two-factor change failed: username=%s ip=%s reason=database_error error=%v", user.Username, clientIP, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return state, false
+	}
+	if !state.Enabled {
+		renderTwoFactorPage(w, r, user, false, http.StatusConflict, "Two-factor authentication is not enabled", nil)
+		return state, false
+	}
+
+	ok, err := checkCurrentPassword(user.ID, r.FormValue(prefix+"_password"))
+	if err != nil {
+		log.Printf("Two-factor change failed: username=%s ip=%s reason=database_error error=%v", user.Username, clientIP, err)
+		renderTwoFactorPage(w, r, user, false, http.StatusInternalServerError, "Internal server error", nil)
+		return state, false
+	}
+	if !ok {
+		log.Printf("Two-factor change failed: username=%s ip=%s reason=wrong_password", user.Username, clientIP)
+		renderTwoFactorPage(w, r, user, false, http.StatusUnauthorized, "Current password is incorrect",
+			map[string]string{prefix + "_password": "Current password is incorrect"})
+		return state, false
+	}
+
+	method, err := verifySecondFactor(user.ID, state.Secret, r.FormValue(prefix+"_code"), time.Now())
+	if err != nil {
+		log.Printf("Two-factor change failed: username=%s ip=%s reason=database_error error=%v", user.Username, clientIP, err)
+		renderTwoFactorPage(w, r, user, false, http.StatusInternalServerError, "Internal server error", nil)
+		return state, false
+	}
+	if method == "" {
+		log.Printf("Two-factor change failed: username=%s ip=%s reason=invalid_code", user.Username, clientIP)
+		renderTwoFactorPage(w, r, user, false, http.StatusUnauthorized, "Invalid authentication code",
+			map[string]string{prefix + "_code": "Enter the current code from your app or an unused recovery code"})
+		return state, false
+	}
+	return state, true
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// RFC 6238 test secret "12345678901234567890", base32 encoded
+const rfcTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestTOTPCode_RFC6238Vectors verifies codes against the SHA-1 test vectors (last 6 of the 8 digits)
+func TestTOTPCode_RFC6238Vectors(t *testing.T) {
+	tests := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range tests {
+		got, err := totpCode(rfcTOTPSecret, unix/totpPeriod)
+		if err != nil {
+			t.Fatalf("totpCode() error = %v", err)
+		}
+		if got != want {
+			t.Errorf("totpCode(T=%d) = %s, want %s", unix, got, want)
+		}
+	}
+}
+
+// TestValidateTOTP_Skew verifies one step of clock drift is accepted and more is rejected
+func TestValidateTOTP_Skew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+
+	previous, _ := totpCode(rfcTOTPSecret, current-1)
+	if step, ok := validateTOTP(rfcTOTPSecret, previous, now); !ok || step != current-1 {
+		t.Errorf("previous step code: step=%d ok=%v, want step=%d ok=true", step, ok, current-1)
+	}
+
+	code, _ := totpCode(rfcTOTPSecret, current)
+	if _, ok := validateTOTP(rfcTOTPSecret, code[:3]+" "+code[3:], now); !ok {
+		t.Errorf("code with a space was rejected")
+	}
+
+	stale, _ := totpCode(rfcTOTPSecret, current-2)
+	if _, ok := validateTOTP(rfcTOTPSecret, stale, now); ok {
+		t.Errorf("code from two steps ago was accepted")
+	}
+
+	for _, bad := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := validateTOTP(rfcTOTPSecret, bad, now); ok {
+			t.Errorf("validateTOTP(%q) accepted", bad)
+		}
+	}
+}
+
+// TestOtpauthURI verifies the key URI authenticator apps import
+func TestOtpauthURI(t *testing.T) {
+	uri, err := url.Parse(otpauthURI("JBSWY3DPEHPK3PXP", "alice smith"))
+	if err != nil {
+		t.Fatalf("otpauthURI() is not a valid URL: %v", err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" {
+		t.Errorf("URI = %s, want otpauth://totp/...", uri)
+	}
+	if uri.Path != "/"+totpIssuer+":alice smith" {
+		t.Errorf("label = %q", uri.Path)
+	}
+	query := uri.Query()
+	if query.Get("secret") != "JBSWY3DPEHPK3PXP" || query.Get("issuer") != totpIssuer || query.Get("digits") != "6" {
+		t.Errorf("query = %v", query)
+	}
+
+	if qrCode, err := qrCodeDataURI(uri.String()); err != nil || !strings.HasPrefix(string(qrCode), "data:image/png;base64,") {
+		t.Errorf("qrCodeDataURI() = %.40q, %v", qrCode, err)
+	}
+}
+
+// TestGenerateRecoveryCodes verifies format, uniqueness and lenient matching of recovery codes
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatalf("generateRecoveryCodes() error = %v", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	format := regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`)
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("code %q has the wrong format", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q issued twice", code)
+		}
+		seen[code] = true
+	}
+
+	typed := strings.ToUpper(strings.Replace(codes[0], "-", " ", 1))
+	if normalizeRecoveryCode(typed) != normalizeRecoveryCode(codes[0]) {
+		t.Errorf("normalizeRecoveryCode(%q) doesn't match %q", typed, codes[0])
+	}
+}
+
+// TestPendingLogin_Cookie verifies the pending login survives a round trip and rejects tampering and expiry
+func TestPendingLogin_Cookie(t *testing.T) {
+	now := time.Now()
+	w := httptest.NewRecorder()
+	if err := setPendingLogin(w, "testuser_pending", true, now); err != nil {
+		t.Fatalf("setPendingLogin() error = %v", err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	req := httptest.NewRequest("GET", "/login/2fa", nil)
+	req.AddCookie(cookie)
+	pending, ok := getPendingLogin(req, now)
+	if !ok || pending.Username != "testuser_pending" || !pending.Enroll {
+		t.Errorf("getPendingLogin() = %+v, %v", pending, ok)
+	}
+	if _, ok := getPendingLogin(req, now.Add(pendingLoginTTL+time.Second)); ok {
+		t.Errorf("expired pending login accepted")
+	}
+
+	// A signed value made for another purpose, like a flash message, is not a pending login
+	req = httptest.NewRequest("GET", "/login/2fa", nil)
+	req.AddCookie(&http.Cookie{Name: pendingLoginCookieName, Value: signCookieValue(`{"u":"admin","x":9999999999}`)})
+	if _, ok := getPendingLogin(req, now); ok {
+		t.Errorf("pending login without the purpose accepted")
+	}
+}
+
+// twoFactorRequest posts a form carrying the cookies a previous response set
+func twoFactorRequest(path string, form url.Values, cookies []*http.Cookie) *http.Request {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+// TestTwoFactorLogin_Integration verifies the code step between password and session
+func TestTwoFactorLogin_Integration(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("correct-password"), bcrypt.MinCost)
+	var userID int
+	err := testDB.QueryRow(`INSERT INTO users (username, email, password, registration_ip, verified_at, totp_secret, totp_enabled_at)
+		VALUES ($1, $2, $3, $4, NOW(), $5, NOW()) RETURNING id`,
+		"testuser_2fa", "testuser_2fa@example.com", string(hashedPassword), "127.0.0.1", rfcTOTPSecret).Scan(&userID)
+	if err != nil {
+		t.Fatalf("failed to create test user: %v", err)
+	}
+	tx, _ := testDB.Begin()
+	recoveryCodes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		t.Fatalf("replaceRecoveryCodes() error = %v", err)
+	}
+	tx.Commit()
+
+	passwordStep := func(t *testing.T) []*http.Cookie {
+		w := postForm(login, "/api/login", url.Values{"username": {"testuser_2fa"}, "password": {"correct-password"}})
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login/2fa" {
+			t.Fatalf("login = %d to %q, want a redirect to /login/2fa", w.Code, w.Header().Get("Location"))
+		}
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == "session_token" {
+				t.Fatalf("session created before the second factor")
+			}
+		}
+		return w.Result().Cookies()
+	}
+	sessionSet := func(w *httptest.ResponseRecorder) bool {
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == "session_token" && cookie.Value != "" {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("wrong code", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		loginTwoFactor(w, twoFactorRequest("/api/login/2fa", url.Values{"code": {"000000"}}, passwordStep(t)))
+		if w.Code != http.StatusUnauthorized || sessionSet(w) {
+			t.Errorf("status code = %d, session=%v, want 401 without session", w.Code, sessionSet(w))
+		}
+	})
+
+	t.Run("totp code, then replay", func(t *testing.T) {
+		code, _ := totpCode(rfcTOTPSecret, time.Now().Unix()/totpPeriod)
+
+		w := httptest.NewRecorder()
+		loginTwoFactor(w, twoFactorRequest("/api/login/2fa", url.Values{"code": {code}}, passwordStep(t)))
+		if w.Code != http.StatusSeeOther || !sessionSet(w) {
+			t.Fatalf("status code = %d, session=%v, want 303 with session; body=%s", w.Code, sessionSet(w), w.Body.String())
+		}
+
+		w = httptest.NewRecorder()
+		loginTwoFactor(w, twoFactorRequest("/api/login/2fa", url.Values{"code": {code}}, passwordStep(t)))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("replayed code: status code = %d, want %d", w.Code, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("recovery code works once", func(t *testing.T) {
+		code := strings.ToUpper(recoveryCodes[0])
+
+		w := httptest.NewRecorder()
+		loginTwoFactor(w, twoFactorRequest("/api/login/2fa", url.Values{"code": {code}}, passwordStep(t)))
+		if w.Code != http.StatusSeeOther || !strings.Contains(flashFrom(w), "recovery code") {
+			t.Fatalf("status code = %d, flash=%q", w.Code, flashFrom(w))
+		}
+
+		w = httptest.NewRecorder()
+		loginTwoFactor(w, twoFactorRequest("/api/login/2fa", url.Values{"code": {code}}, passwordStep(t)))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("reused recovery code: status code = %d, want %d", w.Code, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("no pending login", func(t *testing.T) {
+		w := postForm(loginTwoFactor, "/api/login/2fa", url.Values{"code": {"000000"}})
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+			t.Errorf("without pending login = %d to %q, want a redirect to /login", w.Code, w.Header().Get("Location"))
+		}
+	})
+}
+
+// TestTwoFactorRequiredForAdmin_Integration verifies admins must enroll before their first session
+func TestTwoFactorRequiredForAdmin_Integration(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	t.Setenv("REQUIRE_ADMIN_2FA", "true")
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("correct-password"), bcrypt.MinCost)
+	var userID int
+	err := testDB.QueryRow(`INSERT INTO users (username, email, password, registration_ip, verified_at)
+		VALUES ($1, $2, $3, $4, NOW()) RETURNING id`,
+		"testuser_2fa_admin", "testuser_2fa_admin@example.com", string(hashedPassword), "127.0.0.1").Scan(&userID)
+	if err != nil {
+		t.Fatalf("failed to create test user: %v", err)
+	}
+	grantTestRole(t, testDB, userID, "admin")
+
+	w := postForm(login, "/api/login", url.Values{"username": {"testuser_2fa_admin"}, "password": {"correct-password"}})
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login/2fa/setup" {
+		t.Fatalf("login = %d to %q, want a redirect to /login/2fa/setup", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+
+	// Showing the setup page generates the secret to enroll
+	page := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/login/2fa/setup", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	loginTwoFactorSetupPage(page, req)
+	var secret string
+	testDB.QueryRow("SELECT totp_secret FROM users WHERE username = $1", "testuser_2fa_admin").Scan(&secret)
+	if page.Code != http.StatusOK || secret == "" || !strings.Contains(page.Body.String(), secret) {
+		t.Fatalf("setup page = %d, secret=%q", page.Code, secret)
+	}
+
+	code, _ := totpCode(secret, time.Now().Unix()/totpPeriod)
+	w = httptest.NewRecorder()
+	loginTwoFactorSetup(w, twoFactorRequest("/api/login/2fa/setup", url.Values{"code": {code}}, cookies))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "recovery codes") {
+		t.Fatalf("setup = %d, body=%s", w.Code, w.Body.String())
+	}
+
+	var enabled bool
+	var remaining int
+	testDB.QueryRow("SELECT totp_enabled_at IS NOT NULL FROM users WHERE username = $1", "testuser_2fa_admin").Scan(&enabled)
+	testDB.QueryRow(`SELECT COUNT(*) FROM recovery_codes rc JOIN users u ON u.id = rc.user_id
+		WHERE u.username = $1`, "testuser_2fa_admin").Scan(&remaining)
+	if !enabled || remaining != recoveryCodeCount {
+		t.Errorf("after setup: enabled=%v recovery codes=%d", enabled, remaining)
+	}
+}
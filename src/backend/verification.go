@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Verification links stay valid for two days
+const verificationTokenTTL = 48 * time.Hour
+
+// Minimum time between verification e-mails for the same account
+const verificationResendInterval = time.Minute
+
+// Unverified accounts can log in for a week after registering, after that only once they verify
+const unverifiedLoginGracePeriod = 7 * 24 * time.Hour
+
+// Purpose stored in signed tokens so a token for one flow can't be replayed in another
+const tokenPurposeVerifyEmail = "verify-email"
+
+var (
+	errInvalidVerificationToken = errors.New("invalid verification token")
+	errExpiredVerificationToken = errors.New("verification token expired")
+	errVerificationTokenUsed    = errors.New("verification token already used")
+)
+
+// verificationToken is the signed payload of an e-mailed verification link
+type verificationToken struct {
+	Purpose   string `json:"p"`
+	UserID    int    `json:"u"`
+	Email     string `json:"e"`
+	ExpiresAt int64  `json:"x"`
+}
+
+// Tracks when each account last requested a verification e-mail
+var verificationResends = struct {
+	mu       sync.Mutex
+	lastSent map[int]time.Time
+}{lastSent: make(map[int]time.Time)}
+
+// isValidEmail accepts a bare address like "user@example.com", without display names or line breaks
+func isValidEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Address == email && address.Name == ""
+}
+
+// getBaseURL returns APP_BASE_URL, used to build links in e-mails
+// Never derived from the request Host header, which an attacker could point at their own site
+func getBaseURL() string {
+	return strings.TrimRight(envOrDefault("APP_BASE_URL", "http://localhost:8080"), "/")
+}
+
+// createVerificationToken signs a token binding the account to the address being verified
+func createVerificationToken(userID int, email string, now time.Time) (string, error) {
+	payload, err := json.Marshal(verificationToken{
+		Purpose:   tokenPurposeVerifyEmail,
+		UserID:    userID,
+		Email:     email,
+		ExpiresAt: now.Add(verificationTokenTTL).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return signCookieValue(string(payload)), nil
+}
+
+// parseVerificationToken checks the signature, purpose and expiry of a verification token
+func parseVerificationToken(token string, now time.Time) (verificationToken, error) {
+	var parsed verificationToken
+
+	payload, ok := verifyCookieValue(token)
+	if !ok {
+		return parsed, errInvalidVerificationToken
+	}
+	if err := json.Unmarshal([]byte(payload), &parsed); err != nil || parsed.Purpose != tokenPurposeVerifyEmail {
+		return parsed, errInvalidVerificationToken
+	}
+	if now.Unix() > parsed.ExpiresAt {
+		return parsed, errExpiredVerificationToken
+	}
+	return parsed, nil
+}
+
+// sendVerificationEmail mails a verification link for the account's current address
+func sendVerificationEmail(userID int, username, email string) error {
+	token, err := createVerificationToken(userID, email, time.Now())
+	if err != nil {
+		return err
+	}
+
+	link := getBaseURL() + "/verify-email?token=" + token
+	return mailer.Send(Mail{
+		To:      email,
+		Subject: "Verify your e-mail address",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Please confirm your e-mail address for ¿Who Knows? by opening this link:\n\n%s\n\n"+
+			"The link expires in %d hours. If you didn't create an account, you can ignore this e-mail.\n",
+			username, link, int(verificationTokenTTL.Hours())),
+	})
+}
+
+// consumeVerificationToken marks the address as verified
+// A token is single-use: it only matches while the account still has that address and is unverified,
+// and changing the address (which clears verified_at) invalidates links sent for the old one
+func consumeVerificationToken(token string, now time.Time) (string, error) {
+	parsed, err := parseVerificationToken(token, now)
+	if err != nil {
+		return "", err
+	}
+
+	var username string
+	err = db.QueryRow(`UPDATE users SET verified_at = $1
+		WHERE id = $2 AND email = $3 AND verified_at IS NULL
+		RETURNING username`,
+		now, parsed.UserID, parsed.Email).Scan(&username)
+	if err == sql.ErrNoRows {
+		return "", errVerificationTokenUsed
+	}
+	return username, err
+}
+
+// verifyEmail handles the link from the verification e-mail (GET /verify-email?token=...)
+func verifyEmail(w http.ResponseWriter, r *http.Request) {
+	clientIP := getClientIP(r)
+
+	username, err := consumeVerificationToken(r.URL.Query().Get("token"), time.Now())
+	switch err {
+	case nil:
+		log.Printf("Email verification success: username=%s ip=%s", username, clientIP)
+		setFlash(w, "Your e-mail address has been verified")
+	case errExpiredVerificationToken:
+		log.Printf("Email verification failed: ip=%s reason=expired", clientIP)
+		setFlash(w, "This verification link has expired, please request a new one")
+	case errInvalidVerificationToken, errVerificationTokenUsed:
+		log.Printf("Email verification failed: ip=%s reason=%v", clientIP, err)
+		setFlash(w, "This verification link is invalid or has already been used")
+	default:
+		log.Printf("Email verification failed: ip=%s reason=database_error error=%v", clientIP, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// verificationGraceExpired reports whether the account is still unverified more than
+// unverifiedLoginGracePeriod after registering, which stops it from logging in
+func verificationGraceExpired(username string, now time.Time) (bool, error) {
+	var expired bool
+	err := db.QueryRow("SELECT verified_at IS NULL AND registration_date < $2 FROM users WHERE username = $1",
+		username, now.Add(-unverifiedLoginGracePeriod)).Scan(&expired)
+	return expired, err
+}
+
+// claimVerificationResend records a verification e-mail for the account, unless one was sent
+// less than verificationResendInterval ago
+func claimVerificationResend(userID int, now time.Time) bool {
+	verificationResends.mu.Lock()
+	defer verificationResends.mu.Unlock()
+
+	if now.Sub(verificationResends.lastSent[userID]) < verificationResendInterval {
+		return false
+	}
+	verificationResends.lastSent[userID] = now
+	return true
+}
+
+// remindUnverifiedUser mails a new verification link to an account whose login was refused
+// The resend button is only shown to logged-in users, so this is how they get a working link
+func remindUnverifiedUser(username string, now time.Time) error {
+	user, err := getUserByUsername(username)
+	if err != nil {
+		return err
+	}
+	if !claimVerificationResend(user.ID, now) {
+		return nil
+	}
+	return sendVerificationEmail(user.ID, user.Username, user.Email)
+}
+
+// resendVerification mails a new verification link to the logged-in user (POST /api/resend-verification)
+func resendVerification(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if user.Verified {
+		setFlash(w, "Your e-mail address is already verified")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if !claimVerificationResend(user.ID, time.Now()) {
+		setFlash(w, "A verification e-mail was just sent, please wait a minute before requesting another")
+	} else if err := sendVerificationEmail(user.ID, user.Username, user.Email); err != nil {
+		log.Printf("Verification e-mail failed: username=%s error=%v", user.Username, err)
+		setFlash(w, "We couldn't send the verification e-mail, please try again later")
+	} else {
+		setFlash(w, "A new verification link has been sent to "+user.Email)
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
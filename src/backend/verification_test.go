@@ -0,0 +1,294 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// captureMailer records sent mail instead of delivering it
+type captureMailer struct {
+	mu   sync.Mutex
+	sent []Mail
+}
+
+func (m *captureMailer) Send(mail Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, mail)
+	return nil
+}
+
+// useCaptureMailer swaps the global mailer for the duration of a test
+func useCaptureMailer(t *testing.T) *captureMailer {
+	t.Helper()
+	capture := &captureMailer{}
+	original := mailer
+	mailer = capture
+	t.Cleanup(func() { mailer = original })
+	return capture
+}
+
+// TestVerificationToken verifies signing, expiry and purpose checks
+func TestVerificationToken(t *testing.T) {
+	now := time.Now()
+	token, err := createVerificationToken(42, "verify@example.com", now)
+	if err != nil {
+		t.Fatalf("createVerificationToken() returned error: %v", err)
+	}
+
+	parsed, err := parseVerificationToken(token, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("parseVerificationToken() returned error: %v", err)
+	}
+	if parsed.UserID != 42 || parsed.Email != "verify@example.com" {
+		t.Errorf("parsed = %+v", parsed)
+	}
+
+	if _, err := parseVerificationToken(token, now.Add(verificationTokenTTL+time.Minute)); err != errExpiredVerificationToken {
+		t.Errorf("expired token error = %v, want %v", err, errExpiredVerificationToken)
+	}
+	if _, err := parseVerificationToken(token+"x", now); err != errInvalidVerificationToken {
+		t.Errorf("tampered token error = %v, want %v", err, errInvalidVerificationToken)
+	}
+	// A value signed with the same key for another purpose (like a flash message) is rejected
+	if _, err := parseVerificationToken(signCookieValue(`{"u":42}`), now); err != errInvalidVerificationToken {
+		t.Errorf("wrong purpose error = %v, want %v", err, errInvalidVerificationToken)
+	}
+}
+
+// TestIsValidEmail verifies only bare addresses are accepted
+func TestIsValidEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  bool
+	}{
+		{"user@example.com", true},
+		{"first.last+tag@sub.example.dk", true},
+		{"not-an-email", false},
+		{"Name <user@example.com>", false},
+		{"user@example.com\r\nBcc: victim@example.com", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := isValidEmail(tt.email); got != tt.want {
+			t.Errorf("isValidEmail(%q) = %v, want %v", tt.email, got, tt.want)
+		}
+	}
+}
+
+// TestLogMailer_WritesFile verifies messages are stored as .eml files when a directory is set
+func TestLogMailer_WritesFile(t *testing.T) {
+	dir := t.TempDir()
+	m := LogMailer{Dir: dir, From: "Oggole <no-reply@oggole.test>"}
+
+	if err := m.Send(Mail{To: "user@example.com", Subject: "Hej æøå", Body: "Line one\nLine two"}); err != nil {
+		t.Fatalf("Send() returned error: %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("expected one .eml file, got %v", files)
+	}
+	data, _ := os.ReadFile(files[0])
+	message := string(data)
+	for _, want := range []string{
+		"From: Oggole <no-reply@oggole.test>\r\n",
+		"To: user@example.com\r\n",
+		"Subject: =?UTF-8?q?",
+		"@oggole.test>\r\n",
+		"\r\n\r\nLine one\r\nLine two",
+	} {
+		if !strings.Contains(message, want) {
+			t.Errorf("message does not contain %q:\n%s", want, message)
+		}
+	}
+}
+
+// TestBuildMailMessage_RejectsHeaderInjection verifies line breaks can't add headers
+func TestBuildMailMessage_RejectsHeaderInjection(t *testing.T) {
+	_, err := buildMailMessage("", Mail{To: "user@example.com", Subject: "Hi\r\nBcc: victim@example.com"}, time.Now())
+	if err == nil {
+		t.Errorf("buildMailMessage() accepted a subject with a line break")
+	}
+}
+
+// TestRequireVerifiedUser_Anonymous verifies logged-out visitors are turned away
+func TestRequireVerifiedUser_Anonymous(t *testing.T) {
+	called := false
+	handler := requireVerifiedUser(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/api/example", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("API status code = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/example", nil))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+		t.Errorf("page response = %d %s, want redirect to /login", w.Code, w.Header().Get("Location"))
+	}
+
+	if called {
+		t.Errorf("wrapped handler was called for an anonymous request")
+	}
+}
+
+// TestRegisterRoutes_RequireVerifiedUser verifies unverified accounts can't create tokens, saved searches, bookmarks or alerts
+func TestRegisterRoutes_RequireVerifiedUser(t *testing.T) {
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	unverified := &User{ID: 1, Username: "testuser_unverified", Email: "unverified@example.com"}
+
+	for _, path := range []string{
+		"/api/account/tokens",
+		"/api/searches",
+		"/api/searches/rename",
+		"/api/searches/delete",
+		"/api/searches/alerts",
+		"/api/bookmarks",
+		"/api/bookmarks/update",
+		"/api/bookmarks/delete",
+	} {
+		req := accountRequest(path, url.Values{"id": {"1"}, csrfFieldName: {testCSRFToken}}, unverified, "")
+		req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: testCSRFToken})
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "verify your e-mail") {
+			t.Errorf("%s = %d %s, want 403 asking to verify the e-mail address", path, w.Code, w.Body.String())
+		}
+	}
+}
+
+// TestEmailVerification_Integration verifies registration sends a single-use link that verifies the account
+func TestEmailVerification_Integration(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	templates = template.Must(template.ParseGlob("../templates/*.html"))
+	capture := useCaptureMailer(t)
+
+	form := url.Values{}
+	form.Set("username", "testuser_verify")
+	form.Set("email", "testuser_verify@example.com")
+	form.Set("password", "violet-canoe-42-ladder")
+	form.Set("password2", "violet-canoe-42-ladder")
+
+	req := httptest.NewRequest("POST", "/api/register", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	register(httptest.NewRecorder(), req)
+
+	if len(capture.sent) != 1 || capture.sent[0].To != "testuser_verify@example.com" {
+		t.Fatalf("expected one verification e-mail, got %+v", capture.sent)
+	}
+
+	body := capture.sent[0].Body
+	start := strings.Index(body, "/verify-email?token=")
+	if start == -1 {
+		t.Fatalf("verification e-mail has no link:\n%s", body)
+	}
+	link := strings.Fields(body[start:])[0]
+
+	var verified bool
+	testDB.QueryRow("SELECT verified_at IS NOT NULL FROM users WHERE username = $1", "testuser_verify").Scan(&verified)
+	if verified {
+		t.Fatalf("account was verified before the link was opened")
+	}
+
+	// First use verifies the account
+	w := httptest.NewRecorder()
+	verifyEmail(w, httptest.NewRequest("GET", link, nil))
+	testDB.QueryRow("SELECT verified_at IS NOT NULL FROM users WHERE username = $1", "testuser_verify").Scan(&verified)
+	if !verified {
+		t.Errorf("account not verified after opening the link")
+	}
+
+	// Second use is rejected
+	if _, err := consumeVerificationToken(strings.TrimPrefix(link, "/verify-email?token="), time.Now()); err != errVerificationTokenUsed {
+		t.Errorf("reused token error = %v, want %v", err, errVerificationTokenUsed)
+	}
+}
+
+// TestClaimVerificationResend verifies one verification e-mail per account per resend interval
+func TestClaimVerificationResend(t *testing.T) {
+	now := time.Now()
+	if !claimVerificationResend(-1, now) {
+		t.Fatal("first resend refused")
+	}
+	if claimVerificationResend(-1, now.Add(verificationResendInterval/2)) {
+		t.Error("second resend within the interval allowed")
+	}
+	if !claimVerificationResend(-2, now) {
+		t.Error("resend for another account refused")
+	}
+	if !claimVerificationResend(-1, now.Add(verificationResendInterval)) {
+		t.Error("resend after the interval refused")
+	}
+}
+
+// TestUnverifiedLoginGrace_Integration verifies unverified accounts log in during the grace period,
+// and are refused with a new verification link after it
+func TestUnverifiedLoginGrace_Integration(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	templates = template.Must(template.ParseGlob("../templates/*.html"))
+	capture := useCaptureMailer(t)
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("correct-password"), bcrypt.MinCost)
+	for username, hoursAgo := range map[string]int{
+		"testuser_grace_new": 1,
+		"testuser_grace_old": int(unverifiedLoginGracePeriod.Hours()) + 1,
+	} {
+		_, err := testDB.Exec(`INSERT INTO users (username, email, password, registration_ip, registration_date)
+			VALUES ($1, $2, $3, $4, NOW() - make_interval(hours => $5))`,
+			username, username+"@example.com", string(hashedPassword), "127.0.0.1", hoursAgo)
+		if err != nil {
+			t.Fatalf("failed to create test user: %v", err)
+		}
+	}
+
+	attempt := func(username string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {username}, "password": {"correct-password"}}
+		req := httptest.NewRequest("POST", "/api/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		login(w, req)
+		return w
+	}
+
+	if w := attempt("testuser_grace_new"); w.Code != http.StatusSeeOther {
+		t.Errorf("login during the grace period = %d, want 303", w.Code)
+	}
+
+	w := attempt("testuser_grace_old")
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "verify your e-mail") {
+		t.Errorf("login after the grace period = %d, want 403 asking to verify", w.Code)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "session_token" {
+			t.Errorf("session cookie set for an account past the grace period")
+		}
+	}
+	if len(capture.sent) != 1 || capture.sent[0].To != "testuser_grace_old@example.com" {
+		t.Errorf("expected one new verification e-mail, got %+v", capture.sent)
+	}
+
+	// A second refused login within the resend interval doesn't mail again
+	attempt("testuser_grace_old")
+	if len(capture.sent) != 1 {
+		t.Errorf("%d verification e-mails after a second attempt, want 1", len(capture.sent))
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Name of the cookie carrying the one-shot flash message
+const flashCookieName = "flash"
+
+// User is the logged-in user as seen by handlers and templates
+type User struct {
+	ID       int
+	Username string
+	Email    string
+	Verified bool
+	Admin    bool // holds a role granting admin.access, the admin routes still check their own permission
+
+	SearchHistory bool // opted in to keeping their searches in search_history
+}
+
+var (
+	cookieSigningKey     []byte
+	cookieSigningKeyOnce sync.Once
+)
+
+var errCookieSigningSecretMissing = errors.New("COOKIE_SIGNING_SECRET is required when ENV=production")
+
+// getCookieSigningKey returns the key from loadCookieSigningKey, exiting if there is none
+func getCookieSigningKey() []byte {
+	cookieSigningKeyOnce.Do(func() {
+		key, err := loadCookieSigningKey()
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		cookieSigningKey = key
+	})
+	return cookieSigningKey
+}
+
+// loadCookieSigningKey returns COOKIE_SIGNING_SECRET, or a random per-process key when unset in development
+// A random key invalidates flashes, verification links, pending 2FA logins and single sign-on state on every
+// restart and differs between instances, so production refuses to run without the secret
+func loadCookieSigningKey() ([]byte, error) {
+	if secret := os.Getenv("COOKIE_SIGNING_SECRET"); secret != "" {
+		return []byte(secret), nil
+	}
+	if os.Getenv("ENV") == "production" {
+		return nil, errCookieSigningSecretMissing
+	}
+	log.Println("WARNING: COOKIE_SIGNING_SECRET not set, using a random key for this process")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generating cookie signing key: %w", err)
+	}
+	return key, nil
+}
+
+// signCookieValue returns "<base64 value>.<base64 hmac>"
+func signCookieValue(value string) string {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(value))
+	mac := hmac.New(sha256.New, getCookieSigningKey())
+	mac.Write([]byte(encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyCookieValue checks the signature from signCookieValue and returns the original value
+func verifyCookieValue(signed string) (string, bool) {
+	encoded, signature, found := strings.Cut(signed, ".")
+	if !found {
+		return "", false
+	}
+
+	mac := hmac.New(sha256.New, getCookieSigningKey())
+	mac.Write([]byte(encoded))
+	expected := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return "", false
+	}
+
+	value, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	return string(value), true
+}
+
+// setFlash stores a message to show on the next rendered page
+func setFlash(w http.ResponseWriter, message string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookieName,
+		Value:    signCookieValue(message),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   getCookieSecure(),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   300,
+	})
+}
+
+// popFlash returns the pending flash message and clears the cookie so it's shown only once
+func popFlash(w http.ResponseWriter, r *http.Request) string {
+	cookie, err := r.Cookie(flashCookieName)
+	if err != nil {
+		return ""
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookieName,
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   getCookieSecure(),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	})
+
+	message, ok := verifyCookieValue(cookie.Value)
+	if !ok {
+		return ""
+	}
+	return message
+}
+
+// currentUser resolves the session cookie to a user, or nil when not logged in
+func currentUser(r *http.Request) *User {
+	// Already resolved by requireLogin or requireVerifiedUser
+	if user, ok := r.Context().Value(userContextKey).(*User); ok {
+		return user
+	}
+	// Bearer requests skip the CSRF check, so they must not fall back to the session cookie
+	if _, ok := bearerToken(r); ok {
+		return nil
+	}
+
+	username, err := validateSession(r)
+	if err != nil || username == "" {
+		return nil
+	}
+	user, err := getUserByUsername(username)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to load user: username=%s error=%v", username, err)
+		}
+		return nil
+	}
+	return user
+}
+
+// getUserByUsername loads the account details templates and handlers need
+func getUserByUsername(username string) (*User, error) {
+	user := &User{}
+	err := db.QueryRow(
+		"SELECT id, username, email, verified_at IS NOT NULL, "+adminAccessCondition+", search_history_enabled FROM users WHERE username = $1",
+		username,
+	).Scan(&user.ID, &user.Username, &user.Email, &user.Verified, &user.Admin, &user.SearchHistory)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// buildViewData returns the template data every page needs (User, FlashMessage, CSRFToken and SSOProvider)
+// Handlers add their page-specific keys on top
+func buildViewData(w http.ResponseWriter, r *http.Request) map[string]interface{} {
+	data := map[string]interface{}{
+		"FlashMessage": popFlash(w, r),
+		"CSRFToken":    csrfToken(w, r),
+	}
+	// Name for the single sign-on button on the login and account pages
+	if oidcProvider != nil {
+		data["SSOProvider"] = oidcProvider.Name
+	}
+	// Only set User when logged in so templates' {{if .User}} sees a missing key, not a typed nil
+	if user := currentUser(r); user != nil {
+		data["User"] = user
+	}
+	return data
+}
+
+// localReferer returns the path and query of the Referer to send a browser back to the page it came from
+// Only the path is used, so the redirect can't leave the site
+func localReferer(r *http.Request, fallback string) string {
+	referer, err := url.Parse(r.Referer())
+	if err != nil || !strings.HasPrefix(referer.Path, "/") || strings.HasPrefix(referer.Path, "//") {
+		return fallback
+	}
+	return (&url.URL{Path: referer.Path, RawQuery: referer.RawQuery}).String()
+}
+
+// renderTemplate executes a template, logging and returning a 500 on failure
+func renderTemplate(w http.ResponseWriter, name string, data interface{}) {
+	if err := templates.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("Template execution failed: template=%s error=%v", name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// formErrorResponse is the JSON body returned to API clients when a form submission fails
+type formErrorResponse struct {
+	Error  string            `json:"error"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// wantsJSON reports whether the client asked for a JSON response instead of HTML
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// renderFormError re-renders a form page with the error, field-level errors and the submitted values,
+// or writes the same information as JSON when the client sends Accept: application/json
+func renderFormError(w http.ResponseWriter, r *http.Request, name string, values map[string]string, status int, message string, fields map[string]string) {
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(formErrorResponse{Error: message, Fields: fields})
+		return
+	}
+
+	data := buildViewData(w, r)
+	for key, value := range values {
+		data[key] = value
+	}
+	data["Error"] = message
+	data["FieldErrors"] = fields
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := templates.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("Template execution failed: template=%s error=%v", name, err)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestFlash_RoundTrip verifies a flash is shown once and then cleared
+func TestFlash_RoundTrip(t *testing.T) {
+	w := httptest.NewRecorder()
+	setFlash(w, "You were logged in")
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != flashCookieName {
+		t.Fatalf("expected one flash cookie, got %v", cookies)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+
+	if got := popFlash(w, req); got != "You were logged in" {
+		t.Errorf("popFlash() = %q, want %q", got, "You were logged in")
+	}
+
+	cleared := w.Result().Cookies()
+	if len(cleared) != 1 || cleared[0].MaxAge >= 0 {
+		t.Errorf("popFlash() did not clear the flash cookie: %v", cleared)
+	}
+}
+
+// TestFlash_RejectsTamperedCookie verifies unsigned or modified flashes are ignored
+func TestFlash_RejectsTamperedCookie(t *testing.T) {
+	signed := signCookieValue("genuine")
+	tampered := "Zm9yZ2Vk" + signed[strings.Index(signed, "."):]
+
+	for _, value := range []string{"no-signature", tampered} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: flashCookieName, Value: value})
+
+		if got := popFlash(httptest.NewRecorder(), req); got != "" {
+			t.Errorf("popFlash(%q) = %q, want empty", value, got)
+		}
+	}
+}
+
+// TestLoadCookieSigningKey verifies the random fallback key is refused in production
+func TestLoadCookieSigningKey(t *testing.T) {
+	t.Setenv("COOKIE_SIGNING_SECRET", "")
+	t.Setenv("ENV", "production")
+	if _, err := loadCookieSigningKey(); !errors.Is(err, errCookieSigningSecretMissing) {
+		t.Errorf("loadCookieSigningKey() in production without a secret: error = %v, want errCookieSigningSecretMissing", err)
+	}
+
+	t.Setenv("ENV", "development")
+	if key, err := loadCookieSigningKey(); err != nil || len(key) != 32 {
+		t.Errorf("loadCookieSigningKey() in development = %d bytes, %v, want a random 32-byte key", len(key), err)
+	}
+
+	t.Setenv("ENV", "production")
+	t.Setenv("COOKIE_SIGNING_SECRET", "configured")
+	if key, err := loadCookieSigningKey(); err != nil || string(key) != "configured" {
+		t.Errorf("loadCookieSigningKey() = %q, %v, want the configured secret", key, err)
+	}
+}
+
+// TestLocalReferer verifies browsers are only sent back to pages on this site
+func TestLocalReferer(t *testing.T) {
+	tests := map[string]string{
+		"":                                 "/fallback",
+		"https://oggole.example/?q=go":     "/?q=go",
+		"https://evil.example//evil.com/x": "/fallback",
+		"not a url\x7f":                    "/fallback",
+	}
+	for referer, want := range tests {
+		req := httptest.NewRequest("POST", "/api/bookmarks", nil)
+		req.Header.Set("Referer", referer)
+		if got := localReferer(req, "/fallback"); got != want {
+			t.Errorf("localReferer(%q) = %q, want %q", referer, got, want)
+		}
+	}
+}
+
+// TestTemplates_RenderWithoutUser verifies every page renders for anonymous visitors
+func TestTemplates_RenderWithoutUser(t *testing.T) {
+	templates = template.Must(template.ParseGlob("../templates/*.html"))
+
+	for _, name := range []string{"search.html", "login.html", "register.html", "weather.html", "about.html", "forgot_password.html", "reset_password.html", "login_2fa.html", "two_factor.html"} {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			renderTemplate(w, name, map[string]interface{}{"FlashMessage": "Hello flash"})
+
+			body := w.Body.String()
+			if w.Code != http.StatusOK {
+				t.Fatalf("status code = %d, want %d", w.Code, http.StatusOK)
+			}
+			if !strings.Contains(body, "Hello flash") {
+				t.Errorf("%s did not render the flash message", name)
+			}
+			if strings.Contains(body, "no value") {
+				t.Errorf("%s rendered a missing key as <no value>", name)
+			}
+		})
+	}
+}
+
+// TestIndex_ShowsLoggedInUser verifies the view model resolves the session
+func TestIndex_ShowsLoggedInUser(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	templates = template.Must(template.ParseGlob("../templates/*.html"))
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	_, err := testDB.Exec(`
+		INSERT INTO users (username, email, password, registration_ip)
+		VALUES ($1, $2, $3, $4)
+	`, "testuser_view", "view@example.com", string(hashedPassword), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed to create test user: %v", err)
+	}
+
+	token := "test-view-session-token"
+	err = createSession("testuser_view", token, "Go-http-client/1.1", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed to create test session: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "session_token", Value: token})
+	w := httptest.NewRecorder()
+
+	index(w, req)
+
+	if !strings.Contains(w.Body.String(), "Log out [testuser_view]") {
+		t.Errorf("index did not render the logged-in user")
+	}
+}
+
+// TestRegister_RerendersFormWithErrors verifies field errors and preserved inputs on a browser post
+func TestRegister_RerendersFormWithErrors(t *testing.T) {
+	templates = template.Must(template.ParseGlob("../templates/*.html"))
+
+	form := url.Values{}
+	form.Set("username", "testuser_form")
+	form.Set("email", "form@example.com")
+	form.Set("password", "secret-one")
+	form.Set("password2", "secret-two")
+
+	req := httptest.NewRequest("POST", "/api/register", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	register(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status code = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`value="testuser_form"`,
+		`value="form@example.com"`,
+		`<div class="field-error">Passwords do not match</div>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("response does not contain %q", want)
+		}
+	}
+	if strings.Contains(body, "secret-one") {
+		t.Errorf("response echoed the submitted password")
+	}
+}
+
+// TestLogin_ReturnsJSONErrors verifies API clients get a structured error instead of HTML
+func TestLogin_ReturnsJSONErrors(t *testing.T) {
+	form := url.Values{}
+	form.Set("username", "testuser_json")
+
+	req := httptest.NewRequest("POST", "/api/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+
+	login(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status code = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+
+	var resp formErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Error != "Username and password required" || resp.Fields["password"] == "" || resp.Fields["username"] != "" {
+		t.Errorf("response = %+v", resp)
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"whoknows/utils"
+
+	"github.com/lib/pq"
+)
+
+// Index events batchPages reports to webhooks
+const (
+	eventPageCreated = "page.created"
+	eventPageUpdated = "page.updated"
+	eventPageDeleted = "page.deleted"
+)
+
+// webhookEvents are the events a webhook can subscribe to, in the order the admin page offers them
+var webhookEvents = []string{eventPageCreated, eventPageUpdated, eventPageDeleted}
+
+const (
+	webhookTimeout         = 10 * time.Second
+	maxWebhookAttempts     = 10
+	webhookClaimLease      = time.Minute // claimed deliveries become due again if the worker dies mid-send
+	webhookBatchSize       = 20
+	webhookLogRetention    = 30 * 24 * time.Hour
+	webhookDeliveriesShown = 50
+)
+
+// webhookClient sends index events. Unlike alert webhooks these are configured by admins and usually
+// point at the team's own tools, so internal addresses are allowed
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// IndexEvent is the JSON body posted to webhooks, signed like crawler requests (X-Timestamp, X-Signature)
+type IndexEvent struct {
+	Event      string         `json:"event"`
+	OccurredAt time.Time      `json:"occurred_at"`
+	Page       IndexEventPage `json:"page"`
+}
+
+// IndexEventPage identifies the page an event is about
+type IndexEventPage struct {
+	Title       string `json:"title"`
+	URL         string `json:"url"`
+	Language    string `json:"language"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+func newIndexEvent(event string, page Page) IndexEvent {
+	return IndexEvent{
+		Event:      event,
+		OccurredAt: time.Now().UTC(),
+		Page:       IndexEventPage{Title: page.Title, URL: page.URL, Language: page.Language, ContentType: page.ContentType},
+	}
+}
+
+// Webhook is a configured endpoint on the admin page, with counts from its delivery log
+type Webhook struct {
+	ID        int
+	URL       string
+	Events    []string
+	Active    bool
+	CreatedBy string
+	CreatedAt time.Time
+	Pending   int
+	Failed    int
+}
+
+// HasEvent reports whether the webhook subscribes to event
+func (h Webhook) HasEvent(event string) bool {
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is one entry of the delivery log
+type WebhookDelivery struct {
+	ID             int64
+	WebhookID      int
+	WebhookURL     string
+	Event          string
+	Status         string
+	Attempts       int
+	NextAttemptAt  time.Time
+	LastStatusCode *int
+	LastError      *string
+	CreatedAt      time.Time
+	DeliveredAt    *time.Time
+}
+
+// enqueueWebhookEvents adds a pending delivery per event for every active webhook subscribed to it
+func enqueueWebhookEvents(events []IndexEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	var active bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM webhooks WHERE active)").Scan(&active); err != nil || !active {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO webhook_deliveries (webhook_id, event, payload)
+			SELECT id, $1, $2 FROM webhooks WHERE active AND $1 = ANY(events)`, event.Event, string(payload))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// webhookBackoff returns the retry delay after n failed attempts (30s, 1m, 2m ... capped at 6h)
+func webhookBackoff(attempts int) time.Duration {
+	backoff := 30 * time.Second
+	for i := 1; i < attempts && backoff < 6*time.Hour; i++ {
+		backoff *= 2
+	}
+	if backoff > 6*time.Hour {
+		backoff = 6 * time.Hour
+	}
+	return backoff
+}
+
+// claimedDelivery is a due delivery with the endpoint and secret to send it with
+type claimedDelivery struct {
+	ID       int64
+	Event    string
+	Payload  string
+	Attempts int
+	URL      string
+	Secret   string
+}
+
+// claimWebhookDeliveries pushes up to limit due deliveries of active webhooks back by webhookClaimLease
+// and returns them, SKIP LOCKED lets several app instances share the work without double sending
+func claimWebhookDeliveries(now time.Time, limit int) ([]claimedDelivery, error) {
+	rows, err := db.Query(`
+		UPDATE webhook_deliveries d SET next_attempt_at = $2
+		FROM webhooks w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT pending.id FROM webhook_deliveries pending
+			JOIN webhooks hook ON hook.id = pending.webhook_id
+			WHERE pending.status = 'pending' AND pending.next_attempt_at <= $1 AND hook.active
+			ORDER BY pending.next_attempt_at
+			LIMIT $3
+			FOR UPDATE OF pending SKIP LOCKED
+		)
+		RETURNING d.id, d.event, d.payload, d.attempts, w.url, w.secret
+	`, now, now.Add(webhookClaimLease), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []claimedDelivery
+	for rows.Next() {
+		var d claimedDelivery
+		if err := rows.Scan(&d.ID, &d.Event, &d.Payload, &d.Attempts, &d.URL, &d.Secret); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// sendWebhook posts a delivery and returns the response status, any non-2xx answer is an error
+func sendWebhook(d claimedDelivery) (int, error) {
+	body := []byte(d.Payload)
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Oggole-Webhooks/1.0")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(d.ID, 10))
+	utils.SignRequest(req, body, d.Secret)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// recordWebhookAttempt stores the outcome of a send, scheduling a retry or giving up after maxWebhookAttempts
+func recordWebhookAttempt(d claimedDelivery, statusCode int, sendErr error, now time.Time) error {
+	attempts := d.Attempts + 1
+	code := sql.NullInt64{Int64: int64(statusCode), Valid: statusCode != 0}
+
+	if sendErr == nil {
+		webhookDeliveries.WithLabelValues("delivered").Inc()
+		_, err := db.Exec(`UPDATE webhook_deliveries
+			SET status = 'delivered', attempts = $2, last_status_code = $3, last_error = NULL, delivered_at = $4
+			WHERE id = $1`, d.ID, attempts, code, now)
+		return err
+	}
+
+	status, outcome, next := "pending", "retry", now.Add(webhookBackoff(attempts))
+	if attempts >= maxWebhookAttempts {
+		status, outcome, next = "failed", "failed", now
+	}
+	webhookDeliveries.WithLabelValues(outcome).Inc()
+	log.Printf("Webhook delivery failed: delivery=%d url=%s attempt=%d status=%s error=%v", d.ID, d.URL, attempts, status, sendErr)
+
+	_, err := db.Exec(`UPDATE webhook_deliveries
+		SET status = $2, attempts = $3, last_status_code = $4, last_error = $5, next_attempt_at = $6
+		WHERE id = $1`, d.ID, status, attempts, code, sendErr.Error(), next)
+	return err
+}
+
+// deliverDueWebhooks sends one batch of due deliveries and returns how many were attempted
+func deliverDueWebhooks(ctx context.Context, now time.Time) (int, error) {
+	deliveries, err := claimWebhookDeliveries(now, webhookBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, d := range deliveries {
+		if ctx.Err() != nil {
+			// The rest become due again when their lease runs out
+			return i, ctx.Err()
+		}
+		statusCode, sendErr := sendWebhook(d)
+		if err := recordWebhookAttempt(d, statusCode, sendErr, time.Now()); err != nil {
+			log.Printf("Failed to record webhook delivery: delivery=%d error=%v", d.ID, err)
+		}
+	}
+	return len(deliveries), nil
+}
+
+// pruneWebhookDeliveries drops finished deliveries older than webhookLogRetention from the log
+func pruneWebhookDeliveries(now time.Time) (int64, error) {
+	result, err := db.Exec("DELETE FROM webhook_deliveries WHERE status <> 'pending' AND created_at < $1",
+		now.Add(-webhookLogRetention))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// startWebhookWorker delivers queued index events until ctx is cancelled
+func startWebhookWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Keep going while full batches come back so a backlog drains without waiting a tick each
+			for {
+				n, err := deliverDueWebhooks(ctx, time.Now())
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("Webhook worker run failed: error=%v", err)
+					}
+					break
+				}
+				if n < webhookBatchSize {
+					break
+				}
+			}
+			if n, err := pruneWebhookDeliveries(time.Now()); err != nil {
+				log.Printf("Webhook log pruning failed: error=%v", err)
+			} else if n > 0 {
+				log.Printf("Old webhook deliveries pruned: rows=%d", n)
+			}
+		}
+	}
+}
+
+// listWebhooks returns every webhook with its pending and failed delivery counts
+func listWebhooks() ([]Webhook, error) {
+	rows, err := db.Query(`SELECT w.id, w.url, w.events, w.active, COALESCE(w.created_by, ''), w.created_at,
+			COUNT(d.id) FILTER (WHERE d.status = 'pending'),
+			COUNT(d.id) FILTER (WHERE d.status = 'failed')
+		FROM webhooks w
+		LEFT JOIN webhook_deliveries d ON d.webhook_id = w.id
+		GROUP BY w.id ORDER BY w.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []Webhook
+	for rows.Next() {
+		var h Webhook
+		err := rows.Scan(&h.ID, &h.URL, pq.Array(&h.Events), &h.Active, &h.CreatedBy, &h.CreatedAt, &h.Pending, &h.Failed)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, rows.Err()
+}
+
+// listWebhookDeliveries returns the latest deliveries, of one webhook when webhookID isn't 0
+func listWebhookDeliveries(webhookID int, limit int) ([]WebhookDelivery, error) {
+	rows, err := db.Query(`SELECT d.id, d.webhook_id, w.url, d.event, d.status, d.attempts, d.next_attempt_at,
+			d.last_status_code, d.last_error, d.created_at, d.delivered_at
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE $1 = 0 OR d.webhook_id = $1
+		ORDER BY d.created_at DESC, d.id DESC LIMIT $2`, webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		err := rows.Scan(&d.ID, &d.WebhookID, &d.WebhookURL, &d.Event, &d.Status, &d.Attempts, &d.NextAttemptAt,
+			&d.LastStatusCode, &d.LastError, &d.CreatedAt, &d.DeliveredAt)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// adminWebhooks lists the webhooks and the delivery log (GET /admin/webhooks, ?webhook= filters the log)
+func adminWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhookID, _ := strconv.Atoi(r.URL.Query().Get("webhook"))
+	renderAdminWebhooks(w, r, webhookID, "")
+}
+
+// renderAdminWebhooks renders the webhooks page, newSecret is shown once after a webhook is created
+func renderAdminWebhooks(w http.ResponseWriter, r *http.Request, webhookID int, newSecret string) {
+	hooks, err := listWebhooks()
+	if err != nil {
+		adminError(w, r, "webhooks", err)
+		return
+	}
+	deliveries, err := listWebhookDeliveries(webhookID, webhookDeliveriesShown)
+	if err != nil {
+		adminError(w, r, "webhooks", err)
+		return
+	}
+
+	data := adminViewData(w, r)
+	data["Webhooks"] = hooks
+	data["Deliveries"] = deliveries
+	data["Events"] = webhookEvents
+	data["FilterWebhook"] = webhookID
+	data["NewSecret"] = newSecret
+	data["SignatureHeader"] = utils.SignatureHeader
+	data["TimestampHeader"] = utils.TimestampHeader
+	renderTemplate(w, "admin_webhooks.html", data)
+}
+
+// adminCreateWebhook adds a webhook with a fresh signing secret (POST /api/admin/webhooks)
+// Takes url and one "event" field per subscribed event
+func adminCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	clientIP := getClientIP(r)
+	target := strings.TrimSpace(r.FormValue("url"))
+
+	var events []string
+	for _, event := range webhookEvents {
+		for _, chosen := range r.Form["event"] {
+			if chosen == event {
+				events = append(events, event)
+				break
+			}
+		}
+	}
+	if !validBookmarkURL(target) || len(events) == 0 {
+		setFlash(w, "Enter an http or https URL and choose at least one event")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+		return
+	}
+
+	secret, err := generateToken()
+	if err == nil {
+		_, err = db.Exec("INSERT INTO webhooks (url, secret, events, created_by) VALUES ($1, $2, $3, $4)",
+			target, secret, pq.Array(events), user.Username)
+	}
+	if err != nil {
+		log.Printf("Webhook creation failed: username=%s ip=%s error=%v", user.Username, clientIP, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Webhook created: username=%s ip=%s url=%s events=%s", user.Username, clientIP, target, strings.Join(events, ","))
+	renderAdminWebhooks(w, r, 0, secret)
+}
+
+// adminUpdateWebhook pauses, resumes or deletes a webhook (POST /api/admin/webhooks/update)
+// Deliveries queued while a webhook is paused are sent once it's resumed
+func adminUpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	clientIP := getClientIP(r)
+	action := r.FormValue("action")
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid webhook", http.StatusBadRequest)
+		return
+	}
+
+	var result sql.Result
+	var message string
+	switch action {
+	case "pause":
+		result, err = db.Exec("UPDATE webhooks SET active = FALSE WHERE id = $1", id)
+		message = "Webhook paused"
+	case "resume":
+		result, err = db.Exec("UPDATE webhooks SET active = TRUE WHERE id = $1", id)
+		message = "Webhook resumed"
+	case "delete":
+		result, err = db.Exec("DELETE FROM webhooks WHERE id = $1", id)
+		message = "Webhook deleted"
+	default:
+		http.Error(w, "Invalid webhook change", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Webhook change failed: username=%s ip=%s webhook=%d action=%s error=%v", user.Username, clientIP, id, action, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		message = "That webhook was not found"
+	} else {
+		log.Printf("Webhook changed: username=%s ip=%s webhook=%d action=%s", user.Username, clientIP, id, action)
+	}
+	setFlash(w, message)
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}
+
+// adminRedeliverWebhook queues a failed delivery again with a fresh set of attempts (POST /api/admin/webhooks/redeliver)
+func adminRedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid delivery", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`UPDATE webhook_deliveries SET status = 'pending', attempts = 0, next_attempt_at = NOW()
+		WHERE id = $1 AND status = 'failed'`, id)
+	if err != nil {
+		log.Printf("Webhook redelivery failed: username=%s delivery=%d error=%v", user.Username, id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		setFlash(w, "Only failed deliveries can be sent again")
+	} else {
+		log.Printf("Webhook redelivery queued: username=%s delivery=%d", user.Username, id)
+		setFlash(w, "Delivery queued again")
+	}
+	http.Redirect(w, r, localReferer(r, "/admin/webhooks"), http.StatusSeeOther)
+}
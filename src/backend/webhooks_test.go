@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"whoknows/utils"
+)
+
+// TestWebhookBackoff verifies retry delays double per attempt and stop growing at the cap
+func TestWebhookBackoff(t *testing.T) {
+	tests := map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		5:  8 * time.Minute,
+		20: 6 * time.Hour,
+	}
+	for attempts, want := range tests {
+		if got := webhookBackoff(attempts); got != want {
+			t.Errorf("webhookBackoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+// TestSendWebhook verifies deliveries carry the event headers and a signature receivers can check
+func TestSendWebhook(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		want := utils.ComputeSignature("hook-secret", r.Header.Get(utils.TimestampHeader), body)
+		if r.Header.Get(utils.SignatureHeader) != want {
+			t.Errorf("signature = %q, want %q", r.Header.Get(utils.SignatureHeader), want)
+		}
+		if r.Header.Get("X-Webhook-Event") != eventPageCreated || r.Header.Get("X-Webhook-Delivery") != "7" {
+			t.Errorf("event headers = %q, %q", r.Header.Get("X-Webhook-Event"), r.Header.Get("X-Webhook-Delivery"))
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	delivery := claimedDelivery{ID: 7, Event: eventPageCreated, Payload: `{"event":"page.created"}`, URL: server.URL, Secret: "hook-secret"}
+	if code, err := sendWebhook(delivery); err != nil || code != http.StatusOK {
+		t.Errorf("sendWebhook() = %d, %v, want 200", code, err)
+	}
+
+	status = http.StatusServiceUnavailable
+	if code, err := sendWebhook(delivery); err == nil || code != http.StatusServiceUnavailable {
+		t.Errorf("sendWebhook() = %d, %v, want a 503 error", code, err)
+	}
+}
+
+// TestAdminWebhooksTemplate verifies the new secret, the webhooks and the delivery log are shown
+func TestAdminWebhooksTemplate(t *testing.T) {
+	templates = template.Must(template.ParseGlob("../templates/*.html"))
+	code := 500
+	lastError := "webhook answered 500 Internal Server Error"
+
+	var body strings.Builder
+	err := templates.ExecuteTemplate(&body, "admin_webhooks.html", map[string]interface{}{
+		"User":        &User{Username: "testuser_webhooks"},
+		"Permissions": Permissions{permAdminAccess: true, permWebhooksManage: true},
+		"Events":      webhookEvents,
+		"NewSecret":   "fresh-secret",
+		"Webhooks":    []Webhook{{ID: 3, URL: "https://hooks.example.com/index", Events: []string{eventPageCreated}, Active: true}},
+		"Deliveries": []WebhookDelivery{{ID: 9, WebhookID: 3, WebhookURL: "https://hooks.example.com/index", Event: eventPageCreated,
+			Status: "failed", Attempts: maxWebhookAttempts, LastStatusCode: &code, LastError: &lastError}},
+	})
+	if err != nil {
+		t.Fatalf("admin_webhooks.html failed to render: %v", err)
+	}
+	for _, want := range []string{"fresh-secret", "https://hooks.example.com/index", `action="/api/admin/webhooks/redeliver"`, "webhook answered 500", `value="page.deleted"`} {
+		if !strings.Contains(body.String(), want) {
+			t.Errorf("webhooks page is missing %s", want)
+		}
+	}
+}
+
+// TestWebhooks_Integration verifies events from batchPages are queued, delivered, retried with backoff and redelivered
+func TestWebhooks_Integration(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	defer testDB.Exec("DELETE FROM pages WHERE title LIKE 'testuser_webhook%'")
+	defer testDB.Exec("DELETE FROM webhooks WHERE created_by = 'testuser_webhooks'")
+	t.Setenv("CRAWLER_API_KEY", "test-api-key")
+	t.Setenv("CRAWLER_SIGNING_SECRET", "")
+
+	var mu sync.Mutex
+	var received []IndexEvent
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var event IndexEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		received = append(received, event)
+	}))
+	defer server.Close()
+
+	var webhookID int
+	err := testDB.QueryRow(`INSERT INTO webhooks (url, secret, events, created_by)
+		VALUES ($1, 'secret', '{page.created,page.updated,page.deleted}', 'testuser_webhooks') RETURNING id`, server.URL).Scan(&webhookID)
+	if err != nil {
+		t.Fatalf("failed to create webhook: %v", err)
+	}
+
+	batch := func(body string) {
+		req := httptest.NewRequest("POST", "/api/batch-pages", bytes.NewReader([]byte(body)))
+		req.Header.Set("X-API-Key", "test-api-key")
+		w := httptest.NewRecorder()
+		batchPages(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("batchPages = %d: %s", w.Code, w.Body.String())
+		}
+	}
+	deliver := func() {
+		if _, err := deliverDueWebhooks(context.Background(), time.Now()); err != nil {
+			t.Fatalf("deliverDueWebhooks() error = %v", err)
+		}
+	}
+	events := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		var names []string
+		for _, event := range received {
+			names = append(names, event.Event)
+		}
+		return names
+	}
+
+	page := `{"title":"testuser_webhook_page","url":"https://example.com/testuser_webhook","content":"%s"}`
+	batch(`{"pages":[` + strings.Replace(page, "%s", "first", 1) + `]}`)
+	batch(`{"pages":[` + strings.Replace(page, "%s", "first", 1) + `]}`)
+	batch(`{"pages":[` + strings.Replace(page, "%s", "second", 1) + `]}`)
+	batch(`{"deleted":["https://example.com/testuser_webhook"]}`)
+	deliver()
+
+	if got := strings.Join(events(), " "); got != "page.created page.updated page.deleted" {
+		t.Errorf("delivered events = %q, want created, updated and deleted once each (unchanged pages send nothing)", got)
+	}
+
+	t.Run("retries then fails", func(t *testing.T) {
+		mu.Lock()
+		failing = true
+		mu.Unlock()
+		batch(`{"pages":[` + strings.Replace(page, "%s", "third", 1) + `]}`)
+		deliver()
+
+		var id int64
+		var status string
+		var attempts int
+		var next time.Time
+		testDB.QueryRow(`SELECT id, status, attempts, next_attempt_at FROM webhook_deliveries
+			WHERE webhook_id = $1 ORDER BY id DESC LIMIT 1`, webhookID).Scan(&id, &status, &attempts, &next)
+		if status != "pending" || attempts != 1 || time.Until(next) < 20*time.Second {
+			t.Errorf("after one failure status = %s, attempts = %d, next attempt in %s, want pending, 1 and about 30s", status, attempts, time.Until(next))
+		}
+
+		testDB.Exec("UPDATE webhook_deliveries SET attempts = $2, next_attempt_at = NOW() WHERE id = $1", id, maxWebhookAttempts-1)
+		deliver()
+		testDB.QueryRow("SELECT status FROM webhook_deliveries WHERE id = $1", id).Scan(&status)
+		if status != "failed" {
+			t.Fatalf("status after the last attempt = %s, want failed", status)
+		}
+
+		admin := &User{ID: 1, Username: "testuser_webhooks"}
+		w := httptest.NewRecorder()
+		adminRedeliverWebhook(w, accountRequest("/api/admin/webhooks/redeliver", url.Values{"id": {strconv.FormatInt(id, 10)}}, admin, ""))
+		mu.Lock()
+		failing = false
+		mu.Unlock()
+		deliver()
+		testDB.QueryRow("SELECT status FROM webhook_deliveries WHERE id = $1", id).Scan(&status)
+		if status != "delivered" {
+			t.Errorf("status after redelivery = %s, want delivered", status)
+		}
+	})
+}
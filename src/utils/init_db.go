@@ -8,6 +8,309 @@ import (
 	_ "github.com/lib/pq"
 )
 
+// The schemas below are created by both InitDB() and Migration(), so fresh and migrated databases
+// end up with identical tables. Each is safe to run again on a database that already has it
+
+// crawlSchema holds the crawl frontier (crawl_queue) and per-URL fetch state (crawl_state)
+const crawlSchema = `
+	CREATE TABLE IF NOT EXISTS crawl_queue (
+		url TEXT PRIMARY KEY,
+		depth INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL CHECK(status IN ('pending', 'in_progress', 'done', 'failed', 'blocked')) DEFAULT 'pending',
+		next_fetch_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		failure_count INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		claimed_at TIMESTAMP,
+		added_at TIMESTAMP DEFAULT NOW()
+	);
+
+	CREATE INDEX IF NOT EXISTS crawl_queue_due_idx ON crawl_queue (next_fetch_at)
+		WHERE status IN ('pending', 'done', 'blocked');
+
+	CREATE TABLE IF NOT EXISTS crawl_state (
+		url TEXT PRIMARY KEY REFERENCES crawl_queue(url) ON DELETE CASCADE,
+		etag TEXT,
+		last_modified TEXT,
+		content_hash TEXT,
+		last_fetched_at TIMESTAMP,
+		last_changed_at TIMESTAMP,
+		recrawl_interval_seconds INTEGER NOT NULL,
+		fetch_count INTEGER NOT NULL DEFAULT 0,
+		change_count INTEGER NOT NULL DEFAULT 0
+	);`
+
+// sessionsSchema holds login sessions, keyed by the SHA-256 hash of the cookie token
+// expires_at slides forward with use, absolute_expires_at caps it
+const sessionsSchema = `
+	CREATE TABLE IF NOT EXISTS sessions (
+		id BIGSERIAL UNIQUE,
+		token_hash TEXT PRIMARY KEY,
+		username TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		absolute_expires_at TIMESTAMP NOT NULL,
+		last_seen_at TIMESTAMP DEFAULT NOW(),
+		user_agent TEXT,
+		ip TEXT,
+		created_at TIMESTAMP DEFAULT NOW()
+	);
+
+	CREATE INDEX IF NOT EXISTS sessions_username_idx ON sessions (username);
+	CREATE INDEX IF NOT EXISTS sessions_expires_idx ON sessions (expires_at);`
+
+// passwordResetSchema holds e-mailed password reset tokens, stored as SHA-256 hashes
+const passwordResetSchema = `
+	CREATE TABLE IF NOT EXISTS password_resets (
+		token_hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		email TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP,
+		requested_ip TEXT,
+		created_at TIMESTAMP DEFAULT NOW()
+	);
+
+	CREATE INDEX IF NOT EXISTS password_resets_user_idx ON password_resets (user_id);`
+
+// loginAttemptsSchema holds failed login counts and lockouts per IP ("ip:...") and username ("user:...")
+// Stored in the database so lockouts survive restarts and apply across instances
+const loginAttemptsSchema = `
+	CREATE TABLE IF NOT EXISTS login_attempts (
+		key TEXT PRIMARY KEY,
+		failure_count INTEGER NOT NULL DEFAULT 0,
+		last_failure_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		locked_until TIMESTAMP
+	);`
+
+// twoFactorSchema adds TOTP state to users and holds recovery codes, stored as SHA-256 hashes
+// totp_secret is set while enrolling, 2FA is active once totp_enabled_at is set
+const twoFactorSchema = `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret TEXT;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMP;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT;
+
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		code_hash TEXT NOT NULL,
+		used_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT NOW(),
+		UNIQUE (user_id, code_hash)
+	);`
+
+// rbacSchema holds roles, the permissions each role grants and the roles assigned to users
+// The built-in roles are seeded here, so fresh and migrated databases start with the same admin and analyst roles
+const rbacSchema = `
+	CREATE TABLE IF NOT EXISTS roles (
+		id SERIAL PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		description TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE TABLE IF NOT EXISTS role_permissions (
+		role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+		permission TEXT NOT NULL,
+		PRIMARY KEY (role_id, permission)
+	);
+
+	CREATE TABLE IF NOT EXISTS user_roles (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+		granted_by TEXT,
+		granted_at TIMESTAMP DEFAULT NOW(),
+		PRIMARY KEY (user_id, role_id)
+	);
+
+	INSERT INTO roles (name, description) VALUES
+		('admin', 'Full access to the admin console, including managing user roles'),
+		('analyst', 'Read-only access to pages, ingest stats and search analytics')
+	ON CONFLICT (name) DO NOTHING;
+
+	INSERT INTO role_permissions (role_id, permission)
+	SELECT roles.id, permission FROM roles,
+		unnest(ARRAY['admin.access', 'users.view', 'users.manage', 'pages.view', 'stats.view', 'webhooks.manage']) AS permission
+	WHERE roles.name = 'admin'
+	ON CONFLICT DO NOTHING;
+
+	INSERT INTO role_permissions (role_id, permission)
+	SELECT roles.id, permission FROM roles,
+		unnest(ARRAY['admin.access', 'pages.view', 'stats.view']) AS permission
+	WHERE roles.name = 'analyst'
+	ON CONFLICT DO NOTHING;`
+
+// searchStatsSchema aggregates searches per normalized query and language for the admin analytics
+const searchStatsSchema = `
+	CREATE TABLE IF NOT EXISTS search_stats (
+		query TEXT NOT NULL,
+		language TEXT NOT NULL,
+		search_count INTEGER NOT NULL DEFAULT 0,
+		zero_result_count INTEGER NOT NULL DEFAULT 0,
+		first_searched_at TIMESTAMP DEFAULT NOW(),
+		last_searched_at TIMESTAMP DEFAULT NOW(),
+		PRIMARY KEY (query, language)
+	);
+
+	CREATE INDEX IF NOT EXISTS search_stats_last_searched_idx ON search_stats (last_searched_at);`
+
+// userIdentitiesSchema links accounts to single sign-on identities, one row per provider (issuer) and subject
+const userIdentitiesSchema = `
+	CREATE TABLE IF NOT EXISTS user_identities (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		email TEXT,
+		created_at TIMESTAMP DEFAULT NOW(),
+		last_login_at TIMESTAMP,
+		UNIQUE (issuer, subject)
+	);
+
+	CREATE INDEX IF NOT EXISTS user_identities_user_idx ON user_identities (user_id);`
+
+// apiTokensSchema holds personal access tokens for the JSON API, stored as SHA-256 hashes
+// window_start and window_count hold the current rate limit window, so limits apply across instances
+const apiTokensSchema = `
+	CREATE TABLE IF NOT EXISTS api_tokens (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		token_prefix TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		last_used_at TIMESTAMP,
+		last_used_ip TEXT,
+		use_count BIGINT NOT NULL DEFAULT 0,
+		window_start TIMESTAMP,
+		window_count INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT NOW()
+	);
+
+	CREATE INDEX IF NOT EXISTS api_tokens_user_idx ON api_tokens (user_id);`
+
+// savedSearchesSchema holds users' saved queries and bookmarked results
+// seen_urls is the result set of the last visit to the My searches page, so new results can be highlighted
+const savedSearchesSchema = `
+	CREATE TABLE IF NOT EXISTS saved_searches (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		query TEXT NOT NULL,
+		language TEXT NOT NULL,
+		seen_urls TEXT[] NOT NULL DEFAULT '{}',
+		last_viewed_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT NOW(),
+		UNIQUE (user_id, query, language)
+	);
+
+	CREATE TABLE IF NOT EXISTS bookmarks (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		url TEXT NOT NULL,
+		title TEXT NOT NULL,
+		note TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT NOW(),
+		UNIQUE (user_id, url)
+	);`
+
+// searchHistorySchema adds the opt-in search history settings to users and holds the recorded searches
+// Entries older than the user's search_history_days are deleted by the history reaper
+const searchHistorySchema = `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS search_history_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS search_history_days INTEGER NOT NULL DEFAULT 90;
+
+	CREATE TABLE IF NOT EXISTS search_history (
+		id BIGSERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		query TEXT NOT NULL,
+		language TEXT NOT NULL,
+		results INTEGER NOT NULL DEFAULT 0,
+		searched_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+
+	CREATE INDEX IF NOT EXISTS search_history_user_idx ON search_history (user_id, searched_at DESC);`
+
+// alertsSchema holds alert subscriptions on saved searches, the pages already reported per subscription,
+// the indexed batches waiting to be matched, the queue of notifications the alert worker sends and the
+// in-app inbox the inbox notifier writes to
+const alertsSchema = `
+	CREATE TABLE IF NOT EXISTS alert_subscriptions (
+		id SERIAL PRIMARY KEY,
+		saved_search_id INTEGER NOT NULL REFERENCES saved_searches(id) ON DELETE CASCADE,
+		channel TEXT NOT NULL,
+		webhook_url TEXT,
+		created_at TIMESTAMP DEFAULT NOW(),
+		UNIQUE (saved_search_id, channel)
+	);
+
+	CREATE TABLE IF NOT EXISTS alert_deliveries (
+		subscription_id INTEGER NOT NULL REFERENCES alert_subscriptions(id) ON DELETE CASCADE,
+		page_url TEXT NOT NULL,
+		notified_at TIMESTAMP DEFAULT NOW(),
+		PRIMARY KEY (subscription_id, page_url)
+	);
+
+	CREATE TABLE IF NOT EXISTS alert_evaluations (
+		id BIGSERIAL PRIMARY KEY,
+		urls TEXT[] NOT NULL,
+		created_at TIMESTAMP DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS alert_notifications (
+		id BIGSERIAL PRIMARY KEY,
+		subscription_id INTEGER NOT NULL REFERENCES alert_subscriptions(id) ON DELETE CASCADE,
+		pages TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		last_error TEXT,
+		created_at TIMESTAMP DEFAULT NOW(),
+		sent_at TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS alert_notifications_due_idx ON alert_notifications (status, next_attempt_at);
+
+	CREATE TABLE IF NOT EXISTS inbox_notifications (
+		id BIGSERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		title TEXT NOT NULL,
+		body TEXT NOT NULL,
+		link TEXT NOT NULL DEFAULT '',
+		read_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT NOW()
+	);
+
+	CREATE INDEX IF NOT EXISTS inbox_notifications_user_idx ON inbox_notifications (user_id, created_at DESC);`
+
+// webhooksSchema holds the admin-configured index event webhooks and their delivery log
+// Deliveries double as the worker's queue: pending rows are retried until delivered or failed
+const webhooksSchema = `
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id SERIAL PRIMARY KEY,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT[] NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_by TEXT,
+		created_at TIMESTAMP DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id BIGSERIAL PRIMARY KEY,
+		webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		last_status_code INTEGER,
+		last_error TEXT,
+		created_at TIMESTAMP DEFAULT NOW(),
+		delivered_at TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (status, next_attempt_at);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_idx ON webhook_deliveries (webhook_id, created_at DESC);`
+
 func InitDB() {
 	// Get database URL from environment variable
 	dbURL := os.Getenv("DATABASE_URL")
@@ -22,6 +325,90 @@ func InitDB() {
 	defer db.Close()
 
 	// Drop tables if they exist
+	_, err = db.Exec("DROP TABLE IF EXISTS crawl_state")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS crawl_queue")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS webhook_deliveries")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS webhooks")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS inbox_notifications")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS alert_evaluations")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS alert_notifications")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS alert_deliveries")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS alert_subscriptions")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS search_history")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS bookmarks")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS saved_searches")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS api_tokens")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS user_identities")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS search_stats")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS user_roles")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS role_permissions")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS roles")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS recovery_codes")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS login_attempts")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("DROP TABLE IF EXISTS password_resets")
+	if err != nil {
+		log.Fatal(err)
+	}
 	_, err = db.Exec("DROP TABLE IF EXISTS sessions")
 	if err != nil {
 		log.Fatal(err)
@@ -46,7 +433,8 @@ func InitDB() {
 		registration_date TIMESTAMP DEFAULT NOW(),
 		last_login_ip TEXT,
 		last_login_date TIMESTAMP,
-		login_count INTEGER DEFAULT 0
+		login_count INTEGER DEFAULT 0,
+		verified_at TIMESTAMP
 	);`
 
 	_, err = db.Exec(schema)
@@ -54,6 +442,18 @@ func InitDB() {
 		log.Fatal(err)
 	}
 
+	// Add two-factor columns and the recovery codes table
+	_, err = db.Exec(twoFactorSchema)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create roles and permissions with the built-in roles
+	_, err = db.Exec(rbacSchema)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Kode til at sikre os at vores admin user ikke bliver hardcodet men får info fra env variabler
 	// Insert admin user only if explicitly requested
 	initAdmin := os.Getenv("INIT_ADMIN")
@@ -80,13 +480,19 @@ func InitDB() {
 				"  Generate hash with: go run your_hash_generator.go")
 		}
 
-		// Insert admin user
-		_, err = db.Exec("INSERT INTO users (username, email, password, registration_ip) VALUES ($1, $2, $3, $4)",
-			adminUsername, adminEmail, adminPasswordHash, "system")
+		// Insert admin user, its e-mail comes from the operator so it starts out verified
+		var adminID int
+		err = db.QueryRow("INSERT INTO users (username, email, password, registration_ip, verified_at) VALUES ($1, $2, $3, $4, NOW()) RETURNING id",
+			adminUsername, adminEmail, adminPasswordHash, "system").Scan(&adminID)
 		if err != nil {
 			log.Fatalf("ERROR: Failed to create admin user: %v", err)
 		}
 
+		_, err = db.Exec("INSERT INTO user_roles (user_id, role_id, granted_by) SELECT $1, id, 'system' FROM roles WHERE name = 'admin'", adminID)
+		if err != nil {
+			log.Fatalf("ERROR: Failed to grant admin role: %v", err)
+		}
+
 		log.Printf("Admin user created: %s (%s)", adminUsername, adminEmail)
 	} else {
 		log.Println("Skipping admin user creation (INIT_ADMIN not set to 'true')")
@@ -100,6 +506,7 @@ func InitDB() {
 		language TEXT NOT NULL CHECK(language IN ('en', 'da')) DEFAULT 'en',
 		last_updated TIMESTAMP DEFAULT NOW(),
 		content TEXT NOT NULL,
+		content_type TEXT NOT NULL DEFAULT 'text/html',
 		content_tsv tsvector
 	);`
 
@@ -147,18 +554,70 @@ func InitDB() {
 	}
 
 	// Create sessions table
-	sessionsSchema := `
-	CREATE TABLE IF NOT EXISTS sessions (
-		token TEXT PRIMARY KEY,
-		username TEXT NOT NULL,
-		expires_at TIMESTAMP NOT NULL,
-		created_at TIMESTAMP DEFAULT NOW()
-	);`
-
 	_, err = db.Exec(sessionsSchema)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Create password reset tokens table
+	_, err = db.Exec(passwordResetSchema)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create login throttling table
+	_, err = db.Exec(loginAttemptsSchema)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create single sign-on identities table
+	_, err = db.Exec(userIdentitiesSchema)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create persistent crawl frontier tables
+	_, err = db.Exec(crawlSchema)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create search analytics table
+	_, err = db.Exec(searchStatsSchema)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create personal API tokens table
+	_, err = db.Exec(apiTokensSchema)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create saved searches and bookmarks tables
+	_, err = db.Exec(savedSearchesSchema)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create search history table and settings
+	_, err = db.Exec(searchHistorySchema)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create saved search alert and inbox tables
+	_, err = db.Exec(alertsSchema)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create index event webhook tables
+	_, err = db.Exec(webhooksSchema)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	log.Println("Database initialized successfully")
 }
@@ -8,6 +8,11 @@ import (
 	_ "github.com/lib/pq"
 )
 
+// RecrawlOnlyDepth is the crawl_queue depth given to pages indexed outside the crawl scheduler, by the crawl
+// command or before the frontier existed. It is past any CRAWL_MAX_DEPTH, so the scheduler keeps these pages
+// fresh without following their links again
+const RecrawlOnlyDepth = 1000
+
 func Migration() {
 	dbURL := os.Getenv("DATABASE_URL")
 	if dbURL == "" {
@@ -83,6 +88,150 @@ func Migration() {
 		log.Fatalf("Failed to populate tsvector: %v", err)
 	}
 
+	// Add content_type column for uploaded documents (existing rows are crawled HTML)
+	_, err = tx.Exec(`ALTER TABLE pages ADD COLUMN IF NOT EXISTS content_type TEXT NOT NULL DEFAULT 'text/html';`)
+	if err != nil {
+		log.Fatalf("Failed to add content_type column: %v", err)
+	}
+
+	// Add verified_at column for e-mail verification
+	// Accounts created before verification existed are treated as verified, so backfill only when adding the column
+	var hasVerifiedAt bool
+	err = tx.QueryRow(`SELECT EXISTS (
+		SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'verified_at'
+	)`).Scan(&hasVerifiedAt)
+	if err != nil {
+		log.Fatalf("Failed to check verified_at column: %v", err)
+	}
+	if !hasVerifiedAt {
+		_, err = tx.Exec(`ALTER TABLE users ADD COLUMN verified_at TIMESTAMP;
+			UPDATE users SET verified_at = COALESCE(registration_date, NOW());`)
+		if err != nil {
+			log.Fatalf("Failed to add verified_at column: %v", err)
+		}
+	}
+
+	// Add two-factor columns and the recovery codes table
+	_, err = tx.Exec(twoFactorSchema)
+	if err != nil {
+		log.Fatalf("Failed to create two-factor schema: %v", err)
+	}
+
+	// Create roles and permissions with the built-in roles
+	_, err = tx.Exec(rbacSchema)
+	if err != nil {
+		log.Fatalf("Failed to create roles tables: %v", err)
+	}
+
+	// Make sure the configured admin account holds the admin role
+	if adminUsername := os.Getenv("ADMIN_USERNAME"); adminUsername != "" {
+		_, err = tx.Exec(`INSERT INTO user_roles (user_id, role_id, granted_by)
+			SELECT users.id, roles.id, 'migration' FROM users, roles
+			WHERE users.username = $1 AND roles.name = 'admin'
+			ON CONFLICT DO NOTHING`, adminUsername)
+		if err != nil {
+			log.Fatalf("Failed to grant admin role: %v", err)
+		}
+	}
+
+	// Hash session tokens at rest and add sliding expiry and device columns
+	// Existing cookies keep working: their stored token is replaced by its hash
+	var hasPlainTokens bool
+	err = tx.QueryRow(`SELECT EXISTS (
+		SELECT 1 FROM information_schema.columns WHERE table_name = 'sessions' AND column_name = 'token'
+	)`).Scan(&hasPlainTokens)
+	if err != nil {
+		log.Fatalf("Failed to check sessions table: %v", err)
+	}
+	if hasPlainTokens {
+		_, err = tx.Exec(`ALTER TABLE sessions RENAME COLUMN token TO token_hash;
+			UPDATE sessions SET token_hash = encode(sha256(convert_to(token_hash, 'UTF8')), 'hex');
+			ALTER TABLE sessions
+				ADD COLUMN IF NOT EXISTS id BIGSERIAL UNIQUE,
+				ADD COLUMN IF NOT EXISTS absolute_expires_at TIMESTAMP,
+				ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMP DEFAULT NOW(),
+				ADD COLUMN IF NOT EXISTS user_agent TEXT,
+				ADD COLUMN IF NOT EXISTS ip TEXT;
+			UPDATE sessions SET absolute_expires_at = expires_at WHERE absolute_expires_at IS NULL;
+			ALTER TABLE sessions ALTER COLUMN absolute_expires_at SET NOT NULL;`)
+		if err != nil {
+			log.Fatalf("Failed to migrate sessions table: %v", err)
+		}
+	}
+	_, err = tx.Exec(sessionsSchema)
+	if err != nil {
+		log.Fatalf("Failed to create sessions table: %v", err)
+	}
+
+	// Create password reset tokens table
+	_, err = tx.Exec(passwordResetSchema)
+	if err != nil {
+		log.Fatalf("Failed to create password_resets table: %v", err)
+	}
+
+	// Create login throttling table
+	_, err = tx.Exec(loginAttemptsSchema)
+	if err != nil {
+		log.Fatalf("Failed to create login_attempts table: %v", err)
+	}
+
+	// Create single sign-on identities table
+	_, err = tx.Exec(userIdentitiesSchema)
+	if err != nil {
+		log.Fatalf("Failed to create user_identities table: %v", err)
+	}
+
+	// Create crawl frontier tables
+	_, err = tx.Exec(crawlSchema)
+	if err != nil {
+		log.Fatalf("Failed to create crawl tables: %v", err)
+	}
+
+	// Queue pages indexed before the frontier existed so the scheduler recrawls them too
+	// Due times are spread over a day to avoid fetching the whole index at once
+	_, err = tx.Exec(`INSERT INTO crawl_queue (url, depth, next_fetch_at)
+		SELECT url, $1, NOW() + random() * INTERVAL '1 day' FROM pages
+		WHERE url LIKE 'http%'
+		ON CONFLICT (url) DO NOTHING`, RecrawlOnlyDepth)
+	if err != nil {
+		log.Fatalf("Failed to queue existing pages for recrawl: %v", err)
+	}
+
+	// Create search analytics table
+	_, err = tx.Exec(searchStatsSchema)
+	if err != nil {
+		log.Fatalf("Failed to create search_stats table: %v", err)
+	}
+
+	// Create personal API tokens table
+	_, err = tx.Exec(apiTokensSchema)
+	if err != nil {
+		log.Fatalf("Failed to create api_tokens table: %v", err)
+	}
+
+	// Create saved searches and bookmarks tables
+	_, err = tx.Exec(savedSearchesSchema)
+	if err != nil {
+		log.Fatalf("Failed to create saved_searches tables: %v", err)
+	}
+
+	// Create search history table and settings
+	_, err = tx.Exec(searchHistorySchema)
+	if err != nil {
+		log.Fatalf("Failed to create search_history table: %v", err)
+	}
+
+	// Create saved search alert and inbox tables
+	_, err = tx.Exec(alertsSchema)
+	if err != nil {
+		log.Fatalf("Failed to create alert tables: %v", err)
+	}
+
+	_, err = tx.Exec(webhooksSchema)
+	if err != nil {
+		log.Fatalf("Failed to create webhook tables: %v", err)
+	}
+
 	if err = tx.Commit(); err != nil {
 		log.Fatalf("Failed to commit transaction: %v", err)
 	}